@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// TCPONLY is the RPZ action "rpz-tcp-only.", which makes the resolver answer UDP queries with
+// TC=1 so that the client retries over TCP. tapir does not know it, so it is only used within
+// tapir-pop; the value is well above the tapir actions.
+const TCPONLY tapir.Action = 128
+
+// The CNAME targets of the RPZ actions (draft-vixie-dnsop-dns-rpz, section 3). REDIRECT has
+// no CNAME target, it is local data (see RedirectTarget).
+var actionTargets = map[tapir.Action]string{
+	tapir.ALLOWLIST: "rpz-passthru.",
+	tapir.NXDOMAIN:  ".",
+	tapir.NODATA:    "*.",
+	tapir.DROP:      "rpz-drop.",
+	TCPONLY:         "rpz-tcp-only.",
+}
+
+// ActionString returns the name of action, as used in the policy config and the audit log.
+func ActionString(action tapir.Action) string {
+	if action == TCPONLY {
+		return "TCP-ONLY"
+	}
+	return tapir.ActionToString[action]
+}
+
+// ParseAction returns the action with the name s (case insensitive), see ActionString.
+func ParseAction(s string) (tapir.Action, error) {
+	switch strings.ToUpper(s) {
+	case "TCP-ONLY", "TCPONLY":
+		return TCPONLY, nil
+	}
+	return tapir.StringToAction(strings.ToUpper(s))
+}
+
+// RpzAction returns the action of the RPZ rule rr with the owner name name (without the RPZ zone
+// name). CNAMEs to the special targets are the corresponding actions, and a CNAME to the owner
+// name itself is the old style PASSTHRU. Any other CNAME, and any other RR type, is local data,
+// i.e. REDIRECT.
+func RpzAction(name string, rr dns.RR) tapir.Action {
+	cname, ok := rr.(*dns.CNAME)
+	if !ok {
+		return tapir.REDIRECT
+	}
+	for action, target := range actionTargets {
+		if strings.EqualFold(cname.Target, target) {
+			return action
+		}
+	}
+	if strings.EqualFold(cname.Target, name) {
+		return tapir.ALLOWLIST
+	}
+	return tapir.REDIRECT
+}
+
+// RedirectTarget is the local data that names with the action REDIRECT are rewritten to, i.e. a
+// walled garden. It is either a CNAME or a set of addresses.
+type RedirectTarget struct {
+	Cname string
+	A     []net.IP
+	AAAA  []net.IP
+}
+
+// The policy rules that may have a redirect target of their own, see PopPolicy.Redirects.
+var redirectRules = []string{"denylist", "doubtlist.numsources", "doubtlist.numtapirtags", "doubtlist.denytapir"}
+
+// ParseRedirectTarget reads the redirect target at key in the config. Returns nil if there is
+// none.
+func ParseRedirectTarget(key string) (*RedirectTarget, error) {
+	var conf RedirectConf
+	if err := viper.UnmarshalKey(key, &conf); err != nil {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+	if conf.Cname == "" && len(conf.A) == 0 && len(conf.AAAA) == 0 {
+		return nil, nil
+	}
+	rt := &RedirectTarget{}
+	if conf.Cname != "" {
+		if len(conf.A) != 0 || len(conf.AAAA) != 0 {
+			return nil, fmt.Errorf("%s: a CNAME redirect cannot also have addresses", key)
+		}
+		if _, ok := dns.IsDomainName(conf.Cname); !ok {
+			return nil, fmt.Errorf("%s: invalid CNAME target %q", key, conf.Cname)
+		}
+		rt.Cname = dns.CanonicalName(conf.Cname)
+		if RpzAction("", &dns.CNAME{Target: rt.Cname}) != tapir.REDIRECT {
+			return nil, fmt.Errorf("%s: CNAME target %s is an RPZ action, not a redirect", key, rt.Cname)
+		}
+	}
+	for _, a := range conf.A {
+		ip := net.ParseIP(a)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("%s: invalid IPv4 address %q", key, a)
+		}
+		rt.A = append(rt.A, ip.To4())
+	}
+	for _, a := range conf.AAAA {
+		ip := net.ParseIP(a)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("%s: invalid IPv6 address %q", key, a)
+		}
+		rt.AAAA = append(rt.AAAA, ip)
+	}
+	return rt, nil
+}
+
+// RRs returns the RRset of a REDIRECT rule with the owner name owner.
+func (rt *RedirectTarget) RRs(owner string, ttl uint32) []dns.RR {
+	hdr := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: owner, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	}
+	if rt.Cname != "" {
+		return []dns.RR{&dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: rt.Cname}}
+	}
+	var rrs []dns.RR
+	for _, ip := range rt.A {
+		rrs = append(rrs, &dns.A{Hdr: hdr(dns.TypeA), A: ip})
+	}
+	for _, ip := range rt.AAAA {
+		rrs = append(rrs, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: ip})
+	}
+	return rrs
+}
+
+// Redirect returns the redirect target for names that got the action REDIRECT from the policy
+// rule rule: the target of the rule itself, or else policy.redirect. Returns nil if there is
+// none.
+func (pp *PopPolicy) Redirect(rule string) *RedirectTarget {
+	if rt, exist := pp.Redirects[rule]; exist {
+		return rt
+	}
+	return pp.Redirects[""]
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+func TestRpzFeedActions(t *testing.T) {
+	pd, _ := newPopData(t)
+	const zone = "upstream.rpz."
+	s := &tapir.WBGlist{Name: "upstream", Type: "denylist", RpzZoneName: zone}
+	p := pd.newRpzFeedParser(s)
+	zd := &tapir.ZoneData{ZoneName: zone}
+
+	hdr := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name + zone, Rrtype: rrtype, Class: dns.ClassINET, Ttl: 60}
+	}
+	cname := func(name, target string) dns.RR {
+		return &dns.CNAME{Hdr: hdr(name, dns.TypeCNAME), Target: target}
+	}
+	for _, rr := range []dns.RR{
+		cname("nx.example.", "."),
+		cname("nodata.example.", "*."),
+		cname("drop.example.", "rpz-drop."),
+		cname("tcp.example.", "RPZ-TCP-ONLY."),
+		cname("garden.example.", "walled.garden.example.net."),
+		&dns.A{Hdr: hdr("local.example.", dns.TypeA), A: net.ParseIP("192.0.2.1")},
+		&dns.AAAA{Hdr: hdr("local.example.", dns.TypeAAAA), AAAA: net.ParseIP("2001:db8::1")},
+		cname("self.example.", "self.example."), // old style passthru
+		&dns.RRSIG{Hdr: hdr("sig.example.", dns.TypeRRSIG), TypeCovered: dns.TypeCNAME},
+	} {
+		p.Parse(&rr, zd)
+	}
+
+	want := map[string]tapir.Action{
+		"nx.example.":     tapir.NXDOMAIN,
+		"nodata.example.": tapir.NODATA,
+		"drop.example.":   tapir.DROP,
+		"tcp.example.":    TCPONLY,
+		"garden.example.": tapir.REDIRECT,
+		"local.example.":  tapir.REDIRECT,
+	}
+	if len(p.names) != len(want) {
+		t.Errorf("parsed %d names, want %d: %v", len(p.names), len(want), p.names)
+	}
+	for name, action := range want {
+		if tn, exist := p.names[name]; !exist || tn.Action != action {
+			t.Errorf("%s: action %s, want %s", name, ActionString(tn.Action), ActionString(action))
+		}
+	}
+	if _, exist := p.allow["self.example."]; !exist {
+		t.Errorf("CNAME to the owner itself in a denylist feed not moved to allow_catchall")
+	}
+}
+
+func TestRedirectRules(t *testing.T) {
+	tp := newTestPop(t, func() {
+		viper.Set("policy.redirect.cname", "Walled.Garden.example.net.")
+		viper.Set("policy.denylist.action", "REDIRECT")
+		viper.Set("policy.denylist.redirect.a", []string{"192.0.2.1", "192.0.2.2"})
+		viper.Set("policy.denylist.redirect.aaaa", []string{"2001:db8::1"})
+		viper.Set("policy.doubtlist.numsources.action", "REDIRECT") // policy.redirect
+		viper.Set("policy.doubtlist.numsources.limit", 2)
+		viper.Set("policy.doubtlist.numtapirtags.limit", 1)
+		viper.Set("policy.doubtlist.numtapirtags.action", "tcp-only")
+	})
+	pd := tp.pd
+	tp.addList("denylist", "local-deny", "file", "evil.example.net.")
+	tp.addList("doubtlist", "feed-a", "xfr", "doubt.example.org.")
+	tp.addList("doubtlist", "feed-b", "xfr", "doubt.example.org.")
+	feed := tp.addList("doubtlist", "dns-tapir", "mqtt")
+	feed.Names["tagged.example.org."] = tapir.TapirName{Name: "tagged.example.org.", TagMask: 1}
+	pd.mu.Lock()
+	_, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup})
+	pd.mu.Unlock()
+	if err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+
+	var got []string
+	for _, rr := range axfr(t, tp.addr, testRpzZone) {
+		if owner := rr.Header().Name; dns.IsSubDomain("example.net."+testRpzZone, owner) ||
+			dns.IsSubDomain("example.org."+testRpzZone, owner) {
+			got = append(got, rr.String())
+		}
+	}
+	want := []string{
+		"evil.example.net.rpz.test.\t3600\tIN\tA\t192.0.2.1",
+		"evil.example.net.rpz.test.\t3600\tIN\tA\t192.0.2.2",
+		"evil.example.net.rpz.test.\t3600\tIN\tAAAA\t2001:db8::1",
+		"doubt.example.org.rpz.test.\t3600\tIN\tCNAME\twalled.garden.example.net.",
+		"tagged.example.org.rpz.test.\t3600\tIN\tCNAME\trpz-tcp-only.",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("rules in the AXFR:\n%v\nwant:\n%v", got, want)
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("evil.example.net."+testRpzZone, dns.TypeAAAA)
+	m, err := dns.Exchange(r, tp.addr)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != dns.TypeAAAA {
+		t.Errorf("AAAA query for a redirected name: %v, want the AAAA of the redirect", m.Answer)
+	}
+
+	// When the rule of a redirected name changes, the whole RRset is replaced
+	serial := pd.Rpz.CurrentSerial()
+	pd.mu.Lock()
+	pd.Policy.DenylistAction = TCPONLY
+	upd, err := pd.GenerateRpzIxfr(&tapir.TapirMsg{Added: []tapir.Domain{{Name: "evil.example.net."}}},
+		PolicyTrigger{Kind: TriggerMqtt, Source: "dns-tapir"})
+	pd.mu.Unlock()
+	if err != nil {
+		t.Fatalf("GenerateRpzIxfr: %v", err)
+	}
+	if len(upd.Removed) != 1 || len(upd.Removed[0].RRs) != 3 || len(upd.Added) != 1 {
+		t.Fatalf("IXFR removes %d and adds %d rules, want the redirect replaced", len(upd.Removed), len(upd.Added))
+	}
+	rrs := ixfr(t, tp.addr, testRpzZone, serial)
+	var addrs int
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeA || rr.Header().Rrtype == dns.TypeAAAA {
+			addrs++
+		}
+	}
+	if _, added := ixfrDiff(t, rrs); addrs != 3 || added["evil.example.net."+testRpzZone] != "rpz-tcp-only." {
+		t.Errorf("IXFR from %d removes %d addresses and adds %v, want 3 and the TCP-ONLY rule", serial, addrs, added)
+	}
+}
+
+func TestParseRedirectTarget(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		redirect map[string]any
+	}{
+		{"CNAME and addresses", map[string]any{"cname": "garden.example.", "a": []string{"192.0.2.1"}}},
+		{"CNAME to an action", map[string]any{"cname": "rpz-drop."}},
+		{"IPv6 address as A", map[string]any{"a": []string{"2001:db8::1"}}},
+		{"IPv4 address as AAAA", map[string]any{"aaaa": []string{"192.0.2.1"}}},
+		{"bad address", map[string]any{"a": []string{"192.0.2.256"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testConfig(t)
+			viper.Set("policy.redirect", tc.redirect)
+			if _, err := ParseRedirectTarget("policy.redirect"); err == nil {
+				t.Errorf("ParseRedirectTarget accepted a redirect with %s", tc.name)
+			}
+		})
+	}
+}
+
+func TestSignedRedirect(t *testing.T) {
+	sign := signedConfig(t, "nsec")
+	pd, _ := newPopData(t, sign, func() {
+		viper.Set("policy.denylist.action", "REDIRECT")
+		viper.Set("policy.denylist.redirect.a", []string{"192.0.2.1"})
+		viper.Set("policy.denylist.redirect.aaaa", []string{"2001:db8::1"})
+	})
+	tp := &testPop{pd: pd}
+	tp.addList("denylist", "local-deny", "file", "evil.example.net.")
+	if _, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup}); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	m := new(dns.Msg)
+	m.SetAxfr(testRpzZone)
+	rw := &recordingWriter{}
+	if _, _, err := pd.RpzAxfrOut(rw, m); err != nil {
+		t.Fatalf("RpzAxfrOut: %v", err)
+	}
+	verifySignedZone(t, rw.rrs())
+
+	owner := "evil.example.net." + testRpzZone
+	var covered []uint16
+	for _, rr := range rw.rrs() {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.Hdr.Name == owner {
+			covered = append(covered, sig.TypeCovered)
+		}
+		if nsec, ok := rr.(*dns.NSEC); ok && nsec.Hdr.Name == owner &&
+			!slices.Equal(nsec.TypeBitMap, []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeRRSIG, dns.TypeNSEC}) {
+			t.Errorf("NSEC of a redirect: %s", nsec.String())
+		}
+	}
+	if !slices.Contains(covered, dns.TypeA) || !slices.Contains(covered, dns.TypeAAAA) {
+		t.Errorf("the redirect has RRSIGs over %v, want both A and AAAA", covered)
+	}
+}
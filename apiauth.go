@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ApiRole is the privilege level of an authenticated API client. Roles are ordered,
+// i.e. an operator may do everything a reader may do, and an admin may do everything.
+type ApiRole uint8
+
+const (
+	RoleNone ApiRole = iota
+	RoleReadOnly
+	RoleOperator
+	RoleAdmin
+)
+
+var ApiRoleToString = map[ApiRole]string{
+	RoleNone:     "none",
+	RoleReadOnly: "read-only",
+	RoleOperator: "operator",
+	RoleAdmin:    "admin",
+}
+
+var StringToApiRole = map[string]ApiRole{
+	"read-only": RoleReadOnly,
+	"readonly":  RoleReadOnly,
+	"operator":  RoleOperator,
+	"admin":     RoleAdmin,
+}
+
+// The role required for each command, per API endpoint. Commands not listed here
+// require the admin role.
+var ApiCommandRoles = map[string]map[string]ApiRole{
+	"command": {
+		"status":           RoleReadOnly,
+		"rpz-lookup":       RoleReadOnly,
+		"rpz-list-sources": RoleReadOnly,
+		"bump":             RoleOperator,
+		"rpz-add":          RoleOperator,
+		"rpz-remove":       RoleOperator,
+		"mqtt-start":       RoleOperator,
+		"mqtt-restart":     RoleOperator,
+		"mqtt-stop":        RoleAdmin,
+		"stop":             RoleAdmin,
+	},
+	"bootstrap": {
+		"doubtlist-status": RoleReadOnly,
+		"export-doubtlist": RoleReadOnly,
+		"doubtlist-digest": RoleReadOnly,
+	},
+	"debug": {
+		"rrset":        RoleReadOnly,
+		"zonedata":     RoleReadOnly,
+		"mqtt-stats":   RoleReadOnly,
+		"reaper-stats": RoleReadOnly,
+		"filterlists":  RoleReadOnly,
+		"gen-output":   RoleOperator,
+		"send-status":  RoleOperator,
+	},
+	"audit": {
+		"query": RoleReadOnly,
+	},
+	"policy": { // the HTTP outputs
+		"get": RoleReadOnly,
+	},
+}
+
+type ApiPrincipal struct {
+	Name   string
+	Role   ApiRole
+	Method string // "api-key" or "mtls"
+}
+
+type apiPrincipalKey struct{}
+
+type apiKeyEntry struct {
+	name string
+	key  []byte
+	role ApiRole
+}
+
+type ApiAuth struct {
+	keys       []apiKeyEntry
+	identities map[string]ApiPrincipal // map[cert CN or DNS SAN]ApiPrincipal
+	Logger     *log.Logger
+}
+
+// NewApiAuth builds the API authentication table from the apiserver config. The legacy
+// single apiserver.key is retained and is mapped to the admin role.
+func NewApiAuth(conf *Config) (*ApiAuth, error) {
+	aa := ApiAuth{
+		identities: map[string]ApiPrincipal{},
+		Logger:     conf.Loggers.Api,
+	}
+	if aa.Logger == nil {
+		aa.Logger = log.Default()
+	}
+
+	if conf.ApiServer.Key != "" {
+		aa.keys = append(aa.keys, apiKeyEntry{name: "apiserver.key", key: []byte(conf.ApiServer.Key), role: RoleAdmin})
+	}
+
+	for _, k := range conf.ApiServer.Keys {
+		role, ok := StringToApiRole[strings.ToLower(k.Role)]
+		if !ok {
+			return nil, fmt.Errorf("API key %s: unknown role \"%s\"", k.Name, k.Role)
+		}
+		if k.Key == "" {
+			return nil, fmt.Errorf("API key %s: key is empty", k.Name)
+		}
+		aa.keys = append(aa.keys, apiKeyEntry{name: k.Name, key: []byte(k.Key), role: role})
+	}
+
+	for _, id := range conf.ApiServer.Identities {
+		role, ok := StringToApiRole[strings.ToLower(id.Role)]
+		if !ok {
+			return nil, fmt.Errorf("API identity %s: unknown role \"%s\"", id.Name, id.Role)
+		}
+		aa.identities[id.Name] = ApiPrincipal{Name: id.Name, Role: role, Method: "mtls"}
+	}
+
+	if len(aa.keys) == 0 && len(aa.identities) == 0 {
+		return nil, fmt.Errorf("no API keys or client identities configured")
+	}
+	return &aa, nil
+}
+
+// Authenticate identifies the client, either via a verified TLS client certificate or
+// via the X-API-Key header. A verified client certificate takes precedence.
+func (aa *ApiAuth) Authenticate(r *http.Request) (ApiPrincipal, bool) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		if p, ok := aa.identities[cert.Subject.CommonName]; ok {
+			return p, true
+		}
+		for _, san := range cert.DNSNames {
+			if p, ok := aa.identities[san]; ok {
+				return p, true
+			}
+		}
+	}
+
+	apikey := r.Header.Get("X-API-Key")
+	if apikey == "" {
+		return ApiPrincipal{}, false
+	}
+	for _, k := range aa.keys {
+		if subtle.ConstantTimeCompare([]byte(apikey), k.key) == 1 {
+			return ApiPrincipal{Name: k.name, Role: k.role, Method: "api-key"}, true
+		}
+	}
+	return ApiPrincipal{}, false
+}
+
+// Middleware rejects all requests from unknown clients and stores the principal of
+// known clients in the request context for the per-command authorization.
+func (aa *ApiAuth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := aa.Authenticate(r)
+		if !ok {
+			aa.Logger.Printf("API AUDIT: unauthenticated request for %s from %s rejected", r.URL.Path, r.RemoteAddr)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiPrincipalKey{}, p)))
+	})
+}
+
+func RequestPrincipal(r *http.Request) ApiPrincipal {
+	if p, ok := r.Context().Value(apiPrincipalKey{}).(ApiPrincipal); ok {
+		return p
+	}
+	return ApiPrincipal{Name: "unknown", Role: RoleNone}
+}
+
+// Authorize checks that the client that sent the request holds the role required for the
+// command on the endpoint and writes an audit log entry regardless of the outcome.
+func (aa *ApiAuth) Authorize(r *http.Request, endpoint, command string) error {
+	p := RequestPrincipal(r)
+
+	required := RoleAdmin
+	if role, ok := ApiCommandRoles[endpoint][command]; ok {
+		required = role
+	}
+
+	if p.Role < required {
+		aa.Logger.Printf("API AUDIT: DENIED %s/%s for %s (role %s via %s) from %s: requires role %s",
+			endpoint, command, p.Name, ApiRoleToString[p.Role], p.Method, r.RemoteAddr, ApiRoleToString[required])
+		return fmt.Errorf("permission denied: command \"%s\" requires role %s (client %s has role %s)",
+			command, ApiRoleToString[required], p.Name, ApiRoleToString[p.Role])
+	}
+
+	aa.Logger.Printf("API AUDIT: %s/%s by %s (role %s via %s) from %s",
+		endpoint, command, p.Name, ApiRoleToString[p.Role], p.Method, r.RemoteAddr)
+	return nil
+}
+
+// apiDeny sets the status of a response to a request that failed authorization. The
+// JSON body is still written by the handler.
+func apiDeny(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+}
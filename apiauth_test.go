@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestApiAuth(t *testing.T) {
+	var conf Config
+	conf.Loggers.Api = testLogger()
+	conf.ApiServer.Key = "legacy-secret"
+	conf.ApiServer.Keys = []ApiKeyConf{
+		{Name: "monitor", Key: "monitor-secret", Role: "read-only"},
+		{Name: "ops", Key: "ops-secret", Role: "Operator"},
+	}
+	conf.ApiServer.Identities = []ApiIdentityConf{
+		{Name: "edge1.example", Role: "operator"},
+		{Name: "pop2.example", Role: "readonly"},
+	}
+	aa, err := NewApiAuth(&conf)
+	if err != nil {
+		t.Fatalf("NewApiAuth: %v", err)
+	}
+
+	// The handler authorizes endpoint/command like the API handlers do
+	var principal ApiPrincipal
+	handler := func(endpoint, command string) http.Handler {
+		return aa.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal = RequestPrincipal(r)
+			if err := aa.Authorize(r, endpoint, command); err != nil {
+				apiDeny(w)
+			}
+		}))
+	}
+	clientCert := func(cn string, sans ...string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}, DNSNames: sans}
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	for _, tc := range []struct {
+		name              string
+		key               string
+		tls               *tls.ConnectionState
+		endpoint, command string
+		code              int
+		principal         ApiPrincipal // if authenticated
+	}{
+		{"legacy key", "legacy-secret", nil, "command", "stop", http.StatusOK,
+			ApiPrincipal{Name: "apiserver.key", Role: RoleAdmin, Method: "api-key"}},
+		{"named key", "ops-secret", nil, "command", "bump", http.StatusOK,
+			ApiPrincipal{Name: "ops", Role: RoleOperator, Method: "api-key"}},
+		{"named key, admin command", "ops-secret", nil, "command", "stop", http.StatusForbidden,
+			ApiPrincipal{Name: "ops", Role: RoleOperator, Method: "api-key"}},
+		{"read-only key", "monitor-secret", nil, "bootstrap", "export-doubtlist", http.StatusOK,
+			ApiPrincipal{Name: "monitor", Role: RoleReadOnly, Method: "api-key"}},
+		{"read-only key, write command", "monitor-secret", nil, "command", "rpz-add", http.StatusForbidden,
+			ApiPrincipal{Name: "monitor", Role: RoleReadOnly, Method: "api-key"}},
+		{"read-only key, unlisted command", "monitor-secret", nil, "debug", "no-such-command", http.StatusForbidden,
+			ApiPrincipal{Name: "monitor", Role: RoleReadOnly, Method: "api-key"}},
+		{"client cert CN", "", clientCert("edge1.example"), "command", "bump", http.StatusOK,
+			ApiPrincipal{Name: "edge1.example", Role: RoleOperator, Method: "mtls"}},
+		{"client cert SAN, wins over the key", "legacy-secret", clientCert("pop2", "pop2.example"), "debug", "gen-output", http.StatusForbidden,
+			ApiPrincipal{Name: "pop2.example", Role: RoleReadOnly, Method: "mtls"}},
+		{"unknown client cert, key", "monitor-secret", clientCert("other.example"), "command", "status", http.StatusOK,
+			ApiPrincipal{Name: "monitor", Role: RoleReadOnly, Method: "api-key"}},
+		{"unknown key", "wrong-secret", nil, "command", "status", http.StatusUnauthorized, ApiPrincipal{}},
+		{"missing key", "", nil, "command", "status", http.StatusUnauthorized, ApiPrincipal{}},
+		{"unknown client cert", "", clientCert("other.example"), "command", "status", http.StatusUnauthorized, ApiPrincipal{}},
+	} {
+		principal = ApiPrincipal{}
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/"+tc.endpoint, nil)
+		if tc.key != "" {
+			r.Header.Set("X-API-Key", tc.key)
+		}
+		r.TLS = tc.tls
+		w := httptest.NewRecorder()
+		handler(tc.endpoint, tc.command).ServeHTTP(w, r)
+		if w.Code != tc.code || principal != tc.principal {
+			t.Errorf("%s: %s/%s: %d as %+v, want %d as %+v", tc.name, tc.endpoint, tc.command, w.Code, principal, tc.code, tc.principal)
+		}
+	}
+}
+
+func TestNewApiAuthErrors(t *testing.T) {
+	for name, apiserver := range map[string]ApiserverConf{
+		"no keys":      {},
+		"unknown role": {Keys: []ApiKeyConf{{Name: "k", Key: "secret", Role: "root"}}},
+		"empty key":    {Keys: []ApiKeyConf{{Name: "k", Role: "admin"}}},
+		"identity":     {Identities: []ApiIdentityConf{{Name: "pop.example", Role: "superuser"}}},
+	} {
+		conf := Config{ApiServer: apiserver}
+		conf.Loggers.Api = testLogger()
+		if _, err := NewApiAuth(&conf); err == nil {
+			t.Errorf("NewApiAuth with %s: no error", name)
+		}
+	}
+}
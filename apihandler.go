@@ -5,11 +5,14 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 	"os"
 	"sync"
@@ -69,6 +72,13 @@ func APIcommand(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 			}
 		}()
 
+		if err := conf.Internal.ApiAuth.Authorize(r, "command", cp.Command); err != nil {
+			apiDeny(w)
+			resp.Error = true
+			resp.ErrorMsg = err.Error()
+			return
+		}
+
 		switch cp.Command {
 		case "status":
 			log.Printf("Daemon status inquiry\n")
@@ -103,13 +113,11 @@ func APIcommand(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 				Status: "stopping",
 				Msg:    "Daemon was happy, but now winding down",
 			}
-			log.Printf("Stopping MQTT engine\n")
-			_, err := conf.PopData.MqttEngine.StopEngine()
-			if err != nil {
-				resp.Error = true
-				resp.ErrorMsg = err.Error()
+			// The MQTT engine is stopped as part of the shutdown in mainloop
+			select {
+			case conf.Internal.APIStopCh <- struct{}{}:
+			default: // already stopping
 			}
-			conf.Internal.APIStopCh <- struct{}{}
 		case "bump":
 			resp.Msg, err = BumpSerial(conf, cp.Zone)
 			if err != nil {
@@ -236,14 +244,25 @@ func APIcommand(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// BootstrapResponse is a tapir.BootstrapResponse, plus the sequence counters of the MQTT lists
+// in the response to doubtlist-status.
+type BootstrapResponse struct {
+	tapir.BootstrapResponse
+	Sequences map[string]SequenceStats `json:",omitempty"` // by list name
+}
+
 func APIbootstrap(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		resp := tapir.BootstrapResponse{
+		resp := BootstrapResponse{BootstrapResponse: tapir.BootstrapResponse{
 			Status: "ok", // only status we know, so far
 			Msg:    "We're happy, but send more cookies",
-		}
+		}}
+		exported := false // the response is an export, not a BootstrapResponse
 
 		defer func() {
+			if exported {
+				return
+			}
 			w.Header().Set("Content-Type", "application/json")
 			err := json.NewEncoder(w).Encode(resp)
 			if err != nil {
@@ -253,7 +272,7 @@ func APIbootstrap(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 		}()
 
 		decoder := json.NewDecoder(r.Body)
-		var bp tapir.BootstrapPost
+		var bp ExportPost // a tapir.BootstrapPost, plus the chunk of an export
 		err := decoder.Decode(&bp)
 		if err != nil {
 			log.Println("APIbootstrap: error decoding command post:", err)
@@ -264,6 +283,13 @@ func APIbootstrap(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 
 		log.Printf("API: received /bootstrap request (cmd: %s) from %s.\n", bp.Command, r.RemoteAddr)
 
+		if err := conf.Internal.ApiAuth.Authorize(r, "bootstrap", bp.Command); err != nil {
+			apiDeny(w)
+			resp.Error = true
+			resp.ErrorMsg = err.Error()
+			return
+		}
+
 		switch bp.Command {
 		case "doubtlist-status":
 			me := conf.PopData.MqttEngine
@@ -273,96 +299,113 @@ func APIbootstrap(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 			resp.TopicData = stats
 			// log.Printf("API: doubtlist-status: msgs: %d last msg: %v", stats.MsgCounters[bp.ListName], stats.MsgTimeStamps[bp.ListName])
 			log.Printf("API: doubtlist-status: %v", stats)
-
-		case "export-doubtlist":
+			// The sequence counters of the list, or of all lists of the type if none is given
 			td := conf.PopData
+			resp.Sequences = map[string]SequenceStats{}
 			td.mu.RLock()
-			defer td.mu.RUnlock()
+			for name, wbgl := range td.Lists[bp.listType()] {
+				if ms := td.Sequences[wbgl]; ms != nil && (bp.ListName == "" || bp.ListName == name) {
+					resp.Sequences[name] = ms.Stats()
+				}
+			}
+			td.mu.RUnlock()
 
-			doubtlist, ok := td.Lists["doubtlist"][bp.ListName]
+		case "doubtlist-digest":
+			td := conf.PopData
+			td.mu.RLock()
+			wbgl, ok := td.Lists[bp.listType()][bp.ListName]
 			if !ok {
+				td.mu.RUnlock()
 				resp.Error = true
-				resp.ErrorMsg = fmt.Sprintf("Doubtlist '%s' not found", bp.ListName)
+				resp.ErrorMsg = fmt.Sprintf("List [%s][%s] not found", bp.listType(), bp.ListName)
 				return
 			}
-			log.Printf("Found %s doubtlist containing %d names", bp.ListName, len(doubtlist.Names))
+			snap := NewExportSnapshot(wbgl, td.Positions[wbgl])
+			td.mu.RUnlock()
 
-			switch bp.Encoding {
-			case "gob":
-				w.Header().Set("Content-Type", "application/octet-stream")
-				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=doubtlist-%s.gob", bp.ListName))
+			at := bp.At
+			if at.IsZero() {
+				at = time.Now()
+			}
+			w.Header().Set("Content-Type", "application/json")
+			err := json.NewEncoder(w).Encode(snap.Digest(at))
+			if err != nil {
+				log.Printf("Error encoding digest of %s %s: %v", bp.listType(), bp.ListName, err)
+			}
+			exported = true
+
+		case "export-doubtlist":
+			td := conf.PopData
+			enc, err := NegotiateExportEncoding(bp.Encoding)
+			if err != nil {
+				resp.Error = true
+				resp.ErrorMsg = err.Error()
+				return
+			}
 
-				encoder := gob.NewEncoder(w)
-				err := encoder.Encode(doubtlist)
-				if err != nil {
-					log.Printf("Error encoding doubtlist: %v", err)
+			var snap *ExportSnapshot
+			if bp.Snapshot != "" {
+				// The continuation of an export
+				var ok bool
+				if snap, ok = td.Exports.Get(bp.Snapshot); !ok || snap.hdr.Name != bp.ListName || snap.hdr.Type != bp.listType() {
+					resp.Error = true
+					resp.ErrorMsg = fmt.Sprintf("Export snapshot '%s' of %s '%s' not found (expired?)", bp.Snapshot, bp.listType(), bp.ListName)
+					return
+				}
+			} else {
+				td.mu.RLock()
+				wbgl, ok := td.Lists[bp.listType()][bp.ListName]
+				if !ok {
+					td.mu.RUnlock()
+					resp.Error = true
+					resp.ErrorMsg = fmt.Sprintf("List [%s][%s] not found", bp.listType(), bp.ListName)
+					return
+				}
+				log.Printf("Found %s %s containing %d names", bp.ListName, bp.listType(), len(wbgl.Names))
+				if enc == "gob" {
+					// Old clients get the whole list in one go, encoded under the lock but written
+					// to the client after it is released
+					var buf bytes.Buffer
+					err = gob.NewEncoder(&buf).Encode(wbgl)
+					td.mu.RUnlock()
+					if err != nil {
+						log.Printf("Error encoding %s %s (encoding %s): %v", bp.listType(), bp.ListName, enc, err)
+						resp.Error = true
+						resp.ErrorMsg = fmt.Sprintf("Error encoding %s %s: %v", bp.listType(), bp.ListName, err)
+						return
+					}
+					setExportHeaders(w, bp.listType(), bp.ListName, enc)
+					if _, err := buf.WriteTo(w); err != nil {
+						log.Printf("Error writing %s %s (encoding %s): %v", bp.listType(), bp.ListName, enc, err)
+					}
+					exported = true
+					return
+				}
+				snap = NewExportSnapshot(wbgl, td.Positions[wbgl])
+				td.mu.RUnlock()
+				if err := td.Exports.Add(snap, td.ExportSigner); err != nil {
 					resp.Error = true
 					resp.ErrorMsg = err.Error()
 					return
 				}
-
-				//			case "protobuf":
-				//				w.Header().Set("Content-Type", "application/octet-stream")
-				//				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=doubtlist-%s.protobuf", bp.ListName))
-				//
-				//				data, err := proto.Marshal(doubtlist)
-				//				if err != nil {
-				//					log.Printf("Error encoding doubtlist to protobuf: %v", err)
-				//					resp.Error = true
-				//					resp.ErrorMsg = err.Error()
-				//					return
-				//				}
-
-				//				_, err = w.Write(data)
-				//				if err != nil {
-				//					log.Printf("Error writing protobuf data to response: %v", err)
-				//					resp.Error = true
-				//					resp.ErrorMsg = err.Error()
-				//					return
-				//				}
-
-			// case "flatbuffer":
-			// 	w.Header().Set("Content-Type", "application/octet-stream")
-			// 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=doubtlist-%s.flatbuffer", bp.ListName))
-
-			// 	builder := flatbuffers.NewBuilder(0)
-			// 	names := make([]flatbuffers.UOffsetT, len(doubtlist.Names))
-
-			// 	i := 0
-			// 	for name := range doubtlist.Names {
-			// 		nameOffset := builder.CreateString(name)
-			// 		tapir.NameStart(builder)
-			// 		tapir.NameAddName(builder, nameOffset)
-			// 		names[i] = tapir.NameEnd(builder)
-			// 		i++
-			// 	}
-
-			// 	tapir.DoubtlistStartNamesVector(builder, len(names))
-			// 	for j := len(names) - 1; j >= 0; j-- {
-			// 		builder.PrependUOffsetT(names[j])
-			// 	}
-			// 	namesVector := builder.EndVector(len(names))
-
-			// 	tapir.DoubtlistStart(builder)
-			// 	tapir.DoubtlistAddNames(builder, namesVector)
-			// 	doubtlistOffset := tapir.DoubtlistEnd(builder)
-
-			// 	builder.Finish(doubtlistOffset)
-			// 	buf := builder.FinishedBytes()
-
-			// 	_, err := w.Write(buf)
-			// 	if err != nil {
-			// 		log.Printf("Error writing flatbuffer data to response: %v", err)
-			// 		resp.Error = true
-			// 		resp.ErrorMsg = err.Error()
-			// 		return
-			// 	}
-
-			default:
+			}
+			if enc == "gob" {
 				resp.Error = true
-				resp.ErrorMsg = fmt.Sprintf("Unknown encoding: %s", bp.Encoding)
+				resp.ErrorMsg = "Export snapshots are not available in the gob encoding"
 				return
 			}
+			if bp.Offset < 0 || bp.Offset > snap.hdr.Total {
+				resp.Error = true
+				resp.ErrorMsg = fmt.Sprintf("Offset %d is outside export snapshot '%s' with %d names", bp.Offset, snap.hdr.Snapshot, snap.hdr.Total)
+				return
+			}
+			setExportHeaders(w, bp.listType(), bp.ListName, enc)
+			err = WriteExport(w, enc, snap, bp.Offset, bp.Limit)
+			if err != nil {
+				// Too late for a JSON error response, the client fails to decode the export
+				log.Printf("Error encoding %s %s (encoding %s): %v", bp.listType(), bp.ListName, enc, err)
+			}
+			exported = true
 
 		default:
 			resp.ErrorMsg = fmt.Sprintf("Unknown command: %s", bp.Command)
@@ -371,6 +414,13 @@ func APIbootstrap(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// setExportHeaders sets the HTTP headers of an export of the list listtype/listname in the encoding enc.
+func setExportHeaders(w http.ResponseWriter, listtype, listname, enc string) {
+	w.Header().Set("Content-Type", ExportContentType(enc))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s-%s.%s", listtype, listname, enc))
+	w.Header().Set("X-Tapir-Export-Encoding", enc)
+}
+
 func APIdebug(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 	td := conf.PopData
 
@@ -400,10 +450,17 @@ func APIdebug(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("API: received /debug request (cmd: %s) from %s.\n",
 			dp.Command, r.RemoteAddr)
 
+		if err := conf.Internal.ApiAuth.Authorize(r, "debug", dp.Command); err != nil {
+			apiDeny(w)
+			resp.Error = true
+			resp.ErrorMsg = err.Error()
+			return
+		}
+
 		switch dp.Command {
 		case "rrset":
 			log.Printf("TAPIR-POP debug rrset inquiry")
-			if zd, ok := td.RpzSources[dp.Zone]; ok {
+			if zd, ok := td.RpzSource(dp.Zone); ok {
 				if owner := &zd.Owners[zd.OwnerIndex[dp.Qname]]; owner != nil {
 					if rrset, ok := owner.RRtypes[dp.Qtype]; ok {
 						resp.RRset = rrset
@@ -416,7 +473,7 @@ func APIdebug(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 
 		case "zonedata":
 			log.Printf("TAPIR-POP debug zone inquiry")
-			if zd, ok := td.RpzSources[dp.Zone]; ok {
+			if zd, ok := td.RpzSource(dp.Zone); ok {
 				//			       resp.ZoneData = *zd
 				//			       resp.ZoneData.RRKeepFunc = nil
 				//			       resp.ZoneData.RRParseFunc = nil
@@ -433,6 +490,7 @@ func APIdebug(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 		case "reaper-stats":
 			log.Printf("TAPIR-POP debug reaper stats")
 			resp.ReaperStats = make(map[string]map[time.Time][]string)
+			td.mu.RLock()
 			for SrcName, list := range td.Lists["doubtlist"] {
 				resp.ReaperStats[SrcName] = make(map[time.Time][]string)
 				for ts, names := range list.ReaperData {
@@ -441,10 +499,12 @@ func APIdebug(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 					}
 				}
 			}
+			td.mu.RUnlock()
 
 		case "filterlists":
 			log.Printf("TAPIR-POP debug allow/deny/doubt lists")
 			resp.Lists = map[string]map[string]*tapir.WBGlist{}
+			td.mu.RLock()
 			for t, l := range td.Lists {
 				resp.Lists[t] = map[string]*tapir.WBGlist{}
 				for n, v := range l {
@@ -453,7 +513,7 @@ func APIdebug(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 						Description: td.Lists[t][n].Description,
 						Type:        td.Lists[t][n].Type,
 						Format:      td.Lists[t][n].Format,
-						Names:       td.Lists[t][n].Names,
+						Names:       maps.Clone(td.Lists[t][n].Names), // the response is encoded after unlocking
 						Filename:    td.Lists[t][n].Filename,
 						RpzZoneName: td.Lists[t][n].RpzZoneName,
 						RpzSerial:   td.Lists[t][n].RpzSerial,
@@ -461,18 +521,25 @@ func APIdebug(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 					}
 				}
 			}
+			td.mu.RUnlock()
 
 		case "gen-output":
 			log.Printf("TAPIR-POP debug generate RPZ output")
-			err = td.GenerateRpzAxfr()
+			td.mu.Lock()
+			notify, err := td.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerApi, Source: RequestPrincipal(r).Name})
+			// GenerateRpzAxfr replaces these maps rather than modifying them
+			resp.DenylistedNames = td.DenylistedNames
+			resp.DoubtlistedNames = td.DoubtlistedNames
+			td.mu.Unlock()
+			if notify {
+				err = errors.Join(err, td.NotifyDownstreams())
+			}
 			if err != nil {
 				resp.Error = true
 				resp.ErrorMsg = err.Error()
 			}
-			resp.DenylistedNames = td.DenylistedNames
-			resp.DoubtlistedNames = td.DoubtlistedNames
-			for _, rpzn := range td.Rpz.Axfr.Data {
-				resp.RpzOutput = append(resp.RpzOutput, *rpzn)
+			for _, rpzn := range td.Rpz.Snapshot().Data {
+				resp.RpzOutput = append(resp.RpzOutput, rpzn.RpzName)
 			}
 
 		case "send-status":
@@ -513,15 +580,89 @@ func APIdebug(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type AuditPost struct {
+	Command    string // "query"
+	Name       string
+	FromSerial uint32
+	ToSerial   uint32
+	Limit      int
+}
+
+type AuditResponse struct {
+	Time     time.Time
+	Status   string
+	Msg      string
+	Records  []PolicyAuditRecord
+	Error    bool
+	ErrorMsg string
+}
+
+func APIaudit(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := AuditResponse{
+			Time:   time.Now(),
+			Status: "ok",
+		}
+
+		defer func() {
+			w.Header().Set("Content-Type", "application/json")
+			err := json.NewEncoder(w).Encode(resp)
+			if err != nil {
+				log.Printf("Error from json encoder: %v", err)
+			}
+		}()
+
+		decoder := json.NewDecoder(r.Body)
+		var ap AuditPost
+		err := decoder.Decode(&ap)
+		if err != nil {
+			log.Println("APIaudit: error decoding audit post:", err)
+			resp.Error = true
+			resp.ErrorMsg = fmt.Sprintf("Error decoding audit post: %v", err)
+			return
+		}
+
+		log.Printf("API: received /audit request (cmd: %s) from %s.\n", ap.Command, r.RemoteAddr)
+
+		if err := conf.Internal.ApiAuth.Authorize(r, "audit", ap.Command); err != nil {
+			apiDeny(w)
+			resp.Error = true
+			resp.ErrorMsg = err.Error()
+			return
+		}
+
+		switch ap.Command {
+		case "query":
+			resp.Records, err = conf.PopData.PolicyAudit.Query(AuditQuery{
+				Name:       ap.Name,
+				FromSerial: ap.FromSerial,
+				ToSerial:   ap.ToSerial,
+				Limit:      ap.Limit,
+			})
+			if err != nil {
+				resp.Error = true
+				resp.ErrorMsg = err.Error()
+				return
+			}
+			resp.Msg = fmt.Sprintf("Found %d matching policy audit records", len(resp.Records))
+
+		default:
+			resp.Error = true
+			resp.ErrorMsg = fmt.Sprintf("Unknown command: %s", ap.Command)
+		}
+	}
+}
+
 func SetupRouter(conf *Config) *mux.Router {
 	r := mux.NewRouter().StrictSlash(true)
 
-	sr := r.PathPrefix("/api/v1").Headers("X-API-Key",
-		viper.GetString("apiserver.key")).Subrouter()
+	sr := r.PathPrefix("/api/v1").Subrouter()
+	sr.Use(conf.Internal.ApiAuth.Middleware)
 	sr.HandleFunc("/ping", tapir.APIping("tapir-pop", conf.BootTime)).Methods("POST")
 	sr.HandleFunc("/command", APIcommand(conf)).Methods("POST")
 	sr.HandleFunc("/bootstrap", APIbootstrap(conf)).Methods("POST")
 	sr.HandleFunc("/debug", APIdebug(conf)).Methods("POST")
+	sr.HandleFunc("/audit", APIaudit(conf)).Methods("POST")
 	// sr.HandleFunc("/show/api", tapir.APIshowAPI(r)).Methods("GET")
 
 	return r
@@ -530,7 +671,8 @@ func SetupRouter(conf *Config) *mux.Router {
 func SetupBootstrapRouter(conf *Config) *mux.Router {
 	r := mux.NewRouter().StrictSlash(true)
 
-	sr := r.PathPrefix("/api/v1").Headers("X-API-Key", viper.GetString("apiserver.key")).Subrouter()
+	sr := r.PathPrefix("/api/v1").Subrouter()
+	sr.Use(conf.Internal.ApiAuth.Middleware)
 	sr.HandleFunc("/ping", tapir.APIping("tapir-pop", conf.BootTime)).Methods("POST")
 	sr.HandleFunc("/bootstrap", APIbootstrap(conf)).Methods("POST")
 	// sr.HandleFunc("/debug", APIdebug(conf)).Methods("POST")
@@ -556,10 +698,17 @@ func walkRoutes(router *mux.Router, address string) {
 	//	return nil
 }
 
-// In practice APIdispatcher doesn't need a termination signal, as it will
-// just sit inside http.ListenAndServe, but we keep it for symmetry.
+// The API servers are registered in conf.Internal.Servers and stopped from there on
+// shutdown. The done channel is not used, but we keep it for symmetry.
 func APIhandler(conf *Config, done <-chan struct{}) {
 	gob.Register(tapir.WBGlist{}) // Must register the type for gob encoding
+
+	apiauth, err := NewApiAuth(conf)
+	if err != nil {
+		POPExiter("Error setting up API authentication: %v", err)
+	}
+	conf.Internal.ApiAuth = apiauth
+
 	router := SetupRouter(conf)
 
 	walkRoutes(router, viper.GetString("apiserver.address"))
@@ -585,7 +734,7 @@ func APIhandler(conf *Config, done <-chan struct{}) {
 
 	tlspossible := true
 
-	_, err := os.Stat(certfile)
+	_, err = os.Stat(certfile)
 	if os.IsNotExist(err) {
 		log.Printf("*** APIhandler: Error: TLS cert file \"%s\" does not exist", certfile)
 		tlspossible = false
@@ -618,10 +767,13 @@ func APIhandler(conf *Config, done <-chan struct{}) {
 					ReadTimeout:  10 * time.Second,
 					WriteTimeout: 10 * time.Second,
 				}
+				conf.Internal.Servers.AddHttpServer(apiServer)
 
 				log.Printf("*** API: Starting API dispatcher #%d. Listening on %s", idx+1, address)
 				wg.Done()
-				POPExiter(apiServer.ListenAndServe())
+				if err := apiServer.ListenAndServe(); err != http.ErrServerClosed {
+					POPExiter(err)
+				}
 			}(&wg)
 		}
 	}
@@ -638,9 +790,12 @@ func APIhandler(conf *Config, done <-chan struct{}) {
 						ReadTimeout:  10 * time.Second,
 						WriteTimeout: 10 * time.Second,
 					}
+					conf.Internal.Servers.AddHttpServer(tlsServer)
 					log.Printf("*** API: Starting TLS API dispatcher #%d. Listening on %s", idx+1, tlsaddress)
 					wg.Done()
-					POPExiter(tlsServer.ListenAndServeTLS(certfile, keyfile))
+					if err := tlsServer.ListenAndServeTLS(certfile, keyfile); err != http.ErrServerClosed {
+						POPExiter(err)
+					}
 				}(&wg)
 			}
 		} else {
@@ -658,9 +813,12 @@ func APIhandler(conf *Config, done <-chan struct{}) {
 					ReadTimeout:  10 * time.Second,
 					WriteTimeout: 10 * time.Second,
 				}
+				conf.Internal.Servers.AddHttpServer(apiServer)
 				log.Printf("*** API: Starting Bootstrap API dispatcher #%d. Listening on %s", idx+1, address)
 				wg.Done()
-				POPExiter(apiServer.ListenAndServe())
+				if err := apiServer.ListenAndServe(); err != http.ErrServerClosed {
+					POPExiter(err)
+				}
 			}(&wg)
 		}
 	} else {
@@ -679,10 +837,13 @@ func APIhandler(conf *Config, done <-chan struct{}) {
 						ReadTimeout:  10 * time.Second,
 						WriteTimeout: 10 * time.Second,
 					}
+					conf.Internal.Servers.AddHttpServer(bootstrapTlsServer)
 
 					log.Printf("*** API: Starting Bootstrap TLS API dispatcher #%d. Listening on %s", idx+1, address)
 					wg.Done()
-					POPExiter(bootstrapTlsServer.ListenAndServeTLS(certfile, keyfile))
+					if err := bootstrapTlsServer.ListenAndServeTLS(certfile, keyfile); err != http.ErrServerClosed {
+						POPExiter(err)
+					}
 				}(&wg)
 			}
 		} else {
@@ -692,8 +853,42 @@ func APIhandler(conf *Config, done <-chan struct{}) {
 		log.Println("*** API: No bootstrap TLS address specified")
 	}
 
+	conf.PopData.mu.RLock()
+	httpoutputs := conf.PopData.HttpOutputs
+	conf.PopData.mu.RUnlock()
+	for _, ho := range httpoutputs {
+		if ho.TLS && !tlspossible {
+			log.Printf("*** API: Error: Cannot serve HTTP output %s with TLS without cert and key files.\n", ho.Name)
+			continue
+		}
+		wg.Add(1)
+		go func(wg *sync.WaitGroup) {
+			outputServer := &http.Server{
+				Addr:         ho.Addr,
+				Handler:      SetupHttpOutputRouter(conf, ho),
+				ReadTimeout:  10 * time.Second,
+				WriteTimeout: time.Minute, // the whole policy may be large
+			}
+			conf.Internal.Servers.AddHttpServer(outputServer)
+			log.Printf("*** API: Starting HTTP output %s. Listening on %s", ho.Name, ho.Addr)
+			wg.Done()
+			var err error
+			if ho.TLS {
+				outputServer.TLSConfig = tlsConfig
+				err = outputServer.ListenAndServeTLS(certfile, keyfile)
+			} else {
+				err = outputServer.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				// The policy is still served by the other outputs, don't take them down
+				log.Printf("*** API: Error: HTTP output %s on %s stopped: %v", ho.Name, ho.Addr, err)
+				conf.PopData.ReportStatus("http-output", tapir.StatusFail, "HTTP output %s on %s stopped: %v", ho.Name, ho.Addr, err)
+			}
+		}(&wg)
+	}
+
 	wg.Wait()
-	log.Println("API dispatcher: unclear how to stop the http server nicely.")
+	log.Println("API dispatcher: all servers started. They are stopped via Shutdown() from mainloop.")
 }
 
 func BumpSerial(conf *Config, zone string) (string, error) {
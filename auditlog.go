@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Known kinds of events that may cause a change in the RPZ output.
+const (
+	TriggerStartup   = "startup"
+	TriggerMqtt      = "mqtt"
+	TriggerXfr       = "xfr"
+	TriggerHttp      = "http"
+	TriggerApi       = "api"
+	TriggerReaper    = "reaper"
+	TriggerBootstrap = "bootstrap"
+)
+
+// PolicyTrigger describes what caused a policy evaluation: the kind of event and the
+// source list (or API client) that it came from.
+type PolicyTrigger struct {
+	Kind   string
+	Source string
+}
+
+// One PolicyAuditRecord is written for every name that is added to or removed from
+// the RPZ output.
+type PolicyAuditRecord struct {
+	Time      time.Time `json:"time"`
+	Serial    uint32    `json:"serial"`
+	Op        string    `json:"op"` // "add" or "remove"
+	Name      string    `json:"name"`
+	OldAction string    `json:"old_action,omitempty"`
+	NewAction string    `json:"new_action,omitempty"`
+	Ttl       uint32    `json:"ttl,omitempty"` // TTL of the added rule
+	Trigger   string    `json:"trigger"`
+	Source    string    `json:"source,omitempty"`
+	Rule      string    `json:"rule,omitempty"`
+}
+
+// PolicyAudit is an append-only log of PolicyAuditRecords, stored as JSON lines.
+type PolicyAudit struct {
+	mu       sync.Mutex
+	Filename string
+	file     *os.File
+}
+
+func NewPolicyAudit(filename string) (*PolicyAudit, error) {
+	filename = filepath.Clean(filename)
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644) // #nosec G302
+	if err != nil {
+		return nil, fmt.Errorf("error opening policy audit log '%s': %v", filename, err)
+	}
+	return &PolicyAudit{Filename: filename, file: f}, nil
+}
+
+// Append writes the records to the audit log. A nil *PolicyAudit (i.e. no audit log
+// configured) silently discards the records; a closed one rejects them.
+func (pa *PolicyAudit) Append(records []PolicyAuditRecord) error {
+	if pa == nil || len(records) == 0 {
+		return nil
+	}
+
+	var buf []byte
+	for _, rec := range records {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if pa.file == nil {
+		return fmt.Errorf("policy audit log '%s' is closed, %d records not written", pa.Filename, len(records))
+	}
+	_, err := pa.file.Write(buf)
+	return err
+}
+
+// Close closes the audit log for writing; it can still be queried.
+func (pa *PolicyAudit) Close() error {
+	if pa == nil {
+		return nil
+	}
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if pa.file == nil {
+		return nil
+	}
+	err := pa.file.Close()
+	pa.file = nil
+	return err
+}
+
+type AuditQuery struct {
+	Name       string // if set, only records for this name
+	FromSerial uint32 // if set, only records with serial >= FromSerial
+	ToSerial   uint32 // if set, only records with serial <= ToSerial
+	Limit      int    // if set, only the last Limit matching records
+}
+
+// Query scans the audit log and returns the matching records in the order they were written.
+func (pa *PolicyAudit) Query(q AuditQuery) ([]PolicyAuditRecord, error) {
+	if pa == nil {
+		return nil, fmt.Errorf("no policy audit log configured (key policy.auditlog)")
+	}
+	if q.Name != "" {
+		q.Name = dns.Fqdn(q.Name)
+	}
+
+	f, err := os.Open(pa.Filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res []PolicyAuditRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec PolicyAuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue // a partially written last line, most likely
+		}
+		if q.Name != "" && rec.Name != q.Name {
+			continue
+		}
+		if q.FromSerial != 0 && rec.Serial < q.FromSerial {
+			continue
+		}
+		if q.ToSerial != 0 && rec.Serial > q.ToSerial {
+			continue
+		}
+		res = append(res, rec)
+		if q.Limit > 0 && len(res) > q.Limit {
+			res = res[1:]
+		}
+	}
+	return res, scanner.Err()
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPolicyAudit(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	pa, err := NewPolicyAudit(filename)
+	if err != nil {
+		t.Fatalf("NewPolicyAudit: %v", err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	record := func(serial uint32, op, name string) PolicyAuditRecord {
+		rec := PolicyAuditRecord{Time: now, Serial: serial, Op: op, Name: name, Trigger: TriggerMqtt, Source: "dns-tapir"}
+		if op == "add" {
+			rec.NewAction, rec.Ttl, rec.Rule = "NXDOMAIN", 3600, "doubtlist.numsources"
+		} else {
+			rec.OldAction = "NXDOMAIN"
+		}
+		return rec
+	}
+	if err := pa.Append([]PolicyAuditRecord{record(1, "add", "a.example."), record(1, "add", "b.example.")}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := pa.Append(nil); err != nil {
+		t.Errorf("Append of no records: %v", err)
+	}
+	if err := pa.Append([]PolicyAuditRecord{record(2, "remove", "a.example.")}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	// One JSON object per line
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	if len(lines) != 3 {
+		t.Fatalf("%d lines in the audit log, want 3:\n%s", len(lines), data)
+	}
+	for i, line := range lines {
+		var rec PolicyAuditRecord
+		if err := json.Unmarshal(line, &rec); err != nil || rec.Serial == 0 || rec.Name == "" {
+			t.Errorf("line %d: %q: %v", i+1, line, err)
+		}
+	}
+
+	// Reopened after a restart, the log is appended to
+	if err := pa.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	pa, err = NewPolicyAudit(filename)
+	if err != nil {
+		t.Fatalf("NewPolicyAudit: %v", err)
+	}
+	if err := pa.Append([]PolicyAuditRecord{record(3, "add", "c.example."), record(4, "add", "a.example.")}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	all, err := pa.Query(AuditQuery{})
+	if err != nil || len(all) != 5 {
+		t.Fatalf("Query: %d records, %v, want 5", len(all), err)
+	}
+	for i, want := range []PolicyAuditRecord{
+		record(1, "add", "a.example."), record(1, "add", "b.example."), record(2, "remove", "a.example."),
+		record(3, "add", "c.example."), record(4, "add", "a.example."),
+	} {
+		if !all[i].Time.Equal(want.Time) || all[i].Serial != want.Serial || all[i].Op != want.Op || all[i].Name != want.Name ||
+			all[i].NewAction != want.NewAction || all[i].OldAction != want.OldAction || all[i].Rule != want.Rule {
+			t.Errorf("record %d: %+v, want %+v", i, all[i], want)
+		}
+	}
+
+	// A closed log rejects the records, but can still be queried
+	if err := pa.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := pa.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	if err := pa.Append([]PolicyAuditRecord{record(5, "add", "d.example.")}); err == nil {
+		t.Errorf("Append after Close: no error")
+	}
+	if recs, err := pa.Query(AuditQuery{}); err != nil || len(recs) != 5 {
+		t.Errorf("Query after Close: %d records, %v, want 5", len(recs), err)
+	}
+}
+
+func TestAuditQueryApi(t *testing.T) {
+	pd, conf := newPopData(t)
+	conf.PopData = pd
+	conf.Internal.ApiAuth = &ApiAuth{Logger: testLogger()}
+	handler := APIaudit(conf)
+	query := func(ap AuditPost) AuditResponse {
+		t.Helper()
+		var resp AuditResponse
+		if err := json.Unmarshal(apiRequest(handler, RoleReadOnly, "/api/v1/audit", ap).Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decoding the response to %+v: %v", ap, err)
+		}
+		return resp
+	}
+
+	// Without an audit log
+	harnessLog := pd.PolicyAudit
+	pd.PolicyAudit = nil
+	if resp := query(AuditPost{Command: "query"}); !resp.Error {
+		t.Errorf("query without an audit log: %+v, want an error", resp)
+	}
+
+	pa, err := NewPolicyAudit(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("NewPolicyAudit: %v", err)
+	}
+	defer pa.Close()
+	pd.PolicyAudit = pa
+	defer func() { pd.PolicyAudit = harnessLog }() // closed by the harness
+	var records []PolicyAuditRecord
+	for serial, name := range []string{"a.example.", "b.example.", "a.example.", "c.example.", "a.example."} {
+		records = append(records, PolicyAuditRecord{Time: time.Now(), Serial: uint32(serial + 1), Op: "add", Name: name, Trigger: TriggerApi})
+	}
+	if err := pa.Append(records); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	for _, tc := range []struct {
+		post    AuditPost
+		serials []uint32
+	}{
+		{AuditPost{}, []uint32{1, 2, 3, 4, 5}},
+		{AuditPost{Name: "a.example"}, []uint32{1, 3, 5}}, // not fully qualified
+		{AuditPost{FromSerial: 2, ToSerial: 4}, []uint32{2, 3, 4}},
+		{AuditPost{Name: "a.example.", FromSerial: 2}, []uint32{3, 5}},
+		{AuditPost{Limit: 2}, []uint32{4, 5}}, // the latest ones
+		{AuditPost{Name: "a.example.", ToSerial: 4, Limit: 1}, []uint32{3}},
+		{AuditPost{Name: "nowhere.example."}, nil},
+	} {
+		tc.post.Command = "query"
+		resp := query(tc.post)
+		var serials []uint32
+		for _, rec := range resp.Records {
+			serials = append(serials, rec.Serial)
+		}
+		if resp.Error || !slices.Equal(serials, tc.serials) {
+			t.Errorf("query %+v: serials %v (%s), want %v", tc.post, serials, resp.ErrorMsg, tc.serials)
+		}
+	}
+
+	if resp := query(AuditPost{Command: "purge"}); !resp.Error {
+		t.Errorf("unknown command: %+v, want an error", resp)
+	}
+}
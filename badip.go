@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+)
+
+// ObservedAddrs maps the names in an observation to the addresses they resolved to. The
+// addresses are not part of tapir.TapirMsg; an observation carries them as "Addrs" next to the
+// "Name" of an added (or removed) name, and ParseObservedAddrs decodes them from the same payload.
+type ObservedAddrs map[string][]netip.Addr
+
+// ParseObservedAddrs returns the addresses of the names in the MQTT payload of an observation.
+// Invalid addresses are ignored. Returns nil if there are none.
+func ParseObservedAddrs(payload []byte) ObservedAddrs {
+	var msg struct {
+		Added, Removed []struct {
+			Name  string
+			Addrs []string
+		}
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return nil
+	}
+	var addrs ObservedAddrs
+	for _, d := range append(msg.Added, msg.Removed...) {
+		for _, s := range d.Addrs {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				continue
+			}
+			if addrs == nil {
+				addrs = ObservedAddrs{}
+			}
+			name := dns.Fqdn(d.Name)
+			addrs[name] = append(addrs[name], addr.Unmap())
+		}
+	}
+	return addrs
+}
+
+// badipPrefix returns the prefix that addr is aggregated into, see BadIpPolicy. A prefix that
+// overlaps a CIDR allowlist is not used, as it would also cover allowlisted addresses; the
+// address itself is used instead (and is dropped by the policy if it is allowlisted).
+func (pd *PopData) badipPrefix(addr netip.Addr) netip.Prefix {
+	bits := pd.Policy.BadIp.Ipv6Prefix
+	if addr.Is4() {
+		bits = pd.Policy.BadIp.Ipv4Prefix
+	}
+	p, _ := addr.Prefix(bits)
+	if bits < addr.BitLen() && pd.cidrAllowlistOverlaps(p) {
+		p = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	return p
+}
+
+// badipSrcFormat marks the rpz-ip entries in a list that are derived here, see badipTriggers.
+// They are not part of the list as published by its source, so they are left out of the
+// exports and digests of the list, and are kept when the list is bootstrapped again.
+const badipSrcFormat = "badip"
+
+// BadipRefs are the names that each rpz-ip entry of a list was derived from, see badipTriggers.
+// An entry that is shared by several names is removed with the last of them, see badipRemovals.
+type BadipRefs map[string]map[string]bool // map[entry]map[name]
+
+// badipTriggers returns the rpz-ip entries for the addresses of the names in domains that have
+// any of the badip tags (policy.badip.tags). An entry has the longest lifetime and the tags of
+// all names that resolved to it, including what is already in wbgl. The
+// entries are added to the list like any other name and get their action from the doubtlist
+// policy, e.g. from policy.doubtlist.denytapir.tags, as they have the badip tags.
+// Must be called with pd.mu held.
+func (pd *PopData) badipTriggers(wbgl *tapir.WBGlist, domains []tapir.Domain, addrs ObservedAddrs) []tapir.Domain {
+	if pd.Policy.BadIp.Tags == 0 || len(addrs) == 0 {
+		return nil
+	}
+	expires := func(d *tapir.Domain) time.Time {
+		return d.TimeAdded.Add(time.Duration(d.TTL) * time.Second)
+	}
+	refs := pd.BadipRefs[wbgl]
+	if refs == nil {
+		refs = BadipRefs{}
+		pd.BadipRefs[wbgl] = refs
+	}
+	entries := map[string]*tapir.Domain{}
+	var order []string
+	for _, d := range domains {
+		if d.TagMask&pd.Policy.BadIp.Tags == 0 {
+			continue
+		}
+		for _, addr := range addrs[dns.Fqdn(d.Name)] {
+			name := RpzTrigger{Type: IpTrigger, Prefix: pd.badipPrefix(addr)}.String()
+			if refs[name] == nil {
+				refs[name] = map[string]bool{}
+			}
+			refs[name][dns.Fqdn(d.Name)] = true
+			e, exist := entries[name]
+			if !exist {
+				e = &tapir.Domain{Name: name, TimeAdded: d.TimeAdded, TTL: d.TTL}
+				if tn, exist := wbgl.Names[name]; exist {
+					e.TagMask = tn.TagMask
+					if tn.TimeAdded.Add(tn.TTL).After(expires(e)) {
+						e.TimeAdded, e.TTL = tn.TimeAdded, int(tn.TTL/time.Second)
+					}
+				}
+				entries[name] = e
+				order = append(order, name)
+			}
+			e.TagMask |= d.TagMask
+			if expires(&d).After(expires(e)) {
+				e.TimeAdded, e.TTL = d.TimeAdded, d.TTL
+			}
+		}
+	}
+	res := make([]tapir.Domain, 0, len(order))
+	for _, name := range order {
+		pd.Logger.Printf("ProcessTapirUpdate: %s: rpz-ip entry %s from observed addresses", wbgl.Name, name)
+		res = append(res, *entries[name])
+	}
+	return res
+}
+
+// badipRemovals returns the rpz-ip entries in wbgl that were derived only from the removed names
+// in domains. Must be called with pd.mu held for writing.
+func (pd *PopData) badipRemovals(wbgl *tapir.WBGlist, domains []tapir.Domain) []tapir.Domain {
+	var res []tapir.Domain
+	removed := map[string]bool{}
+	for _, d := range domains {
+		removed[dns.Fqdn(d.Name)] = true
+	}
+	for _, d := range domains {
+		for _, entry := range pd.releaseBadipRefs(wbgl, dns.Fqdn(d.Name)) {
+			if _, exist := wbgl.Names[entry]; exist && !removed[entry] {
+				res = append(res, tapir.Domain{Name: entry})
+			}
+		}
+	}
+	return res
+}
+
+// releaseBadipRefs forgets that the rpz-ip entries of wbgl were derived from name, and returns
+// the entries that are no longer derived from any name. If name is an entry itself, its names
+// are forgotten. Must be called with pd.mu held for writing.
+func (pd *PopData) releaseBadipRefs(wbgl *tapir.WBGlist, name string) []string {
+	refs := pd.BadipRefs[wbgl]
+	if len(refs) == 0 {
+		return nil
+	}
+	delete(refs, name)
+	var released []string
+	for entry, names := range refs {
+		if !names[name] {
+			continue
+		}
+		delete(names, name)
+		if len(names) == 0 {
+			delete(refs, entry)
+			released = append(released, entry)
+		}
+	}
+	slices.Sort(released)
+	return released
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/spf13/viper"
+)
+
+func TestBadIpTriggers(t *testing.T) {
+	pd, _ := newPopData(t)
+	tp := &testPop{pd: pd}
+	const badip tapir.TagMask = 1 << 3
+	pd.Policy.BadIp = BadIpPolicy{Tags: badip, Ipv4Prefix: 24, Ipv6Prefix: 48}
+	// The entries are only in one source, so they get their action from the badip tag
+	pd.Policy.Doubtlist.NumSources = 2
+	pd.Policy.Doubtlist.DenyTapirTags = badip
+	pd.Policy.Doubtlist.DenyTapirAction = tapir.NODATA
+
+	allow := &tapir.WBGlist{Name: "good-nets", Type: "allowlist", SrcFormat: "cidr", ReaperData: map[time.Time]map[string]bool{}}
+	viper.Set("sources.goodnets.filename", writeFile(t, "good.txt", "198.51.100.53\n"))
+	if err := pd.ParseLocalFile("goodnets", allow); err != nil {
+		t.Fatalf("ParseLocalFile: %v", err)
+	}
+	feed := tp.addList("doubtlist", "dns-tapir", "mqtt")
+
+	payload := []byte(fmt.Sprintf(`{"SrcName": "dns-tapir", "ListType": "doubtlist", "MsgType": "observation",
+	  "Added": [
+	    {"Name": "bad.example.", "TimeAdded": %q, "TTL": 3600, "TagMask": %d,
+	     "Addrs": ["192.0.2.1", "192.0.2.77", "198.51.100.7", "198.51.100.53", "2001:db8::1", "bogus"]},
+	    {"Name": "other.example.", "TimeAdded": %q, "TTL": 3600, "TagMask": 1, "Addrs": ["203.0.113.1"]}
+	  ]}`, time.Now().Format(time.RFC3339), badip, time.Now().Format(time.RFC3339)))
+	var tm tapir.TapirMsg
+	if err := json.Unmarshal(payload, &tm); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	addrs := ParseObservedAddrs(payload)
+	if len(addrs["bad.example."]) != 5 || len(addrs["other.example."]) != 1 {
+		t.Fatalf("ParseObservedAddrs: %v", addrs)
+	}
+
+	pd.mu.Lock()
+	_, err := pd.applyTapirUpdate(tm, addrs)
+	pd.mu.Unlock()
+	if err != nil {
+		t.Fatalf("applyTapirUpdate: %v", err)
+	}
+	snap := pd.Rpz.Snapshot()
+	for name, want := range map[string]bool{
+		"bad.example.":             true,
+		"24.0.2.0.192.rpz-ip.":     true,  // 192.0.2.1 and 192.0.2.77 aggregated
+		"32.7.100.51.198.rpz-ip.":  true,  // not aggregated, the /24 contains an allowlisted address
+		"32.53.100.51.198.rpz-ip.": false, // allowlisted
+		"24.0.100.51.198.rpz-ip.":  false,
+		"48.zz.db8.2001.rpz-ip.":   true,
+		"24.0.113.0.203.rpz-ip.":   false, // other.example. has no badip tag
+	} {
+		if _, exist := snap.Data[pd.rpzOwner(name)]; exist != want {
+			t.Errorf("%s in the output: %t, want %t", name, exist, want)
+		}
+	}
+	if rn := snap.Data[pd.rpzOwner("24.0.2.0.192.rpz-ip.")]; rn == nil || rn.Action != tapir.NODATA {
+		t.Errorf("rpz-ip rule %v, want the denytapir action", rn)
+	}
+	if tn := feed.Names["24.0.2.0.192.rpz-ip."]; tn.TagMask != badip || tn.TTL != time.Hour {
+		t.Errorf("rpz-ip entry has tags %v and TTL %v, want the tags and lifetime of the name", tn.TagMask, tn.TTL)
+	}
+
+	// The entries are not part of the list as published by dns-tapir; a bootstrap keeps them
+	published := map[string]tapir.TapirName{"bad.example.": feed.Names["bad.example."], "other.example.": feed.Names["other.example."]}
+	pd.mu.Lock()
+	export := NewExportSnapshot(feed, ListPosition{})
+	pd.importNames(feed, maps.Clone(published))
+	pd.mu.Unlock()
+	now := time.Now()
+	if d, want := export.Digest(now), NewExportSnapshot(&tapir.WBGlist{Names: published}, ListPosition{}).Digest(now); export.hdr.Total != 2 || d.Hash != want.Hash {
+		t.Errorf("export of %d names with digest %s, want only the published names with digest %s", export.hdr.Total, d.Hash, want.Hash)
+	}
+	if len(feed.Names) != 6 {
+		t.Errorf("%d names in the list after a bootstrap, want the 2 names and the 4 rpz-ip entries of bad.example.", len(feed.Names))
+	}
+
+	// Another name that shares an entry
+	update := func(tm tapir.TapirMsg, addrs ObservedAddrs) RpzIxfr {
+		t.Helper()
+		tm.SrcName, tm.ListType = "dns-tapir", "doubtlist"
+		pd.mu.Lock()
+		defer pd.mu.Unlock()
+		ixfr, err := pd.applyTapirUpdate(tm, addrs)
+		if err != nil {
+			t.Fatalf("applyTapirUpdate: %v", err)
+		}
+		return ixfr
+	}
+	update(tapir.TapirMsg{Added: []tapir.Domain{{Name: "also.example.", TimeAdded: time.Now(), TTL: 3600, TagMask: badip}}},
+		ObservedAddrs{"also.example.": {netip.MustParseAddr("192.0.2.5")}})
+
+	// The entries are removed together with the last name they were derived from; the removal
+	// need not carry the addresses
+	ixfr := update(tapir.TapirMsg{Removed: []tapir.Domain{{Name: "bad.example."}}}, nil)
+	if _, exist := feed.Names["24.0.2.0.192.rpz-ip."]; !exist || len(feed.Names) != 3 {
+		t.Errorf("%d names left in the list, want other.example., also.example. and their shared entry", len(feed.Names))
+	}
+	if len(ixfr.Removed) != 3 {
+		t.Errorf("IXFR removes %d rules, want the name and its 2 rpz-ip rules that are not shared", len(ixfr.Removed))
+	}
+	ixfr = update(tapir.TapirMsg{Removed: []tapir.Domain{{Name: "also.example."}}}, nil)
+	if _, exist := feed.Names["24.0.2.0.192.rpz-ip."]; exist || len(feed.Names) != 1 {
+		t.Errorf("%d names left in the list, want only other.example.", len(feed.Names))
+	}
+	if len(ixfr.Removed) != 2 || len(pd.BadipRefs[feed]) != 0 {
+		t.Errorf("IXFR removes %d rules, want the name and the shared rpz-ip rule; refs %v", len(ixfr.Removed), pd.BadipRefs[feed])
+	}
+
+	// A bootstrap drops the entries of the names that are gone
+	update(tapir.TapirMsg{Added: []tapir.Domain{{Name: "also.example.", TimeAdded: time.Now(), TTL: 3600, TagMask: badip}}},
+		ObservedAddrs{"also.example.": {netip.MustParseAddr("192.0.2.5")}})
+	pd.mu.Lock()
+	pd.importNames(feed, map[string]tapir.TapirName{"other.example.": feed.Names["other.example."]})
+	pd.mu.Unlock()
+	if len(feed.Names) != 1 || len(pd.BadipRefs[feed]) != 0 {
+		t.Errorf("%d names left in the list after a bootstrap without also.example., want only other.example.", len(feed.Names))
+	}
+}
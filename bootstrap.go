@@ -5,11 +5,19 @@
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
+	"cmp"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dnstapir/tapir"
@@ -17,141 +25,360 @@ import (
 	"github.com/spf13/viper"
 )
 
-func (td *PopData) BootstrapMqttSource(src SourceConf) (*tapir.WBGlist, error) {
-	// Initialize the API client
-	api := &tapir.ApiClient{
-		BaseUrl:    fmt.Sprintf(src.BootstrapUrl, src.Bootstrap[0]), // Must specify a valid BaseUrl
-		ApiKey:     src.BootstrapKey,
-		AuthMethod: "X-API-Key",
+// BootstrapMqttSource fetches the current contents of the MQTT source src from one of its
+// bootstrap servers. All servers are probed, and the export is fetched from the best one that
+// answered (see probeBootstrapServers), or else the next best. If all of them fail, it starts
+// over after a while, bootstrapAttempts times in all.
+func (td *PopData) BootstrapMqttSource(src SourceConf) (*ListExport, error) {
+	servers, probe, err := td.bootstrapServers(src)
+	if err != nil {
+		return nil, err
+	}
+	var validator *ecdsa.PublicKey
+	if src.BootstrapSigned {
+		validator, err = exportValidatorKey(src)
+		if err != nil {
+			return nil, fmt.Errorf("BootstrapMqttSource: exports of %s must be signed: %v", src.Name, err)
+		}
 	}
 
+	wait := bootstrapRetryWait
+	for attempt := 1; ; attempt++ {
+		for _, bc := range td.probeBootstrapServers(servers, probe) {
+			le, err := td.fetchExport(bc.server, src.Type, src.Name, bc.request)
+			if err != nil {
+				td.Logger.Printf("BootstrapMqttSource: Error fetching the export of %s from %s: %v", src.Name, bc.server, err)
+				continue
+			}
+			if le.Type != "" && le.Type != src.Type {
+				// An old server, that only exports doubtlists
+				td.Logger.Printf("BootstrapMqttSource: Export of %s from %s rejected: it is a %s, not a %s", src.Name, bc.server, le.Type, src.Type)
+				continue
+			}
+			if validator != nil {
+				if err := VerifyExport(le, validator); err != nil {
+					td.Logger.Printf("BootstrapMqttSource: Export of %s from %s rejected: %v", src.Name, bc.server, err)
+					continue
+				}
+				td.Logger.Printf("BootstrapMqttSource: Export of %s from %s has a valid signature", src.Name, bc.server)
+			}
+			wbgl := le.List
+			td.Logger.Printf("BootstrapMqttSource: received %s export of %s from %s with %d names (snapshot %q, %d updates, latest at %s)",
+				le.Encoding, src.Name, bc.server, len(wbgl.Names), le.Snapshot, le.Position.Updates, le.Position.Time.Format(tapir.TimeLayout))
+
+			if td.Debug {
+				td.Logger.Printf("%v", wbgl)
+				td.Logger.Printf("Names present in %s %s:", src.Type, src.Name)
+				out := []string{"Name|Time added|TTL|Tags"}
+				for _, n := range wbgl.Names {
+					out = append(out, fmt.Sprintf("%s|%v|%v|%v", n.Name, n.TimeAdded.Format(tapir.TimeLayout), n.TTL, n.TagMask))
+				}
+				td.Logger.Printf("%s", columnize.SimpleFormat(out))
+			}
+
+			// Successfully received and decoded bootstrap data
+			td.ReportStatus("bootstrap", tapir.StatusOK, "MQTT source %s bootstrapped from %s: %d names (server uptime %v, last MQTT message %s)",
+				src.Name, bc.server, len(wbgl.Names), bc.uptime, bc.latestSub.Format(tapir.TimeLayout))
+			return le, nil
+		}
+		if attempt >= bootstrapAttempts {
+			break
+		}
+		td.Logger.Printf("BootstrapMqttSource: all bootstrap servers for %s failed (attempt %d of %d), retrying in %v",
+			src.Name, attempt, bootstrapAttempts, wait)
+		time.Sleep(wait)
+		wait *= 2
+	}
+
+	// If no bootstrap server succeeded
+	return nil, fmt.Errorf("BootstrapMqttSource: all bootstrap servers failed (%d attempts)", bootstrapAttempts)
+}
+
+// bootstrapServers returns the bootstrap servers of the MQTT source src, except myself, and the
+// function that probes them (see probeBootstrapServers).
+func (td *PopData) bootstrapServers(src SourceConf) ([]string, func(string) (*bootstrapCandidate, error), error) {
 	cd := viper.GetString("certs.certdir")
 	if cd == "" {
-		POPExiter("BootstrapMqttSource error: missing config key: certs.certdir")
+		return nil, nil, fmt.Errorf("BootstrapMqttSource: missing config key: certs.certdir")
 	}
 	// cert := cd + "/" + certname
-    key := viper.GetString("certs.tapir-pop.key")
-    cert := viper.GetString("certs.tapir-pop.cert")
+	key := viper.GetString("certs.tapir-pop.key")
+	cert := viper.GetString("certs.tapir-pop.cert")
 	tlsConfig, err := tapir.NewClientConfig(viper.GetString("certs.cacertfile"), key, cert)
 	if err != nil {
-		POPExiter("BootstrapMqttSource: Error: Could not set up TLS: %v", err)
+		return nil, nil, fmt.Errorf("BootstrapMqttSource: could not set up TLS: %v", err)
 	}
-	// XXX: Need to verify that the server cert is valid for the bootstrap server
-	tlsConfig.InsecureSkipVerify = true
-	err = api.SetupTLS(tlsConfig)
-	if err != nil {
-		POPExiter("BootstrapMqttSource: error setting up TLS for the API client: %v", err)
+
+	// Never bootstrap from myself
+	self := append(viper.GetStringSlice("bootstrapserver.addresses"), viper.GetStringSlice("bootstrapserver.tlsaddresses")...)
+	var servers []string
+	for _, server := range src.Bootstrap {
+		if slices.Contains(self, server) {
+			td.Logger.Printf("BootstrapMqttSource: MQTT bootstrap server %s is myself, skipping", server)
+			continue
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		return nil, nil, fmt.Errorf("BootstrapMqttSource: no bootstrap servers for %s (other than myself)", src.Name)
 	}
 
-	bootstrapaddrs := viper.GetStringSlice("bootstrapserver.addresses")
-	tlsbootstrapaddrs := viper.GetStringSlice("bootstrapserver.tlsaddresses")
-	bootstrapaddrs = append(bootstrapaddrs, tlsbootstrapaddrs...)
+	probe := func(server string) (*bootstrapCandidate, error) {
+		return td.probeBootstrapServer(src, server, tlsConfig)
+	}
+	return servers, probe, nil
+}
 
-	// Iterate over the bootstrap servers
-	for _, server := range src.Bootstrap {
-		// Is this myself?
-		for _, bs := range bootstrapaddrs {
-			if bs == server {
-				td.Logger.Printf("BootstrapMqttSource: MQTT bootstrap server %s is myself, skipping", server)
-				continue
+var (
+	bootstrapAttempts  = 3
+	bootstrapRetryWait = 5 * time.Second // doubled for every attempt
+)
+
+// bootstrapCandidate is a bootstrap server that answered the probe, see probeBootstrapServer.
+type bootstrapCandidate struct {
+	server    string
+	uptime    time.Duration
+	latestSub time.Time // the latest MQTT message for the list
+	subMsgs   uint64
+	request   func(ExportPost) (int, []byte, error)
+}
+
+// probeBootstrapServers probes all the servers in parallel and returns the ones that answered,
+// best first: the one with the latest MQTT message for the list, and of those the one that has
+// been up the longest.
+func (td *PopData) probeBootstrapServers(servers []string, probe func(string) (*bootstrapCandidate, error)) []*bootstrapCandidate {
+	cands := make([]*bootstrapCandidate, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bc, err := probe(server)
+			if err != nil {
+				td.Logger.Printf("BootstrapMqttSource: MQTT bootstrap server %s: %v", server, err)
+				return
 			}
+			cands[i] = bc
+		}()
+	}
+	wg.Wait()
+
+	cands = slices.DeleteFunc(cands, func(bc *bootstrapCandidate) bool { return bc == nil })
+	slices.SortStableFunc(cands, func(a, b *bootstrapCandidate) int {
+		if c := b.latestSub.Compare(a.latestSub); c != 0 {
+			return c
 		}
+		return cmp.Compare(b.uptime, a.uptime)
+	})
+	return cands
+}
 
-		api.BaseUrl = fmt.Sprintf(src.BootstrapUrl, server)
+// probeBootstrapServer pings the bootstrap server server and asks for the status of the list of
+// the MQTT source src.
+func (td *PopData) probeBootstrapServer(src SourceConf, server string, tlsConfig *tls.Config) (*bootstrapCandidate, error) {
+	api := &tapir.ApiClient{
+		BaseUrl:    fmt.Sprintf(src.BootstrapUrl, server),
+		ApiKey:     src.BootstrapKey,
+		AuthMethod: "X-API-Key",
+	}
+	serverTls, err := bootstrapTlsConfig(tlsConfig, server, src.BootstrapTls)
+	if err == nil {
+		err = api.SetupTLS(serverTls)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error setting up TLS: %v", err)
+	}
 
-		// Send an API ping command
-		pr, err := api.SendPing(0, false)
-		if err != nil {
-			td.Logger.Printf("BootstrapMqttSource: Ping to MQTT bootstrap server %s failed: %v", server, err)
-			continue
-		}
+	// Send an API ping command
+	pr, err := api.SendPing(0, false)
+	if err != nil {
+		return nil, fmt.Errorf("ping failed: %v", err)
+	}
+	bc := &bootstrapCandidate{
+		server: server,
+		uptime: time.Since(pr.BootTime).Round(time.Second),
+		request: func(post ExportPost) (int, []byte, error) {
+			return api.RequestNG(http.MethodPost, "/bootstrap", post, true)
+		},
+	}
 
-		uptime := time.Since(pr.BootTime).Round(time.Second)
-		td.Logger.Printf("BootstrapMqttSource: MQTT bootstrap server %s uptime: %v. It has processed %d MQTT messages", server, uptime, 17)
+	status, buf, err := api.RequestNG(http.MethodPost, "/bootstrap", tapir.BootstrapPost{
+		Command:  "doubtlist-status",
+		ListName: src.Name,
+		Encoding: "json", // XXX: This is our default, but we'll test other encodings later
+	}, true)
+	if err != nil {
+		return nil, fmt.Errorf("error from doubtlist-status: %v", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("HTTP error from doubtlist-status: %s", buf)
+	}
 
-		status, buf, err := api.RequestNG(http.MethodPost, "/bootstrap", tapir.BootstrapPost{
-			Command:  "doubtlist-status",
-			ListName: src.Name,
-			Encoding: "json", // XXX: This is our default, but we'll test other encodings later
-		}, true)
+	var br tapir.BootstrapResponse
+	err = json.Unmarshal(buf, &br)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding doubtlist-status response: %v", err)
+	}
+	if br.Error {
+		// Still a candidate, but only if no server knows more
+		td.Logger.Printf("BootstrapMqttSource: Bootstrap server %s responded with error: %s (instead of doubtlist status)", server, br.ErrorMsg)
+	}
+	if len(br.Msg) != 0 {
+		td.Logger.Printf("BootstrapMqttSource: Bootstrap server %s responded: %s", server, br.Msg)
+	}
+	bc.latestSub = br.TopicData[src.Name].LatestSub
+	bc.subMsgs = br.TopicData[src.Name].SubMsgs
 
-		if err != nil {
-			fmt.Printf("Error from RequestNG: %v\n", err)
-			continue
-		}
+	td.Logger.Printf("BootstrapMqttSource: MQTT bootstrap server %s uptime: %v. It has processed %d MQTT messages on the %s topic (last sub msg arrived at %s)",
+		server, bc.uptime, bc.subMsgs, src.Name, bc.latestSub.Format(tapir.TimeLayout))
+	return bc, nil
+}
 
-		if status != http.StatusOK {
-			td.Logger.Printf("HTTP Error: %s\n", buf)
-			continue
+// bootstrapTlsConfig returns the TLS config for the bootstrap server server: base (with the CA
+// in certs.cacertfile), with the verification of the server certificate from the entry for
+// server in confs, if any. By default the certificate is verified against the name or address of
+// the server in the URL. With pinned keys, one of the keys in the verified chain must be pinned
+// instead.
+func bootstrapTlsConfig(base *tls.Config, server string, confs []BootstrapTlsConf) (*tls.Config, error) {
+	cfg := base.Clone()
+	cfg.InsecureSkipVerify = false
+	var bc BootstrapTlsConf
+	for _, c := range confs {
+		if c.Server == server {
+			bc = c
+			break
 		}
+	}
+	if bc.ServerName != "" {
+		cfg.ServerName = bc.ServerName
+	}
+	if len(bc.Spki) == 0 {
+		return cfg, nil
+	}
 
-		var br tapir.BootstrapResponse
-		err = json.Unmarshal(buf, &br)
-		if err != nil {
-			td.Logger.Printf("BootstrapMqttSource: Error decoding doubtlist-status response from %s: %v. Giving up.\n", server, err)
-			continue
+	pins := map[[sha256.Size]byte]bool{}
+	for _, s := range bc.Spki {
+		pin, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid pinned key %q for %s: not a base64 SHA-256 hash", s, server)
 		}
-		if br.Error {
-			td.Logger.Printf("BootstrapMqttSource: Bootstrap server %s responded with error: %s (instead of doubtlist status)", server, br.ErrorMsg)
+		pins[[sha256.Size]byte(pin)] = true
+	}
+	roots := cfg.RootCAs
+	// The chain is verified by VerifyConnection, without the check of the name
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("bootstrap server %s sent no certificate", server)
 		}
-		if len(br.Msg) != 0 {
-			td.Logger.Printf("BootstrapMqttSource: Bootstrap server %s responded: %s", server, br.Msg)
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
 		}
-
-		td.Logger.Printf("BootstrapMqttSource: MQTT bootstrap server %s uptime: %v. It has processed %d MQTT messages on the %s topic (last sub msg arrived at %s), ", server, uptime, br.TopicData[src.Name].SubMsgs, src.Name, br.TopicData[src.Name].LatestSub.Format(tapir.TimeLayout))
-
-		status, buf, err = api.RequestNG(http.MethodPost, "/bootstrap", tapir.BootstrapPost{
-			Command:  "export-doubtlist",
-			ListName: src.Name,
-			Encoding: "gob", // XXX: This is our default, but we'll test other encodings later
-		}, true)
-
+		chains, err := cs.PeerCertificates[0].Verify(opts)
 		if err != nil {
-			td.Logger.Printf("BootstrapMqttSource: Error from RequestNG: %v\n", err)
-			continue
+			return fmt.Errorf("bootstrap server %s: %v", server, err)
 		}
-
-		if status != http.StatusOK {
-			td.Logger.Printf("BootstrapMqttSource: HTTP Error: %s\n", buf)
-			continue
+		for _, chain := range chains {
+			for _, cert := range chain {
+				if pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+					return nil
+				}
+			}
 		}
+		return fmt.Errorf("bootstrap server %s: no pinned key in the certificate chain", server)
+	}
+	return cfg, nil
+}
 
-		var doubtlist tapir.WBGlist
-		decoder := gob.NewDecoder(bytes.NewReader(buf))
-		err = decoder.Decode(&doubtlist)
+var (
+	exportChunkSize = 100000          // names per request
+	exportRetries   = 3               // per chunk
+	exportRetryWait = 2 * time.Second // times the number of failures
+)
+
+// exportError is an error response from the bootstrap server to an export request.
+type exportError struct{ msg string }
+
+func (e exportError) Error() string { return e.msg }
+
+// fetchExport fetches the export of the list listtype/name from server in chunks of exportChunkSize
+// names, all from the same snapshot. A failed chunk is retried (exportRetries times) from where
+// the download stopped; if the snapshot has expired on the server, the download starts over with
+// a new one. Servers that do not do snapshots send the whole list in the first response.
+func (td *PopData) fetchExport(server, listtype, name string, request func(ExportPost) (int, []byte, error)) (*ListExport, error) {
+	post := ExportPost{
+		BootstrapPost: tapir.BootstrapPost{
+			Command:  "export-doubtlist",
+			ListName: name,
+			Encoding: strings.Join(ExportEncodings, ","),
+		},
+		ListType: listtype,
+		Limit:    exportChunkSize,
+	}
+	var le *ListExport
+	failures := 0
+	for {
+		chunk, err := fetchExportChunk(request, post)
 		if err != nil {
-			// fmt.Printf("Error decoding doubtlist data: %v\n", err)
-			// If decoding the gob failed, perhaps we received a tapir.BootstrapResponse instead?
-			var br tapir.BootstrapResponse
-			err = json.Unmarshal(buf, &br)
-			if err != nil {
-				td.Logger.Printf("BootstrapMqttSource: Error decoding bootstrap response from %s: %v. Giving up.\n", server, err)
+			var ee exportError
+			switch {
+			case errors.As(err, &ee) && le == nil && post.Encoding != "gob":
+				// An old server that only knows gob
+				td.Logger.Printf("BootstrapMqttSource: Bootstrap server %s: %v. Retrying with gob", server, err)
+				post.Encoding = "gob"
 				continue
+			case errors.As(err, &ee) && le != nil:
+				td.Logger.Printf("BootstrapMqttSource: Bootstrap server %s: %v. Starting over with a new snapshot", server, err)
+				le, post.Snapshot, post.Offset = nil, "", 0
 			}
-			if br.Error {
-				td.Logger.Printf("BootstrapMqttSource: Bootstrap server %s responded with error: %s (instead of GOB blob)", server, br.ErrorMsg)
-			}
-			if len(br.Msg) != 0 {
-				td.Logger.Printf("BootstrapMqttSource: Bootstrap server %s responded: %s (instead of GOB blob)", server, br.Msg)
+			failures++
+			if failures > exportRetries {
+				return nil, err
 			}
-			// return nil, fmt.Errorf("Command Error: %s", br.ErrorMsg)
+			td.Logger.Printf("BootstrapMqttSource: Error fetching names %d- of %s from %s: %v. Retrying (%d/%d)",
+				post.Offset, name, server, err, failures, exportRetries)
+			time.Sleep(time.Duration(failures) * exportRetryWait)
 			continue
 		}
+		failures = 0
 
-		if td.Debug {
-			td.Logger.Printf("%v", doubtlist)
-			td.Logger.Printf("Names present in doubtlist %s:", src.Name)
-			out := []string{"Name|Time added|TTL|Tags"}
-			for _, n := range doubtlist.Names {
-				out = append(out, fmt.Sprintf("%s|%v|%v|%v", n.Name, n.TimeAdded.Format(tapir.TimeLayout), n.TTL, n.TagMask))
+		if le == nil {
+			le = chunk
+		} else {
+			if chunk.Snapshot != le.Snapshot || chunk.Offset != post.Offset {
+				return nil, fmt.Errorf("got names %d- of snapshot %q, want names %d- of snapshot %q",
+					chunk.Offset, chunk.Snapshot, post.Offset, le.Snapshot)
+			}
+			for n, tn := range chunk.List.Names {
+				le.List.Names[n] = tn
 			}
-			td.Logger.Printf("%s", columnize.SimpleFormat(out))
 		}
-
-		// Successfully received and decoded bootstrap data
-		return &doubtlist, nil
+		post.Offset += chunk.Count
+		if le.Snapshot == "" || post.Offset >= le.Total {
+			le.Count = len(le.List.Names)
+			return le, nil
+		}
+		if chunk.Count == 0 {
+			return nil, fmt.Errorf("no names after %d of %d in snapshot %q", post.Offset, le.Total, le.Snapshot)
+		}
+		post.Snapshot = le.Snapshot
+		td.Logger.Printf("BootstrapMqttSource: received %d of %d names of %s from %s", post.Offset, le.Total, name, server)
 	}
+}
 
-	// If no bootstrap server succeeded
-	return nil, fmt.Errorf("BootstrapMqttSource: all bootstrap servers failed")
+// fetchExportChunk sends the export request post and decodes the response.
+func fetchExportChunk(request func(ExportPost) (int, []byte, error), post ExportPost) (*ListExport, error) {
+	status, buf, err := request(post)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %d: %s", status, buf)
+	}
+	var br tapir.BootstrapResponse
+	if json.Unmarshal(buf, &br) == nil && br.Error {
+		return nil, exportError{br.ErrorMsg}
+	}
+	return ReadExport(buf)
 }
@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestProbeBootstrapServers(t *testing.T) {
+	pd, _ := newPopData(t)
+	now := time.Now()
+	probed := map[string]*bootstrapCandidate{
+		"stale:443":   {uptime: 48 * time.Hour, latestSub: now.Add(-time.Hour)},
+		"young:443":   {uptime: time.Minute, latestSub: now},
+		"old:443":     {uptime: 24 * time.Hour, latestSub: now},
+		"unknown:443": {uptime: 72 * time.Hour}, // no status for the list
+		"down:443":    nil,
+	}
+	servers := []string{"down:443", "stale:443", "young:443", "unknown:443", "old:443"}
+
+	start := time.Now()
+	cands := pd.probeBootstrapServers(servers, func(server string) (*bootstrapCandidate, error) {
+		time.Sleep(50 * time.Millisecond)
+		bc := probed[server]
+		if bc == nil {
+			return nil, fmt.Errorf("connection refused")
+		}
+		bc.server = server
+		return bc, nil
+	})
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("probing %d servers took %v, want them probed in parallel", len(servers), elapsed)
+	}
+	var got []string
+	for _, bc := range cands {
+		got = append(got, bc.server)
+	}
+	if want := []string{"old:443", "young:443", "stale:443", "unknown:443"}; !slices.Equal(got, want) {
+		t.Errorf("servers in order %v, want %v", got, want)
+	}
+}
+
+func TestBootstrapSkipsMyself(t *testing.T) {
+	pd, _ := newPopData(t)
+	viper.Set("certs.certdir", t.TempDir())
+	viper.Set("bootstrapserver.tlsaddresses", []string{"192.0.2.1:5454"})
+	_, err := pd.BootstrapMqttSource(SourceConf{
+		Name:         "dns-tapir",
+		Bootstrap:    []string{"192.0.2.1:5454"},
+		BootstrapUrl: "https://%s/api/v1",
+	})
+	if err == nil || !strings.Contains(err.Error(), "other than myself") {
+		t.Errorf("BootstrapMqttSource from myself: %v, want no servers", err)
+	}
+}
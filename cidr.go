@@ -0,0 +1,350 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dnstapir/tapir"
+)
+
+// A list with the format "cidr" holds address prefixes. The names of the list are the
+// canonical rpz-ip triggers of the prefixes (e.g. "24.0.113.0.203.rpz-ip." for 203.0.113.0/24),
+// so that a CIDR denylist or doubtlist goes through the same policy evaluation as any other list
+// and ends up as rpz-ip triggers in the output. Each CIDR list also has a PrefixTree with the same
+// prefixes (see PopData.Cidrs), which is what allowlisting by a CIDR allowlist uses.
+
+// PrefixTree is a binary radix tree of address prefixes, one tree per address family.
+type PrefixTree struct {
+	roots [2]*prefixNode // IPv4, IPv6
+	n     int
+}
+
+type prefixNode struct {
+	child [2]*prefixNode
+	set   bool // the prefix that ends at this node is in the tree
+}
+
+func NewPrefixTree() *PrefixTree {
+	return &PrefixTree{}
+}
+
+// bit returns bit i (counting from the most significant bit) of addr.
+func bit(addr netip.Addr, i int) int {
+	b := addr.AsSlice()
+	return int(b[i/8]>>(7-i%8)) & 1
+}
+
+func family(addr netip.Addr) int {
+	if addr.Is4() {
+		return 0
+	}
+	return 1
+}
+
+// Insert adds the prefix p to the tree. Reports whether p was not already in it.
+func (t *PrefixTree) Insert(p netip.Prefix) bool {
+	p = p.Masked()
+	f := family(p.Addr())
+	if t.roots[f] == nil {
+		t.roots[f] = &prefixNode{}
+	}
+	n := t.roots[f]
+	for i := 0; i < p.Bits(); i++ {
+		b := bit(p.Addr(), i)
+		if n.child[b] == nil {
+			n.child[b] = &prefixNode{}
+		}
+		n = n.child[b]
+	}
+	if n.set {
+		return false
+	}
+	n.set = true
+	t.n++
+	return true
+}
+
+// Delete removes the prefix p from the tree, and the nodes that are no longer needed. Reports
+// whether p was in the tree.
+func (t *PrefixTree) Delete(p netip.Prefix) bool {
+	p = p.Masked()
+	f := family(p.Addr())
+	path := []*prefixNode{t.roots[f]}
+	for i := 0; i < p.Bits() && path[i] != nil; i++ {
+		path = append(path, path[i].child[bit(p.Addr(), i)])
+	}
+	n := path[len(path)-1]
+	if n == nil || len(path) != p.Bits()+1 || !n.set {
+		return false
+	}
+	n.set = false
+	t.n--
+	for i := len(path) - 1; i > 0; i-- {
+		if path[i].set || path[i].child[0] != nil || path[i].child[1] != nil {
+			break
+		}
+		path[i-1].child[bit(p.Addr(), i-1)] = nil
+	}
+	return true
+}
+
+// Covering returns the most specific prefix in the tree that contains p (which may be p
+// itself).
+func (t *PrefixTree) Covering(p netip.Prefix) (netip.Prefix, bool) {
+	p = p.Masked()
+	n := t.roots[family(p.Addr())]
+	var match netip.Prefix
+	found := false
+	for i := 0; n != nil; i++ {
+		if n.set {
+			match, _ = p.Addr().Prefix(i)
+			found = true
+		}
+		if i == p.Bits() {
+			break
+		}
+		n = n.child[bit(p.Addr(), i)]
+	}
+	return match, found
+}
+
+// Contains reports whether some prefix in the tree contains p.
+func (t *PrefixTree) Contains(p netip.Prefix) bool {
+	_, found := t.Covering(p)
+	return found
+}
+
+// Overlaps reports whether some prefix in the tree contains p or is contained in p.
+func (t *PrefixTree) Overlaps(p netip.Prefix) bool {
+	p = p.Masked()
+	n := t.roots[family(p.Addr())]
+	for i := 0; n != nil; i++ {
+		if n.set || i == p.Bits() {
+			return true // Delete removes the nodes without prefixes below them
+		}
+		n = n.child[bit(p.Addr(), i)]
+	}
+	return false
+}
+
+// Len returns the number of prefixes in the tree.
+func (t *PrefixTree) Len() int {
+	return t.n
+}
+
+// ParseCidr parses a prefix in CIDR notation. A plain address is a host prefix (/32 or /128).
+// The prefix is masked.
+func ParseCidr(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if p.Addr().Is4In6() {
+		if p.Bits() < 96 {
+			return netip.Prefix{}, fmt.Errorf("%s: IPv4-mapped prefix shorter than /96", s)
+		}
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), nil
+}
+
+// CidrName returns the name of the prefix s in a CIDR list, i.e. its rpz-ip trigger. s is either
+// a prefix in CIDR notation or already an rpz-ip trigger (as in a list from a backup).
+func CidrName(s string) (string, netip.Prefix, error) {
+	if TriggerTypeOf(s) == IpTrigger {
+		t, err := ParseRpzTrigger(s)
+		if err != nil {
+			return "", netip.Prefix{}, err
+		}
+		return t.String(), t.Prefix, nil
+	}
+	p, err := ParseCidr(s)
+	if err != nil {
+		return "", netip.Prefix{}, err
+	}
+	return RpzTrigger{Type: IpTrigger, Prefix: p}.String(), p, nil
+}
+
+// ParseCidrs reads prefixes, one per line, from r into names. Empty lines and comments (from
+// "#" to the end of the line) are ignored. Returns the number of prefixes read.
+func ParseCidrs(r io.Reader, names map[string]tapir.TapirName) (int, error) {
+	scanner := bufio.NewScanner(r)
+	count := 0
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, _, err := CidrName(line)
+		if err != nil {
+			return count, fmt.Errorf("line %d: invalid prefix %q: %v", lineno, line, err)
+		}
+		names[name] = tapir.TapirName{Name: name}
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// ParseCidrFile reads the prefixes in the file filename into names, see ParseCidrs.
+func ParseCidrFile(filename string, names map[string]tapir.TapirName) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return ParseCidrs(f, names)
+}
+
+// FetchCidrs fetches the prefixes at url into names, see ParseCidrs.
+func FetchCidrs(url string, names map[string]tapir.TapirName) (int, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return ParseCidrs(resp.Body, names)
+}
+
+// HttpRefresher fetches the HTTP sources with a refresh interval (sources.*.refresh) again when
+// it has passed, and updates the output with the differences.
+func (pd *PopData) HttpRefresher(conf *Config, stopch chan struct{}) {
+	log.Printf("HttpRefresher: Starting")
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	fetched := map[*tapir.WBGlist]time.Time{}
+	for {
+		select {
+		case <-ticker.C:
+			pd.mu.RLock()
+			srcs := maps.Clone(pd.HttpSources)
+			pd.mu.RUnlock()
+			for wbgl, src := range srcs {
+				if _, exist := fetched[wbgl]; !exist {
+					fetched[wbgl] = time.Now() // at startup
+					continue
+				}
+				if time.Since(fetched[wbgl]) < time.Duration(src.Refresh)*time.Second {
+					continue
+				}
+				fetched[wbgl] = time.Now()
+				if err := pd.refreshHttpSource(wbgl, src.Url); err != nil {
+					pd.Logger.Printf("HttpRefresher: %v", err)
+					pd.ReportStatus("sources", tapir.StatusWarn, "Source %s not refreshed: %v", wbgl.Name, err)
+				}
+			}
+		case <-stopch:
+			log.Printf("HttpRefresher: stopping")
+			return
+		}
+	}
+}
+
+// refreshHttpSource fetches the CIDR list wbgl from url again, and updates the output with the
+// prefixes that have been added and removed.
+func (pd *PopData) refreshHttpSource(wbgl *tapir.WBGlist, url string) error {
+	names := map[string]tapir.TapirName{}
+	n, err := FetchCidrs(url, names)
+	if err != nil {
+		return fmt.Errorf("error fetching %s from %s: %v", wbgl.Name, url, err)
+	}
+
+	pd.mu.Lock()
+	tm := tapir.TapirMsg{SrcName: wbgl.Name, ListType: wbgl.Type}
+	for name := range names {
+		if _, exist := wbgl.Names[name]; !exist {
+			tm.Added = append(tm.Added, tapir.Domain{Name: name})
+		}
+	}
+	for name := range wbgl.Names {
+		if _, exist := names[name]; !exist {
+			tm.Removed = append(tm.Removed, tapir.Domain{Name: name})
+		}
+	}
+	wbgl.Names = names
+	pd.indexCidrList(wbgl)
+	var ixfr RpzIxfr
+	if len(tm.Added) > 0 || len(tm.Removed) > 0 {
+		ixfr, err = pd.GenerateRpzIxfr(&tm, PolicyTrigger{Kind: TriggerHttp, Source: wbgl.Name})
+	}
+	pd.mu.Unlock()
+	pd.Logger.Printf("refreshHttpSource: %d prefixes fetched from %s, %d added and %d removed", n, url, len(tm.Added), len(tm.Removed))
+	if err != nil {
+		return fmt.Errorf("error updating the output with %s: %v", wbgl.Name, err)
+	}
+	if !ixfr.Empty() {
+		return pd.NotifyDownstreams()
+	}
+	return nil
+}
+
+// indexCidrList builds the prefix tree of the CIDR list wbgl from its names. Names that are
+// prefixes in CIDR notation (e.g. from a bootstrap server) are replaced by their names in the
+// list, see CidrName, and invalid ones are dropped. Must be called with pd.mu held for writing.
+func (pd *PopData) indexCidrList(wbgl *tapir.WBGlist) {
+	tree := NewPrefixTree()
+	for name, tn := range wbgl.Names {
+		cname, prefix, err := CidrName(name)
+		if err != nil {
+			pd.Logger.Printf("indexCidrList: invalid prefix %q in CIDR list %s dropped: %v", name, wbgl.Name, err)
+			delete(wbgl.Names, name)
+			continue
+		}
+		if cname != name {
+			delete(wbgl.Names, name)
+			tn.Name = cname
+			wbgl.Names[cname] = tn
+		}
+		tree.Insert(prefix)
+	}
+	pd.Cidrs[wbgl] = tree
+}
+
+// cidrAllowlisted reports whether the address trigger t is within a prefix in a CIDR allowlist.
+// The prefixes in a CIDR list are addresses, so they protect both the addresses in answers
+// (rpz-ip) and the addresses of nameservers (rpz-nsip).
+func (pd *PopData) cidrAllowlisted(t RpzTrigger) bool {
+	if t.Type != IpTrigger && t.Type != NsipTrigger {
+		return false
+	}
+	for _, list := range pd.Lists["allowlist"] {
+		if tree, exist := pd.Cidrs[list]; exist && list.Format == "cidr" && tree.Contains(t.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cidrAllowlistOverlaps reports whether a prefix in a CIDR allowlist contains p or is contained
+// in p.
+func (pd *PopData) cidrAllowlistOverlaps(p netip.Prefix) bool {
+	for _, list := range pd.Lists["allowlist"] {
+		if tree, exist := pd.Cidrs[list]; exist && list.Format == "cidr" && tree.Overlaps(p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/spf13/viper"
+)
+
+func TestPrefixTree(t *testing.T) {
+	tree := NewPrefixTree()
+	for _, s := range []string{"192.0.2.0/24", "198.51.100.128/25", "2001:db8::/32", "10.0.0.0/8"} {
+		if !tree.Insert(netip.MustParsePrefix(s)) {
+			t.Errorf("Insert(%s) = false for a new prefix", s)
+		}
+	}
+	if tree.Insert(netip.MustParsePrefix("192.0.2.0/24")) || tree.Len() != 4 {
+		t.Errorf("a duplicate was inserted, %d prefixes", tree.Len())
+	}
+	for s, want := range map[string]string{
+		"192.0.2.1/32":        "192.0.2.0/24",
+		"192.0.2.0/24":        "192.0.2.0/24",
+		"192.0.0.0/16":        "",
+		"198.51.100.200/32":   "198.51.100.128/25",
+		"198.51.100.1/32":     "",
+		"2001:db8:1::/48":     "2001:db8::/32",
+		"2001:db9::/32":       "",
+		"::ffff:10.0.0.1/128": "", // another address family than 10.0.0.0/8
+	} {
+		p, found := tree.Covering(netip.MustParsePrefix(s))
+		if found && p.String() != want {
+			t.Errorf("Covering(%s) = %s, want %q", s, p, want)
+		} else if !found && want != "" {
+			t.Errorf("Covering(%s) found nothing, want %s", s, want)
+		}
+	}
+	if tree.Delete(netip.MustParsePrefix("192.0.2.0/25")) {
+		t.Errorf("Delete of a prefix that is not in the tree succeeded")
+	}
+	if !tree.Delete(netip.MustParsePrefix("192.0.2.0/24")) || tree.Contains(netip.MustParsePrefix("192.0.2.1/32")) {
+		t.Errorf("192.0.2.0/24 still in the tree after Delete")
+	}
+	if !tree.Contains(netip.MustParsePrefix("10.1.2.3/32")) || tree.Len() != 3 {
+		t.Errorf("Delete removed more than the prefix, %d prefixes left", tree.Len())
+	}
+}
+
+func TestParseCidrs(t *testing.T) {
+	names := map[string]tapir.TapirName{}
+	n, err := ParseCidrFile(writeFile(t, "cidrs.txt", `# bad addresses
+192.0.2.0/24
+198.51.100.7          # a single address
+2001:db8:1::/48
+::ffff:203.0.113.0/120
+24.0.100.51.198.rpz-ip.
+`), names)
+	if err != nil || n != 5 {
+		t.Fatalf("ParseCidrFile: %d prefixes, %v", n, err)
+	}
+	for _, name := range []string{"24.0.2.0.192.rpz-ip.", "32.7.100.51.198.rpz-ip.", "48.zz.1.db8.2001.rpz-ip.",
+		"24.0.113.0.203.rpz-ip.", "24.0.100.51.198.rpz-ip."} {
+		if _, exist := names[name]; !exist {
+			t.Errorf("%s not in the parsed names: %v", name, names)
+		}
+	}
+	if _, err := ParseCidrs(strings.NewReader("192.0.2.0/33\n"), names); err == nil {
+		t.Errorf("ParseCidrs accepted an invalid prefix")
+	}
+}
+
+func TestCidrSources(t *testing.T) {
+	pd, _ := newPopData(t)
+	tp := &testPop{pd: pd}
+
+	allow := &tapir.WBGlist{Name: "good-nets", Type: "allowlist", SrcFormat: "cidr", ReaperData: map[time.Time]map[string]bool{}}
+	viper.Set("sources.goodnets.filename", writeFile(t, "good.txt", "192.0.2.0/24\n2001:db8::/32\n"))
+	if err := pd.ParseLocalFile("goodnets", allow); err != nil {
+		t.Fatalf("ParseLocalFile: %v", err)
+	}
+
+	badnets := []string{
+		"192.0.2.128/25", // within the allowlist
+		"198.51.100.0/24",
+		"2001:db8:5::1", // within the allowlist
+		"2001:db9::/32",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, strings.Join(badnets, "\n"))
+	}))
+	defer srv.Close()
+	deny := &tapir.WBGlist{Name: "bad-nets", Type: "denylist", SrcFormat: "cidr", ReaperData: map[time.Time]map[string]bool{}}
+	if err := pd.ParseHttpSource("badnets", srv.URL, deny); err != nil {
+		t.Fatalf("ParseHttpSource: %v", err)
+	}
+	tp.addList("doubtlist", "feed", "xfr", "24.0.2.0.192.rpz-nsip.", "24.0.2.0.192.rpz-client-ip.")
+
+	if _, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup}); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	snap := pd.Rpz.Snapshot()
+	for name, want := range map[string]bool{
+		"25.128.2.0.192.rpz-ip.":      false,
+		"24.0.100.51.198.rpz-ip.":     true,
+		"128.1.zz.5.db8.2001.rpz-ip.": false,
+		"32.zz.db9.2001.rpz-ip.":      true,
+		"24.0.2.0.192.rpz-nsip.":      false, // a CIDR allowlist also protects nameserver addresses
+		"24.0.2.0.192.rpz-client-ip.": true,  // but not clients
+	} {
+		if _, exist := snap.Data[pd.rpzOwner(name)]; exist != want {
+			t.Errorf("trigger %s in the output: %t, want %t", name, exist, want)
+		}
+	}
+
+	// An MQTT update in CIDR notation to the allowlist removes the covered triggers
+	ixfr, err := pd.applyTapirUpdate(tapir.TapirMsg{
+		SrcName:  "good-nets",
+		ListType: "allowlist",
+		Added:    []tapir.Domain{{Name: "198.51.100.0/23", TimeAdded: time.Now(), TTL: 3600}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("applyTapirUpdate: %v", err)
+	}
+	if len(ixfr.Removed) != 1 || ixfr.Removed[0].Name != "24.0.100.51.198.rpz-ip." {
+		t.Errorf("IXFR removes %d rules, want the trigger covered by the new prefix", len(ixfr.Removed))
+	}
+	if _, exist := allow.Names["23.0.100.51.198.rpz-ip."]; !exist {
+		t.Errorf("the new prefix is not in the allowlist as an rpz-ip trigger: %v", allow.Names)
+	}
+
+	// After the prefix is removed again, the tree no longer protects the addresses in it, and
+	// the triggers that it covered are back in the output
+	ixfr, err = pd.applyTapirUpdate(tapir.TapirMsg{
+		SrcName:  "good-nets",
+		ListType: "allowlist",
+		Removed:  []tapir.Domain{{Name: "198.51.100.0/23"}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("applyTapirUpdate: %v", err)
+	}
+	if pd.Allowlisted("24.0.100.51.198.rpz-ip.") {
+		t.Errorf("198.51.100.0/24 still allowlisted after the prefix was removed")
+	}
+	if len(ixfr.Added) != 1 || ixfr.Added[0].Name != "24.0.100.51.198.rpz-ip." {
+		t.Errorf("IXFR adds %d rules, want the trigger that was covered by the removed prefix", len(ixfr.Added))
+	}
+
+	// A refresh of the HTTP source updates the output with the differences
+	badnets = []string{"192.0.2.128/25", "2001:db9::/32", "203.0.113.0/24"}
+	serial := pd.Rpz.CurrentSerial()
+	if err := pd.refreshHttpSource(deny, srv.URL); err != nil {
+		t.Fatalf("refreshHttpSource: %v", err)
+	}
+	snap = pd.Rpz.Snapshot()
+	for name, want := range map[string]bool{
+		"24.0.100.51.198.rpz-ip.": false,
+		"24.0.113.0.203.rpz-ip.":  true,
+		"32.zz.db9.2001.rpz-ip.":  true,
+	} {
+		if _, exist := snap.Data[pd.rpzOwner(name)]; exist != want {
+			t.Errorf("trigger %s in the output after the refresh: %t, want %t", name, exist, want)
+		}
+	}
+	if snap.Serial != serial+1 || len(deny.Names) != 3 || !pd.Cidrs[deny].Contains(netip.MustParsePrefix("203.0.113.1/32")) {
+		t.Errorf("after the refresh: serial %d (was %d), %d names in the list", snap.Serial, serial, len(deny.Names))
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
@@ -31,6 +31,7 @@ type Config struct {
 		Mqtt      *log.Logger
 		Dnsengine *log.Logger
 		Policy    *log.Logger
+		Api       *log.Logger
 	}
 	Internal InternalConf
 	PopData  *PopData
@@ -41,6 +42,7 @@ type ServicesConf struct {
 	Rpz struct {
 		ZoneName    string `validate:"required"`
 		SerialCache string `validate:"required"`
+		Apex        RpzApexConf
 	}
 
 	Reaper struct {
@@ -48,12 +50,45 @@ type ServicesConf struct {
 	}
 }
 
+// RpzApexConf is the apex of the RPZ output zone (services.rpz.apex). Unset SOA fields get
+// defaults, see ParseRpzApex.
+type RpzApexConf struct {
+	Mname       string // SOA MNAME, default the first nameserver
+	Rname       string // SOA RNAME
+	Ttl         uint32 // TTL of the SOA, NS and glue RRs, default services.rpz.ttl
+	Refresh     uint32
+	Retry       uint32
+	Expire      uint32
+	Minimum     uint32              `validate:"lte=86400"` // negative caching TTL
+	Nameservers []RpzNameserverConf `validate:"required,dive"`
+}
+
+type RpzNameserverConf struct {
+	Name      string   `validate:"required"`
+	Addresses []string // glue, required for (and only allowed for) names in the RPZ zone
+}
+
 type ApiserverConf struct {
-	Active       *bool    `validate:"required"`
-	Name         string   `validate:"required"`
-	Key          string   `validate:"required"`
-	Addresses    []string `validate:"required"`
-	TlsAddresses []string `validate:"required"`
+	Active       *bool             `validate:"required"`
+	Name         string            `validate:"required"`
+	Key          string            `validate:"required_without_all=Keys Identities"` // legacy, has the admin role
+	Keys         []ApiKeyConf      `validate:"dive"`
+	Identities   []ApiIdentityConf `validate:"dive"`
+	Addresses    []string          `validate:"required"`
+	TlsAddresses []string          `validate:"required"`
+	Logfile      string
+}
+
+type ApiKeyConf struct {
+	Name string `validate:"required"`
+	Key  string `validate:"required"`
+	Role string `validate:"required,oneof=read-only readonly operator admin"`
+}
+
+// An identity is a TLS client certificate, matched on subject CN or a DNS SAN.
+type ApiIdentityConf struct {
+	Name string `validate:"required"`
+	Role string `validate:"required,oneof=read-only readonly operator admin"`
 }
 
 type DnsengineConf struct {
@@ -70,6 +105,15 @@ type BootstrapServerConf struct {
 	Addresses    []string `validate:"required"`
 	TlsAddresses []string `validate:"required"`
 	Logfile      string
+	SigningKey   string // ECDSA key that signs the exports
+}
+
+// BootstrapTlsConf is how the certificate of a bootstrap server is verified. The certificate must
+// always be issued by the CA in certs.cacertfile.
+type BootstrapTlsConf struct {
+	Server     string   // as in the list of bootstrap servers of the source
+	ServerName string   // the name to send as SNI and to verify the certificate against
+	Spki       []string // pinned keys: the base64 SHA-256 hash of the SubjectPublicKeyInfo; the name is not verified
 }
 
 type ServerConf struct {
@@ -82,51 +126,81 @@ type KeystoreConf struct {
 }
 
 type SourceConf struct {
-	Active       *bool  `validate:"required"`
-	Name         string `validate:"required"`
-	Description  string `validate:"required"`
-	Type         string `validate:"required"`
-	Format       string `validate:"required"`
-	Source       string `validate:"required"`
-    Immutable    bool
-	Topic        string
-	ValidatorKey string
-	Bootstrap    []string
-	BootstrapUrl string
-	BootstrapKey string
-	Filename     string
-	Upstream     string
-	Zone         string
-    BackupFile   string
+	Active          *bool  `validate:"required"`
+	Name            string `validate:"required"`
+	Description     string `validate:"required"`
+	Type            string `validate:"required"`
+	Format          string `validate:"required"`
+	Source          string `validate:"required"`
+	Immutable       bool
+	Topic           string
+	ValidatorKey    string
+	Bootstrap       []string
+	BootstrapUrl    string
+	BootstrapKey    string
+	BootstrapTls    []BootstrapTlsConf // how to verify the bootstrap servers, by default the name in the URL
+	BootstrapSigned bool               // the export must be signed with the validator key
+	Filename        string
+	Url             string
+	Refresh         int // http sources: seconds between fetches, 0 to fetch only at startup
+	Upstream        string
+	Zone            string
+	BackupFile      string
 }
 
 type PolicyConf struct {
-	Logfile string
+	Logfile  string
+	AuditLog string
 	//	Logger    *log.Logger
 	Allowlist struct {
 		Action string `validate:"required"`
 	}
 	Denylist struct {
-		Action string `validate:"required"`
+		Action   string `validate:"required"`
+		Redirect RedirectConf
 	}
 	Doubtlist DoubtlistConf
+	Redirect  RedirectConf // for REDIRECT rules without a redirect of their own
+	Ttl       struct {
+		Denylist  uint32
+		Doubtlist uint32
+		Actions   map[string]uint32
+		Sources   map[string]uint32
+		Lifetime  bool
+		Min       uint32
+	}
+	BadIp struct { // rpz-ip rules for the addresses of observed names
+		Tags       []string
+		Ipv4Prefix int `validate:"omitempty,min=1,max=32"`
+		Ipv6Prefix int `validate:"omitempty,min=1,max=128"`
+	}
 }
 
 type ListConf struct {
 }
 
+// RedirectConf is the local data of REDIRECT rules: either a CNAME or A and/or AAAA addresses.
+type RedirectConf struct {
+	Cname string
+	A     []string
+	AAAA  []string
+}
+
 type DoubtlistConf struct {
 	NumSources struct {
-		Limit  int    `validate:"required"`
-		Action string `validate:"required"`
+		Limit    int    `validate:"required"`
+		Action   string `validate:"required"`
+		Redirect RedirectConf
 	}
 	NumTapirTags struct {
-		Limit  int    `validate:"required"`
-		Action string `validate:"required"`
+		Limit    int    `validate:"required"`
+		Action   string `validate:"required"`
+		Redirect RedirectConf
 	}
 	DenyTapir struct {
-		Tags   []string `validate:"required"`
-		Action string   `validate:"required"`
+		Tags     []string `validate:"required"`
+		Action   string   `validate:"required"`
+		Redirect RedirectConf
 	}
 }
 
@@ -135,6 +209,8 @@ type InternalConf struct {
 	// RpzCmdCh      chan RpzCmdData
 	APIStopCh         chan struct{}
 	ComponentStatusCh chan tapir.ComponentStatusUpdate
+	ApiAuth           *ApiAuth
+	Servers           *ServerRegistry
 }
 
 func ValidateConfig(v *viper.Viper, cfgfile string) error {
@@ -6,6 +6,8 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 
 	"github.com/dnstapir/tapir"
@@ -23,93 +25,121 @@ func (pd *PopData) ConfigUpdater(conf *Config, stopch chan struct{}) {
 	// Create a new mqtt engine just for the statusupdater.
 	me := pd.MqttEngine
 	if me == nil {
-		POPExiter("ConfigUpdater: MQTT Engine not running")
+		pd.Logger.Printf("ConfigUpdater: MQTT Engine not running, config updates will not be received")
+		pd.ReportStatus("mqtt-config", tapir.StatusFail, "MQTT Engine not running, config updates will not be received")
+		return
 	}
 
 	ConfigChan := make(chan tapir.MqttPkgIn, 5)
 
 	configTopic := viper.GetString("tapir.config.topic")
 	if configTopic == "" {
-		POPExiter("ConfigUpdater: MQTT config topic not set")
+		pd.Logger.Printf("ConfigUpdater: MQTT config topic not set (key tapir.config.topic)")
+		pd.ReportStatus("mqtt-config", tapir.StatusFail, "MQTT config topic not set (key tapir.config.topic)")
+		return
 	}
 
 	pd.Logger.Printf("ConfigUpdater: Adding sub topic '%s' to MQTT Engine", configTopic)
 	msg, err := me.SubToTopic(configTopic, ConfigChan, "struct", true) // XXX: Brr. kludge.
 	if err != nil {
-		POPExiter("ConfigUpdater: Error adding topic %s to MQTT Engine: %v", configTopic, err)
+		pd.Logger.Printf("ConfigUpdater: Error adding topic %s to MQTT Engine: %v", configTopic, err)
+		pd.ReportStatus("mqtt-config", tapir.StatusFail, "Error subscribing to config topic %s: %v", configTopic, err)
+		return
 	}
 	pd.Logger.Printf("ConfigUpdater: Topic status for MQTT engine %s: %+v", me.Creator, msg)
 
 	log.Printf("ConfigUpdater: Starting")
 
 	for inbox := range ConfigChan {
-		log.Printf("ConfigUpdater: got config update message on topic %s: %v", inbox.Topic)
+		log.Printf("ConfigUpdater: got config update message on topic %s", inbox.Topic)
 		var gconfig tapir.GlobalConfig
 		err = json.Unmarshal(inbox.Payload, &gconfig)
 		if err != nil {
 			log.Printf("ConfigUpdater: error unmarshalling config update message: %v", err)
+			pd.ReportStatus("mqtt-config", tapir.StatusFail, "Error unmarshalling config update message: %v", err)
 			continue
 		}
-		pd.ProcessTapirGlobalConfig(gconfig)
+		err = pd.ProcessTapirGlobalConfig(gconfig)
 		if err != nil {
 			log.Printf("ConfigUpdater: error processing config update message: %v", err)
+			pd.ReportStatus("mqtt-config", tapir.StatusFail, "Error processing config update message: %v", err)
+			continue
 		}
+		pd.ReportStatus("mqtt-config", tapir.StatusOK, "Config update from topic %s applied", inbox.Topic)
 	}
 }
 
-func (pd *PopData) ProcessTapirGlobalConfig(gconfig tapir.GlobalConfig) {
-    log.Printf("TapirProcessGlobalConfig: %+v", gconfig)
+func (pd *PopData) ProcessTapirGlobalConfig(gconfig tapir.GlobalConfig) error {
+	log.Printf("TapirProcessGlobalConfig: %+v", gconfig)
+	pd.Rpz.SetEnvelopeSize(gconfig.Rpz.EnvelopeSize)
 
-    // Assume there is only one topic and that it is the one we want
-    // TODO maybe sanitize or sanity check or something
-    newTopic := gconfig.ObservationTopics[0]
-    bootstrapServers := gconfig.Bootstrap.Servers
-    bootstrapUrl := gconfig.Bootstrap.BaseUrl
-    bootstrapKey := gconfig.Bootstrap.ApiToken
+	// Assume there is only one topic and that it is the one we want
+	// TODO maybe sanitize or sanity check or something
+	if len(gconfig.ObservationTopics) == 0 {
+		return fmt.Errorf("global config contains no observation topics")
+	}
+	newTopic := gconfig.ObservationTopics[0]
+	bootstrapServers := gconfig.Bootstrap.Servers
+	bootstrapUrl := gconfig.Bootstrap.BaseUrl
+	bootstrapKey := gconfig.Bootstrap.ApiToken
+
+	var errs []error
+
+	var mqttlists []*tapir.WBGlist
+	pd.mu.RLock()
+	for _, listtype := range []string{"allowlist", "denylist", "doubtlist"} {
+		for _, wbgl := range pd.Lists[listtype] {
+			if wbgl.Immutable || wbgl.Datasource != "mqtt" {
+				continue
+			}
+			mqttlists = append(mqttlists, wbgl)
+		}
+	}
+	pd.mu.RUnlock()
 
-	//for _, listtype := range []string{"allowlist", "denylist", "doubtlist"} {
-	for _, wbgl := range pd.Lists["doubtlist"] {
-        if  wbgl.Immutable || wbgl.Datasource != "mqtt" {
-            continue
-        }
+	for _, wbgl := range mqttlists {
 
-        for _, topic := range wbgl.MqttDetails.Topics {
-            pd.MqttEngine.RemoveTopic(topic)
-            break // Only one topic
-        }
+		pd.mu.RLock()
+		topics := wbgl.MqttDetails.Topics
+		pd.mu.RUnlock()
+		for _, topic := range topics {
+			pd.MqttEngine.RemoveTopic(topic)
+			break // Only one topic
+		}
 
 		pd.mu.Lock()
-        wbgl.MqttDetails.Topics = append(wbgl.MqttDetails.Topics, newTopic.Topic)
-        wbgl.MqttDetails.Bootstrap = bootstrapServers
-        wbgl.MqttDetails.BootstrapUrl = bootstrapUrl
-        wbgl.MqttDetails.BootstrapKey = bootstrapKey
+		wbgl.MqttDetails.Topics = append(wbgl.MqttDetails.Topics, newTopic.Topic)
+		wbgl.MqttDetails.Bootstrap = bootstrapServers
+		wbgl.MqttDetails.BootstrapUrl = bootstrapUrl
+		wbgl.MqttDetails.BootstrapKey = bootstrapKey
 		pd.mu.Unlock()
 
-        _, err := pd.MqttEngine.SubToTopic(newTopic.Topic, pd.TapirObservations, "struct", true) // XXX: Brr. kludge.
-        if err != nil {
-            POPExiter("ProcessTapirGlobalConfig: Error adding topic %s: %v", newTopic, err)
-        }
-
-        src := SourceConf{
-            Bootstrap:    wbgl.MqttDetails.Bootstrap,
-            BootstrapUrl: wbgl.MqttDetails.BootstrapUrl,
-            BootstrapKey: wbgl.MqttDetails.BootstrapKey,
-            Name:         wbgl.Name,
-            Format:       wbgl.Format,
-        }
-
-        if len(gconfig.Bootstrap.Servers) > 0 {
-            pd.Logger.Printf("ProcessTapirGlobalConfig: %d bootstrap servers advertised: %v", wbgl.Name, len(src.Bootstrap), src.Bootstrap)
-            tmp, err := pd.BootstrapMqttSource(src)
-            if err != nil {
-                pd.Logger.Printf("ProcessTapirGlobalConfig: Error bootstrapping MQTT source %s: %v", wbgl.Name, err)
-            } else {
-		        pd.mu.Lock()
-                *wbgl = *tmp
-		        pd.mu.Unlock()
-            }
-        }
+		pd.bufferUpdates(wbgl.Type, wbgl.Name)
+		_, err := pd.MqttEngine.SubToTopic(newTopic.Topic, pd.TapirObservations, "struct", true) // XXX: Brr. kludge.
+		if err != nil {
+			pd.dropHandover(wbgl.Type, wbgl.Name)
+			// Without a subscription the list cannot be updated, but the other lists are unaffected
+			errs = append(errs, fmt.Errorf("list %s: error adding topic %s: %v", wbgl.Name, newTopic.Topic, err))
+			continue
+		}
+
+		// The verification of the exports is from the configuration of the source
+		src := pd.mqttSourceConf(wbgl)
+		src.Topic = newTopic.Topic
+
+		var boot *ListExport
+		if len(gconfig.Bootstrap.Servers) > 0 {
+			pd.Logger.Printf("ProcessTapirGlobalConfig: %s: %d bootstrap servers advertised: %v", wbgl.Name, len(src.Bootstrap), src.Bootstrap)
+			boot, err = pd.BootstrapMqttSource(src)
+			if err != nil {
+				pd.Logger.Printf("ProcessTapirGlobalConfig: Error bootstrapping MQTT source %s: %v", wbgl.Name, err)
+				pd.ReportStatus("bootstrap", tapir.StatusWarn, "Error bootstrapping MQTT source %s: %v", wbgl.Name, err)
+			}
+		}
+		// Without an export the list keeps its names, and the buffered updates are applied to them
+		pd.completeHandover(wbgl.Type, wbgl, boot, nil, true)
 
 		pd.Logger.Printf("*** DONE Processing global config")
-    }
+	}
+	return errors.Join(errs...)
 }
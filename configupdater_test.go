@@ -0,0 +1,43 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/dnstapir/tapir"
+)
+
+func TestProcessTapirGlobalConfig(t *testing.T) {
+	pd, _ := newPopData(t)
+	tp := &testPop{pd: pd}
+	lists := []*tapir.WBGlist{
+		tp.addList("allowlist", "core-allow", "mqtt"),
+		tp.addList("doubtlist", "dns-tapir", "mqtt"),
+	}
+	for _, wbgl := range lists {
+		wbgl.MqttDetails = &tapir.MqttDetails{Topics: []string{"events/old"}}
+	}
+	local := tp.addList("denylist", "local-deny", "file")
+
+	var gconfig tapir.GlobalConfig
+	gconfig.ObservationTopics = []tapir.ConfigTopic{{Topic: "events/new"}}
+	gconfig.Bootstrap.BaseUrl = "https://bootstrap.example/api/v1"
+	if err := pd.ProcessTapirGlobalConfig(gconfig); err != nil {
+		t.Fatalf("ProcessTapirGlobalConfig: %v", err)
+	}
+	for _, wbgl := range lists {
+		if md := wbgl.MqttDetails; !slices.Contains(md.Topics, "events/new") || md.BootstrapUrl != gconfig.Bootstrap.BaseUrl {
+			t.Errorf("%s %s: topics %v, bootstrap url %q, want the ones from the config", wbgl.Type, wbgl.Name, md.Topics, md.BootstrapUrl)
+		}
+	}
+	if local.MqttDetails != nil {
+		t.Errorf("the config was applied to the file list %s", local.Name)
+	}
+	if len(pd.Handovers) != 0 {
+		t.Errorf("handovers still buffering updates: %v", pd.Handovers)
+	}
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"strings"
@@ -31,6 +32,7 @@ func DnsEngine(conf *Config) error {
 			go func(addr, net string) {
 				conf.Loggers.Dnsengine.Printf("DnsEngine: serving on %s (%s)\n", addr, net)
 				server := &dns.Server{Addr: addr, Net: net}
+				conf.Internal.Servers.AddDnsServer(server)
 
 				// Must bump the buffer size of incoming UDP msgs, as updates
 				// may be much larger then queries
@@ -38,7 +40,7 @@ func DnsEngine(conf *Config) error {
 				if err := server.ListenAndServe(); err != nil {
 					conf.Loggers.Dnsengine.Printf("Failed to setup the %s server: %s\n", net, err.Error())
 				} else {
-					conf.Loggers.Dnsengine.Printf("DnsEngine: listening on %s/%s\n", addr, net)
+					conf.Loggers.Dnsengine.Printf("DnsEngine: stopped serving on %s/%s\n", addr, net)
 				}
 			}(addr, net)
 		}
@@ -69,11 +71,11 @@ func createHandler(conf *Config) func(w dns.ResponseWriter, r *dns.Msg) {
 				lg.Printf("Error from WriteMsg(): %v", err)
 			}
 
-			if _, ok := pd.RpzSources[qname]; ok {
+			if zd, ok := pd.RpzSource(qname); ok {
 				lg.Printf("Received Notify for known zone %s. Fetching from upstream", qname)
 				zonech <- RpzRefresh{
 					Name:     qname, // send zone name into RefreshEngine
-					ZoneType: pd.RpzSources[qname].ZoneType,
+					ZoneType: zd.ZoneType,
 				}
 			}
 			lg.Printf("Notify message: %v\n", m.String())
@@ -88,7 +90,7 @@ func createHandler(conf *Config) func(w dns.ResponseWriter, r *dns.Msg) {
 				if err != nil {
 					lg.Printf("Error from RpzResponder(): %v", err)
 				}
-			} else if zd, ok := pd.RpzSources[qname]; ok {
+			} else if zd, ok := pd.RpzSource(qname); ok {
 				// The qname is equal to the name of a zone we have
 				err := ApexResponder(w, r, zd, qname, qtype, lg)
 				if err != nil {
@@ -97,9 +99,11 @@ func createHandler(conf *Config) func(w dns.ResponseWriter, r *dns.Msg) {
 			} else {
 				lg.Printf("DnsHandler: Qname is '%s', which is not a known zone.", qname)
 				known_zones := []string{pd.Rpz.ZoneName}
+				pd.mu.RLock()
 				for z := range pd.RpzSources {
 					known_zones = append(known_zones, z)
 				}
+				pd.mu.RUnlock()
 				lg.Printf("DnsHandler: Known zones are: %v", known_zones)
 
 				// Let's see if we can find the zone
@@ -156,7 +160,7 @@ func (pd *PopData) RpzResponder(w dns.ResponseWriter, r *dns.Msg, qtype uint16,
 
 	//	apex := zd.Owners[zd.OwnerIndex[zd.ZoneName]]
 	// zd.Logger.Printf("*** Ownerindex(%s)=%d apex: %v", zd.ZoneName, zd.OwnerIndex[zd.ZoneName], apex)
-	zd := pd.Rpz.Axfr.ZoneData
+	zd := pd.Rpz.ZoneData
 	// XXX: we need this, but later var glue tapir.RRset
 
 	downstream, _, err := net.SplitHostPort(w.RemoteAddr().String())
@@ -165,6 +169,19 @@ func (pd *PopData) RpzResponder(w dns.ResponseWriter, r *dns.Msg, qtype uint16,
 		return nil
 	}
 
+	if qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		if !pd.beginXfr() {
+			lg.Printf("RpzResponder: shutting down, refusing %s from %s", dns.TypeToString[qtype], downstream)
+			m.MsgHdr.Rcode = dns.RcodeRefused
+			err = w.WriteMsg(m)
+			if err != nil {
+				lg.Printf("Error from WriteMsg(): %v", err)
+			}
+			return nil
+		}
+		defer pd.XfrsInFlight.Done()
+	}
+
 	switch qtype {
 	case dns.TypeAXFR:
 		lg.Printf("We have the zone %s, so let's try to serve it", pd.Rpz.ZoneName)
@@ -197,12 +214,37 @@ func (pd *PopData) RpzResponder(w dns.ResponseWriter, r *dns.Msg, qtype uint16,
 		// zd.Logger.Printf("There are %d SOA RRs in %s. rrset: %v", len(apex.RRtypes[dns.TypeSOA].RRs),
 		// 			   zd.ZoneName, apex.RRtypes[dns.TypeSOA])
 		//		m.Answer = append(m.Answer, dns.RR(&zd.SOA))
-		pd.Rpz.Axfr.SOA.Serial = pd.Rpz.CurrentSerial
-		m.Answer = append(m.Answer, dns.RR(&pd.Rpz.Axfr.SOA))
+		snap := pd.Rpz.Snapshot()
+		m.Answer = append(m.Answer, dns.RR(snap.SOA))
 		//		m.Ns = append(m.Ns, apex.RRtypes[dns.TypeNS].RRs...)
-		m.Ns = append(m.Ns, pd.Rpz.Axfr.ZoneData.NSrrs...)
-		//		glue = *zd.FindGlue(apex.RRtypes[dns.TypeNS])
-		//		m.Extra = append(m.Extra, glue.RRs...)
+		m.Ns = append(m.Ns, snap.NSrrs...)
+		if dnssecOK(r, m) && snap.Signed != nil {
+			m.Answer = append(m.Answer, snap.Signed.soaSigs...)
+			_, nssigs := snap.Signed.apexRRset(dns.TypeNS)
+			m.Ns = append(m.Ns, nssigs...)
+		}
+		m.Extra = append(m.Extra, snap.Glue...)
+
+	case dns.TypeNS:
+		snap := pd.Rpz.Snapshot()
+		m.Answer = append(m.Answer, snap.NSrrs...)
+		m.Extra = append(m.Extra, snap.Glue...)
+		if dnssecOK(r, m) && snap.Signed != nil {
+			_, nssigs := snap.Signed.apexRRset(dns.TypeNS)
+			m.Answer = append(m.Answer, nssigs...)
+		}
+
+	case dns.TypeDNSKEY:
+		snap := pd.Rpz.Snapshot()
+		if snap.Signed == nil {
+			m.Ns = append(m.Ns, dns.RR(snap.SOA))
+			break
+		}
+		dnskeys, sigs := snap.Signed.apexRRset(dns.TypeDNSKEY)
+		m.Answer = append(m.Answer, dnskeys...)
+		if dnssecOK(r, m) {
+			m.Answer = append(m.Answer, sigs...)
+		}
 
 	default:
 		// every apex query we don't want to deal with
@@ -318,7 +360,12 @@ func QueryResponder(w dns.ResponseWriter, r *dns.Msg, zd *tapir.ZoneData, qname
 
 		owner = zd.Owners[zd.OwnerIndex[qname]]
 	default:
-		POPExiter("Error: QueryResponder: unknown zone type: %d", zd.ZoneType)
+		m.MsgHdr.Rcode = dns.RcodeServerFailure
+		err := w.WriteMsg(m)
+		if err != nil {
+			lg.Printf("Error from WriteMsg(): %v", err)
+		}
+		return fmt.Errorf("QueryResponder: zone %s has unknown zone type: %d", zd.ZoneName, zd.ZoneType)
 	}
 
 	var glue *tapir.RRset
@@ -408,12 +455,22 @@ func (pd *PopData) QueryResponder(w dns.ResponseWriter, r *dns.Msg, qname string
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.MsgHdr.Authoritative = true
+	snap := pd.Rpz.Snapshot()
+
+	sz := snap.Signed
+	if !dnssecOK(r, m) {
+		sz = nil // no DNSSEC records in the response
+	}
 
 	returnNXDOMAIN := func() {
 		// return NXDOMAIN
 		m.MsgHdr.Rcode = dns.RcodeNameError
 		//		m.Ns = append(m.Ns, apex.RRtypes[dns.TypeSOA].RRs...)
-		m.Ns = append(m.Ns, dns.RR(&pd.Rpz.Axfr.SOA))
+		m.Ns = append(m.Ns, dns.RR(snap.SOA))
+		if sz != nil {
+			m.Ns = append(m.Ns, sz.soaSigs...)
+			m.Ns = append(m.Ns, pd.Rpz.signer.denial(sz, qname, true)...)
+		}
 		err := w.WriteMsg(m)
 		if err != nil {
 			lg.Printf("Error from WriteMsg(): %v", err)
@@ -424,16 +481,68 @@ func (pd *PopData) QueryResponder(w dns.ResponseWriter, r *dns.Msg, qname string
 
 	//	var err error
 	var exist bool
-	var tn *tapir.RpzName
+	var tn *RpzRule
 
-	if tn, exist = pd.Rpz.Axfr.Data[qname]; exist {
+	var glue []dns.RR
+	for _, rr := range snap.Glue {
+		if strings.EqualFold(rr.Header().Name, qname) {
+			glue = append(glue, rr)
+		}
+	}
+	if len(glue) > 0 {
+		// One of our nameservers
+		for _, rr := range glue {
+			if rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		if len(m.Answer) > 0 && sz != nil {
+			for _, rr := range sz.apex {
+				if sig, ok := rr.(*dns.RRSIG); ok && strings.EqualFold(sig.Hdr.Name, qname) &&
+					(sig.TypeCovered == qtype || qtype == dns.TypeANY) {
+					m.Answer = append(m.Answer, sig)
+				}
+			}
+		}
+		if len(m.Answer) == 0 {
+			m.Ns = append(m.Ns, dns.RR(snap.SOA))
+			if sz != nil {
+				m.Ns = append(m.Ns, sz.soaSigs...)
+				m.Ns = append(m.Ns, pd.Rpz.signer.denial(sz, qname, false)...)
+			}
+		}
+		err := w.WriteMsg(m)
+		if err != nil {
+			lg.Printf("Error from WriteMsg(): %v", err)
+		}
+		return nil
+	}
+
+	if tn, exist = snap.Data[qname]; exist {
 		m.MsgHdr.Rcode = dns.RcodeSuccess
-		switch qtype {
-		case dns.TypeCNAME, dns.TypeANY:
-			m.Answer = append(m.Answer, *tn.RR)
-			m.Ns = append(m.Ns, pd.Rpz.Axfr.NSrrs...)
+		for _, rr := range tn.RRs {
+			if rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		switch {
+		case len(m.Answer) > 0:
+			m.Ns = append(m.Ns, snap.NSrrs...)
+			if sz != nil {
+				for _, rr := range sz.ruleSigs[qname] {
+					if sig := rr.(*dns.RRSIG); sig.TypeCovered == qtype || qtype == dns.TypeANY {
+						m.Answer = append(m.Answer, sig)
+					}
+				}
+				_, nssigs := sz.apexRRset(dns.TypeNS)
+				m.Ns = append(m.Ns, nssigs...)
+			}
 		default:
-			m.Ns = append(m.Ns, dns.RR(&pd.Rpz.Axfr.SOA))
+			m.Ns = append(m.Ns, dns.RR(snap.SOA))
+			if sz != nil {
+				m.Ns = append(m.Ns, sz.soaSigs...)
+				m.Ns = append(m.Ns, pd.Rpz.signer.denial(sz, qname, false)...)
+			}
 		}
 		err := w.WriteMsg(m)
 		if err != nil {
@@ -445,13 +554,21 @@ func (pd *PopData) QueryResponder(w dns.ResponseWriter, r *dns.Msg, qname string
 	return nil
 }
 
+// RpzSource returns the upstream RPZ zone with the given name, if there is one.
+func (pd *PopData) RpzSource(zone string) (*tapir.ZoneData, bool) {
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+	zd, ok := pd.RpzSources[zone]
+	return zd, ok
+}
+
 func (pd *PopData) FindZone(qname string) *tapir.ZoneData {
 	var tzone string
 	labels := strings.Split(qname, ".")
 	for i := 1; i < len(labels)-1; i++ {
 		tzone = strings.Join(labels[i:], ".")
 		log.Printf("FindZone for qname='%s': testing '%s'", qname, tzone)
-		if z, ok := pd.RpzSources[tzone]; ok {
+		if z, ok := pd.RpzSource(tzone); ok {
 			log.Printf("Yes, zone=%s for qname=%s", tzone, qname)
 			return z
 		}
@@ -467,7 +584,7 @@ func (pd *PopData) FindZoneNG(qname string) *tapir.ZoneData {
 			break // done
 		}
 		log.Printf("FindZone for qname='%s': testing '%s'", qname, qname[i:])
-		if z, ok := pd.RpzSources[qname[i:]]; ok {
+		if z, ok := pd.RpzSource(qname[i:]); ok {
 			log.Printf("Yes, zone=%s for qname=%s", qname[i:], qname)
 			return z
 		}
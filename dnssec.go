@@ -0,0 +1,753 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"crypto"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// Online DNSSEC signing of the RPZ output zone. Every version (RpzSnapshot) of a signed zone
+// carries its signatures and its NSEC or NSEC3 chain. A new version only re-signs what changed
+// since the previous version (plus signatures that are about to expire), and the DNSSEC records
+// that were replaced are added to the IXFR, so that downstreams receive signed IXFRs.
+
+// RpzSigner holds the keys and the signing policy of the output zone.
+type RpzSigner struct {
+	zone     string
+	zsks     []*signingKey // sign everything except the DNSKEY RRset
+	ksks     []*signingKey // sign the DNSKEY RRset
+	dnskeys  []dns.RR
+	nsec3    *dns.NSEC3PARAM // nil means NSEC
+	validity time.Duration   // signature lifetime
+	refresh  time.Duration   // re-sign when a signature expires within this time
+}
+
+type signingKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// SignedZone is the DNSSEC part of one version of the output zone. Like the rest of the
+// snapshot it is never modified once published.
+type SignedZone struct {
+	soaSigs  []dns.RR            // RRSIGs over the SOA, new for every version
+	apex     []dns.RR            // DNSKEYs, NSEC3PARAM and the RRSIGs over them and over the NS RRset
+	ruleSigs map[string][]dns.RR // map[owner]RRSIGs over the rule
+	chain    []*chainLink        // the NSEC or NSEC3 chain in chain order
+	ents     map[string]int      // NSEC3 only: empty non-terminals, map[name]number of rules below
+}
+
+// chainLink is one NSEC or NSEC3 record with its signatures.
+type chainLink struct {
+	key   string   // chain order: canonicalKey(name) for NSEC, the hash for NSEC3
+	name  string   // the (unhashed) name that the record is for
+	types []uint16 // the types at name
+	rr    dns.RR   // the NSEC or NSEC3 record
+	sigs  []dns.RR
+}
+
+// LoadRpzSigner reads the DNSSEC config of the output zone (services.rpz.dnssec) and the keys.
+// Returns nil if the output zone should not be signed.
+func LoadRpzSigner(zone string) (*RpzSigner, error) {
+	if !viper.GetBool("services.rpz.dnssec.active") {
+		return nil, nil
+	}
+	s := RpzSigner{
+		zone:     dns.Fqdn(zone),
+		validity: viper.GetDuration("services.rpz.dnssec.validity"),
+		refresh:  viper.GetDuration("services.rpz.dnssec.refresh"),
+	}
+	if s.validity == 0 {
+		s.validity = 14 * 24 * time.Hour
+	}
+	if s.refresh == 0 {
+		s.refresh = s.validity / 4
+	}
+	if s.refresh >= s.validity {
+		return nil, fmt.Errorf("services.rpz.dnssec.refresh (%v) must be shorter than services.rpz.dnssec.validity (%v)",
+			s.refresh, s.validity)
+	}
+
+	switch denial := viper.GetString("services.rpz.dnssec.denial"); denial {
+	case "", "nsec":
+	case "nsec3":
+		salt := viper.GetString("services.rpz.dnssec.nsec3salt")
+		if salt == "-" {
+			salt = ""
+		}
+		if _, err := hex.DecodeString(salt); err != nil || len(salt) > 510 {
+			return nil, fmt.Errorf("services.rpz.dnssec.nsec3salt %q is not a valid salt", salt)
+		}
+		s.nsec3 = &dns.NSEC3PARAM{
+			Hdr:        dns.RR_Header{Name: s.zone, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET},
+			Hash:       dns.SHA1,
+			Iterations: uint16(viper.GetUint32("services.rpz.dnssec.nsec3iterations")),
+			SaltLength: uint8(len(salt) / 2),
+			Salt:       strings.ToUpper(salt),
+		}
+	default:
+		return nil, fmt.Errorf("services.rpz.dnssec.denial %q is unknown, must be nsec or nsec3", denial)
+	}
+
+	keyfiles := viper.GetStringSlice("services.rpz.dnssec.keys")
+	if len(keyfiles) == 0 {
+		return nil, fmt.Errorf("DNSSEC signing of %s is active, but there are no keys (services.rpz.dnssec.keys)", s.zone)
+	}
+	for _, kf := range keyfiles {
+		key, err := readSigningKey(kf, s.zone)
+		if err != nil {
+			return nil, err
+		}
+		s.dnskeys = append(s.dnskeys, key.dnskey)
+		if key.dnskey.Flags&dns.SEP != 0 {
+			s.ksks = append(s.ksks, key)
+		} else {
+			s.zsks = append(s.zsks, key)
+		}
+	}
+	// With only one kind of key, those keys sign everything
+	if len(s.zsks) == 0 {
+		s.zsks = s.ksks
+	}
+	if len(s.ksks) == 0 {
+		s.ksks = s.zsks
+	}
+	return &s, nil
+}
+
+// readSigningKey reads a key pair in BIND format (Kzone.+alg+tag.key and .private). The file
+// name may be given with or without suffix.
+func readSigningKey(filename, zone string) (*signingKey, error) {
+	prefix := strings.TrimSuffix(strings.TrimSuffix(filename, ".key"), ".private")
+	f, err := os.Open(prefix + ".key")
+	if err != nil {
+		return nil, fmt.Errorf("error reading DNSSEC key: %v", err)
+	}
+	defer f.Close()
+	rr, err := dns.ReadRR(f, prefix+".key")
+	if err != nil {
+		return nil, fmt.Errorf("error parsing DNSSEC key %s.key: %v", prefix, err)
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("%s.key does not contain a DNSKEY", prefix)
+	}
+	if !strings.EqualFold(dnskey.Hdr.Name, zone) {
+		return nil, fmt.Errorf("DNSSEC key %s.key is for %s, not %s", prefix, dnskey.Hdr.Name, zone)
+	}
+
+	pf, err := os.Open(prefix + ".private")
+	if err != nil {
+		return nil, fmt.Errorf("error reading DNSSEC private key: %v", err)
+	}
+	defer pf.Close()
+	priv, err := dnskey.ReadPrivateKey(pf, prefix+".private")
+	if err != nil {
+		return nil, fmt.Errorf("error parsing DNSSEC private key %s.private: %v", prefix, err)
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("DNSSEC private key %s.private cannot be used for signing", prefix)
+	}
+	return &signingKey{dnskey: dnskey, signer: signer}, nil
+}
+
+// sign returns the RRSIGs over rrset by keys.
+func (s *RpzSigner) sign(keys []*signingKey, rrset []dns.RR, now time.Time) ([]dns.RR, error) {
+	// Spread out the expiration times, so that not all signatures must be refreshed at once
+	expire := now.Add(s.validity - rand.N(s.validity/8+1))
+	hdr := rrset[0].Header()
+	var sigs []dns.RR
+	for _, key := range keys {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: hdr.Ttl},
+			KeyTag:     key.dnskey.KeyTag(),
+			SignerName: s.zone,
+			Algorithm:  key.dnskey.Algorithm,
+			Inception:  uint32(now.Add(-time.Hour).Unix()), // allow for clock skew
+			Expiration: uint32(expire.Unix()),
+		}
+		if err := sig.Sign(key.signer, rrset); err != nil {
+			return nil, fmt.Errorf("error signing %s %s: %v", hdr.Name, dns.TypeToString[hdr.Rrtype], err)
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+// fresh reports whether rrs contains signatures and none of them must be refreshed yet.
+func (s *RpzSigner) fresh(rrs []dns.RR, now time.Time) bool {
+	limit := now.Add(s.refresh).Unix()
+	signed := false
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if int64(sig.Expiration) < limit {
+				return false
+			}
+			signed = true
+		}
+	}
+	return signed
+}
+
+// nsecTtl returns the TTL of NSEC and NSEC3 records (RFC 9077).
+func nsecTtl(soa *dns.SOA) uint32 {
+	return min(soa.Minttl, soa.Hdr.Ttl)
+}
+
+// chainName returns the owner name and the sort key of the NSEC or NSEC3 record for name.
+func (s *RpzSigner) chainName(name string) (owner, key string) {
+	if s.nsec3 == nil {
+		return name, canonicalKey(name)
+	}
+	hash := dns.HashName(name, s.nsec3.Hash, s.nsec3.Iterations, s.nsec3.Salt)
+	return strings.ToLower(hash) + "." + s.zone, hash
+}
+
+// chainNext returns the "next" field of a record that points to the record for name.
+func (s *RpzSigner) chainNext(name, key string) string {
+	if s.nsec3 == nil {
+		return name
+	}
+	return key
+}
+
+// types returns the types at name, or nil if name is not in the chain.
+func (s *RpzSigner) types(snap *RpzSnapshot, ents map[string]int, name string) []uint16 {
+	rn := snap.Data[name]
+	var glue []uint16
+	for _, rr := range snap.Glue {
+		if rr.Header().Name == name && !slices.Contains(glue, rr.Header().Rrtype) {
+			glue = append(glue, rr.Header().Rrtype)
+		}
+	}
+	switch {
+	case name == s.zone && s.nsec3 == nil:
+		return []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY}
+	case name == s.zone:
+		return []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM}
+	case rn != nil && s.nsec3 == nil:
+		return append(rrtypes(rn.RRs), dns.TypeRRSIG, dns.TypeNSEC)
+	case rn != nil:
+		return append(rrtypes(rn.RRs), dns.TypeRRSIG)
+	case len(glue) > 0 && s.nsec3 == nil:
+		return append(glue, dns.TypeRRSIG, dns.TypeNSEC)
+	case len(glue) > 0:
+		return append(glue, dns.TypeRRSIG)
+	case ents[name] > 0:
+		return []uint16{} // empty non-terminal
+	}
+	return nil
+}
+
+// ancestors returns the names between name and the zone apex, both excluded.
+func (s *RpzSigner) ancestors(name string) []string {
+	var names []string
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if len(name)-off <= len(s.zone) {
+			break
+		}
+		names = append(names, name[off:])
+	}
+	return names
+}
+
+// signNext signs next, the coming version of the output zone. If incremental, only the names
+// in the last IXFR of next are re-signed, otherwise all names are checked. Unchanged records
+// with fresh signatures are reused from the current version. If the last IXFR of next leads
+// to next, the DNSSEC records that are replaced are added to it. Must be called with rd.writer
+// held.
+func (rd *RpzData) signNext(next *RpzSnapshot, incremental bool) error {
+	if rd.signer == nil {
+		return nil
+	}
+	rd.setSOA(next)
+	cur := rd.current.Load()
+	var touched []string
+	n := len(next.IxfrChain)
+	if incremental && n > 0 && cur != nil && cur.Signed != nil {
+		for _, rns := range [][]*RpzRule{next.IxfrChain[n-1].Removed, next.IxfrChain[n-1].Added} {
+			for _, rn := range rns {
+				if owner := (*rn.RR).Header().Name; !slices.Contains(touched, owner) {
+					touched = append(touched, owner)
+				}
+			}
+		}
+	} else {
+		incremental = false
+	}
+
+	del, add, err := rd.signer.signVersion(cur, next, touched, !incremental, time.Now())
+	if err != nil {
+		return err
+	}
+	if n > 0 && next.IxfrChain[n-1].ToSerial == next.Serial {
+		next.IxfrChain[n-1].DelRRs = del
+		next.IxfrChain[n-1].AddRRs = add
+	}
+	return nil
+}
+
+// signVersion creates next.Signed from prev.Signed. With all set, every name is checked,
+// otherwise only the touched names. Returns the DNSSEC records that were removed and added.
+func (s *RpzSigner) signVersion(prev, next *RpzSnapshot, touched []string, all bool, now time.Time) ([]dns.RR, []dns.RR, error) {
+	old := &SignedZone{}
+	if prev != nil && prev.Signed != nil {
+		old = prev.Signed
+	}
+	sz := &SignedZone{}
+	var del, add []dns.RR
+	replace := func(oldrrs, newrrs []dns.RR) {
+		del = append(del, oldrrs...)
+		add = append(add, newrrs...)
+	}
+	var err error
+
+	// The SOA changes in every version
+	sz.soaSigs, err = s.sign(s.zsks, []dns.RR{next.SOA}, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	replace(old.soaSigs, sz.soaSigs)
+
+	// The rest of the apex is re-signed when the signatures expire or the apex changes
+	if prev != nil && slices.Equal(prev.NSrrs, next.NSrrs) && slices.Equal(prev.Glue, next.Glue) &&
+		prev.SOA.Hdr.Ttl == next.SOA.Hdr.Ttl && s.fresh(old.apex, now) {
+		sz.apex = old.apex
+	} else {
+		sz.apex, err = s.signApex(next, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		replace(old.apex, sz.apex)
+	}
+
+	// The rules
+	if all {
+		touched = nil
+		for owner := range old.ruleSigs {
+			touched = append(touched, owner)
+		}
+		for owner := range next.Data {
+			if _, exist := old.ruleSigs[owner]; !exist {
+				touched = append(touched, owner)
+			}
+		}
+	}
+	sz.ruleSigs = maps.Clone(old.ruleSigs)
+	if sz.ruleSigs == nil {
+		sz.ruleSigs = map[string][]dns.RR{}
+	}
+	for _, owner := range touched {
+		oldsigs, signed := sz.ruleSigs[owner]
+		delete(sz.ruleSigs, owner)
+		rn, exist := next.Data[owner]
+		switch {
+		case !exist:
+			replace(oldsigs, nil)
+		case signed && prev.Data[owner] != nil && slices.EqualFunc(prev.Data[owner].RRs, rn.RRs, sameRR) && s.fresh(oldsigs, now):
+			sz.ruleSigs[owner] = oldsigs
+		default:
+			var sigs []dns.RR
+			for _, rrtype := range rrtypes(rn.RRs) { // one RRset per type
+				rrset := slices.DeleteFunc(slices.Clone(rn.RRs), func(rr dns.RR) bool { return rr.Header().Rrtype != rrtype })
+				tsigs, err := s.sign(s.zsks, rrset, now)
+				if err != nil {
+					return nil, nil, err
+				}
+				sigs = append(sigs, tsigs...)
+			}
+			sz.ruleSigs[owner] = sigs
+			replace(oldsigs, sigs)
+		}
+	}
+
+	// Empty non-terminals, only NSEC3 has records for them
+	if s.nsec3 != nil {
+		if all || old.ents == nil {
+			sz.ents = map[string]int{}
+			for owner := range next.Data {
+				for _, anc := range s.ancestors(owner) {
+					sz.ents[anc]++
+				}
+			}
+			for _, rr := range next.Glue {
+				for _, anc := range s.ancestors(rr.Header().Name) {
+					sz.ents[anc]++
+				}
+			}
+		} else {
+			sz.ents = maps.Clone(old.ents)
+			for _, owner := range touched {
+				_, was := prev.Data[owner]
+				_, is := next.Data[owner]
+				if was == is {
+					continue
+				}
+				for _, anc := range s.ancestors(owner) {
+					if is {
+						sz.ents[anc]++
+					} else if sz.ents[anc]--; sz.ents[anc] <= 0 {
+						delete(sz.ents, anc)
+					}
+					touched = append(touched, anc) // the loop does not see these
+				}
+			}
+		}
+	}
+
+	sz.chain, err = s.signChain(old.chain, next, sz.ents, touched, all, now, replace)
+	if err != nil {
+		return nil, nil, err
+	}
+	next.Signed = sz
+	return del, add, nil
+}
+
+// rrtypes returns the types of rrs, in the order they first appear.
+func rrtypes(rrs []dns.RR) []uint16 {
+	var types []uint16
+	for _, rr := range rrs {
+		if !slices.Contains(types, rr.Header().Rrtype) {
+			types = append(types, rr.Header().Rrtype)
+		}
+	}
+	return types
+}
+
+// sameRR reports whether a and b are the same record, including the TTL.
+func sameRR(a, b dns.RR) bool {
+	return a == b || (dns.IsDuplicate(a, b) && a.Header().Ttl == b.Header().Ttl)
+}
+
+// signApex signs the apex RRsets other than the SOA.
+func (s *RpzSigner) signApex(snap *RpzSnapshot, now time.Time) ([]dns.RR, error) {
+	var apex, dnskeys []dns.RR
+	for _, k := range s.dnskeys {
+		k = dns.Copy(k)
+		k.Header().Ttl = snap.SOA.Hdr.Ttl
+		dnskeys = append(dnskeys, k)
+	}
+	sigs, err := s.sign(s.ksks, dnskeys, now)
+	if err != nil {
+		return nil, err
+	}
+	apex = append(append(apex, dnskeys...), sigs...)
+
+	if len(snap.NSrrs) > 0 {
+		sigs, err = s.sign(s.zsks, snap.NSrrs, now)
+		if err != nil {
+			return nil, err
+		}
+		apex = append(apex, sigs...)
+	}
+
+	// The glue, one RRset per name and type
+	for i := 0; i < len(snap.Glue); {
+		hdr := snap.Glue[i].Header()
+		j := i + 1
+		for j < len(snap.Glue) && snap.Glue[j].Header().Name == hdr.Name && snap.Glue[j].Header().Rrtype == hdr.Rrtype {
+			j++
+		}
+		sigs, err = s.sign(s.zsks, snap.Glue[i:j], now)
+		if err != nil {
+			return nil, err
+		}
+		apex = append(apex, sigs...)
+		i = j
+	}
+
+	if s.nsec3 != nil {
+		param := dns.Copy(s.nsec3)
+		param.Header().Ttl = nsecTtl(snap.SOA)
+		sigs, err = s.sign(s.zsks, []dns.RR{param}, now)
+		if err != nil {
+			return nil, err
+		}
+		apex = append(append(apex, param), sigs...)
+	}
+	return apex, nil
+}
+
+// signChain returns the NSEC or NSEC3 chain of next. With all set, the chain is built from all
+// names in next, otherwise only the touched names are updated in the old chain. Records are
+// reused from the old chain when they are unchanged and their signatures are fresh; records
+// that are replaced are passed to replace.
+func (s *RpzSigner) signChain(old []*chainLink, next *RpzSnapshot, ents map[string]int, touched []string,
+	all bool, now time.Time, replace func(oldrrs, newrrs []dns.RR)) ([]*chainLink, error) {
+
+	byKey := func(a, b *chainLink) int { return strings.Compare(a.key, b.key) }
+	oldLinks := make(map[string]*chainLink, len(old))
+	for _, l := range old {
+		oldLinks[l.key] = l
+	}
+
+	var links []*chainLink
+	if all || len(old) == 0 {
+		names := make(map[string]bool, len(next.Data)+len(ents)+1)
+		names[s.zone] = true
+		for owner := range next.Data {
+			names[owner] = true
+		}
+		for _, rr := range next.Glue {
+			names[rr.Header().Name] = true
+		}
+		for name := range ents {
+			names[name] = true
+		}
+		links = make([]*chainLink, 0, len(names))
+		for name := range names {
+			_, key := s.chainName(name)
+			links = append(links, &chainLink{key: key, name: name, types: s.types(next, ents, name)})
+		}
+		slices.SortFunc(links, byKey)
+	} else {
+		// The old chain without the touched names, merged with the touched names that exist
+		skip := map[string]bool{}
+		var changed []*chainLink
+		for _, name := range touched {
+			_, key := s.chainName(name)
+			if skip[key] {
+				continue
+			}
+			skip[key] = true
+			if types := s.types(next, ents, name); types != nil {
+				changed = append(changed, &chainLink{key: key, name: name, types: types})
+			}
+		}
+		slices.SortFunc(changed, byKey)
+
+		links = make([]*chainLink, 0, len(old)+len(changed))
+		i := 0
+		for _, l := range old {
+			for i < len(changed) && changed[i].key < l.key {
+				links = append(links, changed[i])
+				i++
+			}
+			if !skip[l.key] {
+				links = append(links, l)
+			}
+		}
+		links = append(links, changed[i:]...)
+	}
+
+	ttl := nsecTtl(next.SOA)
+	present := make(map[string]bool, len(links))
+	for i, l := range links {
+		present[l.key] = true
+		nxt := links[(i+1)%len(links)]
+		ol := oldLinks[l.key]
+		if ol != nil && slices.Equal(ol.types, l.types) && chainNextOf(ol.rr) == s.chainNext(nxt.name, nxt.key) &&
+			ol.rr.Header().Ttl == ttl && s.fresh(ol.sigs, now) {
+			links[i] = ol
+			continue
+		}
+
+		link := &chainLink{key: l.key, name: l.name, types: l.types}
+		owner, _ := s.chainName(l.name)
+		hdr := dns.RR_Header{Name: owner, Class: dns.ClassINET, Ttl: ttl}
+		if s.nsec3 == nil {
+			hdr.Rrtype = dns.TypeNSEC
+			link.rr = &dns.NSEC{Hdr: hdr, NextDomain: nxt.name, TypeBitMap: l.types}
+		} else {
+			hdr.Rrtype = dns.TypeNSEC3
+			link.rr = &dns.NSEC3{
+				Hdr:        hdr,
+				Hash:       s.nsec3.Hash,
+				Iterations: s.nsec3.Iterations,
+				SaltLength: s.nsec3.SaltLength,
+				Salt:       s.nsec3.Salt,
+				HashLength: 20, // SHA-1
+				NextDomain: nxt.key,
+				TypeBitMap: l.types,
+			}
+		}
+		var err error
+		link.sigs, err = s.sign(s.zsks, []dns.RR{link.rr}, now)
+		if err != nil {
+			return nil, err
+		}
+		var oldrrs []dns.RR
+		if ol != nil {
+			oldrrs = append([]dns.RR{ol.rr}, ol.sigs...)
+		}
+		replace(oldrrs, append([]dns.RR{link.rr}, link.sigs...))
+		links[i] = link
+	}
+
+	// Records for names that are gone
+	for _, l := range old {
+		if !present[l.key] {
+			replace(append([]dns.RR{l.rr}, l.sigs...), nil)
+		}
+	}
+	return links, nil
+}
+
+func chainNextOf(rr dns.RR) string {
+	switch rr := rr.(type) {
+	case *dns.NSEC:
+		return rr.NextDomain
+	case *dns.NSEC3:
+		return rr.NextDomain
+	}
+	return ""
+}
+
+// ResignRpz creates a new version of the output zone if any signatures in the current version
+// are about to expire. Returns true if there is a new version.
+func (rd *RpzData) ResignRpz() (bool, error) {
+	if rd.signer == nil {
+		return false, nil
+	}
+	rd.writer.Lock()
+	defer rd.writer.Unlock()
+
+	cur := rd.current.Load()
+	if cur.Signed != nil && !cur.Signed.expiring(rd.signer, time.Now()) {
+		return false, nil
+	}
+	next := rd.next()
+	next.ApplyIxfr(RpzIxfr{FromSerial: cur.Serial, ToSerial: cur.Serial + 1}) // XXX: not dealing with serial wraps
+	if err := rd.signNext(next, false); err != nil {
+		return false, err
+	}
+	rd.publish(next)
+	return true, nil
+}
+
+// expiring reports whether any signature must be refreshed.
+func (sz *SignedZone) expiring(s *RpzSigner, now time.Time) bool {
+	if !s.fresh(sz.soaSigs, now) || !s.fresh(sz.apex, now) {
+		return true
+	}
+	for _, sigs := range sz.ruleSigs {
+		if !s.fresh(sigs, now) {
+			return true
+		}
+	}
+	for _, l := range sz.chain {
+		if !s.fresh(l.sigs, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// ChainRRs returns the NSEC or NSEC3 records with their RRSIGs in chain order.
+func (sz *SignedZone) ChainRRs() []dns.RR {
+	rrs := make([]dns.RR, 0, 2*len(sz.chain))
+	for _, l := range sz.chain {
+		rrs = append(rrs, l.rr)
+		rrs = append(rrs, l.sigs...)
+	}
+	return rrs
+}
+
+// apexRRset returns the records of type t at the apex and their RRSIGs.
+func (sz *SignedZone) apexRRset(t uint16) (rrs, sigs []dns.RR) {
+	for _, rr := range sz.apex {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if sig.TypeCovered == t {
+				sigs = append(sigs, rr)
+			}
+		} else if rr.Header().Rrtype == t {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, sigs
+}
+
+// link returns the chain record for the name with key and whether it matches. If it does not
+// match, the record returned covers key.
+func (sz *SignedZone) link(key string) (*chainLink, bool) {
+	i, found := slices.BinarySearchFunc(sz.chain, key, func(l *chainLink, key string) int {
+		return strings.Compare(l.key, key)
+	})
+	if found {
+		return sz.chain[i], true
+	}
+	if i == 0 {
+		i = len(sz.chain) // before the first name, covered by the last record
+	}
+	return sz.chain[i-1], false
+}
+
+// denial returns the NSEC or NSEC3 records (with RRSIGs) that prove that qname does not exist
+// (nxdomain) or that qname has no records of the queried type.
+func (s *RpzSigner) denial(sz *SignedZone, qname string, nxdomain bool) []dns.RR {
+	var links []*chainLink
+	add := func(l *chainLink) {
+		if !slices.Contains(links, l) {
+			links = append(links, l)
+		}
+	}
+	qname = strings.ToLower(qname)
+	switch {
+	case !nxdomain:
+		_, key := s.chainName(qname)
+		if l, match := sz.link(key); match {
+			add(l)
+		}
+	case s.nsec3 == nil:
+		l, _ := sz.link(canonicalKey(qname))
+		add(l)
+		// No wildcard below the closest encloser, the longest ancestor of qname that exists
+		ce := s.zone
+		for _, anc := range s.ancestors(qname) {
+			if _, match := sz.link(canonicalKey(anc)); match {
+				ce = anc
+				break
+			}
+		}
+		l, _ = sz.link(canonicalKey("*." + ce))
+		add(l)
+	default:
+		// RFC 5155, section 7.2.2: the closest encloser, the next closer name and the wildcard
+		nextCloser := qname
+		ce := s.zone
+		for _, anc := range s.ancestors(qname) {
+			_, key := s.chainName(anc)
+			if _, match := sz.link(key); match {
+				ce = anc
+				break
+			}
+			nextCloser = anc
+		}
+		for _, name := range []string{ce, nextCloser, "*." + ce} {
+			_, key := s.chainName(name)
+			l, _ := sz.link(key)
+			add(l)
+		}
+	}
+	var rrs []dns.RR
+	for _, l := range links {
+		rrs = append(rrs, l.rr)
+		rrs = append(rrs, l.sigs...)
+	}
+	return rrs
+}
+
+// dnssecOK reports whether the query asks for DNSSEC records (the DO bit) and adds an EDNS(0)
+// OPT RR to the response if the query has one.
+func dnssecOK(r, m *dns.Msg) bool {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	m.SetEdns0(max(opt.UDPSize(), dns.MinMsgSize), opt.Do())
+	return opt.Do()
+}
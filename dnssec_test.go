@@ -0,0 +1,319 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// writeTestKey generates an ECDSA P-256 key for the test RPZ zone and writes it in BIND format.
+// Returns the file name prefix.
+func writeTestKey(t *testing.T, dir string, flags uint16) string {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: testRpzZone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("DNSKEY.Generate: %v", err)
+	}
+	prefix := filepath.Join(dir, fmt.Sprintf("K%s+%03d+%05d", testRpzZone, key.Algorithm, key.KeyTag()))
+	if err := os.WriteFile(prefix+".key", []byte(key.String()+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(prefix+".private", []byte(key.PrivateKeyString(priv)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return prefix
+}
+
+// signedConfig returns a config function for newPopData that turns on signing with a KSK and a ZSK.
+func signedConfig(t *testing.T, denial string) func() {
+	dir := t.TempDir()
+	keys := []string{writeTestKey(t, dir, 257), writeTestKey(t, dir, 256)}
+	return func() {
+		viper.Set("services.rpz.dnssec.active", true)
+		viper.Set("services.rpz.dnssec.keys", keys)
+		viper.Set("services.rpz.dnssec.denial", denial)
+		viper.Set("services.rpz.dnssec.nsec3salt", "cafe")
+		viper.Set("services.rpz.dnssec.validity", "240h")
+		viper.Set("services.rpz.dnssec.refresh", "24h")
+	}
+}
+
+// verifySignedZone checks that every RRset in the zone transfer rrs is signed with valid
+// signatures and that the NSEC or NSEC3 chain covers all names and is closed.
+func verifySignedZone(t *testing.T, rrs []dns.RR) {
+	t.Helper()
+	type rrsetKey struct {
+		name  string
+		rtype uint16
+	}
+	rrsets := map[rrsetKey][]dns.RR{}
+	sigs := map[rrsetKey][]*dns.RRSIG{}
+	keys := map[uint16]*dns.DNSKEY{}
+	names := map[string]bool{}
+	for _, rr := range rrs[:len(rrs)-1] { // the trailing SOA is the same as the leading one
+		hdr := rr.Header()
+		switch rr := rr.(type) {
+		case *dns.RRSIG:
+			k := rrsetKey{strings.ToLower(hdr.Name), rr.TypeCovered}
+			sigs[k] = append(sigs[k], rr)
+			continue
+		case *dns.DNSKEY:
+			keys[rr.KeyTag()] = rr
+		}
+		k := rrsetKey{strings.ToLower(hdr.Name), hdr.Rrtype}
+		rrsets[k] = append(rrsets[k], rr)
+		if hdr.Rrtype != dns.TypeNSEC3 {
+			names[k.name] = true
+		}
+	}
+	if len(keys) == 0 {
+		t.Fatalf("no DNSKEYs in the zone")
+	}
+
+	for k, rrset := range rrsets {
+		if len(sigs[k]) == 0 {
+			t.Errorf("%s %s is not signed", k.name, dns.TypeToString[k.rtype])
+			continue
+		}
+		for _, sig := range sigs[k] {
+			key := keys[sig.KeyTag]
+			if key == nil {
+				t.Errorf("RRSIG over %s %s by unknown key %d", k.name, dns.TypeToString[k.rtype], sig.KeyTag)
+				continue
+			}
+			if err := sig.Verify(key, rrset); err != nil {
+				t.Errorf("RRSIG over %s %s does not verify: %v", k.name, dns.TypeToString[k.rtype], err)
+			}
+			if !sig.ValidityPeriod(time.Now()) {
+				t.Errorf("RRSIG over %s %s is not valid now", k.name, dns.TypeToString[k.rtype])
+			}
+		}
+		delete(sigs, k)
+	}
+	for k := range sigs {
+		t.Errorf("RRSIG over %s %s, which is not in the zone", k.name, dns.TypeToString[k.rtype])
+	}
+
+	// The chain
+	var nsec3param *dns.NSEC3PARAM
+	next := map[string]string{}
+	for k, rrset := range rrsets {
+		switch rr := rrset[0].(type) {
+		case *dns.NSEC:
+			next[k.name] = strings.ToLower(rr.NextDomain)
+		case *dns.NSEC3:
+			next[strings.ToUpper(dns.SplitDomainName(k.name)[0])] = rr.NextDomain
+		case *dns.NSEC3PARAM:
+			nsec3param = rr
+		}
+	}
+	var want []string // the names or hashes in the chain
+	for name := range names {
+		if nsec3param == nil {
+			want = append(want, name)
+			continue
+		}
+		want = append(want, dns.HashName(name, nsec3param.Hash, nsec3param.Iterations, nsec3param.Salt))
+		for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+			if anc := name[off:]; len(anc) > len(testRpzZone) && !names[anc] { // empty non-terminal
+				want = append(want, dns.HashName(anc, nsec3param.Hash, nsec3param.Iterations, nsec3param.Salt))
+			}
+		}
+	}
+	slices.Sort(want)
+	want = slices.Compact(want)
+	if len(next) != len(want) {
+		t.Errorf("chain has %d records, want %d", len(next), len(want))
+	}
+	start := testRpzZone
+	if nsec3param != nil {
+		start = want[0]
+	}
+	cur, seen := start, 0
+	for {
+		nxt, exist := next[cur]
+		if !exist {
+			t.Fatalf("chain is broken at %s", cur)
+		}
+		seen++
+		if cur = nxt; cur == start || seen > len(next) {
+			break
+		}
+	}
+	if seen != len(want) {
+		t.Errorf("chain from %s has %d records, want %d", start, seen, len(want))
+	}
+}
+
+// applyIxfr applies the IXFR rrs to the zone, a set of RRs in presentation format. SOAs are
+// not part of the zone.
+func applyIxfr(t *testing.T, zone map[string]bool, rrs []dns.RR) {
+	t.Helper()
+	soas := 0
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		if _, ok := rr.(*dns.SOA); ok {
+			soas++
+			continue
+		}
+		if soas%2 == 1 {
+			if !zone[rr.String()] {
+				t.Errorf("IXFR removes an RR that is not in the zone: %s", rr)
+			}
+			delete(zone, rr.String())
+		} else {
+			zone[rr.String()] = true
+		}
+	}
+}
+
+func zoneSet(rrs []dns.RR) map[string]bool {
+	zone := map[string]bool{}
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.SOA); !ok {
+			zone[rr.String()] = true
+		}
+	}
+	return zone
+}
+
+func TestSignedOutput(t *testing.T) {
+	for _, denial := range []string{"nsec", "nsec3"} {
+		t.Run(denial, func(t *testing.T) {
+			pd, _ := newPopData(t, signedConfig(t, denial))
+			tp := &testPop{pd: pd}
+			feed := tp.addList("doubtlist", "dns-tapir", "mqtt")
+			for _, name := range []string{"one.example.org.", "deep.down.below.example.org.", "two.example.net."} {
+				feed.Names[name] = tapir.TapirName{Name: name, Action: tapir.NXDOMAIN}
+			}
+			if _, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup}); err != nil {
+				t.Fatalf("GenerateRpzAxfr: %v", err)
+			}
+			axfrOut := func() []dns.RR {
+				m := new(dns.Msg)
+				m.SetAxfr(testRpzZone)
+				rw := &recordingWriter{}
+				if _, _, err := pd.RpzAxfrOut(rw, m); err != nil {
+					t.Fatalf("RpzAxfrOut: %v", err)
+				}
+				return rw.rrs()
+			}
+			before := axfrOut()
+			verifySignedZone(t, before)
+			fromSerial := pd.Rpz.CurrentSerial()
+
+			// Incremental changes: a new name with new empty non-terminals, and a removed name
+			feed.Names["new.name.example.com."] = tapir.TapirName{Name: "new.name.example.com.", Action: tapir.NXDOMAIN}
+			delete(feed.Names, "deep.down.below.example.org.")
+			if _, err := pd.GenerateRpzIxfr(&tapir.TapirMsg{
+				Added:   []tapir.Domain{{Name: "new.name.example.com."}},
+				Removed: []tapir.Domain{{Name: "deep.down.below.example.org."}},
+			}, PolicyTrigger{Kind: TriggerMqtt, Source: "dns-tapir"}); err != nil {
+				t.Fatalf("GenerateRpzIxfr: %v", err)
+			}
+			after := axfrOut()
+			verifySignedZone(t, after)
+
+			// Expiring signatures are refreshed in a new version
+			if resigned, err := pd.Rpz.ResignRpz(); err != nil || resigned {
+				t.Fatalf("ResignRpz with fresh signatures: %v, %v; want false", resigned, err)
+			}
+			pd.Rpz.signer.refresh = pd.Rpz.signer.validity - time.Minute
+			if resigned, err := pd.Rpz.ResignRpz(); err != nil || !resigned {
+				t.Fatalf("ResignRpz with expiring signatures: %v, %v; want true", resigned, err)
+			}
+			pd.Rpz.signer.refresh = 24 * time.Hour
+			if pd.Rpz.CurrentSerial() != fromSerial+2 {
+				t.Errorf("serial after re-signing is %d, want %d", pd.Rpz.CurrentSerial(), fromSerial+2)
+			}
+			resigned := axfrOut()
+			verifySignedZone(t, resigned)
+
+			// The IXFRs take a downstream from the first version to the last
+			m := new(dns.Msg)
+			m.SetIxfr(testRpzZone, fromSerial, "ns."+testRpzZone, "hostmaster."+testRpzZone)
+			rw := &recordingWriter{}
+			if _, _, err := pd.RpzIxfrOut(rw, m); err != nil {
+				t.Fatalf("RpzIxfrOut: %v", err)
+			}
+			zone := zoneSet(before)
+			applyIxfr(t, zone, rw.rrs())
+			want := zoneSet(resigned)
+			for rr := range want {
+				if !zone[rr] {
+					t.Errorf("IXFR result is missing %s", rr)
+				}
+			}
+			for rr := range zone {
+				if !want[rr] {
+					t.Errorf("IXFR result has %s, which is not in the zone", rr)
+				}
+			}
+		})
+	}
+}
+
+func TestSignedQueries(t *testing.T) {
+	pd, _ := newPopData(t, signedConfig(t, "nsec"))
+	tp := &testPop{pd: pd}
+	feed := tp.addList("doubtlist", "dns-tapir", "mqtt")
+	feed.Names["bad.example.org."] = tapir.TapirName{Name: "bad.example.org.", Action: tapir.NXDOMAIN}
+	if _, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup}); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+
+	query := func(qname string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(qname, qtype)
+		m.SetEdns0(1232, true)
+		rw := &recordingWriter{}
+		if err := pd.QueryResponder(rw, m, qname, qtype, testLogger()); err != nil {
+			t.Fatalf("QueryResponder: %v", err)
+		}
+		return rw.msgs[0]
+	}
+
+	r := query("bad.example.org."+testRpzZone, dns.TypeCNAME)
+	if len(r.Answer) != 2 || r.Answer[1].Header().Rrtype != dns.TypeRRSIG {
+		t.Errorf("answer to a signed rule: %v, want the CNAME and its RRSIG", r.Answer)
+	}
+
+	r = query("ns1."+testRpzZone, dns.TypeAAAA)
+	if len(r.Answer) != 2 || r.Answer[0].Header().Rrtype != dns.TypeAAAA || r.Answer[1].Header().Rrtype != dns.TypeRRSIG {
+		t.Errorf("answer to a query for the nameserver address: %v, want the AAAA and its RRSIG", r.Answer)
+	}
+
+	qname := "good.example.org." + testRpzZone
+	r = query(qname, dns.TypeCNAME)
+	if r.Rcode != dns.RcodeNameError {
+		t.Fatalf("rcode %s for a name that does not exist", dns.RcodeToString[r.Rcode])
+	}
+	covered := false
+	for _, rr := range r.Ns {
+		if nsec, ok := rr.(*dns.NSEC); ok &&
+			canonicalKey(nsec.Hdr.Name) < canonicalKey(qname) &&
+			(canonicalKey(qname) < canonicalKey(nsec.NextDomain) || nsec.NextDomain == testRpzZone) {
+			covered = true
+		}
+	}
+	if !covered {
+		t.Errorf("NXDOMAIN for %s has no NSEC that covers it: %v", qname, r.Ns)
+	}
+}
@@ -0,0 +1,578 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dnstapir/tapir"
+)
+
+// The bootstrap export of a list ("export-doubtlist") comes in three encodings:
+//
+//   - "gob": the tapir.WBGlist as a gob, which only works between peers with identical versions
+//     of tapir.WBGlist. Kept for compatibility.
+//   - "json": newline delimited JSON, an ExportHeader followed by one ExportName per line.
+//   - "binary": the magic "TAPX", then length-prefixed records (the length as an unsigned
+//     varint): an ExportHeader followed by one ExportName per record, see appendExportName.
+//
+// The json and binary encodings are versioned (ExportVersion) and language neutral. The client
+// sends the encodings it accepts, in order of preference and separated by commas, as
+// BootstrapPost.Encoding, and the server uses the first one it supports. The client recognizes
+// the encoding from the start of the response (ReadExport).
+//
+// The json and binary exports are taken from an ExportSnapshot of the list, so the server only
+// holds the lock on the lists while it copies the names, not while it sends them. The client may
+// fetch the snapshot in chunks (ExportPost), and continue with the same snapshot after an
+// interrupted download. The header of every chunk has the position of the MQTT updates of the list
+// when the snapshot was taken, so that the client can skip the updates that are already in it.
+// If the server has a signing key, the header also has a signature over the whole snapshot,
+// see exportSigningInput.
+
+// ExportVersion 1 has no snapshots; its header has no Snapshot, Offset, Total and Position.
+// Version 2 has no Signature.
+const ExportVersion = 3
+
+const (
+	exportMagic     = "TAPX"
+	exportJsonMagic = "tapir-list-export"
+)
+
+// ExportEncodings are the encodings of the bootstrap export that the server supports.
+var ExportEncodings = []string{"binary", "json", "gob"}
+
+// ExportHeader describes an exported list, or a chunk of it.
+type ExportHeader struct {
+	Export    string // exportJsonMagic in the json encoding
+	Version   int
+	Name      string // the name of the list
+	Type      string // the list type
+	Format    string // the format of the list, e.g. "map" or "cidr"
+	Time      time.Time
+	Count     int          // the number of names that follow
+	Snapshot  string       // the ID of the snapshot, see ExportPost
+	Offset    int          // the index in the snapshot of the first name that follows
+	Total     int          // the number of names in the snapshot
+	Position  ListPosition // of the list when the snapshot was taken
+	Signature string       // detached JWS over the snapshot, see exportSigningInput
+}
+
+// ListPosition is how far the MQTT updates of a list have come.
+type ListPosition struct {
+	Updates uint64    // the number of updates applied
+	Time    time.Time // the time stamp of the latest one
+}
+
+// ExportPost is the request for an export ("export-doubtlist") or a digest ("doubtlist-digest",
+// see ListDigest). It is a tapir.BootstrapPost with the type of the list (despite the names of
+// the commands, any list type) and the (optional) part of a snapshot to send.
+type ExportPost struct {
+	tapir.BootstrapPost
+	ListType string    // "allowlist", "denylist" or "doubtlist"; empty means "doubtlist"
+	Snapshot string    // continue with this snapshot; empty means a new one
+	Offset   int       // the index of the first name to send
+	Limit    int       // the max number of names to send, 0 means all
+	At       time.Time // the time of the digest, see ListDigest
+}
+
+func (bp ExportPost) listType() string {
+	if bp.ListType == "" {
+		return "doubtlist" // from before ListType
+	}
+	return bp.ListType
+}
+
+// ListExport is a decoded export, or chunk of an export.
+type ListExport struct {
+	ExportHeader
+	List     *tapir.WBGlist
+	Encoding string
+}
+
+// ExportName is a name in an exported list.
+type ExportName struct {
+	Name         string
+	TimeAdded    time.Time
+	TTL          int64 // seconds
+	TagMask      uint32
+	ExtendedTags []string `json:",omitempty"`
+}
+
+// NegotiateExportEncoding returns the first of the comma separated encodings in accept that the
+// server supports. An empty accept means gob, which is what old clients expect.
+func NegotiateExportEncoding(accept string) (string, error) {
+	if strings.TrimSpace(accept) == "" {
+		return "gob", nil
+	}
+	for _, enc := range strings.Split(accept, ",") {
+		enc = strings.ToLower(strings.TrimSpace(enc))
+		if slices.Contains(ExportEncodings, enc) {
+			return enc, nil
+		}
+	}
+	return "", fmt.Errorf("none of the encodings %q is supported (supported: %s)", accept,
+		strings.Join(ExportEncodings, ", "))
+}
+
+// ExportContentType returns the HTTP Content-Type of an export in the encoding enc.
+func ExportContentType(enc string) string {
+	if enc == "json" {
+		return "application/x-ndjson"
+	}
+	return "application/octet-stream"
+}
+
+// ExportSnapshot is a copy of the names of a list at one point in time, sorted by name.
+type ExportSnapshot struct {
+	hdr     ExportHeader
+	names   []ExportName
+	expires time.Time
+}
+
+// NewExportSnapshot copies the names of wbgl, which is at the position pos, except the rpz-ip
+// entries derived here (see badipSrcFormat). Must be called with pd.mu held (for reading); the
+// names are sorted later, see ExportSnapshots.Add.
+func NewExportSnapshot(wbgl *tapir.WBGlist, pos ListPosition) *ExportSnapshot {
+	snap := &ExportSnapshot{
+		hdr: ExportHeader{
+			Version:  ExportVersion,
+			Name:     wbgl.Name,
+			Type:     wbgl.Type,
+			Format:   wbgl.Format,
+			Time:     time.Now().UTC(),
+			Total:    len(wbgl.Names),
+			Position: pos,
+		},
+		names: make([]ExportName, 0, len(wbgl.Names)),
+	}
+	for _, tn := range wbgl.Names {
+		if tn.SrcFormat == badipSrcFormat {
+			continue
+		}
+		snap.names = append(snap.names, exportName(tn))
+	}
+	snap.hdr.Total = len(snap.names)
+	return snap
+}
+
+func (snap *ExportSnapshot) sort() {
+	slices.SortFunc(snap.names, func(a, b ExportName) int { return strings.Compare(a.Name, b.Name) })
+}
+
+const (
+	exportSnapshotTtl  = 10 * time.Minute // after the last request for it
+	maxExportSnapshots = 8
+)
+
+// ExportSnapshots are the snapshots that clients are fetching. A snapshot expires
+// exportSnapshotTtl after the last request for it, and there are at most maxExportSnapshots;
+// the one that expires first is dropped to make room for a new one.
+type ExportSnapshots struct {
+	mu    sync.Mutex
+	snaps map[string]*ExportSnapshot
+}
+
+// Add sorts snap, signs it with signer (unless nil), gives it an ID and keeps it.
+func (es *ExportSnapshots) Add(snap *ExportSnapshot, signer *ecdsa.PrivateKey) error {
+	snap.sort()
+	if signer != nil {
+		sig, err := signDetachedJws(signer, exportSigningInput(snap.hdr, snap.names))
+		if err != nil {
+			return fmt.Errorf("error signing the export of %s: %v", snap.hdr.Name, err)
+		}
+		snap.hdr.Signature = sig
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	snap.hdr.Snapshot = hex.EncodeToString(id)
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.snaps == nil {
+		es.snaps = map[string]*ExportSnapshot{}
+	}
+	es.expire()
+	for len(es.snaps) >= maxExportSnapshots {
+		var first string
+		for id, s := range es.snaps {
+			if first == "" || s.expires.Before(es.snaps[first].expires) {
+				first = id
+			}
+		}
+		delete(es.snaps, first)
+	}
+	snap.expires = time.Now().Add(exportSnapshotTtl)
+	es.snaps[snap.hdr.Snapshot] = snap
+	return nil
+}
+
+// Get returns the snapshot with the ID id, unless it has expired.
+func (es *ExportSnapshots) Get(id string) (*ExportSnapshot, bool) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.expire()
+	snap, exist := es.snaps[id]
+	if exist {
+		snap.expires = time.Now().Add(exportSnapshotTtl)
+	}
+	return snap, exist
+}
+
+// expire drops the expired snapshots. Must be called with es.mu held.
+func (es *ExportSnapshots) expire() {
+	now := time.Now()
+	for id, snap := range es.snaps {
+		if now.After(snap.expires) {
+			delete(es.snaps, id)
+		}
+	}
+}
+
+// WriteExport writes at most limit (0 means all) names of snap, from the index offset, to w in
+// the encoding enc, which is "json" or "binary".
+func WriteExport(w io.Writer, enc string, snap *ExportSnapshot, offset, limit int) error {
+	if offset < 0 || offset > len(snap.names) {
+		return fmt.Errorf("offset %d is outside snapshot %s with %d names", offset, snap.hdr.Snapshot, len(snap.names))
+	}
+	names := snap.names[offset:]
+	if limit > 0 && limit < len(names) {
+		names = names[:limit]
+	}
+	hdr := snap.hdr
+	hdr.Offset = offset
+	hdr.Count = len(names)
+	bw := bufio.NewWriter(w)
+
+	switch enc {
+	case "json":
+		hdr.Export = exportJsonMagic
+		je := json.NewEncoder(bw)
+		if err := je.Encode(hdr); err != nil {
+			return err
+		}
+		for _, en := range names {
+			if err := je.Encode(en); err != nil {
+				return err
+			}
+		}
+
+	case "binary":
+		bw.WriteString(exportMagic)
+		if err := writeRecord(bw, appendExportHeader(nil, hdr)); err != nil {
+			return err
+		}
+		var rec []byte
+		for _, en := range names {
+			rec = appendExportName(rec[:0], en)
+			if err := writeRecord(bw, rec); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("unknown export encoding %q", enc)
+	}
+	return bw.Flush()
+}
+
+// ReadExport decodes an exported list, or chunk of a list, in any of the encodings.
+func ReadExport(buf []byte) (*ListExport, error) {
+	var le *ListExport
+	var err error
+	switch {
+	case bytes.HasPrefix(buf, []byte(exportMagic)):
+		le, err = readBinaryExport(bytes.NewReader(buf[len(exportMagic):]))
+		if le != nil {
+			le.Encoding = "binary"
+		}
+
+	case bytes.HasPrefix(bytes.TrimSpace(buf), []byte("{")):
+		le, err = readJsonExport(bytes.NewReader(buf))
+		if le != nil {
+			le.Encoding = "json"
+		}
+
+	default:
+		var wbgl tapir.WBGlist
+		if err = gob.NewDecoder(bytes.NewReader(buf)).Decode(&wbgl); err != nil {
+			return nil, err
+		}
+		le = &ListExport{
+			ExportHeader: ExportHeader{Name: wbgl.Name, Type: wbgl.Type, Format: wbgl.Format,
+				Count: len(wbgl.Names), Total: len(wbgl.Names)},
+			List:     &wbgl,
+			Encoding: "gob",
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if le.Version < 2 {
+		le.Total = le.Count // the whole list
+	}
+	return le, nil
+}
+
+func exportName(tn tapir.TapirName) ExportName {
+	return ExportName{
+		Name:         tn.Name,
+		TimeAdded:    tn.TimeAdded,
+		TTL:          int64(tn.TTL / time.Second),
+		TagMask:      uint32(tn.TagMask),
+		ExtendedTags: tn.ExtendedTags,
+	}
+}
+
+func (en ExportName) tapirName() tapir.TapirName {
+	return tapir.TapirName{
+		Name:         en.Name,
+		TimeAdded:    en.TimeAdded,
+		TTL:          time.Duration(en.TTL) * time.Second,
+		TagMask:      tapir.TagMask(en.TagMask),
+		ExtendedTags: en.ExtendedTags,
+	}
+}
+
+// newListExport returns an export with an empty list as described by hdr.
+func newListExport(hdr ExportHeader) (*ListExport, error) {
+	if hdr.Version < 1 || hdr.Version > ExportVersion {
+		return nil, fmt.Errorf("unsupported export version %d", hdr.Version)
+	}
+	return &ListExport{
+		ExportHeader: hdr,
+		List: &tapir.WBGlist{
+			Name:       hdr.Name,
+			Type:       hdr.Type,
+			Format:     hdr.Format,
+			Names:      make(map[string]tapir.TapirName, hdr.Count),
+			ReaperData: map[time.Time]map[string]bool{},
+		},
+	}, nil
+}
+
+func readJsonExport(r io.Reader) (*ListExport, error) {
+	dec := json.NewDecoder(r)
+	var hdr ExportHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return nil, fmt.Errorf("error decoding export header: %v", err)
+	}
+	if hdr.Export != exportJsonMagic {
+		return nil, fmt.Errorf("not a list export")
+	}
+	le, err := newListExport(hdr)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < hdr.Count; i++ {
+		var en ExportName
+		if err := dec.Decode(&en); err != nil {
+			return nil, fmt.Errorf("error decoding name %d of %d: %v", i+1, hdr.Count, err)
+		}
+		le.List.Names[en.Name] = en.tapirName()
+	}
+	return le, nil
+}
+
+func readBinaryExport(r *bytes.Reader) (*ListExport, error) {
+	rec, err := readRecord(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading export header: %v", err)
+	}
+	var hdr ExportHeader
+	if err := parseExportHeader(rec, &hdr); err != nil {
+		return nil, fmt.Errorf("error decoding export header: %v", err)
+	}
+	le, err := newListExport(hdr)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < hdr.Count; i++ {
+		rec, err := readRecord(r)
+		if err == nil {
+			var en ExportName
+			if err = parseExportName(rec, &en); err == nil {
+				le.List.Names[en.Name] = en.tapirName()
+				continue
+			}
+		}
+		return nil, fmt.Errorf("error decoding name %d of %d: %v", i+1, hdr.Count, err)
+	}
+	return le, nil
+}
+
+// The binary records are sequences of fields: strings (length-prefixed), unsigned and signed
+// integers, all as varints. A header record is version, name, type, format, time (Unix
+// seconds), count, and from version 2 snapshot, offset, total, the number of updates and the time
+// of the latest update (Unix nanoseconds) of the position, and from version 3 the signature. A
+// name record is name, time added (Unix seconds, 0 if unknown), TTL, tag mask,
+// and the number of extended tags followed by the tags.
+
+func writeRecord(w *bufio.Writer, rec []byte) error {
+	if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(rec)))); err != nil {
+		return err
+	}
+	_, err := w.Write(rec)
+	return err
+}
+
+func readRecord(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	rec := make([]byte, n)
+	_, err = io.ReadFull(r, rec)
+	return rec, err
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(binary.AppendUvarint(b, uint64(len(s))), s...)
+}
+
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnix(secs int64) time.Time {
+	if secs == 0 {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0).UTC()
+}
+
+func appendExportHeader(b []byte, hdr ExportHeader) []byte {
+	b = binary.AppendUvarint(b, uint64(hdr.Version))
+	b = appendString(b, hdr.Name)
+	b = appendString(b, hdr.Type)
+	b = appendString(b, hdr.Format)
+	b = binary.AppendVarint(b, unixTime(hdr.Time))
+	b = binary.AppendUvarint(b, uint64(hdr.Count))
+	b = appendString(b, hdr.Snapshot)
+	b = binary.AppendUvarint(b, uint64(hdr.Offset))
+	b = binary.AppendUvarint(b, uint64(hdr.Total))
+	b = binary.AppendUvarint(b, hdr.Position.Updates)
+	var nanos int64
+	if !hdr.Position.Time.IsZero() {
+		nanos = hdr.Position.Time.UnixNano()
+	}
+	b = binary.AppendVarint(b, nanos)
+	return appendString(b, hdr.Signature)
+}
+
+func appendExportName(b []byte, en ExportName) []byte {
+	b = appendString(b, en.Name)
+	b = binary.AppendVarint(b, unixTime(en.TimeAdded))
+	b = binary.AppendVarint(b, en.TTL)
+	b = binary.AppendUvarint(b, uint64(en.TagMask))
+	b = binary.AppendUvarint(b, uint64(len(en.ExtendedTags)))
+	for _, tag := range en.ExtendedTags {
+		b = appendString(b, tag)
+	}
+	return b
+}
+
+// recordParser reads the fields of a binary record. The first error sticks.
+type recordParser struct {
+	b   []byte
+	err error
+}
+
+func (p *recordParser) uvarint() uint64 {
+	if p.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(p.b)
+	if n <= 0 {
+		p.err = fmt.Errorf("truncated record")
+		return 0
+	}
+	p.b = p.b[n:]
+	return v
+}
+
+func (p *recordParser) varint() int64 {
+	if p.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(p.b)
+	if n <= 0 {
+		p.err = fmt.Errorf("truncated record")
+		return 0
+	}
+	p.b = p.b[n:]
+	return v
+}
+
+func (p *recordParser) string() string {
+	n := p.uvarint()
+	if p.err != nil {
+		return ""
+	}
+	if n > uint64(len(p.b)) {
+		p.err = fmt.Errorf("truncated record")
+		return ""
+	}
+	s := string(p.b[:n])
+	p.b = p.b[n:]
+	return s
+}
+
+func parseExportHeader(rec []byte, hdr *ExportHeader) error {
+	p := recordParser{b: rec}
+	hdr.Version = int(p.uvarint())
+	hdr.Name = p.string()
+	hdr.Type = p.string()
+	hdr.Format = p.string()
+	hdr.Time = fromUnix(p.varint())
+	hdr.Count = int(p.uvarint())
+	if hdr.Version >= 2 {
+		hdr.Snapshot = p.string()
+		hdr.Offset = int(p.uvarint())
+		hdr.Total = int(p.uvarint())
+		hdr.Position.Updates = p.uvarint()
+		if nanos := p.varint(); nanos != 0 {
+			hdr.Position.Time = time.Unix(0, nanos).UTC()
+		}
+	}
+	if hdr.Version >= 3 {
+		hdr.Signature = p.string()
+	}
+	return p.err
+}
+
+func parseExportName(rec []byte, en *ExportName) error {
+	p := recordParser{b: rec}
+	en.Name = p.string()
+	en.TimeAdded = fromUnix(p.varint())
+	en.TTL = p.varint()
+	en.TagMask = uint32(p.uvarint())
+	ntags := p.uvarint()
+	if ntags > uint64(len(p.b)) {
+		return fmt.Errorf("truncated record")
+	}
+	for i := uint64(0); i < ntags && p.err == nil; i++ {
+		en.ExtendedTags = append(en.ExtendedTags, p.string())
+	}
+	return p.err
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+)
+
+func testExportList() *tapir.WBGlist {
+	added := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	return &tapir.WBGlist{
+		Name:   "dns-tapir",
+		Type:   "doubtlist",
+		Format: "map",
+		Names: map[string]tapir.TapirName{
+			"evil.example.":        {Name: "evil.example.", TimeAdded: added, TTL: time.Hour, TagMask: 5},
+			"tagged.example.":      {Name: "tagged.example.", TimeAdded: added, TTL: 90 * time.Second, ExtendedTags: []string{"a", "b"}},
+			"24.0.2.0.192.rpz-ip.": {Name: "24.0.2.0.192.rpz-ip."}, // no lifetime
+		},
+		ReaperData: map[time.Time]map[string]bool{},
+	}
+}
+
+func TestExportEncodings(t *testing.T) {
+	want := testExportList()
+	pos := ListPosition{Updates: 7, Time: time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)}
+	var es ExportSnapshots
+	snap := NewExportSnapshot(want, pos)
+	if err := es.Add(snap, nil); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	for _, enc := range ExportEncodings {
+		var buf bytes.Buffer
+		var err error
+		if enc == "gob" {
+			err = gob.NewEncoder(&buf).Encode(want)
+		} else {
+			err = WriteExport(&buf, enc, snap, 0, 0)
+		}
+		if err != nil {
+			t.Fatalf("WriteExport(%s): %v", enc, err)
+		}
+		le, err := ReadExport(buf.Bytes())
+		if err != nil || le.Encoding != enc {
+			t.Fatalf("ReadExport of %s: %v", enc, err)
+		}
+		got := le.List
+		if got.Name != want.Name || got.Type != want.Type || got.Format != want.Format || len(got.Names) != len(want.Names) || le.Total != 3 {
+			t.Errorf("%s: got list %s (%s, %s) with %d of %d names", enc, got.Name, got.Type, got.Format, len(got.Names), le.Total)
+		}
+		if enc != "gob" && (le.Snapshot != snap.hdr.Snapshot || le.Position != pos) {
+			t.Errorf("%s: snapshot %q at %+v, want %q at %+v", enc, le.Snapshot, le.Position, snap.hdr.Snapshot, pos)
+		}
+		for name, wtn := range want.Names {
+			gtn := got.Names[name]
+			if gtn.Name != name || !gtn.TimeAdded.Equal(wtn.TimeAdded) || gtn.TTL != wtn.TTL ||
+				gtn.TagMask != wtn.TagMask || !slices.Equal(gtn.ExtendedTags, wtn.ExtendedTags) {
+				t.Errorf("%s: %s is %+v, want %+v", enc, name, gtn, wtn)
+			}
+		}
+	}
+
+	// A chunk has the names in the order of the snapshot
+	for _, enc := range []string{"json", "binary"} {
+		var buf bytes.Buffer
+		if err := WriteExport(&buf, enc, snap, 1, 1); err != nil {
+			t.Fatalf("WriteExport(%s): %v", enc, err)
+		}
+		le, err := ReadExport(buf.Bytes())
+		if err != nil || le.Offset != 1 || le.Count != 1 || le.Total != 3 {
+			t.Fatalf("%s chunk: %+v, %v", enc, le, err)
+		}
+		if _, exist := le.List.Names["evil.example."]; !exist {
+			t.Errorf("%s chunk has %v, want the second name", enc, le.List.Names)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteExport(&buf, "binary", snap, 0, 0); err != nil {
+		t.Fatalf("WriteExport: %v", err)
+	}
+	if _, err := ReadExport(buf.Bytes()[:buf.Len()-3]); err == nil {
+		t.Errorf("ReadExport accepted a truncated binary export")
+	}
+	if _, err := ReadExport([]byte(`{"Status": "ok", "Error": true}`)); err == nil {
+		t.Errorf("ReadExport accepted a BootstrapResponse")
+	}
+	if got, exist := es.Get(snap.hdr.Snapshot); !exist || got != snap {
+		t.Errorf("snapshot %s not found", snap.hdr.Snapshot)
+	}
+}
+
+func TestNegotiateExportEncoding(t *testing.T) {
+	for accept, want := range map[string]string{
+		"":                  "gob",
+		"binary,json,gob":   "binary",
+		"protobuf, JSON":    "json",
+		"flatbuffer,binary": "binary",
+	} {
+		if enc, err := NegotiateExportEncoding(accept); err != nil || enc != want {
+			t.Errorf("NegotiateExportEncoding(%q) = %s, %v, want %s", accept, enc, err, want)
+		}
+	}
+	if enc, err := NegotiateExportEncoding("protobuf"); err == nil {
+		t.Errorf("NegotiateExportEncoding(protobuf) = %s, want an error", enc)
+	}
+}
+
+func TestBootstrapExport(t *testing.T) {
+	pd, conf := newPopData(t)
+	conf.PopData = pd
+	conf.Internal.ApiAuth = &ApiAuth{Logger: testLogger()}
+	list := testExportList()
+	pd.Lists["doubtlist"]["dns-tapir"] = list
+	pd.Positions[list] = ListPosition{Updates: 42, Time: time.Now().Add(-time.Minute).UTC()}
+	handler := APIbootstrap(conf)
+
+	var fail func(ExportPost) bool // fails the request if true
+	request := func(post ExportPost) (int, []byte, error) {
+		if fail != nil && fail(post) {
+			return 0, nil, fmt.Errorf("connection reset")
+		}
+		w := apiRequest(handler, RoleAdmin, "/api/v1/bootstrap", post)
+		return w.Code, w.Body.Bytes(), nil
+	}
+	post := func(encoding string) *httptest.ResponseRecorder {
+		return apiRequest(handler, RoleAdmin, "/api/v1/bootstrap",
+			tapir.BootstrapPost{Command: "export-doubtlist", ListName: "dns-tapir", Encoding: encoding})
+	}
+
+	for encoding, want := range map[string]string{"": "gob", "json,gob": "json", "binary": "binary"} {
+		w := post(encoding)
+		le, err := ReadExport(w.Body.Bytes())
+		if err != nil || le.Encoding != want || len(le.List.Names) != 3 {
+			t.Errorf("export with encoding %q: %v", encoding, err)
+			continue
+		}
+		if w.Header().Get("X-Tapir-Export-Encoding") != want || w.Header().Get("Content-Type") != ExportContentType(want) {
+			t.Errorf("export with encoding %q: headers %v", encoding, w.Header())
+		}
+	}
+
+	var br tapir.BootstrapResponse
+	if err := json.Unmarshal(post("protobuf").Body.Bytes(), &br); err != nil || !br.Error {
+		t.Errorf("export with an unsupported encoding: %+v, %v, want an error response", br, err)
+	}
+
+	// A download in chunks of one name that is interrupted after the first chunk continues with
+	// the same snapshot, also if the list changes meanwhile
+	defer func(size int, wait time.Duration) { exportChunkSize, exportRetryWait = size, wait }(exportChunkSize, exportRetryWait)
+	exportChunkSize, exportRetryWait = 1, 0
+	failed := false
+	fail = func(post ExportPost) bool {
+		if post.Offset == 1 && !failed {
+			failed = true
+			pd.mu.Lock()
+			list.Names["new.example."] = tapir.TapirName{Name: "new.example."}
+			pd.mu.Unlock()
+			return true
+		}
+		return false
+	}
+	le, err := pd.fetchExport("test", "doubtlist", "dns-tapir", request)
+	if err != nil {
+		t.Fatalf("fetchExport: %v", err)
+	}
+	if !failed || len(le.List.Names) != 3 || le.Total != 3 || le.Position != pd.Positions[list] {
+		t.Errorf("fetchExport: %d of %d names at %+v, want the 3 names at %+v", len(le.List.Names), le.Total, le.Position, pd.Positions[list])
+	}
+
+	// An expired snapshot starts the download over
+	fail = func(post ExportPost) bool {
+		if post.Offset == 2 && post.Snapshot == le.Snapshot {
+			pd.Exports.mu.Lock()
+			delete(pd.Exports.snaps, post.Snapshot)
+			pd.Exports.mu.Unlock()
+		}
+		return false
+	}
+	le2, err := pd.fetchExport("test", "doubtlist", "dns-tapir", request)
+	if err != nil || len(le2.List.Names) != 4 || le2.Snapshot == le.Snapshot {
+		t.Errorf("fetchExport after expiry: %v", err)
+	}
+
+	// The client applies only the updates that are newer than the snapshot
+	client, _ := newPopData(t)
+	ctp := &testPop{pd: client}
+	cl := ctp.addList("doubtlist", "dns-tapir", "mqtt")
+	client.mu.Lock()
+	client.importNames(cl, le.List.Names)
+	client.Bootstrapped[cl] = le.Position.Time
+	client.mu.Unlock()
+	if len(cl.ReaperData) != 2 {
+		t.Errorf("imported list has %d reaper time slots, want 2 (one per name with a lifetime)", len(cl.ReaperData))
+	}
+	for _, tc := range []struct {
+		name string
+		ts   time.Time
+		want bool
+	}{
+		{"old.example.", le.Position.Time.Add(-time.Second), false},
+		{"fresh.example.", le.Position.Time.Add(time.Second), true},
+	} {
+		client.mu.Lock()
+		_, err := client.applyTapirUpdate(tapir.TapirMsg{
+			SrcName:   "dns-tapir",
+			ListType:  "doubtlist",
+			TimeStamp: tc.ts,
+			Added:     []tapir.Domain{{Name: tc.name, TimeAdded: tc.ts, TTL: 3600}},
+		}, nil)
+		client.mu.Unlock()
+		if _, exist := cl.Names[tc.name]; err != nil || exist != tc.want {
+			t.Errorf("update with %s: in the list %t, want %t (%v)", tc.name, exist, tc.want, err)
+		}
+	}
+	if pos := client.Positions[cl]; pos.Updates != 1 {
+		t.Errorf("client position %+v, want 1 update", pos)
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/dnstapir/tapir"
+	"github.com/spf13/viper"
+)
+
+// The signature of an export is a detached JWS (RFC 7515, appendix F) in compact serialization,
+// "header..signature", made with the same kind of ECDSA keys that sign the MQTT messages. The
+// payload is the whole snapshot in a canonical form (exportSigningInput), so it is independent of
+// the encoding and of how the client fetches the snapshot in chunks.
+
+// exportSigningInput returns the payload of the signature of the snapshot described by hdr with
+// the names names (sorted by name): the binary header record of the snapshot without its ID,
+// signature and encoding details, followed by the length-prefixed binary name records.
+func exportSigningInput(hdr ExportHeader, names []ExportName) []byte {
+	b := appendExportHeader(nil, ExportHeader{
+		Name:     hdr.Name,
+		Type:     hdr.Type,
+		Format:   hdr.Format,
+		Time:     hdr.Time,
+		Count:    hdr.Total,
+		Total:    hdr.Total,
+		Position: hdr.Position,
+	})
+	var rec []byte
+	for _, en := range names {
+		rec = appendExportName(rec[:0], en)
+		b = binary.AppendUvarint(b, uint64(len(rec)))
+		b = append(b, rec...)
+	}
+	return b
+}
+
+// VerifyExport verifies the signature of the complete export le with the key key.
+func VerifyExport(le *ListExport, key *ecdsa.PublicKey) error {
+	if le.Signature == "" {
+		return fmt.Errorf("the export of %s is not signed", le.Name)
+	}
+	if len(le.List.Names) != le.Total {
+		return fmt.Errorf("the export of %s is incomplete, %d of %d names", le.Name, len(le.List.Names), le.Total)
+	}
+	names := make([]ExportName, 0, len(le.List.Names))
+	for _, tn := range le.List.Names {
+		names = append(names, exportName(tn))
+	}
+	slices.SortFunc(names, func(a, b ExportName) int { return strings.Compare(a.Name, b.Name) })
+	return verifyDetachedJws(le.Signature, exportSigningInput(le.ExportHeader, names), key)
+}
+
+// jwsAlgorithm returns the JWS algorithm and hash for ECDSA keys on curve.
+func jwsAlgorithm(curve elliptic.Curve) (string, crypto.Hash, error) {
+	switch curve {
+	case elliptic.P256():
+		return "ES256", crypto.SHA256, nil
+	case elliptic.P384():
+		return "ES384", crypto.SHA384, nil
+	case elliptic.P521():
+		return "ES512", crypto.SHA512, nil
+	}
+	return "", 0, fmt.Errorf("unsupported curve %s", curve.Params().Name)
+}
+
+func jwsSigningInput(header string, payload []byte) []byte {
+	return []byte(header + "." + base64.RawURLEncoding.EncodeToString(payload))
+}
+
+// signDetachedJws returns a detached JWS over payload made with key.
+func signDetachedJws(key *ecdsa.PrivateKey, payload []byte) (string, error) {
+	alg, hash, err := jwsAlgorithm(key.Curve)
+	if err != nil {
+		return "", err
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"alg":%q}`, alg)))
+	h := hash.New()
+	h.Write(jwsSigningInput(header, payload))
+	r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+	if err != nil {
+		return "", err
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	r.FillBytes(sig[:size])
+	s.FillBytes(sig[size:])
+	return header + ".." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// verifyDetachedJws verifies the detached JWS jws over payload with key.
+func verifyDetachedJws(jws string, payload []byte, key *ecdsa.PublicKey) error {
+	parts := strings.Split(jws, ".")
+	if len(parts) != 3 || parts[1] != "" {
+		return fmt.Errorf("not a detached JWS")
+	}
+	hdrjson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("error decoding the JWS header: %v", err)
+	}
+	var hdr struct {
+		Alg  string   `json:"alg"`
+		Crit []string `json:"crit"`
+	}
+	if err := json.Unmarshal(hdrjson, &hdr); err != nil {
+		return fmt.Errorf("error decoding the JWS header: %v", err)
+	}
+	alg, hash, err := jwsAlgorithm(key.Curve)
+	if err != nil {
+		return err
+	}
+	if hdr.Alg != alg || len(hdr.Crit) != 0 {
+		return fmt.Errorf("JWS algorithm %q does not match the %s key", hdr.Alg, alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	size := (key.Curve.Params().BitSize + 7) / 8
+	if err != nil || len(sig) != 2*size {
+		return fmt.Errorf("invalid JWS signature")
+	}
+	h := hash.New()
+	h.Write(jwsSigningInput(parts[0], payload))
+	r := new(big.Int).SetBytes(sig[:size])
+	s := new(big.Int).SetBytes(sig[size:])
+	if !ecdsa.Verify(key, h.Sum(nil), r, s) {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
+
+// exportValidatorKey returns the key that the exports of the MQTT source src must be signed
+// with: the validator key of the source, or else of the observations topic.
+func exportValidatorKey(src SourceConf) (*ecdsa.PublicKey, error) {
+	keyfile := src.ValidatorKey
+	if keyfile == "" {
+		keyfile = viper.GetString("tapir.observations.validatorkey")
+	}
+	if keyfile == "" {
+		return nil, fmt.Errorf("no validator key for %s (sources.*.validatorkey or tapir.observations.validatorkey)", src.Name)
+	}
+	key, err := tapir.FetchMqttValidatorKey(src.Topic, filepath.Clean(keyfile))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching validator key %s: %v", keyfile, err)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("no validator key in %s", keyfile)
+	}
+	return key, nil
+}
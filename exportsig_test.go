@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+)
+
+func TestExportSignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	var es ExportSnapshots
+	snap := NewExportSnapshot(testExportList(), ListPosition{Updates: 3, Time: time.Now()})
+	if err := es.Add(snap, key); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	// The signature covers the list, not the encoding or the chunks
+	for _, enc := range []string{"json", "binary"} {
+		le := &ListExport{List: &tapir.WBGlist{Names: map[string]tapir.TapirName{}}}
+		for offset := 0; offset < 3; offset += 2 {
+			var buf bytes.Buffer
+			if err := WriteExport(&buf, enc, snap, offset, 2); err != nil {
+				t.Fatalf("WriteExport(%s): %v", enc, err)
+			}
+			chunk, err := ReadExport(buf.Bytes())
+			if err != nil {
+				t.Fatalf("ReadExport(%s): %v", enc, err)
+			}
+			le.ExportHeader = chunk.ExportHeader
+			for name, tn := range chunk.List.Names {
+				le.List.Names[name] = tn
+			}
+		}
+		if err := VerifyExport(le, &key.PublicKey); err != nil {
+			t.Errorf("%s: VerifyExport: %v", enc, err)
+		}
+		if err := VerifyExport(le, &other.PublicKey); err == nil {
+			t.Errorf("%s: export verified with another key", enc)
+		}
+		tn := le.List.Names["evil.example."]
+		tn.TagMask = 0
+		le.List.Names["evil.example."] = tn
+		if err := VerifyExport(le, &key.PublicKey); err == nil {
+			t.Errorf("%s: modified export verified", enc)
+		}
+	}
+
+	unsigned := NewExportSnapshot(testExportList(), ListPosition{})
+	if err := es.Add(unsigned, nil); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteExport(&buf, "binary", unsigned, 0, 0); err != nil {
+		t.Fatalf("WriteExport: %v", err)
+	}
+	if le, err := ReadExport(buf.Bytes()); err != nil || VerifyExport(le, &key.PublicKey) == nil {
+		t.Errorf("unsigned export verified (%v)", err)
+	}
+}
+
+func TestBootstrapTlsConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	server := srv.Listener.Addr().String()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	base := &tls.Config{RootCAs: roots}
+	sum := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+	badpin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	for _, tc := range []struct {
+		desc  string
+		base  *tls.Config
+		conf  BootstrapTlsConf
+		valid bool
+	}{
+		{"address in the URL", base, BootstrapTlsConf{}, true},
+		{"other server's config", base, BootstrapTlsConf{Server: "192.0.2.1:443", ServerName: "wrong.example"}, true},
+		{"name in the certificate", base, BootstrapTlsConf{Server: server, ServerName: "example.com"}, true},
+		{"name not in the certificate", base, BootstrapTlsConf{Server: server, ServerName: "wrong.example"}, false},
+		{"pinned key", base, BootstrapTlsConf{Server: server, ServerName: "wrong.example", Spki: []string{badpin, pin}}, true},
+		{"other pinned key", base, BootstrapTlsConf{Server: server, Spki: []string{badpin}}, false},
+		{"pinned key from another CA", &tls.Config{RootCAs: x509.NewCertPool()}, BootstrapTlsConf{Server: server, Spki: []string{pin}}, false},
+	} {
+		cfg, err := bootstrapTlsConfig(tc.base, server, []BootstrapTlsConf{tc.conf})
+		if err != nil {
+			t.Fatalf("%s: bootstrapTlsConfig: %v", tc.desc, err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: connection error %v, want success %t", tc.desc, err, tc.valid)
+		}
+	}
+
+	if _, err := bootstrapTlsConfig(base, server, []BootstrapTlsConf{{Server: server, Spki: []string{"not-a-hash"}}}); err == nil {
+		t.Errorf("bootstrapTlsConfig accepted an invalid pin")
+	}
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/dnstapir/tapir"
+)
+
+// The handover from the initial contents of an MQTT source to the live updates goes in three
+// steps:
+//
+//  1. bufferUpdates, before subscribing to the topic: from now on the updates of the list are
+//     kept, not applied.
+//  2. The list is fetched from a bootstrap server and/or restored from its backup.
+//  3. completeHandover: the freshest of the bootstrap export and the backup becomes the contents
+//     of the list, the buffered updates are applied in the order they were sent (skipping the
+//     ones that are already in the contents), and later updates are applied as they arrive.
+
+// bufferedUpdate is an MQTT update that arrived during the handover of its list.
+type bufferedUpdate struct {
+	tm    tapir.TapirMsg
+	addrs ObservedAddrs
+}
+
+func handoverKey(listtype, name string) string {
+	return listtype + "/" + name
+}
+
+// bufferUpdates starts the handover of the list listtype/name: the MQTT updates of the list are
+// buffered until completeHandover or dropHandover.
+func (pd *PopData) bufferUpdates(listtype, name string) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	if pd.Handovers == nil {
+		pd.Handovers = map[string][]bufferedUpdate{}
+	}
+	pd.Handovers[handoverKey(listtype, name)] = []bufferedUpdate{}
+}
+
+// bufferUpdate keeps tm if its list is in the middle of a handover, and reports whether it did.
+// Must be called with pd.mu held for writing.
+func (pd *PopData) bufferUpdate(tm tapir.TapirMsg, addrs ObservedAddrs) bool {
+	key := handoverKey(tm.ListType, tm.SrcName)
+	buf, exist := pd.Handovers[key]
+	if !exist {
+		return false
+	}
+	pd.Handovers[key] = append(buf, bufferedUpdate{tm: tm, addrs: addrs})
+	pd.Logger.Printf("ProcessTapirUpdate: %s is being bootstrapped, update buffered (%d buffered)", key, len(buf)+1)
+	return true
+}
+
+// dropHandover ends the handover of the list listtype/name without applying the buffered
+// updates, e.g. when the subscription of the topic failed.
+func (pd *PopData) dropHandover(listtype, name string) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	delete(pd.Handovers, handoverKey(listtype, name))
+}
+
+// ListBackup is the saved contents of an MQTT list, see BackupListsState.
+type ListBackup struct {
+	Position ListPosition // of the list when it was saved
+	Names    map[string]tapir.TapirName
+}
+
+// Freshness returns the time of the latest update in the backup.
+func (lb *ListBackup) Freshness() time.Time {
+	return listFreshness(lb.Position, lb.Names)
+}
+
+// Freshness returns the time of the latest update in the export.
+func (le *ListExport) Freshness() time.Time {
+	return listFreshness(le.Position, le.List.Names)
+}
+
+// listFreshness returns the time of the latest update in a list at the position pos with the
+// names names. Without a position (from old peers or backups) the time the newest name was added
+// is used instead.
+func listFreshness(pos ListPosition, names map[string]tapir.TapirName) time.Time {
+	if !pos.Time.IsZero() {
+		return pos.Time
+	}
+	var latest time.Time
+	for _, tn := range names {
+		if tn.TimeAdded.After(latest) {
+			latest = tn.TimeAdded
+		}
+	}
+	return latest
+}
+
+// completeHandover ends the handover of wbgl, which must be in pd.Lists[listtype]. The contents
+// of the list become the fresher of boot and backup (either may be nil; if both are, the list
+// keeps its names), then the buffered updates are applied in the order of their time stamps.
+// If the list is live, i.e. already in the RPZ output, the changes of the contents are sent as
+// an IXFR.
+func (pd *PopData) completeHandover(listtype string, wbgl *tapir.WBGlist, boot *ListExport, backup *ListBackup, live bool) {
+	pd.mu.Lock()
+	var pos ListPosition
+	var names map[string]tapir.TapirName
+	switch {
+	case boot != nil && (backup == nil || !backup.Freshness().After(boot.Freshness())):
+		pos, names = boot.Position, boot.List.Names
+		pd.Logger.Printf("Handover: %s: using the bootstrap export with %d names (latest update %s)",
+			wbgl.Name, len(names), boot.Freshness().Format(tapir.TimeLayout))
+	case backup != nil:
+		pos, names = backup.Position, backup.Names
+		pd.Logger.Printf("Handover: %s: using the backup with %d names (latest update %s)",
+			wbgl.Name, len(names), backup.Freshness().Format(tapir.TimeLayout))
+	}
+	var changed bool
+	if names != nil {
+		old := wbgl.Names
+		pd.importNames(wbgl, names)
+		pd.Positions[wbgl] = pos
+		pd.Bootstrapped[wbgl] = pos.Time
+		if fix := namesDiff(old, wbgl.Names); live && len(fix.Added)+len(fix.Removed) > 0 {
+			fix.SrcName, fix.ListType = wbgl.Name, listtype
+			pd.Logger.Printf("Handover: %s: %d names added or changed and %d removed", wbgl.Name, len(fix.Added), len(fix.Removed))
+			ixfr, err := pd.GenerateRpzIxfr(&fix, PolicyTrigger{Kind: TriggerBootstrap, Source: wbgl.Name})
+			if err != nil {
+				pd.Logger.Printf("Handover: %s: error generating IXFR: %v", wbgl.Name, err)
+			}
+			changed = !ixfr.Empty()
+		}
+	}
+
+	key := handoverKey(listtype, wbgl.Name)
+	buf := pd.Handovers[key]
+	delete(pd.Handovers, key)
+	slices.SortStableFunc(buf, func(a, b bufferedUpdate) int { return a.tm.TimeStamp.Compare(b.tm.TimeStamp) })
+	for _, bu := range buf {
+		ixfr, err := pd.applyTapirUpdate(bu.tm, bu.addrs)
+		if err != nil {
+			pd.Logger.Printf("Handover: %s: error applying buffered update: %v", key, err)
+			continue
+		}
+		changed = changed || !ixfr.Empty()
+	}
+	pd.Logger.Printf("Handover: %s: %d buffered updates replayed, live from now on", key, len(buf))
+	pd.mu.Unlock()
+
+	if changed {
+		if err := pd.NotifyDownstreams(); err != nil {
+			pd.Logger.Printf("Handover: %s: error notifying downstreams: %v", key, err)
+		}
+	}
+}
+
+// rebootstrap replaces the contents of the live MQTT list wbgl with the export from fetch, with
+// the updates that arrive meanwhile buffered, and sends the changes as an IXFR. If fetch fails,
+// the list keeps its names.
+func (pd *PopData) rebootstrap(wbgl *tapir.WBGlist, fetch func() (*ListExport, error)) error {
+	pd.bufferUpdates(wbgl.Type, wbgl.Name)
+	boot, err := fetch()
+	pd.completeHandover(wbgl.Type, wbgl, boot, nil, true)
+	return err
+}
+
+// namesDiff returns the names in new that are not in old or have changed, as additions, and the
+// names in old that are not in new, as removals.
+func namesDiff(old, new map[string]tapir.TapirName) tapir.TapirMsg {
+	var tm tapir.TapirMsg
+	for name, tn := range new {
+		if otn, exist := old[name]; exist && otn.TagMask == tn.TagMask && otn.TTL == tn.TTL && otn.TimeAdded.Equal(tn.TimeAdded) {
+			continue
+		}
+		tm.Added = append(tm.Added, tapir.Domain{Name: name, TimeAdded: tn.TimeAdded, TTL: int(tn.TTL / time.Second), TagMask: tn.TagMask})
+	}
+	for name := range old {
+		if _, exist := new[name]; !exist {
+			tm.Removed = append(tm.Removed, tapir.Domain{Name: name})
+		}
+	}
+	return tm
+}
+
+// restoreFromBackup reads the backup of a list from filename. Backups from before ListBackup
+// are just the names.
+func (pd *PopData) restoreFromBackup(filename string) (*ListBackup, bool) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		pd.Logger.Printf("Could not open '%s' for reading backup, err: '%s'", filename, err)
+		return nil, false
+	}
+
+	var lb ListBackup
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&lb); err == nil {
+		return &lb, true
+	}
+	lb = ListBackup{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&lb.Names); err != nil {
+		pd.Logger.Printf("Could not decode backup '%s', err: '%s'", filename, err)
+		return nil, false
+	}
+	return &lb, true
+}
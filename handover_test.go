@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"encoding/gob"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+)
+
+func TestHandover(t *testing.T) {
+	pd, _ := newPopData(t)
+	tp := &testPop{pd: pd}
+	snapshot := time.Now().Add(-time.Minute).UTC()
+
+	pd.bufferUpdates("doubtlist", "dns-tapir")
+	update := func(ts time.Time, added, removed string) {
+		t.Helper()
+		tm := tapir.TapirMsg{SrcName: "dns-tapir", ListType: "doubtlist", MsgType: "observation", TimeStamp: ts}
+		if added != "" {
+			tm.Added = []tapir.Domain{{Name: added, TimeAdded: ts, TTL: 3600}}
+		}
+		if removed != "" {
+			tm.Removed = []tapir.Domain{{Name: removed}}
+		}
+		if ok, err := pd.ProcessTapirUpdate(tm, nil); !ok || err != nil {
+			t.Fatalf("ProcessTapirUpdate: %t, %v", ok, err)
+		}
+	}
+	// Received out of order while the list is being bootstrapped
+	update(snapshot.Add(2*time.Second), "", "new.example.")
+	update(snapshot.Add(time.Second), "new.example.", "")
+	update(snapshot.Add(-time.Second), "stale.example.", "") // already in the snapshot (or removed since)
+	update(snapshot.Add(3*time.Second), "live.example.", "")
+
+	boot := &ListExport{
+		ExportHeader: ExportHeader{Snapshot: "1", Position: ListPosition{Updates: 5, Time: snapshot}},
+		List: &tapir.WBGlist{Names: map[string]tapir.TapirName{
+			"boot.example.": {Name: "boot.example.", TimeAdded: snapshot, TTL: time.Hour},
+		}},
+	}
+	backup := &ListBackup{
+		Position: ListPosition{Updates: 3, Time: snapshot.Add(-time.Hour)},
+		Names:    map[string]tapir.TapirName{"backup.example.": {Name: "backup.example."}},
+	}
+	wbgl := tp.addList("doubtlist", "dns-tapir", "mqtt")
+	pd.completeHandover("doubtlist", wbgl, boot, backup, false)
+
+	for name, want := range map[string]bool{
+		"boot.example.":   true,
+		"backup.example.": false, // older than the bootstrap export
+		"new.example.":    false, // added and removed, in that order
+		"stale.example.":  false,
+		"live.example.":   true,
+	} {
+		if _, exist := wbgl.Names[name]; exist != want {
+			t.Errorf("%s in the list: %t, want %t", name, exist, want)
+		}
+	}
+	if pos := pd.Positions[wbgl]; pos.Updates != 8 || !pos.Time.Equal(snapshot.Add(3*time.Second)) {
+		t.Errorf("position after the handover %+v, want 8 updates", pos)
+	}
+
+	// Once live, updates are applied directly
+	update(time.Now(), "later.example.", "")
+	if _, exist := wbgl.Names["later.example."]; !exist || len(pd.Handovers) != 0 {
+		t.Errorf("update after the handover not applied")
+	}
+
+	// A fresher backup wins over the bootstrap export
+	backup.Position.Time = snapshot.Add(time.Minute)
+	pd.bufferUpdates("doubtlist", "dns-tapir")
+	pd.completeHandover("doubtlist", wbgl, boot, backup, false)
+	if _, exist := wbgl.Names["backup.example."]; !exist || len(wbgl.Names) != 1 {
+		t.Errorf("list after the handover with a fresher backup: %v", wbgl.Names)
+	}
+}
+
+func TestRestoreFromBackup(t *testing.T) {
+	pd, _ := newPopData(t)
+	tp := &testPop{pd: pd}
+	wbgl := tp.addList("doubtlist", "dns-tapir", "mqtt", "a.example.", "b.example.")
+	wbgl.BackupFile = filepath.Join(t.TempDir(), "dns-tapir.gob")
+	pos := ListPosition{Updates: 17, Time: time.Now().UTC().Round(time.Second)}
+	pd.Positions[wbgl] = pos
+
+	pd.BackupListsState()
+	lb, ok := pd.restoreFromBackup(wbgl.BackupFile)
+	if !ok || len(lb.Names) != 2 || lb.Position != pos {
+		t.Fatalf("restoreFromBackup: %+v, %t", lb, ok)
+	}
+
+	// A backup from before ListBackup has only the names
+	f, err := os.Create(wbgl.BackupFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := time.Now().Add(-time.Hour).UTC().Round(time.Second)
+	err = gob.NewEncoder(f).Encode(map[string]tapir.TapirName{"c.example.": {Name: "c.example.", TimeAdded: added}})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, ok = pd.restoreFromBackup(wbgl.BackupFile)
+	if !ok || len(lb.Names) != 1 || !lb.Freshness().Equal(added) {
+		t.Errorf("restoreFromBackup of an old backup: %+v, %t", lb, ok)
+	}
+	if _, ok := pd.restoreFromBackup(filepath.Join(t.TempDir(), "missing.gob")); ok {
+		t.Errorf("restoreFromBackup of a missing file succeeded")
+	}
+}
+
+func TestMqttAllowlist(t *testing.T) {
+	server, conf := newPopData(t)
+	conf.PopData = server
+	conf.Internal.ApiAuth = &ApiAuth{Logger: testLogger()}
+	stp := &testPop{pd: server}
+	stp.addList("allowlist", "core-allow", "mqtt", "good.example.", "fine.example.")
+	stp.addList("doubtlist", "core-allow", "mqtt", "evil.example.")
+	handler := APIbootstrap(conf)
+	request := func(post ExportPost) (int, []byte, error) {
+		w := apiRequest(handler, RoleReadOnly, "/api/v1/bootstrap", post)
+		return w.Code, w.Body.Bytes(), nil
+	}
+
+	pd, _ := newPopData(t)
+	tp := &testPop{pd: pd}
+	pd.bufferUpdates("allowlist", "core-allow")
+	tm := tapir.TapirMsg{SrcName: "core-allow", ListType: "allowlist", MsgType: "intel-update", TimeStamp: time.Now(),
+		Added: []tapir.Domain{{Name: "new.example."}}}
+	if ok, err := pd.ProcessTapirUpdate(tm, nil); !ok || err != nil {
+		t.Fatalf("ProcessTapirUpdate: %t, %v", ok, err)
+	}
+	le, err := pd.fetchExport("test", "allowlist", "core-allow", request)
+	if err != nil || le.Type != "allowlist" {
+		t.Fatalf("fetchExport of the allowlist: %+v, %v", le, err)
+	}
+	wbgl := tp.addList("allowlist", "core-allow", "mqtt")
+	pd.completeHandover("allowlist", wbgl, le, nil, false)
+	if len(wbgl.Names) != 3 {
+		t.Errorf("allowlist after the handover: %v, want the 2 bootstrapped names and the buffered one", wbgl.Names)
+	}
+
+	// Backed up like the doubtlists
+	wbgl.BackupFile = filepath.Join(t.TempDir(), "core-allow.gob")
+	pd.BackupListsState()
+	if lb, ok := pd.restoreFromBackup(wbgl.BackupFile); !ok || len(lb.Names) != 3 {
+		t.Errorf("restoreFromBackup of the allowlist: %+v, %t", lb, ok)
+	}
+
+	// A request without a list type is for a doubtlist, as from old clients
+	status, buf, _ := request(ExportPost{BootstrapPost: tapir.BootstrapPost{Command: "export-doubtlist", ListName: "core-allow", Encoding: "json"}})
+	if le, err := ReadExport(buf); status != http.StatusOK || err != nil || le.Type != "doubtlist" || len(le.List.Names) != 1 {
+		t.Errorf("export without a list type: %d, %v", status, err)
+	}
+}
@@ -0,0 +1,408 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// The test harness builds a complete PopData from in-memory config (no files in /etc/dnstapir
+// are read), with stand-ins for the things that TAPIR-POP normally talks to:
+//   - upstream RPZ primaries are in-process miekg/dns authoritative servers (startUpstreamRpz)
+//   - the MQTT engine is replaced by writing TapirMsgs directly into pd.TapirObservations
+//     (injectObservation), which is exactly what the engine does with validated messages
+//   - downstream resolvers are real DNS clients doing SOA, AXFR and IXFR (axfr, ixfr, soaSerial)
+
+const testRpzZone = "rpz.test."
+
+type testPop struct {
+	pd     *PopData
+	conf   *Config
+	stopch chan struct{}
+	addr   string // address of the TAPIR-POP DNS engine
+}
+
+func testLogger() *log.Logger {
+	if testing.Verbose() {
+		return log.New(os.Stderr, "", log.Lmicroseconds)
+	}
+	return log.New(io.Discard, "", 0)
+}
+
+// testConfig is the minimal config needed by NewPopData. Individual tests may adjust the
+// resulting pd.Policy directly.
+func testConfig(t *testing.T) {
+	t.Helper()
+	viper.Reset()
+	viper.Set("services.rpz.zonename", testRpzZone)
+	viper.Set("services.rpz.serialcache", t.TempDir()+"/rpz-serial.yaml")
+	viper.Set("services.rpz.apex.nameservers", []map[string]any{
+		{"name": "ns1." + testRpzZone, "addresses": []string{"127.0.0.1", "::1"}},
+	})
+	viper.Set("services.reaper.interval", 3600)
+	viper.Set("services.refreshengine.active", true)
+	viper.Set("policy.auditlog", t.TempDir()+"/audit.jsonl")
+	viper.Set("policy.allowlist.action", "PASSTHRU")
+	viper.Set("policy.denylist.action", "NODATA")
+	viper.Set("policy.doubtlist.numsources.limit", 1)
+	viper.Set("policy.doubtlist.numsources.action", "NXDOMAIN")
+	viper.Set("policy.doubtlist.numtapirtags.limit", 4)
+	viper.Set("policy.doubtlist.numtapirtags.action", "DROP")
+	viper.Set("policy.doubtlist.denytapir.tags", []string{"likelymalware"})
+	viper.Set("policy.doubtlist.denytapir.action", "DROP")
+}
+
+// newPopData creates a PopData without starting any engines. Used by the unit tests. The config
+// functions may add to the config from testConfig; viper must not be modified once engines run.
+func newPopData(t *testing.T, config ...func()) (*PopData, *Config) {
+	t.Helper()
+	testConfig(t)
+	for _, f := range config {
+		f()
+	}
+	lg := testLogger()
+	conf := &Config{}
+	conf.Loggers.Mqtt = lg
+	conf.Loggers.Dnsengine = lg
+	conf.Loggers.Policy = lg
+	conf.Loggers.Api = lg
+	conf.Internal.ComponentStatusCh = make(chan tapir.ComponentStatusUpdate, 100)
+	conf.Internal.Servers = &ServerRegistry{}
+
+	pd, err := NewPopData(conf, lg)
+	if err != nil {
+		t.Fatalf("NewPopData: %v", err)
+	}
+	pd.AddCatchallLists()
+	t.Cleanup(func() { _ = pd.PolicyAudit.Close() })
+
+	// Nothing reads the status updates in the tests, but senders must not block
+	go func() {
+		for range conf.Internal.ComponentStatusCh {
+		}
+	}()
+	return pd, conf
+}
+
+// newTestPop creates a PopData and starts the RefreshEngine and the DNS engine (on a random port).
+func newTestPop(t *testing.T, config ...func()) *testPop {
+	t.Helper()
+	pd, conf := newPopData(t, config...)
+	pd.TapirObservations = make(chan tapir.MqttPkgIn, 10)
+
+	tp := &testPop{pd: pd, conf: conf, stopch: make(chan struct{})}
+	stopped := make(chan struct{})
+	go func() {
+		pd.RefreshEngine(conf, tp.stopch)
+		close(stopped)
+	}()
+	// The next test resets viper, so the engine must be gone before this test is done
+	t.Cleanup(func() {
+		close(tp.stopch)
+		<-stopped
+	})
+
+	tp.addr = startDnsServer(t, dns.HandlerFunc(createHandler(conf)))
+	return tp
+}
+
+// addList adds an in-memory list, e.g. a stand-in for an MQTT or file source.
+func (tp *testPop) addList(listtype, name, datasource string, names ...string) *tapir.WBGlist {
+	wbgl := &tapir.WBGlist{
+		Name:       name,
+		Type:       listtype,
+		Format:     "map",
+		Datasource: datasource,
+		Names:      map[string]tapir.TapirName{},
+		ReaperData: map[time.Time]map[string]bool{},
+	}
+	for _, n := range names {
+		wbgl.Names[n] = tapir.TapirName{Name: n, TimeAdded: time.Now()}
+	}
+	tp.pd.mu.Lock()
+	tp.pd.Lists[listtype][name] = wbgl
+	tp.pd.mu.Unlock()
+	return wbgl
+}
+
+// injectObservation delivers a TapirMsg to the RefreshEngine the same way the MQTT engine does.
+func (tp *testPop) injectObservation(t *testing.T, tm tapir.TapirMsg) {
+	t.Helper()
+	payload, err := json.Marshal(tm)
+	if err != nil {
+		t.Fatalf("json.Marshal(TapirMsg): %v", err)
+	}
+	tp.pd.TapirObservations <- tapir.MqttPkgIn{Topic: "events/up/test/observations", Payload: payload, Validated: true}
+}
+
+// waitForSerial polls the SOA of the output zone until the serial is at least serial.
+func (tp *testPop) waitForSerial(t *testing.T, serial uint32) uint32 {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cur := soaSerial(t, tp.addr, testRpzZone)
+		if cur >= serial {
+			return cur
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s serial %d (current serial %d)", testRpzZone, serial, cur)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// startDnsServer starts a UDP and a TCP server on the same random port on the loopback interface.
+func startDnsServer(t *testing.T, handler dns.Handler) string {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("net.Listen: %v", err)
+		}
+		pc, err := net.ListenPacket("udp", ln.Addr().String())
+		if err != nil {
+			ln.Close()
+			continue // port taken for UDP, try another one
+		}
+
+		for _, server := range []*dns.Server{
+			{Listener: ln, Handler: handler},
+			{PacketConn: pc, Handler: handler},
+		} {
+			started := make(chan struct{})
+			server.NotifyStartedFunc = func() { close(started) }
+			go func(s *dns.Server) {
+				_ = s.ActivateAndServe()
+			}(server)
+			<-started
+			t.Cleanup(func() { _ = server.Shutdown() })
+		}
+		return ln.Addr().String()
+	}
+	t.Fatalf("unable to find a free port for the DNS server")
+	return ""
+}
+
+// upstreamRpz is an authoritative server for a single RPZ, used as the upstream primary
+// of an "xfr" source.
+type upstreamRpz struct {
+	zone   string
+	serial uint32
+	rules  map[string]string // map[name]CNAME target
+	addr   string
+}
+
+func startUpstreamRpz(t *testing.T, zone string, rules map[string]string) *upstreamRpz {
+	t.Helper()
+	up := &upstreamRpz{zone: dns.Fqdn(zone), serial: 1, rules: rules}
+	up.addr = startDnsServer(t, dns.HandlerFunc(up.serve))
+	return up
+}
+
+func (up *upstreamRpz) soa() dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: up.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+		Ns:      "ns." + up.zone,
+		Mbox:    "hostmaster." + up.zone,
+		Serial:  up.serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  60,
+	}
+}
+
+func (up *upstreamRpz) serve(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	if r.Question[0].Name != up.zone {
+		m.Rcode = dns.RcodeRefused
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	switch r.Question[0].Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		rrs := []dns.RR{up.soa(), &dns.NS{
+			Hdr: dns.RR_Header{Name: up.zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+			Ns:  "ns." + up.zone,
+		}}
+		for name, target := range up.rules {
+			rrs = append(rrs, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: name + up.zone, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+				Target: target,
+			})
+		}
+		rrs = append(rrs, up.soa())
+
+		ch := make(chan *dns.Envelope, 1)
+		ch <- &dns.Envelope{RR: rrs}
+		close(ch)
+		tr := new(dns.Transfer)
+		_ = tr.Out(w, r, ch)
+		_ = w.Close()
+		return
+
+	case dns.TypeSOA:
+		m.Answer = append(m.Answer, up.soa())
+	default:
+		m.Ns = append(m.Ns, up.soa())
+	}
+	_ = w.WriteMsg(m)
+}
+
+func soaSerial(t *testing.T, addr, zone string) uint32 {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeSOA)
+	c := dns.Client{Net: "tcp", Timeout: 2 * time.Second}
+	r, _, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("SOA query for %s to %s: %v", zone, addr, err)
+	}
+	for _, rr := range r.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial
+		}
+	}
+	t.Fatalf("no SOA in response for %s from %s: %s", zone, addr, r.String())
+	return 0
+}
+
+// xfrIn does an AXFR or (if serial != 0) an IXFR and returns all the RRs in the transfer.
+func xfrIn(t *testing.T, addr, zone string, ixfrSerial uint32) []dns.RR {
+	t.Helper()
+	m := new(dns.Msg)
+	if ixfrSerial == 0 {
+		m.SetAxfr(zone)
+	} else {
+		m.SetIxfr(zone, ixfrSerial, "ns."+zone, "hostmaster."+zone)
+	}
+
+	tr := dns.Transfer{ReadTimeout: 5 * time.Second}
+	envch, err := tr.In(m, addr)
+	if err != nil {
+		t.Fatalf("transfer of %s from %s: %v", zone, addr, err)
+	}
+	var rrs []dns.RR
+	for env := range envch {
+		if env.Error != nil {
+			t.Fatalf("transfer of %s from %s: %v", zone, addr, env.Error)
+		}
+		rrs = append(rrs, env.RR...)
+	}
+	return rrs
+}
+
+func axfr(t *testing.T, addr, zone string) []dns.RR {
+	t.Helper()
+	return xfrIn(t, addr, zone, 0)
+}
+
+func ixfr(t *testing.T, addr, zone string, serial uint32) []dns.RR {
+	t.Helper()
+	return xfrIn(t, addr, zone, serial)
+}
+
+// ixfrDiff splits an IXFR into the removed and the added RPZ rules (as map[owner]CNAME target)
+// across all the diff sequences in it.
+func ixfrDiff(t *testing.T, rrs []dns.RR) (removed, added map[string]string) {
+	t.Helper()
+	removed, added = map[string]string{}, map[string]string{}
+	if len(rrs) < 2 {
+		t.Fatalf("IXFR too short: %d RRs", len(rrs))
+	}
+	var soas int
+	for _, rr := range rrs[1 : len(rrs)-1] { // skip the outer SOA pair
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			soas++
+		case *dns.CNAME:
+			if soas%2 == 1 {
+				removed[rr.Hdr.Name] = rr.Target
+			} else {
+				added[rr.Hdr.Name] = rr.Target
+			}
+		}
+	}
+	return removed, added
+}
+
+// recordingWriter is a dns.ResponseWriter that keeps the messages written to it, for calling the
+// transfer functions directly. onWrite (if set) is called before each message is recorded and may
+// fail the write.
+type recordingWriter struct {
+	msgs    []*dns.Msg
+	onWrite func(n int) error // n is the number of messages written so far
+}
+
+func (rw *recordingWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (rw *recordingWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 5353}
+}
+func (rw *recordingWriter) Write([]byte) (int, error) { return 0, nil }
+func (rw *recordingWriter) Close() error              { return nil }
+func (rw *recordingWriter) TsigStatus() error         { return nil }
+func (rw *recordingWriter) TsigTimersOnly(bool)       {}
+func (rw *recordingWriter) Hijack()                   {}
+
+func (rw *recordingWriter) WriteMsg(m *dns.Msg) error {
+	if rw.onWrite != nil {
+		if err := rw.onWrite(len(rw.msgs)); err != nil {
+			return err
+		}
+	}
+	rw.msgs = append(rw.msgs, m)
+	return nil
+}
+
+// rrs returns the answer sections of all the messages written.
+func (rw *recordingWriter) rrs() []dns.RR {
+	var rrs []dns.RR
+	for _, m := range rw.msgs {
+		rrs = append(rrs, m.Answer...)
+	}
+	return rrs
+}
+
+// rpzRules returns the RPZ rules in an AXFR as map[owner]CNAME target.
+func rpzRules(rrs []dns.RR) map[string]string {
+	rules := map[string]string{}
+	for _, rr := range rrs {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			rules[cname.Hdr.Name] = cname.Target
+		}
+	}
+	return rules
+}
+
+// apiRequest POSTs body, encoded as JSON, to the API handler as the path, from a client with
+// the role role. The authentication is skipped, see TestApiAuth.
+func apiRequest(handler http.HandlerFunc, role ApiRole, path string, body any) *httptest.ResponseRecorder {
+	buf, _ := json.Marshal(body)
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(buf))
+	r = r.WithContext(context.WithValue(r.Context(), apiPrincipalKey{}, ApiPrincipal{Name: "test", Role: role}))
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
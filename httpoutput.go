@@ -0,0 +1,227 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dnstapir/tapir"
+	"github.com/gorilla/mux"
+	"github.com/miekg/dns"
+)
+
+// An HTTP output (format "tapir-http-1") serves the RPZ policy over HTTP, for consumers that do
+// not do zone transfers. A GET of the path of the output URL returns the whole policy, or with
+// ?since=<serial> the changes since that serial, from the IXFR chain. If the chain does not
+// reach back to the serial, the whole policy is returned. The serial is the ETag of the
+// response, so a consumer that is up to date gets 304 Not Modified. Responses are gzipped if
+// the client accepts it. The clients authenticate like those of the bootstrap API.
+
+// HttpOutput is an output that serves the policy on Addr (host:port) under Path.
+type HttpOutput struct {
+	Name string
+	Addr string
+	Path string
+	TLS  bool
+}
+
+// PolicyExport is the policy, or the changes to it, as served by the HTTP outputs.
+type PolicyExport struct {
+	Zone       string
+	Serial     uint32
+	Full       bool   // Added is the whole policy, else the changes since FromSerial
+	FromSerial uint32 `json:",omitempty"`
+	Added      []PolicyRule
+	Removed    []string `json:",omitempty"`
+}
+
+// PolicyRule is a name in the policy with its action. Data is the local data of REDIRECT rules.
+type PolicyRule struct {
+	Name   string
+	Action string
+	Data   []string `json:",omitempty"`
+}
+
+// addHttpOutput sets up the HTTP output output, served on output.Url. The servers are started by
+// APIhandler.
+func (pd *PopData) addHttpOutput(name string, output PopOutput) error {
+	u, err := url.Parse(output.Url)
+	if err != nil {
+		return fmt.Errorf("invalid url %q: %v", output.Url, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid url %q: scheme must be http or https", output.Url)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return fmt.Errorf("invalid url %q: %v", output.Url, err)
+	}
+	ho := &HttpOutput{Name: output.Name, Addr: u.Host, Path: u.Path, TLS: u.Scheme == "https"}
+	if ho.Name == "" {
+		ho.Name = name
+	}
+	if ho.Path == "" {
+		ho.Path = "/"
+	}
+	pd.mu.Lock()
+	pd.HttpOutputs = append(pd.HttpOutputs, ho)
+	pd.mu.Unlock()
+	pd.Logger.Printf("Output %s: serving the policy on %s", name, output.Url)
+	return nil
+}
+
+func SetupHttpOutputRouter(conf *Config, ho *HttpOutput) *mux.Router {
+	r := mux.NewRouter().StrictSlash(true)
+	r.Use(conf.Internal.ApiAuth.Middleware)
+	r.HandleFunc(ho.Path, APIpolicy(conf, ho)).Methods("GET", "HEAD")
+	return r
+}
+
+func APIpolicy(conf *Config, ho *HttpOutput) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := conf.Internal.ApiAuth.Authorize(r, "policy", "get"); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		pd := conf.PopData
+		snap := pd.Rpz.Snapshot()
+		if snap == nil {
+			http.Error(w, "no policy yet", http.StatusServiceUnavailable)
+			return
+		}
+
+		etag := fmt.Sprintf("W/\"%d\"", snap.Serial) // weak, as the diffs and the gzipped responses differ
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Header().Set("X-Tapir-Serial", strconv.FormatUint(uint64(snap.Serial), 10))
+		if etagMatch(r.Header.Get("If-None-Match"), snap.Serial) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		var pe *PolicyExport
+		if s := r.URL.Query().Get("since"); s != "" {
+			since, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid serial %q", s), http.StatusBadRequest)
+				return
+			}
+			pe = pd.policyDiff(snap, uint32(since))
+		}
+		if pe == nil {
+			pe = pd.policyExport(snap)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		var out io.Writer = w
+		if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		}
+		if err := json.NewEncoder(out).Encode(pe); err != nil {
+			log.Printf("APIpolicy: %s: error encoding the policy (serial %d) for %s: %v", ho.Name, snap.Serial, r.RemoteAddr, err)
+		}
+	}
+}
+
+// policyExport returns the whole policy in snap.
+func (pd *PopData) policyExport(snap *RpzSnapshot) *PolicyExport {
+	pe := PolicyExport{Zone: pd.Rpz.ZoneName, Serial: snap.Serial, Full: true}
+	pe.Added = make([]PolicyRule, 0, len(snap.Data))
+	for _, owner := range snap.Owners() {
+		pe.Added = append(pe.Added, policyRule(snap.Data[owner]))
+	}
+	return &pe
+}
+
+// policyDiff returns the changes to the policy from the serial since to snap, or nil if the IXFR
+// chain of snap does not reach back to since.
+func (pd *PopData) policyDiff(snap *RpzSnapshot, since uint32) *PolicyExport {
+	pe := PolicyExport{Zone: pd.Rpz.ZoneName, Serial: snap.Serial, FromSerial: since, Added: []PolicyRule{}}
+	if since == snap.Serial {
+		return &pe
+	}
+	first := slices.IndexFunc(snap.IxfrChain, func(ixfr RpzIxfr) bool { return ixfr.FromSerial == since })
+	if first < 0 {
+		return nil
+	}
+
+	changes := map[string]*RpzRule{} // nil if removed
+	for _, ixfr := range snap.IxfrChain[first:] {
+		for _, rn := range ixfr.Removed {
+			changes[rn.Name] = nil
+		}
+		for _, rn := range ixfr.Added {
+			changes[rn.Name] = rn
+		}
+	}
+	var added []*RpzRule
+	for name, rn := range changes {
+		if rn == nil {
+			pe.Removed = append(pe.Removed, name)
+		} else {
+			added = append(added, rn)
+		}
+	}
+	sortRpzNames(added)
+	for _, rn := range added {
+		pe.Added = append(pe.Added, policyRule(rn))
+	}
+	slices.SortFunc(pe.Removed, func(a, b string) int { return strings.Compare(canonicalKey(a), canonicalKey(b)) })
+	return &pe
+}
+
+func policyRule(rn *RpzRule) PolicyRule {
+	pr := PolicyRule{Name: rn.Name, Action: ActionString(rn.Action)}
+	if rn.Action == tapir.REDIRECT {
+		for _, rr := range rn.RRs {
+			pr.Data = append(pr.Data, dns.TypeToString[rr.Header().Rrtype]+" "+
+				strings.TrimPrefix(rr.String(), rr.Header().String()))
+		}
+	}
+	return pr
+}
+
+// etagMatch reports whether the If-None-Match header inm matches the ETag of serial.
+func etagMatch(inm string, serial uint32) bool {
+	want := fmt.Sprintf("\"%d\"", serial)
+	for _, tag := range strings.Split(inm, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == want || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip reports whether the Accept-Encoding header ae accepts gzip.
+func acceptsGzip(ae string) bool {
+	for _, coding := range strings.Split(ae, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		q, found := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+		if found {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/spf13/viper"
+)
+
+func TestHttpOutput(t *testing.T) {
+	pd, conf := newPopData(t)
+	conf.PopData = pd
+	conf.Internal.ApiAuth = &ApiAuth{
+		Logger: testLogger(),
+		keys:   []apiKeyEntry{{name: "consumer", key: []byte("secret"), role: RoleReadOnly}},
+	}
+	tp := &testPop{pd: pd}
+	tp.addList("doubtlist", "dns-tapir", "mqtt", "evil.example.", "bad.example.")
+	if _, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup}); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	if err := pd.addHttpOutput("http1", PopOutput{Url: "http://127.0.0.1:5678/tapir/v1/policy"}); err != nil {
+		t.Fatalf("addHttpOutput: %v", err)
+	}
+	router := SetupHttpOutputRouter(conf, pd.HttpOutputs[0])
+
+	get := func(query string, header map[string]string) (*http.Response, *PolicyExport) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/tapir/v1/policy"+query, nil)
+		r.Header.Set("X-API-Key", "secret")
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		resp := w.Result()
+		if resp.StatusCode != http.StatusOK {
+			return resp, nil
+		}
+		var body io.Reader = resp.Body
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = gz
+		}
+		var pe PolicyExport
+		if err := json.NewDecoder(body).Decode(&pe); err != nil {
+			t.Fatal(err)
+		}
+		return resp, &pe
+	}
+	update := func(added, removed string) {
+		t.Helper()
+		tm := tapir.TapirMsg{SrcName: "dns-tapir", ListType: "doubtlist", MsgType: "observation", TimeStamp: time.Now()}
+		if added != "" {
+			tm.Added = []tapir.Domain{{Name: added, TimeAdded: time.Now(), TTL: 3600}}
+		}
+		if removed != "" {
+			tm.Removed = []tapir.Domain{{Name: removed}}
+		}
+		if ok, err := pd.ProcessTapirUpdate(tm, nil); !ok || err != nil {
+			t.Fatalf("ProcessTapirUpdate: %t, %v", ok, err)
+		}
+	}
+
+	serial := pd.Rpz.CurrentSerial()
+	resp, pe := get("", nil)
+	if pe == nil || !pe.Full || pe.Serial != serial || len(pe.Added) != 2 || pe.Added[0].Name != "bad.example." || pe.Added[0].Action != "NXDOMAIN" {
+		t.Fatalf("whole policy: %d, %+v", resp.StatusCode, pe)
+	}
+	etag := resp.Header.Get("ETag")
+	if resp, _ := get("", map[string]string{"If-None-Match": etag}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("GET with the current ETag: %d, want 304", resp.StatusCode)
+	}
+
+	update("other.example.", "")
+	update("", "evil.example.")
+	if resp, _ := get("", map[string]string{"If-None-Match": etag}); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET with an old ETag: %d, want 200", resp.StatusCode)
+	}
+	_, pe = get(fmt.Sprintf("?since=%d", serial), map[string]string{"Accept-Encoding": "gzip"})
+	if pe == nil || pe.Full || pe.FromSerial != serial || pe.Serial != pd.Rpz.CurrentSerial() ||
+		len(pe.Added) != 1 || pe.Added[0].Name != "other.example." || len(pe.Removed) != 1 || pe.Removed[0] != "evil.example." {
+		t.Errorf("changes since %d: %+v", serial, pe)
+	}
+	if _, pe := get(fmt.Sprintf("?since=%d", pd.Rpz.CurrentSerial()), nil); pe == nil || pe.Full || len(pe.Added)+len(pe.Removed) != 0 {
+		t.Errorf("changes since the current serial: %+v", pe)
+	}
+	// The IXFR chain does not reach back that far
+	if _, pe := get(fmt.Sprintf("?since=%d", serial-10), nil); pe == nil || !pe.Full || len(pe.Added) != 2 {
+		t.Errorf("changes since an unknown serial: %+v", pe)
+	}
+
+	if resp, _ := get("?since=x", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET with an invalid serial: %d, want 400", resp.StatusCode)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/tapir/v1/policy", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GET without a key: %d, want 401", w.Code)
+	}
+}
+
+func TestParseHttpOutputs(t *testing.T) {
+	pd, _ := newPopData(t, func() {
+		viper.Set("outputs", map[string]any{
+			"http1":    map[string]any{"active": true, "format": "tapir-http-1", "url": "http://127.0.0.1:5678/tapir/v1/policy"},
+			"inactive": map[string]any{"active": false, "format": "tapir-http-1", "url": "http://127.0.0.1:5679/"},
+			"bad":      map[string]any{"active": true, "format": "tapir-http-1", "url": "ftp://127.0.0.1:5680/"},
+			"resolver": map[string]any{"active": true, "format": "rpz", "downstream": "127.0.0.1:5353"},
+		})
+	})
+	for i := 1; i <= 2; i++ {
+		if err := pd.ParseOutputs(); err != nil {
+			t.Fatalf("ParseOutputs: %v", err)
+		}
+		if len(pd.HttpOutputs) != 1 || len(pd.Downstreams) != 1 {
+			t.Fatalf("parse %d: %d HTTP outputs and %d downstreams, want 1 of each", i, len(pd.HttpOutputs), len(pd.Downstreams))
+		}
+	}
+	if ho := pd.HttpOutputs[0]; ho.Name != "http1" || ho.Addr != "127.0.0.1:5678" || ho.Path != "/tapir/v1/policy" || ho.TLS {
+		t.Errorf("HTTP output %+v", ho)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for ae, want := range map[string]bool{
+		"":                       false,
+		"gzip":                   true,
+		"deflate, GZIP;q=0.5":    true,
+		"gzip;q=0, identity":     false,
+		"br, identity;q=0.5":     false,
+		"gzip ; q=1.0, compress": true,
+	} {
+		if got := acceptsGzip(ae); got != want {
+			t.Errorf("acceptsGzip(%q) = %t, want %t", ae, got, want)
+		}
+	}
+}
@@ -6,13 +6,47 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"slices"
 
 	//	"github.com/smhanov/dawg"
 	"github.com/dnstapir/tapir"
 )
 
+// listFormats are the formats of the lists that the policy can evaluate, per list type.
+var listFormats = map[string][]string{
+	"allowlist": {"map", "cidr", "dawg"},
+	"denylist":  {"map", "cidr", "dawg"},
+	"doubtlist": {"map", "cidr"},
+}
+
+// checkListFormat returns an error if the policy can not evaluate the list wbgl. Such a list is
+// rejected when it is loaded, so the policy need not check the format of every list per name.
+func checkListFormat(wbgl *tapir.WBGlist) error {
+	if !slices.Contains(listFormats[wbgl.Type], wbgl.Format) {
+		return fmt.Errorf("%s %s has format %q, which is not supported for %ss", wbgl.Type, wbgl.Name, wbgl.Format, wbgl.Type)
+	}
+	return nil
+}
+
+// Allowlisted reports whether name is allowlisted. An address trigger is also allowlisted by a
+// less specific prefix of the same type, and an NSDNAME trigger by the nameserver name, see
+// allowKeys. rpz-ip and rpz-nsip triggers are also allowlisted by the prefixes in CIDR
+// allowlists.
 func (pd *PopData) Allowlisted(name string) bool {
+	for _, key := range allowKeys(name) {
+		if pd.allowlisted(key) {
+			return true
+		}
+	}
+	if tt := TriggerTypeOf(name); tt == IpTrigger || tt == NsipTrigger {
+		if t, err := ParseRpzTrigger(name); err == nil && pd.cidrAllowlisted(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pd *PopData) allowlisted(name string) bool {
 	for _, list := range pd.Lists["allowlist"] {
 		switch list.Format {
 		case "dawg":
@@ -22,7 +56,7 @@ func (pd *PopData) Allowlisted(name string) bool {
 			if list.Dawgf.IndexOf(name) != -1 {
 				return true
 			}
-		case "map":
+		case "map", "cidr":
 			if tapir.GlobalCF.Debug {
 				pd.Logger.Printf("Allowlisted: MAP: checking %s in allowlist %s", name, list.Name)
 			}
@@ -44,7 +78,7 @@ func (pd *PopData) Denylisted(name string) bool {
 			if list.Dawgf.IndexOf(name) != -1 {
 				return true
 			}
-		case "map":
+		case "map", "cidr":
 			if _, exists := list.Names[name]; exists {
 				return true
 			}
@@ -59,14 +93,12 @@ func (pd *PopData) Doubtlisted(name string) bool {
 			pd.Logger.Printf("Doubtlisted: checking %s in doubtlist %s", name, list.Name)
 		}
 		switch list.Format {
-		case "map":
+		case "map", "cidr":
 			if _, exists := list.Names[name]; exists {
 				return true
 			}
 			//		case "trie":
 			//			return list.Trie.Search(name) != nil
-		default:
-			log.Fatalf("Unknown doubtlist format %s", list.Format)
 		}
 	}
 	return false
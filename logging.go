@@ -86,6 +86,30 @@ func SetupLogging(conf *Config) {
 		conf.Loggers.Dnsengine = log.Default()
 	}
 
+	logfile = viper.GetString("apiserver.logfile")
+	if logfile != "" {
+		logfile = filepath.Clean(logfile)
+		f, err := os.OpenFile(logfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644) // #nosec G302
+		if err != nil {
+			POPExiter("error opening TAPIR-POP API audit logfile '%s': %v", logfile, err)
+		}
+
+		if debug {
+			prefix = "api: "
+		}
+		conf.Loggers.Api = log.New(f, prefix, logoptions)
+		conf.Loggers.Api.SetOutput(&lumberjack.Logger{
+			Filename:   logfile,
+			MaxSize:    20,
+			MaxBackups: 3,
+			MaxAge:     14,
+		})
+		fmt.Printf("TAPIR-POP API audit logging to: %s\n", logfile)
+	} else {
+		log.Println("No API audit logfile specified, using default")
+		conf.Loggers.Api = log.Default()
+	}
+
 	logfile = viper.GetString("tapir.mqtt.logfile")
 	if logfile != "" {
 		logfile = filepath.Clean(logfile)
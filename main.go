@@ -5,14 +5,14 @@
 package main
 
 import (
-    "encoding/gob"
+	"context"
+	"encoding/gob"
 	"fmt"
 	"log"
 
 	"os"
 	"os/signal"
 
-	"sync"
 	"syscall"
 	"time"
 
@@ -33,43 +33,59 @@ func (pd *PopData) SaveRpzSerial() error {
 	// Save the current value of pd.Downstreams.Serial to a text file
 	serialFile := viper.GetString("services.rpz.serialcache")
 	if serialFile == "" {
-		log.Fatalf("POPExiter:No serial cache file specified")
+		return fmt.Errorf("no serial cache file specified (key services.rpz.serialcache)")
 	}
 	// serialData := []byte(fmt.Sprintf("%d", pd.Rpz.CurrentSerial))
 	// err := os.WriteFile(serialFile, serialData, 0644)
-	serialYaml := fmt.Sprintf("current_serial: %d\n", pd.Rpz.CurrentSerial)
+	serial := pd.Rpz.CurrentSerial()
+	serialYaml := fmt.Sprintf("current_serial: %d\n", serial)
 	err := os.WriteFile(serialFile, []byte(serialYaml), 0644) // #nosec G306
 	if err != nil {
 		log.Printf("Error writing YAML serial to file: %v", err)
 	} else {
-		log.Printf("Saved current serial %d to file %s", pd.Rpz.CurrentSerial, serialFile)
+		log.Printf("Saved current serial %d to file %s", serial, serialFile)
 	}
 	return err
 }
 
+// BackupListsState saves the MQTT lists (of all list types) that have a backup file.
 func (pd *PopData) BackupListsState() {
-    for _, l := range pd.Lists["doubtlist"] {
-        func() {
-            if l.Datasource != "mqtt" || l.BackupFile == "" {
-                return
-            }
-
-            file, err := os.Create(l.BackupFile)
-            defer file.Close()
-            if err != nil {
-                pd.Logger.Printf("Skipped creating backup file '%s' due to error: %s", l.BackupFile, err)
-                return
-            }
-            encoder := gob.NewEncoder(file)
-            encoder.Encode(l.Names)
-        }()
-    }
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+	for _, listtype := range []string{"allowlist", "doubtlist", "denylist"} {
+		for _, l := range pd.Lists[listtype] {
+			if l.Datasource != "mqtt" || l.BackupFile == "" {
+				continue
+			}
+			pd.backupList(l)
+		}
+	}
 }
 
-func mainloop(conf *Config, configfile *string, pd *PopData) {
+// backupList saves the names and the position of the list l to its backup file. Must be called
+// with pd.mu held (for reading).
+func (pd *PopData) backupList(l *tapir.WBGlist) {
+	file, err := os.Create(l.BackupFile)
+	if err != nil {
+		pd.Logger.Printf("Skipped creating backup file '%s' due to error: %s", l.BackupFile, err)
+		return
+	}
+	defer file.Close()
+	encoder := gob.NewEncoder(file)
+	err = encoder.Encode(ListBackup{Position: pd.Positions[l], Names: l.Names})
+	if err != nil {
+		pd.Logger.Printf("Error writing backup file '%s': %v", l.BackupFile, err)
+		return
+	}
+	pd.Logger.Printf("Saved %d names from list [%s][%s] to backup file '%s'", len(l.Names), l.Type, l.Name, l.BackupFile)
+}
+
+// mainloop returns when TAPIR-POP has been told to stop, either via SIGINT/SIGTERM or via
+// the API "stop" command, and the shutdown has been completed.
+func mainloop(conf *Config, configfile *string, pd *PopData, stopch chan struct{}) {
 	log.Println("mainloop: enter")
-	exit := make(chan os.Signal, 1)
-	signal.Notify(exit, syscall.SIGINT, syscall.SIGTERM)
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
 	hupper := make(chan os.Signal, 1)
 	signal.Notify(hupper, syscall.SIGHUP)
 
@@ -99,48 +115,37 @@ func mainloop(conf *Config, configfile *string, pd *PopData) {
 		os.Exit(1)
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	go func() {
-		for {
-			// log.Println("mainloop: signal dispatcher")
-			select {
-			case <-exit:
-				log.Println("mainloop: Exit signal received. Cleaning up.")
-				err := pd.SaveRpzSerial()
-				if err != nil {
-					log.Printf("Error saving RPZ serial: %v", err)
-				}
-
-				pd.BackupListsState()
-
-				// do whatever we need to do to wrap up nicely
-				wg.Done()
-			case <-hupper:
-				// config file to use has already been set in main()
-				if err := viper.ReadInConfig(); err == nil {
-					fmt.Fprintln(os.Stderr, "Using config file:", *configfile)
-				} else {
-					POPExiter("Could not load config %s: Error: %v", *configfile, err)
-				}
-
-				log.Println("mainloop: SIGHUP received. Forcing refresh of all configured zones.")
-				log.Printf("mainloop: Requesting refresh of all RPZ zones")
-				conf.PopData.RpzRefreshCh <- RpzRefresh{Name: ""}
-			case <-conf.Internal.APIStopCh:
-				log.Printf("mainloop: API instruction to stop\n")
-				err := pd.SaveRpzSerial()
-				if err != nil {
-					log.Printf("Error saving RPZ serial: %v", err)
-				}
-				wg.Done()
+loop:
+	for {
+		// log.Println("mainloop: signal dispatcher")
+		select {
+		case <-ctx.Done():
+			log.Println("mainloop: Exit signal received. Cleaning up.")
+			break loop
+		case <-hupper:
+			// config file to use has already been set in main()
+			if err := viper.ReadInConfig(); err == nil {
+				fmt.Fprintln(os.Stderr, "Using config file:", *configfile)
+			} else {
+				POPExiter("Could not load config %s: Error: %v", *configfile, err)
 			}
+
+			log.Println("mainloop: SIGHUP received. Forcing refresh of all configured zones.")
+			log.Printf("mainloop: Requesting refresh of all RPZ zones")
+			conf.PopData.RpzRefreshCh <- RpzRefresh{Name: ""}
+		case <-conf.Internal.APIStopCh:
+			log.Printf("mainloop: API instruction to stop\n")
+			break loop
 		}
-	}()
-	wg.Wait()
+	}
 
 	log.Println("mainloop: leaving signal dispatcher")
+	err := pd.Shutdown(conf, stopch)
+	if err != nil {
+		log.Printf("mainloop: shutdown was not clean: %v", err)
+	} else {
+		log.Println("mainloop: shutdown complete")
+	}
 }
 
 var Gconfig Config
@@ -223,19 +228,29 @@ func main() {
 	if pd.MqttEngine == nil {
 		pd.mu.Lock()
 		err := pd.CreateMqttEngine(mqttclientid, statusch, pd.MqttLogger)
+		pd.mu.Unlock()
 		if err != nil {
 			POPExiter("Error creating MQTT Engine: %v", err)
 		}
-		pd.mu.Unlock()
 		err = pd.StartMqttEngine(pd.MqttEngine)
 		if err != nil {
 			POPExiter("Error starting MQTT Engine: %v", err)
 		}
 	}
 
-	go pd.ConfigUpdater(&Gconfig, stopch) // Note that ConfigUpdater must as early as possible
-	go pd.StatusUpdater(&Gconfig, stopch) // Note that StatusUpdater must as early as possible
-	go pd.RefreshEngine(&Gconfig, stopch)
+	// The MQTT outputs need the MQTT Engine, and the downstreams must be known before the first
+	// output is generated by ParseSourcesNG
+	err = pd.ParseOutputs()
+	if err != nil {
+		POPExiter("Error from ParseOutputs: %v", err)
+	}
+
+	go pd.ConfigUpdater(&Gconfig, stopch)              // Note that ConfigUpdater must as early as possible
+	pd.startEngine(pd.StatusUpdater, &Gconfig, stopch) // Note that StatusUpdater must as early as possible
+	pd.startEngine(pd.RefreshEngine, &Gconfig, stopch)
+	pd.startEngine(pd.Reconciler, &Gconfig, stopch)
+	pd.startEngine(pd.PolicyPublisher, &Gconfig, stopch)
+	pd.startEngine(pd.HttpRefresher, &Gconfig, stopch)
 
 	log.Println("*** main: Calling ParseSourcesNG()")
 	err = pd.ParseSourcesNG()
@@ -244,13 +259,9 @@ func main() {
 	}
 	log.Println("*** main: Returned from ParseSourcesNG()")
 
-	err = pd.ParseOutputs()
-	if err != nil {
-		POPExiter("Error from ParseOutputs: %v", err)
-	}
-
-	apistopper := make(chan struct{}) //
+	apistopper := make(chan struct{}, 1)
 	Gconfig.Internal.APIStopCh = apistopper
+	Gconfig.Internal.Servers = &ServerRegistry{}
 	go APIhandler(&Gconfig, apistopper)
 	//	go httpsserver(&conf, apistopper)
 
@@ -268,5 +279,6 @@ func main() {
 		TimeStamp: time.Now(),
 	}
 
-	mainloop(&Gconfig, &cfgFileUsed, pd)
+	mainloop(&Gconfig, &cfgFileUsed, pd, stopch)
+	os.Exit(0)
 }
@@ -15,13 +15,13 @@ import (
 
 func (pd *PopData) CreateMqttEngine(clientid string, statusch chan tapir.ComponentStatusUpdate, lg *log.Logger) error {
 	if clientid == "" {
-		POPExiter("Error starting MQTT Engine: clientid not specified in config")
+		return fmt.Errorf("error starting MQTT Engine: clientid not specified in config")
 	}
 	var err error
 	pd.Logger.Printf("Creating MQTT Engine with clientid %s", clientid)
-	pd.MqttEngine, err = tapir.NewMqttEngine("tapir-pop", clientid, tapir.TapirSub, statusch, lg) // sub, but no pub
+	pd.MqttEngine, err = tapir.NewMqttEngine("tapir-pop", clientid, tapir.TapirSub|tapir.TapirPub, statusch, lg) // pub for the status and the MQTT outputs
 	if err != nil {
-		POPExiter("Error from NewMqttEngine: %v\n", err)
+		return fmt.Errorf("error from NewMqttEngine: %v", err)
 	}
 	return nil
 }
@@ -33,7 +33,7 @@ func (pd *PopData) StartMqttEngine(meng *tapir.MqttEngine) error {
 
 	cmnder, outbox, inbox, err := meng.StartEngine()
 	if err != nil {
-		log.Fatalf("Error from StartEngine(): %v", err)
+		return fmt.Errorf("error from StartEngine(): %v", err)
 	}
 	pd.TapirMqttCmdCh = cmnder
 	pd.TapirMqttPubCh = outbox
@@ -53,8 +53,9 @@ func (pd *PopData) StartMqttEngine(meng *tapir.MqttEngine) error {
 //    - if different, add the diff (DEL+ADD) to a growing "IXFR" describing the consequences of the update.
 //
 
+// addrs are the addresses of the names in the update, if any (see ObservedAddrs).
 // func (pd *PopData) ProcessTapirUpdate(tpkg tapir.MqttPkgIn) (bool, error) {
-func (pd *PopData) ProcessTapirUpdate(tm tapir.TapirMsg) (bool, error) {
+func (pd *PopData) ProcessTapirUpdate(tm tapir.TapirMsg, addrs ObservedAddrs) (bool, error) {
 	//	tm := tapir.TapirMsg{}
 	//	err := json.Unmarshal(tpkg.Payload, &tm)
 	//	if err != nil {
@@ -62,6 +63,28 @@ func (pd *PopData) ProcessTapirUpdate(tm tapir.TapirMsg) (bool, error) {
 	//		return false, fmt.Errorf("MQTT: failed to decode json: %v", err)
 	//	}
 
+	// The list update and the policy evaluation must be one unit, otherwise a concurrent
+	// update of another list could be evaluated against a half-updated state.
+	pd.mu.Lock()
+	if pd.bufferUpdate(tm, addrs) {
+		pd.mu.Unlock()
+		return true, nil
+	}
+	ixfr, err := pd.applyTapirUpdate(tm, addrs)
+	pd.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if !ixfr.Empty() {
+		err = pd.NotifyDownstreams()
+	}
+	return true, err // return to RefreshEngine
+}
+
+// applyTapirUpdate updates the list that tm refers to and generates the resulting IXFR. The
+// observed addresses of the names with a badip tag are added to the list as rpz-ip entries, see
+// badipTriggers. Must be called with pd.mu held for writing.
+func (pd *PopData) applyTapirUpdate(tm tapir.TapirMsg, addrs ObservedAddrs) (RpzIxfr, error) {
 	if pd.Debug {
 		pd.Logger.Printf("ProcessTapirUpdate: update of MQTT source %s contains %d adds and %d removes",
 			tm.SrcName, len(tm.Added), len(tm.Removed))
@@ -78,12 +101,35 @@ func (pd *PopData) ProcessTapirUpdate(tm tapir.TapirMsg) (bool, error) {
 		wbgl, exists = pd.Lists[tm.ListType][tm.SrcName]
 	default:
 		pd.Logger.Printf("TapirUpdate for unknown listtype from source \"%s\" rejected.", tm.SrcName)
-		return false, fmt.Errorf("MQTT ListType %s is unknown, update rejected", tm.ListType)
+		return RpzIxfr{}, fmt.Errorf("MQTT ListType %s is unknown, update rejected", tm.ListType)
 	}
 
 	if !exists {
 		pd.Logger.Printf("TapirUpdate for unknown source \"%s\" rejected.", tm.SrcName)
-		return false, fmt.Errorf("MQTT Source %s is unknown, update rejected", tm.SrcName)
+		return RpzIxfr{}, fmt.Errorf("MQTT Source %s is unknown, update rejected", tm.SrcName)
+	}
+
+	// The updates up to the time of the bootstrap snapshot (or backup) are already in the list
+	if bt := pd.Bootstrapped[wbgl]; !tm.TimeStamp.IsZero() && tm.TimeStamp.Before(bt) {
+		pd.Logger.Printf("ProcessTapirUpdate: update of %s from %s is older than the bootstrap snapshot (%s), already applied",
+			wbgl.Name, tm.TimeStamp.Format(tapir.TimeLayout), bt.Format(tapir.TimeLayout))
+		return RpzIxfr{}, nil
+	}
+	pos := pd.Positions[wbgl]
+	pos.Updates++
+	if tm.TimeStamp.After(pos.Time) {
+		pos.Time = tm.TimeStamp
+	}
+	pd.Positions[wbgl] = pos
+	pd.orderNames(wbgl, &tm)
+
+	tree := pd.Cidrs[wbgl]
+	if wbgl.Format == "cidr" {
+		tm.Added = pd.cidrNames(wbgl, tm.Added)
+		tm.Removed = pd.cidrNames(wbgl, tm.Removed)
+	} else {
+		tm.Added = append(tm.Added, pd.badipTriggers(wbgl, tm.Added, addrs)...)
+		tm.Removed = append(tm.Removed, pd.badipRemovals(wbgl, tm.Removed)...)
 	}
 
 	for _, tname := range tm.Added {
@@ -94,32 +140,19 @@ func (pd *PopData) ProcessTapirUpdate(tm tapir.TapirMsg) (bool, error) {
 			TTL:       ttl,
 			TagMask:   tname.TagMask,
 		}
+		if _, derived := pd.BadipRefs[wbgl][tmp.Name]; derived {
+			tmp.SrcFormat = badipSrcFormat
+		}
 		wbgl.Names[tname.Name] = tmp
+		if tree != nil {
+			t, _ := ParseRpzTrigger(tname.Name)
+			tree.Insert(t.Prefix)
+		}
 
 		pd.Logger.Printf("ProcessTapirUpdate: adding name %s to %s (TimeAdded: %s ttl: %v)",
 			tname.Name, wbgl.Name, tname.TimeAdded.Format(tapir.TimeLayout), tname.TTL)
 
-		// Time that the name will be removed from the list
-		// must ensure that reapertime is at least ReaperInterval into the future
-		reptime := tname.TimeAdded.Add(ttl).Truncate(pd.ReaperInterval).Add(pd.ReaperInterval)
-
-		// Ensure that there are no prior removal events for this name
-		for reaperTime, namesMap := range wbgl.ReaperData {
-			if reaperTime.Before(reptime) {
-				if _, exists := namesMap[tname.Name]; exists {
-					delete(namesMap, tname.Name)
-					if len(namesMap) == 0 {
-						delete(wbgl.ReaperData, reaperTime)
-					}
-				}
-			}
-		}
-
-		// Add the name to the removal list for the time it will be removed
-		if wbgl.ReaperData[reptime] == nil {
-			wbgl.ReaperData[reptime] = make(map[string]bool)
-		}
-		wbgl.ReaperData[reptime][tname.Name] = true
+		pd.scheduleReaping(wbgl, tname.Name, tname.TimeAdded.Add(ttl))
 	}
 
 	pd.Logger.Printf("ProcessTapirUpdate: current state of %s %s ReaperData:", tm.ListType, wbgl.Name)
@@ -137,37 +170,27 @@ func (pd *PopData) ProcessTapirUpdate(tm tapir.TapirMsg) (bool, error) {
 
 	for _, tname := range tm.Removed {
 		delete(wbgl.Names, dns.Fqdn(tname.Name))
+		if tree != nil {
+			t, _ := ParseRpzTrigger(tname.Name)
+			tree.Delete(t.Prefix)
+		}
 	}
 
-	ixfr, err := pd.GenerateRpzIxfr(&tm)
-	if err != nil {
-		return false, err
-	}
-	err = pd.ProcessIxfrIntoAxfr(ixfr)
-	return true, err // return to RefreshEngine
+	return pd.GenerateRpzIxfr(&tm, PolicyTrigger{Kind: TriggerMqtt, Source: tm.SrcName})
 }
 
-func (pd *PopData) ProcessIxfrIntoAxfr(ixfr RpzIxfr) error {
-	for _, tn := range ixfr.Removed {
-		delete(pd.Rpz.Axfr.Data, tn.Name)
-		if pd.Debug {
-			pd.Logger.Printf("PIIA: Deleting domain %s", tn.Name)
+// cidrNames returns domains with the prefixes in CIDR notation replaced by their names in the
+// CIDR list wbgl, see CidrName. Invalid prefixes are logged and dropped.
+func (pd *PopData) cidrNames(wbgl *tapir.WBGlist, domains []tapir.Domain) []tapir.Domain {
+	res := make([]tapir.Domain, 0, len(domains))
+	for _, d := range domains {
+		name, _, err := CidrName(d.Name)
+		if err != nil {
+			pd.Logger.Printf("ProcessTapirUpdate: invalid prefix %q for CIDR list %s ignored: %v", d.Name, wbgl.Name, err)
+			continue
 		}
+		d.Name = name
+		res = append(res, d)
 	}
-	for _, tn := range ixfr.Added {
-		if _, exist := pd.Rpz.Axfr.Data[tn.Name]; exist {
-			// XXX: this should not happen.
-			pd.Logger.Printf("Error: ProcessIxfrIntoAxfr: domain %s already exists. This should not happen.",
-				tn.Name)
-		} else {
-			pd.Rpz.Axfr.Data[tn.Name] = tn
-			if pd.Debug {
-				pd.Logger.Printf("PIIA: Adding domain %s", tn.Name)
-			}
-		}
-	}
-
-	//	pd.Logger.Printf("PIIA Notifying %d downstreams for RPZ zone %s", len(pd.RpzDownstreams), pd.Rpz.ZoneName)
-	err := pd.NotifyDownstreams()
-	return err
+	return res
 }
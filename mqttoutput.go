@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/dnstapir/tapir"
+)
+
+// An MQTT output (format "tapir-mqtt-1") publishes the changes of the RPZ policy, i.e. the rules
+// that every new IXFR adds and removes, as signed TAPIR messages. Edge components and other POPs
+// can subscribe to the decided policy instead of the raw intelligence.
+
+// PolicyMsg is a change of the policy. It is a tapir.TapirMsg, so any MQTT source can consume it,
+// with the action of every added name and the sequence number of the message (see ParseMsgSeq).
+type PolicyMsg struct {
+	tapir.TapirMsg
+	Added  []PolicyDomain // replaces TapirMsg.Added
+	Seq    uint64
+	Serial uint32 // of the RPZ output after the change
+}
+
+// PolicyDomain is a name that has been added to the policy, or whose action has changed.
+type PolicyDomain struct {
+	tapir.Domain
+	Action string
+}
+
+// MqttOutput is an output that publishes PolicyMsgs on an MQTT topic.
+type MqttOutput struct {
+	Name     string // the SrcName of the messages
+	ListType string // the ListType of the messages
+	Topic    string
+	seq      atomic.Uint64
+}
+
+const policyQueueSize = 100
+
+// addMqttOutput sets up the MQTT output output: the topic, with the messages signed with the key
+// in output.SigningKey.
+func (pd *PopData) addMqttOutput(name string, output PopOutput) error {
+	if pd.MqttEngine == nil {
+		return fmt.Errorf("MQTT Engine not running")
+	}
+	if output.Topic == "" || output.SigningKey == "" {
+		return fmt.Errorf("both topic and signingkey must be set")
+	}
+	signkey, err := tapir.FetchMqttSigningKey(output.Topic, filepath.Clean(output.SigningKey))
+	if err != nil {
+		return fmt.Errorf("error fetching MQTT signing key %s: %v", output.SigningKey, err)
+	}
+	if _, err := pd.MqttEngine.PubToTopic(output.Topic, signkey, "struct", true); err != nil { // XXX: Brr. kludge.
+		return fmt.Errorf("error adding topic %s to MQTT Engine: %v", output.Topic, err)
+	}
+	mo := &MqttOutput{Name: output.Name, ListType: output.Type, Topic: output.Topic}
+	if mo.Name == "" {
+		mo.Name = name
+	}
+	if mo.ListType == "" {
+		mo.ListType = "doubtlist"
+	}
+	pd.mu.Lock()
+	pd.MqttOutputs = append(pd.MqttOutputs, mo)
+	pd.mu.Unlock()
+	pd.Logger.Printf("Output %s: publishing the policy changes on MQTT topic %s", name, output.Topic)
+	return nil
+}
+
+// publishPolicy queues the changes in ixfr, made at the time now, for publication on the MQTT
+// outputs. If PolicyPublisher is not keeping up, the changes are dropped; the subscribers see a
+// gap in the sequence numbers. Must be called with pd.mu held (at least for reading) and
+// pd.Rpz.writer held, so that the changes are queued in the order of the serials.
+func (pd *PopData) publishPolicy(ixfr RpzIxfr, now time.Time) {
+	if len(pd.MqttOutputs) == 0 {
+		return
+	}
+	added := make([]PolicyDomain, 0, len(ixfr.Added))
+	changed := map[string]bool{}
+	for _, rn := range ixfr.Added {
+		added = append(added, PolicyDomain{
+			Domain: tapir.Domain{Name: rn.Name, TimeAdded: now},
+			Action: ActionString(rn.Action),
+		})
+		changed[rn.Name] = true
+	}
+	var removed []tapir.Domain
+	for _, rn := range ixfr.Removed {
+		if !changed[rn.Name] { // else replaced by the new rule
+			removed = append(removed, tapir.Domain{Name: rn.Name})
+		}
+	}
+
+	for _, mo := range pd.MqttOutputs {
+		msg := PolicyMsg{
+			TapirMsg: tapir.TapirMsg{
+				SrcName:   mo.Name,
+				Creator:   "tapir-pop",
+				MsgType:   "intel-update",
+				ListType:  mo.ListType,
+				Removed:   removed,
+				TimeStamp: now,
+				TimeStr:   now.Format(tapir.TimeLayout),
+			},
+			Added:  added,
+			Seq:    mo.seq.Add(1),
+			Serial: ixfr.ToSerial,
+		}
+		select {
+		case pd.PolicyUpdates <- tapir.MqttPkgOut{Topic: mo.Topic, Type: "raw", RawData: msg}:
+		default:
+			pd.ReportStatus("mqtt-output", tapir.StatusWarn, "Policy change %d (serial %d) not published on %s, the queue is full",
+				msg.Seq, ixfr.ToSerial, mo.Topic)
+		}
+	}
+}
+
+// PolicyPublisher hands the queued policy changes (see publishPolicy) to the MQTT Engine.
+func (pd *PopData) PolicyPublisher(conf *Config, stopch chan struct{}) {
+	log.Printf("PolicyPublisher: Starting")
+	for {
+		select {
+		case pkg := <-pd.PolicyUpdates:
+			select {
+			case pd.TapirMqttPubCh <- pkg:
+			case <-stopch:
+				log.Printf("PolicyPublisher: stopping")
+				return
+			}
+		case <-stopch:
+			log.Printf("PolicyPublisher: stopping")
+			return
+		}
+	}
+}
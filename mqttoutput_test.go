@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+)
+
+func TestPublishPolicy(t *testing.T) {
+	pd, _ := newPopData(t)
+	tp := &testPop{pd: pd}
+	allow := tp.addList("allowlist", "local-allow", "file", "good.example.")
+	wbgl := tp.addList("doubtlist", "dns-tapir", "mqtt")
+	if _, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup}); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	pd.MqttOutputs = []*MqttOutput{{Name: "dns-tapir-out", ListType: "doubtlist", Topic: "events/up/pop/policy"}}
+	pd.PolicyUpdates = make(chan tapir.MqttPkgOut, 1)
+
+	update := func(added, removed []string) {
+		t.Helper()
+		tm := tapir.TapirMsg{SrcName: "dns-tapir", ListType: "doubtlist", MsgType: "observation", TimeStamp: time.Now()}
+		for _, name := range added {
+			tm.Added = append(tm.Added, tapir.Domain{Name: name, TimeAdded: time.Now(), TTL: 3600})
+		}
+		for _, name := range removed {
+			tm.Removed = append(tm.Removed, tapir.Domain{Name: name})
+		}
+		if ok, err := pd.ProcessTapirUpdate(tm, nil); !ok || err != nil {
+			t.Fatalf("ProcessTapirUpdate: %t, %v", ok, err)
+		}
+	}
+	// What the subscribers get
+	receive := func() (tapir.TapirMsg, PolicyMsg, uint64) {
+		t.Helper()
+		var pkg tapir.MqttPkgOut
+		select {
+		case pkg = <-pd.PolicyUpdates:
+		default:
+			t.Fatalf("no policy change published")
+		}
+		if pkg.Topic != "events/up/pop/policy" || pkg.Type != "raw" {
+			t.Errorf("published on %s as %s", pkg.Topic, pkg.Type)
+		}
+		payload, err := json.Marshal(pkg.RawData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tm tapir.TapirMsg
+		var pm PolicyMsg
+		if err := json.Unmarshal(payload, &tm); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(payload, &pm); err != nil {
+			t.Fatal(err)
+		}
+		return tm, pm, ParseMsgSeq(payload)
+	}
+
+	update([]string{"evil.example.", "good.example."}, nil) // the allowlisted name is not in the policy
+	tm, pm, seq := receive()
+	if tm.SrcName != "dns-tapir-out" || tm.ListType != "doubtlist" || len(tm.Added) != 1 || tm.Added[0].Name != "evil.example." || seq != 1 {
+		t.Errorf("published addition: %+v, seq %d", tm, seq)
+	}
+	if len(pm.Added) != 1 || pm.Added[0].Action != "NXDOMAIN" || pm.Serial != pd.Rpz.CurrentSerial() {
+		t.Errorf("published addition: %+v, want the action and serial %d", pm, pd.Rpz.CurrentSerial())
+	}
+
+	// A new action replaces the rule, it is not a removal
+	pd.mu.Lock()
+	pd.Policy.Doubtlist.NumSourcesAction = tapir.DROP
+	pd.mu.Unlock()
+	update([]string{"evil.example."}, nil)
+	if tm, pm, seq := receive(); len(tm.Removed) != 0 || len(pm.Added) != 1 || pm.Added[0].Action != "DROP" || seq != 2 {
+		t.Errorf("published change of action: %+v, seq %d", pm, seq)
+	}
+
+	// The subscribers see a gap if a change is dropped
+	update(nil, []string{"evil.example."})
+	update([]string{"other.example."}, nil) // queue full
+	if tm, _, seq := receive(); len(tm.Removed) != 1 || tm.Removed[0].Name != "evil.example." || seq != 3 {
+		t.Errorf("published removal: %+v, seq %d", tm, seq)
+	}
+	update(nil, []string{"other.example."})
+	if _, _, seq := receive(); seq != 5 {
+		t.Errorf("sequence number after a dropped change %d, want 5", seq)
+	}
+	if _, exist := wbgl.Names["other.example."]; exist {
+		t.Errorf("other.example. still in the list")
+	}
+
+	// A regenerated output is published as the changes from the previous one
+	regenerate := func() {
+		t.Helper()
+		pd.mu.Lock()
+		defer pd.mu.Unlock()
+		if _, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerApi, Source: "test"}); err != nil {
+			t.Fatalf("GenerateRpzAxfr: %v", err)
+		}
+	}
+	pd.mu.Lock()
+	delete(allow.Names, "good.example.")
+	wbgl.Names["axfr.example."] = tapir.TapirName{Name: "axfr.example.", TimeAdded: time.Now()}
+	pd.mu.Unlock()
+	regenerate()
+	if tm, pm, seq := receive(); len(pm.Added) != 2 || pm.Added[0].Name != "axfr.example." || pm.Added[1].Name != "good.example." ||
+		len(tm.Removed) != 0 || seq != 6 || pm.Serial != pd.Rpz.CurrentSerial() {
+		t.Errorf("published regenerated output: %+v, seq %d", pm, seq)
+	}
+	pd.mu.Lock()
+	delete(wbgl.Names, "axfr.example.")
+	pd.mu.Unlock()
+	regenerate()
+	if tm, pm, seq := receive(); len(pm.Added) != 0 || len(tm.Removed) != 1 || tm.Removed[0].Name != "axfr.example." || seq != 7 {
+		t.Errorf("published regenerated output: %+v, seq %d", tm, seq)
+	}
+	regenerate()
+	select {
+	case pkg := <-pd.PolicyUpdates:
+		t.Errorf("unchanged output published: %+v", pkg.RawData)
+	default:
+	}
+}
@@ -5,12 +5,13 @@
 package main
 
 import (
-	"log"
+	"fmt"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dnstapir/tapir"
 	"github.com/spf13/viper"
@@ -24,29 +25,36 @@ type PopOutput struct {
 	Type        string // listtype, usually "doubtlist"
 	Format      string // i.e. rpz, etc
 	Downstream  string
+	Topic       string // MQTT outputs: the topic to publish the policy changes on
+	SigningKey  string // MQTT outputs: the key to sign the messages with
+	Url         string // HTTP outputs: where to serve the policy
 }
 
 type PopOutputs struct {
 	Outputs map[string]PopOutput
 }
 
+// ParseOutputs sets up the outputs in the config. It is called by main after the MQTT Engine is
+// created, as the MQTT outputs publish via the engine.
 func (pd *PopData) ParseOutputs() error {
-	pd.Logger.Printf("ParseOutputs: reading outputs from %s", tapir.PopOutputsCfgFile)
-	cfgdata, err := os.ReadFile(tapir.PopOutputsCfgFile)
-	if err != nil {
-		log.Fatalf("Error from ReadFile(%s): %v", tapir.PopOutputsCfgFile, err)
-	}
-
+	// The outputs config (tapir.PopOutputsCfgFile) has already been merged into the viper config in main()
+	pd.Logger.Printf("ParseOutputs: reading outputs from config")
 	var oconf = PopOutputs{
 		Outputs: make(map[string]PopOutput),
 	}
 
-	// pd.Logger.Printf("ParseOutputs: config read: %s", cfgdata)
-	err = yaml.Unmarshal(cfgdata, &oconf)
+	err := viper.UnmarshalKey("outputs", &oconf.Outputs)
 	if err != nil {
-		log.Fatalf("Error from yaml.Unmarshal(OutputsConfig): %v", err)
+		return fmt.Errorf("error unmarshalling outputs config: %v", err)
 	}
 
+	// Parsing the outputs again replaces them, rather than adding them a second time
+	pd.mu.Lock()
+	pd.MqttOutputs = nil
+	pd.HttpOutputs = nil
+	pd.Downstreams = map[string]RpzDownstream{}
+	pd.mu.Unlock()
+
 	pd.Logger.Printf("ParseOutputs: found %d outputs", len(oconf.Outputs))
 	for name, v := range oconf.Outputs {
 		pd.Logger.Printf("ParseOutputs: output %s: type %s, format %s, downstream %s",
@@ -54,6 +62,20 @@ func (pd *PopData) ParseOutputs() error {
 	}
 
 	for name, output := range oconf.Outputs {
+		if output.Active && strings.ToLower(output.Format) == "tapir-mqtt-1" {
+			if err := pd.addMqttOutput(name, output); err != nil {
+				pd.Logger.Printf("Output %s: not used: %v", name, err)
+				pd.ReportStatus("mqtt-output", tapir.StatusFail, "Output %s not used: %v", name, err)
+			}
+			continue
+		}
+		if output.Active && strings.ToLower(output.Format) == "tapir-http-1" {
+			if err := pd.addHttpOutput(name, output); err != nil {
+				pd.Logger.Printf("Output %s: not used: %v", name, err)
+				pd.ReportStatus("http-output", tapir.StatusFail, "Output %s not used: %v", name, err)
+			}
+			continue
+		}
 		if output.Active && strings.ToLower(output.Format) == "rpz" {
 			pd.Logger.Printf("Output %s: Adding RPZ downstream %s to list of Notify receivers", name, output.Downstream)
 			addr, port, err := net.SplitHostPort(output.Downstream)
@@ -73,6 +95,12 @@ func (pd *PopData) ParseOutputs() error {
 			pd.Downstreams[addr] = RpzDownstream{Address: addr, Port: portInt}
 		}
 	}
+	return nil
+}
+
+// LoadRpzSerial reads the serial of the output zone saved by the previous run (see SaveRpzSerial).
+// It must be called before BootstrapRpzOutput.
+func (pd *PopData) LoadRpzSerial() {
 	// Read the current value of pd.Downstreams.Serial from a text file
 	serialFile := viper.GetString("services.rpz.serialcache")
 
@@ -81,7 +109,7 @@ func (pd *PopData) ParseOutputs() error {
 		serialData, err := os.ReadFile(serialFile)
 		if err != nil {
 			pd.Logger.Printf("Error reading serial from file %s: %v", serialFile, err)
-			pd.Rpz.CurrentSerial = 1
+			pd.Rpz.initialSerial = 1
 		} else {
 			var serialYaml struct {
 				CurrentSerial uint32 `yaml:"current_serial"`
@@ -89,28 +117,27 @@ func (pd *PopData) ParseOutputs() error {
 			err = yaml.Unmarshal(serialData, &serialYaml)
 			if err != nil {
 				pd.Logger.Printf("Error unmarshalling YAML serial data: %v", err)
-				pd.Rpz.CurrentSerial = 1
+				pd.Rpz.initialSerial = 1
 			} else {
-				pd.Rpz.CurrentSerial = serialYaml.CurrentSerial
-				pd.Logger.Printf("Loaded serial %d from file %s", pd.Rpz.CurrentSerial, serialFile)
+				pd.Rpz.initialSerial = serialYaml.CurrentSerial
+				pd.Logger.Printf("Loaded serial %d from file %s", pd.Rpz.initialSerial, serialFile)
 			}
 		}
 	} else {
 		pd.Logger.Printf("No serial cache file specified, starting serial at 1")
-		pd.Rpz.CurrentSerial = 1
+		pd.Rpz.initialSerial = 1
 	}
-	// pd.Rpz.CurrentSerial = pd.Downstreams.Serial
-	return nil
 }
 
 // Note: we onlygethere when we know that this name is only doubtlisted
 // so no need tocheckfor allow- or denylisting
-func (pd *PopData) ComputeRpzDoubtlistAction(name string) tapir.Action {
+// Returns the action and the name of the policy rule that decided it.
+func (pd *PopData) ComputeRpzDoubtlistAction(name string) (tapir.Action, string) {
 
 	var doubtHits = map[string]*tapir.TapirName{}
 	for listname, list := range pd.Lists["doubtlist"] {
 		switch list.Format {
-		case "map":
+		case "map", "cidr":
 			if v, exists := list.Names[name]; exists {
 				// pd.Logger.Printf("ComputeRpzDoubtlistAction: found %s in doubtlist %s (%d names)",
 				// 	name, listname, len(list.Names))
@@ -120,14 +147,21 @@ func (pd *PopData) ComputeRpzDoubtlistAction(name string) tapir.Action {
 			//			if list.Trie.Search(name) != nil {
 			//				doubtHits = append(doubtHits, v)
 			//			}
-		default:
-			POPExiter("Unknown doubtlist format %s", list.Format)
-		}
+		} // other formats are rejected when the list is loaded, see checkListFormat
+	}
+	var tags tapir.TagMask
+	for _, tn := range doubtHits {
+		tags |= tn.TagMask
+	}
+	if tags&pd.Policy.Doubtlist.DenyTapirTags != 0 {
+		pd.Policy.Logger.Printf("ComputeRpzDoubtlistAction: name %s has one of the denytapir tags, action is %s",
+			name, ActionString(pd.Policy.Doubtlist.DenyTapirAction))
+		return pd.Policy.Doubtlist.DenyTapirAction, "doubtlist.denytapir"
 	}
 	if len(doubtHits) >= pd.Policy.Doubtlist.NumSources {
 		pd.Policy.Logger.Printf("ComputeRpzDoubtlistAction: name %s is in %d or more sources, action is %s",
-			name, pd.Policy.Doubtlist.NumSources, tapir.ActionToString[pd.Policy.Doubtlist.NumSourcesAction])
-		return pd.Policy.Doubtlist.NumSourcesAction
+			name, pd.Policy.Doubtlist.NumSources, ActionString(pd.Policy.Doubtlist.NumSourcesAction))
+		return pd.Policy.Doubtlist.NumSourcesAction, "doubtlist.numsources"
 	}
 	pd.Policy.Logger.Printf("ComputeRpzDoubtlistAction: name %s is in %d sources, not enough for action", name, len(doubtHits))
 
@@ -135,53 +169,98 @@ func (pd *PopData) ComputeRpzDoubtlistAction(name string) tapir.Action {
 		numtapirtags := doubtHits["dns-tapir"].TagMask.NumTags()
 		if numtapirtags >= pd.Policy.Doubtlist.NumTapirTags {
 			pd.Policy.Logger.Printf("ComputeRpzDoubtlistAction: name %s has more than %d tapir tags, action is %s",
-				name, pd.Policy.Doubtlist.NumTapirTags, tapir.ActionToString[pd.Policy.Doubtlist.NumTapirTagsAction])
-			return pd.Policy.Doubtlist.NumTapirTagsAction
+				name, pd.Policy.Doubtlist.NumTapirTags, ActionString(pd.Policy.Doubtlist.NumTapirTagsAction))
+			return pd.Policy.Doubtlist.NumTapirTagsAction, "doubtlist.numtapirtags"
 		}
 		pd.Policy.Logger.Printf("ComputeRpzDoubtlistAction: name %s has %d tapir tags, not enough for action", name, numtapirtags)
 	}
 	pd.Policy.Logger.Printf("ComputeRpzDoubtlistAction: name %s is present in %d doubtlists, but does not trigger any action",
 		name, len(doubtHits))
-	return pd.Policy.AllowlistAction
+	return pd.Policy.AllowlistAction, "doubtlist.noaction"
 }
 
-// Decision to block a doubtlisted name:
-// 1. More than N tags present
-// 2. Name is present in more than M sources
-// 3. Name
-
-func ApplyDoubtPolicy(name string, v *tapir.TapirName) string {
-	var rpzaction string
-	if v.HasAction(tapir.NXDOMAIN) {
-		rpzaction = "."
-	} else if v.HasAction(tapir.NODATA) {
-		rpzaction = "*."
-	} else if v.HasAction(tapir.DROP) {
-		rpzaction = "rpz-drop."
-	} else if v.TagMask != 0 {
-		log.Printf("there are tags")
-		rpzaction = "rpz-drop."
-	}
-
-	return rpzaction
+// RpzTtl returns the TTL of the RPZ rule for name, which got action from the policy rule (see
+// ComputeRpzAction). The TTL is the first that is set of:
+//  1. the shortest TTL of the sources (lists) that name is in
+//  2. the TTL for the action
+//  3. the TTL for the list type (denylist or doubtlist)
+//  4. services.rpz.ttl
+//
+// and with policy.ttl.lifetime set, it is never longer than the remaining lifetime of the TAPIR
+// observations of name, so that resolvers do not cache a block longer than the intelligence
+// behind it is valid. Must be called with pd.mu held.
+func (pd *PopData) RpzTtl(name string, action tapir.Action, rule string) uint32 {
+	tp := &pd.Policy.Ttl
+	ttl := pd.Rpz.Ttl
+	listtype := "doubtlist"
+	if rule == "denylist" {
+		listtype = "denylist"
+		if tp.Denylist != 0 {
+			ttl = tp.Denylist
+		}
+	} else if tp.Doubtlist != 0 {
+		ttl = tp.Doubtlist
+	}
+	if t, exist := tp.Actions[action]; exist {
+		ttl = t
+	}
+
+	var srcttl uint32
+	var expires time.Time // the last expiration of the observations of name
+	indefinite := false   // name is in a list without expiration
+	for listname, list := range pd.Lists[listtype] {
+		var tn tapir.TapirName
+		var found bool
+		switch list.Format {
+		case "dawg":
+			found = list.Dawgf.IndexOf(name) != -1
+		case "map", "cidr":
+			tn, found = list.Names[name]
+		}
+		if !found {
+			continue
+		}
+		if t, exist := tp.Sources[strings.ToLower(listname)]; exist && (srcttl == 0 || t < srcttl) {
+			srcttl = t
+		}
+		if tn.TTL == 0 || tn.TimeAdded.IsZero() {
+			indefinite = true
+		} else if exp := tn.TimeAdded.Add(tn.TTL); exp.After(expires) {
+			expires = exp
+		}
+	}
+	if srcttl != 0 {
+		ttl = srcttl
+	}
+	if tp.Lifetime && !indefinite && !expires.IsZero() {
+		remaining := expires.Sub(timeNow()).Truncate(time.Second)
+		if remaining < time.Duration(ttl)*time.Second {
+			ttl = uint32(max(remaining, 0) / time.Second)
+		}
+	}
+	return max(ttl, tp.Min)
 }
 
-func (pd *PopData) ComputeRpzAction(name string) tapir.Action {
+// timeNow is the clock of RpzTtl, replaced in tests.
+var timeNow = time.Now
+
+// Returns the action and the name of the policy rule that decided it.
+func (pd *PopData) ComputeRpzAction(name string) (tapir.Action, string) {
 	if pd.Allowlisted(name) {
 		if pd.Debug {
-			pd.Policy.Logger.Printf("ComputeRpzAction: name %s is doubtlisted, action is %s", name, tapir.ActionToString[pd.Policy.AllowlistAction])
+			pd.Policy.Logger.Printf("ComputeRpzAction: name %s is doubtlisted, action is %s", name, ActionString(pd.Policy.AllowlistAction))
 		}
-		return pd.Policy.AllowlistAction
+		return pd.Policy.AllowlistAction, "allowlist"
 	} else if pd.Denylisted(name) {
 		if pd.Debug {
-			pd.Policy.Logger.Printf("ComputeRpzAction: name %s is denylisted, action is %s", name, tapir.ActionToString[pd.Policy.DenylistAction])
+			pd.Policy.Logger.Printf("ComputeRpzAction: name %s is denylisted, action is %s", name, ActionString(pd.Policy.DenylistAction))
 		}
-		return pd.Policy.DenylistAction
+		return pd.Policy.DenylistAction, "denylist"
 	} else if pd.Doubtlisted(name) {
 		if pd.Debug {
 			pd.Policy.Logger.Printf("ComputeRpzAction: name %s is doubtlisted, needs further evaluation to determine action", name)
 		}
 		return pd.ComputeRpzDoubtlistAction(name) // This is not complete, only a placeholder for now.
 	}
-	return tapir.ALLOWLIST
+	return tapir.ALLOWLIST, "unlisted"
 }
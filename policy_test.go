@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/spf13/viper"
+)
+
+func TestComputeRpzAction(t *testing.T) {
+	pd, _ := newPopData(t)
+	tp := &testPop{pd: pd}
+	tp.addList("allowlist", "local-allow", "file", "good.example.com.", "both.example.com.")
+	tp.addList("denylist", "local-deny", "file", "evil.example.net.", "both.example.com.")
+	tp.addList("doubtlist", "feed-a", "xfr", "doubt1.example.org.", "doubt2.example.org.", "evil.example.net.")
+	tp.addList("doubtlist", "feed-b", "xfr", "doubt2.example.org.")
+	tapirfeed := tp.addList("doubtlist", "dns-tapir", "mqtt", "tagged.example.org.", "doubt2.example.org.")
+	const likelymalware tapir.TagMask = 1 << 2
+	pd.Policy.Doubtlist.DenyTapirTags = likelymalware
+	tn := tapirfeed.Names["tagged.example.org."]
+	tn.TagMask = likelymalware
+	tapirfeed.Names["tagged.example.org."] = tn
+
+	tests := []struct {
+		name       string
+		numsources int
+		wantAction tapir.Action
+		wantRule   string
+	}{
+		{"good.example.com.", 1, pd.Policy.AllowlistAction, "allowlist"},
+		{"both.example.com.", 1, pd.Policy.AllowlistAction, "allowlist"}, // allowlisting wins
+		{"evil.example.net.", 1, pd.Policy.DenylistAction, "denylist"},   // denylisting wins over doubt
+		{"doubt1.example.org.", 1, pd.Policy.Doubtlist.NumSourcesAction, "doubtlist.numsources"},
+		{"doubt1.example.org.", 2, pd.Policy.AllowlistAction, "doubtlist.noaction"},
+		{"doubt2.example.org.", 2, pd.Policy.Doubtlist.NumSourcesAction, "doubtlist.numsources"},
+		{"tagged.example.org.", 2, pd.Policy.Doubtlist.DenyTapirAction, "doubtlist.denytapir"}, // a denytapir tag in one source
+		{"tagged.example.org.", 1, pd.Policy.Doubtlist.DenyTapirAction, "doubtlist.denytapir"}, // wins over numsources
+		{"unknown.example.", 1, tapir.ALLOWLIST, "unlisted"},
+	}
+
+	for _, tt := range tests {
+		pd.Policy.Doubtlist.NumSources = tt.numsources
+		action, rule := pd.ComputeRpzAction(tt.name)
+		if action != tt.wantAction || rule != tt.wantRule {
+			t.Errorf("ComputeRpzAction(%s) with numsources %d = (%s, %s), want (%s, %s)",
+				tt.name, tt.numsources, tapir.ActionToString[action], rule,
+				tapir.ActionToString[tt.wantAction], tt.wantRule)
+		}
+	}
+}
+
+func TestDoubtlistUnknownFormatIsIgnored(t *testing.T) {
+	pd, _ := newPopData(t)
+	tp := &testPop{pd: pd}
+	tp.addList("doubtlist", "feed-a", "xfr", "doubt1.example.org.")
+	broken := tp.addList("doubtlist", "broken", "xfr", "doubt1.example.org.")
+	broken.Format = "no-such-format"
+
+	// Must neither exit nor count the broken list as a hit
+	pd.Policy.Doubtlist.NumSources = 2
+	action, rule := pd.ComputeRpzAction("doubt1.example.org.")
+	if action != pd.Policy.AllowlistAction || rule != "doubtlist.noaction" {
+		t.Errorf("ComputeRpzAction with a broken doubtlist = (%s, %s), want (%s, doubtlist.noaction)",
+			tapir.ActionToString[action], rule, tapir.ActionToString[pd.Policy.AllowlistAction])
+	}
+
+	// Such a list is rejected when it is loaded
+	if err := checkListFormat(broken); err == nil {
+		t.Errorf("checkListFormat accepted a doubtlist with format %s", broken.Format)
+	}
+	if err := checkListFormat(&tapir.WBGlist{Name: "dawg", Type: "doubtlist", Format: "dawg"}); err == nil {
+		t.Errorf("checkListFormat accepted a DAWG doubtlist")
+	}
+	if err := checkListFormat(&tapir.WBGlist{Name: "dawg", Type: "allowlist", Format: "dawg"}); err != nil {
+		t.Errorf("checkListFormat rejected a DAWG allowlist: %v", err)
+	}
+}
+
+func TestRpzTtl(t *testing.T) {
+	pd, _ := newPopData(t, func() {
+		viper.Set("services.rpz.ttl", 3600)
+		viper.Set("policy.ttl.denylist", 86400)
+		viper.Set("policy.ttl.doubtlist", 600)
+		viper.Set("policy.ttl.actions", map[string]any{"drop": 1800})
+		viper.Set("policy.ttl.sources", map[string]any{"dns-tapir": 60, "slow-feed": 900})
+		viper.Set("policy.ttl.lifetime", true)
+		viper.Set("policy.ttl.min", 30)
+	})
+	tp := &testPop{pd: pd}
+	tp.addList("denylist", "local-deny", "file", "evil.example.net.")
+	tp.addList("doubtlist", "feed-a", "xfr", "doubt.example.org.", "both.example.org.")
+	slow := tp.addList("doubtlist", "slow-feed", "xfr", "both.example.org.")
+	tapirfeed := tp.addList("doubtlist", "dns-tapir", "mqtt")
+	now := time.Now()
+	defer func(clock func() time.Time) { timeNow = clock }(timeNow)
+	timeNow = func() time.Time { return now }
+	for name, ttl := range map[string]time.Duration{
+		"short.example.org.":   45 * time.Second,
+		"expired.example.org.": -time.Hour,
+		"long.example.org.":    time.Hour,
+	} {
+		tapirfeed.Names[name] = tapir.TapirName{Name: name, TimeAdded: now, TTL: ttl}
+		slow.Names[name] = tapir.TapirName{Name: name, TimeAdded: now, TTL: ttl}
+	}
+
+	tests := []struct {
+		name   string
+		action tapir.Action
+		rule   string
+		want   uint32
+	}{
+		{"evil.example.net.", tapir.NODATA, "denylist", 86400},                  // list type
+		{"evil.example.net.", tapir.DROP, "denylist", 1800},                     // action over list type
+		{"doubt.example.org.", tapir.NXDOMAIN, "doubtlist.numsources", 600},     // list type
+		{"both.example.org.", tapir.NXDOMAIN, "doubtlist.numsources", 900},      // source over list type
+		{"long.example.org.", tapir.DROP, "doubtlist.numsources", 60},           // shortest source
+		{"short.example.org.", tapir.NXDOMAIN, "doubtlist.numsources", 45},      // remaining lifetime
+		{"expired.example.org.", tapir.NXDOMAIN, "doubtlist.numsources", 30},    // never below min
+		{"unknown.example.org.", tapir.NXDOMAIN, "doubtlist.numtapirtags", 600}, // no sources
+	}
+	for _, tt := range tests {
+		if got := pd.RpzTtl(tt.name, tt.action, tt.rule); got != tt.want {
+			t.Errorf("RpzTtl(%s, %s, %s) = %d, want %d", tt.name, tapir.ActionToString[tt.action], tt.rule, got, tt.want)
+		}
+	}
+
+	// The generated rules get the TTLs
+	if _, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup}); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	rn := pd.Rpz.Snapshot().Data[pd.rpzOwner("evil.example.net.")]
+	if rn == nil || (*rn.RR).Header().Ttl != 86400 {
+		t.Errorf("denylisted rule in the output: %v, want TTL 86400", rn)
+	}
+
+	// A new TTL for a name in an update replaces the rule, even if the action is the same
+	pd.Policy.Ttl.Denylist = 7200
+	ixfr, err := pd.GenerateRpzIxfr(&tapir.TapirMsg{Added: []tapir.Domain{{Name: "evil.example.net."}}},
+		PolicyTrigger{Kind: TriggerMqtt, Source: "local-deny"})
+	if err != nil {
+		t.Fatalf("GenerateRpzIxfr: %v", err)
+	}
+	if len(ixfr.Removed) != 1 || len(ixfr.Added) != 1 || (*ixfr.Added[0].RR).Header().Ttl != 7200 {
+		t.Errorf("IXFR after a TTL change removes %d and adds %v, want the rule replaced with TTL 7200",
+			len(ixfr.Removed), ixfr.Added)
+	}
+}
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"strings"
 	"time"
 
 	"github.com/dnstapir/tapir"
@@ -17,9 +18,87 @@ import (
 // 4. Generate a new IXFR for the deleted items
 // 5. Send the IXFR to the RPZ
 func (pd *PopData) Reaper(full bool) error {
+	pd.mu.Lock()
+	ixfr, err := pd.reap()
+	pd.mu.Unlock()
+	if err != nil {
+		pd.Logger.Printf("Reaper: Error from GenerateRpzIxfr(): %v", err)
+	}
+	if !ixfr.Empty() {
+		err = pd.NotifyDownstreams()
+		if err != nil {
+			pd.Logger.Printf("Reaper: Error from NotifyDownstreams(): %v", err)
+		}
+	}
+	return nil
+}
+
+// scheduleReaping makes the reaper remove name from wbgl at expires (or, as the reaper works in
+// time slots, at most ReaperInterval later), instead of at any earlier time.
+// Must be called with pd.mu held for writing.
+func (pd *PopData) scheduleReaping(wbgl *tapir.WBGlist, name string, expires time.Time) {
+	// Time that the name will be removed from the list
+	// must ensure that reapertime is at least ReaperInterval into the future
+	reptime := expires.Truncate(pd.ReaperInterval).Add(pd.ReaperInterval)
+
+	// Ensure that there are no prior removal events for this name
+	for reaperTime, namesMap := range wbgl.ReaperData {
+		if reaperTime.Before(reptime) {
+			if _, exists := namesMap[name]; exists {
+				delete(namesMap, name)
+				if len(namesMap) == 0 {
+					delete(wbgl.ReaperData, reaperTime)
+				}
+			}
+		}
+	}
+
+	// Add the name to the removal list for the time it will be removed
+	if wbgl.ReaperData == nil {
+		wbgl.ReaperData = map[time.Time]map[string]bool{}
+	}
+	if wbgl.ReaperData[reptime] == nil {
+		wbgl.ReaperData[reptime] = make(map[string]bool)
+	}
+	wbgl.ReaperData[reptime][name] = true
+}
+
+// importNames replaces the names of wbgl with names, e.g. from a bootstrap export or a backup,
+// and schedules the removal of the ones with a lifetime. The rpz-ip entries derived here are
+// not in an export; they are kept, unless all the names they were derived from are gone. Must
+// be called with pd.mu held for writing.
+func (pd *PopData) importNames(wbgl *tapir.WBGlist, names map[string]tapir.TapirName) {
+	released := map[string]bool{}
+	for name, tn := range wbgl.Names {
+		if _, exist := names[name]; !exist && tn.SrcFormat != badipSrcFormat {
+			for _, entry := range pd.releaseBadipRefs(wbgl, name) {
+				released[entry] = true
+			}
+		}
+	}
+	for name, tn := range wbgl.Names {
+		if _, exist := names[name]; !exist && tn.SrcFormat == badipSrcFormat && !released[name] {
+			names[name] = tn
+		}
+	}
+	wbgl.Names = names
+	wbgl.ReaperData = map[time.Time]map[string]bool{}
+	if wbgl.Format == "cidr" {
+		pd.indexCidrList(wbgl)
+	}
+	for name, tn := range wbgl.Names {
+		if tn.TTL > 0 {
+			pd.scheduleReaping(wbgl, name, tn.TimeAdded.Add(tn.TTL))
+		}
+	}
+}
+
+// reap removes the expired names from all lists. Must be called with pd.mu held for writing.
+func (pd *PopData) reap() (RpzIxfr, error) {
 	timekey := time.Now().Truncate(pd.ReaperInterval)
 	// tpkg := tapir.MqttPkgIn{}
 	tm := tapir.TapirMsg{}
+	var reaped []string // names of the lists that had expired names
 	pd.Logger.Printf("Reaper: working on time slot %s across all lists", timekey.Format(tapir.TimeLayout))
 	for _, listtype := range []string{"allowlist", "doubtlist", "denylist"} {
 		for listname, wbgl := range pd.Lists[listtype] {
@@ -32,7 +111,6 @@ func (pd *PopData) Reaper(full bool) error {
 					}
 
 					pd.Logger.Printf("Reaper: Warning: found old reaperdata for time slot %s (that has already passed). Moving %d names to current time slot (%s)", t.Format(tapir.TimeLayout), len(d), timekey.Format(tapir.TimeLayout))
-					pd.mu.Lock()
 					if _, exist := wbgl.ReaperData[timekey]; !exist {
 						wbgl.ReaperData[timekey] = map[string]bool{}
 					}
@@ -41,39 +119,36 @@ func (pd *PopData) Reaper(full bool) error {
 					}
 					// wbgl.ReaperData[timekey] = d
 					delete(wbgl.ReaperData, t)
-					pd.mu.Unlock()
 				}
 			}
 			// pd.Logger.Printf("Reaper: working on %s %s", listtype, listname)
 			if len(wbgl.ReaperData[timekey]) > 0 {
 				pd.Logger.Printf("Reaper: list [%s][%s] has %d timekeys stored", listtype, listname,
 					len(wbgl.ReaperData[timekey]))
-				pd.mu.Lock()
 				for name := range wbgl.ReaperData[timekey] {
 					pd.Logger.Printf("Reaper: removing %s from %s %s", name, listtype, listname)
 					delete(pd.Lists[listtype][listname].Names, name)
+					if tree, exist := pd.Cidrs[wbgl]; exist {
+						if t, err := ParseRpzTrigger(name); err == nil {
+							tree.Delete(t.Prefix)
+						}
+					}
 					delete(wbgl.ReaperData[timekey], name)
+					pd.releaseBadipRefs(wbgl, name) // the entries expire on their own
 					tm.Removed = append(tm.Removed, tapir.Domain{Name: name})
 				}
+				reaped = append(reaped, listname)
 				// pd.Logger.Printf("Reaper: %s %s now has %d items:", listtype, listname, len(pd.Lists[listtype][listname].Names))
 				// for name, item := range pd.Lists[listtype][listname].Names {
 				// 	pd.Logger.Printf("Reaper: remaining: key: %s name: %s", name, item.Name)
 				// }
 				delete(wbgl.ReaperData, timekey)
-				pd.mu.Unlock()
 			}
 		}
 	}
 
-	if len(tm.Removed) > 0 {
-		ixfr, err := pd.GenerateRpzIxfr(&tm)
-		if err != nil {
-			pd.Logger.Printf("Reaper: Error from GenerateRpzIxfr(): %v", err)
-		}
-		err = pd.ProcessIxfrIntoAxfr(ixfr)
-		if err != nil {
-			pd.Logger.Printf("Reaper: Error from ProcessIxfrIntoAxfr(): %v", err)
-		}
+	if len(tm.Removed) == 0 {
+		return RpzIxfr{}, nil
 	}
-	return nil
+	return pd.GenerateRpzIxfr(&tm, PolicyTrigger{Kind: TriggerReaper, Source: strings.Join(reaped, ",")})
 }
@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/spf13/viper"
+)
+
+// An MQTT list that misses an update (or applies one that the other PoPs never saw) stays wrong
+// until it is bootstrapped again. The Reconciler compares the digest of every MQTT list with the
+// digest of the same list on a bootstrap server, and re-bootstraps the lists that have
+// drifted. The corrections are sent to the downstreams as an IXFR, see completeHandover.
+
+// ListDigest is the number of names in a list and a hash over them, see ExportSnapshot.Digest.
+type ListDigest struct {
+	Name     string
+	At       time.Time // names that have expired at At are not included
+	Count    int
+	Hash     string // hex SHA-256
+	Position ListPosition
+}
+
+// Digest returns the digest of the names in the snapshot that have not expired at the time at:
+// the SHA-256 of the length-prefixed binary name records, sorted by name. Two lists with the
+// same names, with the same time added, lifetime and tags, have the same digest.
+func (snap *ExportSnapshot) Digest(at time.Time) ListDigest {
+	snap.sort()
+	h := sha256.New()
+	var rec []byte
+	count := 0
+	for _, en := range snap.names {
+		if en.TTL > 0 && !en.TimeAdded.Add(time.Duration(en.TTL)*time.Second).After(at) {
+			continue
+		}
+		rec = appendExportName(rec[:0], en)
+		h.Write(binary.AppendUvarint(nil, uint64(len(rec))))
+		h.Write(rec)
+		count++
+	}
+	return ListDigest{
+		Name:     snap.hdr.Name,
+		At:       at.UTC(),
+		Count:    count,
+		Hash:     hex.EncodeToString(h.Sum(nil)),
+		Position: snap.hdr.Position,
+	}
+}
+
+// fetchDigest asks a bootstrap server for the digest of the list listtype/name at the time at.
+func fetchDigest(request func(ExportPost) (int, []byte, error), listtype, name string, at time.Time) (*ListDigest, error) {
+	status, buf, err := request(ExportPost{
+		BootstrapPost: tapir.BootstrapPost{
+			Command:  "doubtlist-digest",
+			ListName: name,
+		},
+		ListType: listtype,
+		At:       at,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %d: %s", status, buf)
+	}
+	var br tapir.BootstrapResponse
+	if json.Unmarshal(buf, &br) == nil && br.Error {
+		return nil, fmt.Errorf("%s", br.ErrorMsg)
+	}
+	var ld ListDigest
+	if err := json.Unmarshal(buf, &ld); err != nil {
+		return nil, fmt.Errorf("error decoding digest: %v", err)
+	}
+	if ld.Name != name || ld.Hash == "" {
+		return nil, fmt.Errorf("got a digest of %q, want one of %s", ld.Name, name)
+	}
+	return &ld, nil
+}
+
+// reconcileGrace is how far the bootstrap server may be ahead of us before the difference is
+// no longer explained by updates that have not reached us yet.
+var reconcileGrace = time.Minute
+
+// reconcileList compares the MQTT list wbgl with the digest from a bootstrap server and
+// re-bootstraps it if they differ, and reports whether it did. The lists have drifted if they
+// differ although both have seen the same latest update, or if the server is more than
+// reconcileGrace ahead. If the server is behind, it is the one that has to catch up.
+func (pd *PopData) reconcileList(wbgl *tapir.WBGlist, digest func(at time.Time) (*ListDigest, error), rebootstrap func() (*ListExport, error)) (bool, error) {
+	pd.mu.RLock()
+	snap := NewExportSnapshot(wbgl, pd.Positions[wbgl])
+	pd.mu.RUnlock()
+	local := snap.Digest(snap.hdr.Time)
+
+	remote, err := digest(local.At)
+	if err != nil {
+		return false, err
+	}
+	lpos, rpos := local.Position.Time, remote.Position.Time
+	switch {
+	case local.Count == remote.Count && local.Hash == remote.Hash:
+		pd.Logger.Printf("Reconciler: %s is in sync (%d names)", wbgl.Name, local.Count)
+		return false, nil
+	case lpos.After(rpos):
+		pd.Logger.Printf("Reconciler: %s differs from the bootstrap server, which is behind (latest update %s, ours %s)",
+			wbgl.Name, rpos.Format(tapir.TimeLayout), lpos.Format(tapir.TimeLayout))
+		return false, nil
+	case rpos.After(lpos) && !rpos.After(lpos.Add(reconcileGrace)):
+		pd.Logger.Printf("Reconciler: %s differs from the bootstrap server, which has updates that may still be on their way (latest update %s, ours %s)",
+			wbgl.Name, rpos.Format(tapir.TimeLayout), lpos.Format(tapir.TimeLayout))
+		return false, nil
+	}
+
+	pd.ReportStatus("reconciler", tapir.StatusWarn, "%s has drifted: %d names here, %d on the bootstrap server (latest update %s, ours %s). Bootstrapping it again",
+		wbgl.Name, local.Count, remote.Count, rpos.Format(tapir.TimeLayout), lpos.Format(tapir.TimeLayout))
+	if err := pd.rebootstrap(wbgl, rebootstrap); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// mqttSourceConf returns the configuration of the MQTT list wbgl, with the bootstrap servers
+// from the global config, if any.
+func (pd *PopData) mqttSourceConf(wbgl *tapir.WBGlist) SourceConf {
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+	src := pd.MqttSources[wbgl]
+	src.Name = wbgl.Name
+	src.Type = wbgl.Type
+	src.Format = wbgl.Format
+	if md := wbgl.MqttDetails; md != nil && len(md.Bootstrap) > 0 {
+		src.Bootstrap = md.Bootstrap
+		src.BootstrapUrl = md.BootstrapUrl
+		src.BootstrapKey = md.BootstrapKey
+	}
+	return src
+}
+
+// reconcileSource reconciles the MQTT list wbgl with the best of its bootstrap servers that
+// can send a digest.
+func (pd *PopData) reconcileSource(wbgl *tapir.WBGlist) error {
+	src := pd.mqttSourceConf(wbgl)
+	if len(src.Bootstrap) == 0 {
+		return nil
+	}
+	servers, probe, err := pd.bootstrapServers(src)
+	if err != nil {
+		return err
+	}
+	digest := func(at time.Time) (*ListDigest, error) {
+		for _, bc := range pd.probeBootstrapServers(servers, probe) {
+			ld, err := fetchDigest(bc.request, src.Type, src.Name, at)
+			if err != nil {
+				pd.Logger.Printf("Reconciler: Error fetching the digest of %s from %s: %v", src.Name, bc.server, err)
+				continue
+			}
+			return ld, nil
+		}
+		return nil, fmt.Errorf("no digest of %s from any of %d bootstrap servers", src.Name, len(servers))
+	}
+	_, err = pd.reconcileList(wbgl, digest, func() (*ListExport, error) {
+		return pd.BootstrapMqttSource(src)
+	})
+	return err
+}
+
+// Reconciler reconciles the MQTT lists that have bootstrap servers every
+// services.reconciler.interval seconds (default one hour), see reconcileList.
+func (pd *PopData) Reconciler(conf *Config, stopch chan struct{}) {
+	if !viper.GetBool("services.reconciler.active") {
+		log.Printf("Reconciler is NOT active. MQTT lists are only bootstrapped at start and on new global configs.")
+		return
+	}
+	interval := time.Duration(viper.GetInt("services.reconciler.interval")) * time.Second
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	log.Printf("Reconciler: Starting, interval %v", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopch:
+			log.Printf("Reconciler: stopping")
+			return
+		case <-ticker.C:
+		}
+
+		var lists []*tapir.WBGlist
+		pd.mu.RLock()
+		for _, listtype := range []string{"allowlist", "doubtlist", "denylist"} {
+			for _, wbgl := range pd.Lists[listtype] {
+				if wbgl.Immutable || wbgl.Datasource != "mqtt" {
+					continue
+				}
+				if _, busy := pd.Handovers[handoverKey(listtype, wbgl.Name)]; busy {
+					continue
+				}
+				lists = append(lists, wbgl)
+			}
+		}
+		pd.mu.RUnlock()
+
+		for _, wbgl := range lists {
+			if pd.ShuttingDown.Load() {
+				return
+			}
+			if err := pd.reconcileSource(wbgl); err != nil {
+				pd.Logger.Printf("Reconciler: Error reconciling %s: %v", wbgl.Name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+)
+
+func TestListDigest(t *testing.T) {
+	list := testExportList()
+	now := time.Date(2024, 5, 1, 12, 1, 0, 0, time.UTC)
+	d1 := NewExportSnapshot(list, ListPosition{}).Digest(now)
+
+	// The order of the names does not matter, but their contents do
+	list2 := testExportList()
+	tn := list2.Names["evil.example."]
+	d2 := NewExportSnapshot(list2, ListPosition{}).Digest(now)
+	if d1.Count != 3 || d1.Hash != d2.Hash {
+		t.Errorf("digests of the same list: %+v, %+v", d1, d2)
+	}
+	tn.TagMask = 1
+	list2.Names["evil.example."] = tn
+	if d := NewExportSnapshot(list2, ListPosition{}).Digest(now); d.Hash == d1.Hash {
+		t.Errorf("digest unchanged when the tags of a name changed")
+	}
+
+	// Expired names are left out, whether they have been reaped or not
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	d3 := NewExportSnapshot(list, ListPosition{}).Digest(at)
+	delete(list.Names, "tagged.example.")
+	d4 := NewExportSnapshot(list, ListPosition{}).Digest(at)
+	if d3.Count != 2 || d3.Hash != d4.Hash {
+		t.Errorf("digest with an expired name %+v, without it %+v", d3, d4)
+	}
+}
+
+func TestReconcileList(t *testing.T) {
+	server, conf := newPopData(t)
+	conf.PopData = server
+	conf.Internal.ApiAuth = &ApiAuth{Logger: testLogger()}
+	// The names must not have expired
+	latest := time.Now().Add(-30 * time.Second).UTC()
+	slist := testExportList()
+	for name, tn := range slist.Names {
+		tn.TimeAdded = latest
+		slist.Names[name] = tn
+	}
+	server.Lists["doubtlist"]["dns-tapir"] = slist
+	server.Positions[slist] = ListPosition{Updates: 42, Time: latest}
+	handler := APIbootstrap(conf)
+	request := func(post ExportPost) (int, []byte, error) {
+		w := apiRequest(handler, RoleReadOnly, "/api/v1/bootstrap", post)
+		return w.Code, w.Body.Bytes(), nil
+	}
+	digest := func(at time.Time) (*ListDigest, error) { return fetchDigest(request, "doubtlist", "dns-tapir", at) }
+	rebootstrapped := 0
+	rebootstrap := func() (*ListExport, error) {
+		rebootstrapped++
+		return server.fetchExport("test", "doubtlist", "dns-tapir", request)
+	}
+
+	client, _ := newPopData(t)
+	ctp := &testPop{pd: client}
+	cl := ctp.addList("doubtlist", "dns-tapir", "mqtt")
+	client.mu.Lock()
+	client.importNames(cl, maps.Clone(slist.Names))
+	client.Positions[cl] = server.Positions[slist]
+	client.mu.Unlock()
+	if _, err := client.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup}); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	if done, err := client.reconcileList(cl, digest, rebootstrap); done || err != nil || rebootstrapped != 0 {
+		t.Errorf("reconcileList of a list in sync: %t, %v", done, err)
+	}
+
+	// A missed removal and a name that the server does not have
+	client.mu.Lock()
+	cl.Names["extra.example."] = tapir.TapirName{Name: "extra.example."}
+	client.mu.Unlock()
+	server.mu.Lock()
+	delete(slist.Names, "evil.example.")
+	server.mu.Unlock()
+
+	// The server has updates that we may not have seen yet
+	server.Positions[slist] = ListPosition{Updates: 43, Time: latest.Add(time.Second)}
+	if done, err := client.reconcileList(cl, digest, rebootstrap); done || err != nil {
+		t.Errorf("reconcileList with updates in flight: %t, %v", done, err)
+	}
+
+	// The same updates, but different names
+	client.Positions[cl] = server.Positions[slist]
+	if done, err := client.reconcileList(cl, digest, rebootstrap); !done || err != nil || rebootstrapped != 1 {
+		t.Fatalf("reconcileList of a list that has drifted: %t, %v", done, err)
+	}
+	snap := client.Rpz.Snapshot()
+	for name, want := range map[string]bool{"evil.example.": false, "extra.example.": false, "tagged.example.": true} {
+		if _, exist := cl.Names[name]; exist != want {
+			t.Errorf("%s in the list after reconciliation: %t, want %t", name, exist, want)
+		}
+		if _, exist := snap.Data[client.rpzOwner(name)]; exist != want {
+			t.Errorf("%s in the output after reconciliation: %t, want %t", name, exist, want)
+		}
+	}
+	if len(snap.IxfrChain) != 1 {
+		t.Errorf("%d IXFRs after reconciliation, want 1", len(snap.IxfrChain))
+	}
+	if done, err := client.reconcileList(cl, digest, rebootstrap); done || err != nil {
+		t.Errorf("reconcileList after reconciliation: %t, %v", done, err)
+	}
+
+	// A server that is behind is not used
+	client.mu.Lock()
+	delete(cl.Names, "tagged.example.")
+	client.Positions[cl] = ListPosition{Updates: 50, Time: latest.Add(time.Hour)}
+	client.mu.Unlock()
+	if done, err := client.reconcileList(cl, digest, rebootstrap); done || err != nil {
+		t.Errorf("reconcileList with a server that is behind: %t, %v", done, err)
+	}
+}
@@ -23,7 +23,8 @@ type RpzRefresh struct {
 	Upstream string
 	//	RRKeepFunc  func(uint16) bool
 	RRParseFunc func(*dns.RR, *tapir.ZoneData) bool
-	ZoneType    tapir.ZoneType // 1=xfr, 2=map, 3=slice
+	ParseDone   func(updated bool) // called after every refresh, see rpzFeedParser.Done
+	ZoneType    tapir.ZoneType     // 1=xfr, 2=map, 3=slice
 	Resp        chan RpzRefreshResult
 }
 
@@ -40,6 +41,7 @@ type RefreshCounter struct {
 	IncomingSerial uint32
 	//	RRKeepFunc     func(uint16) bool
 	RRParseFunc func(*dns.RR, *tapir.ZoneData) bool
+	ParseDone   func(updated bool)
 	Upstream    string
 	Downstreams []string
 }
@@ -99,16 +101,19 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 			case "observation", "intel-update":
 				log.Printf("RefreshEngine: Tapir Observation update: (src: %s) %d additions and %d removals\n",
 					tm.SrcName, len(tm.Added), len(tm.Removed))
-				_, err := pd.ProcessTapirUpdate(tm)
+				if !pd.checkSequence(tm, ParseMsgSeq(tpkg.Payload)) {
+					continue
+				}
+				_, err := pd.ProcessTapirUpdate(tm, ParseObservedAddrs(tpkg.Payload))
 				if err != nil {
-					Gconfig.Internal.ComponentStatusCh <- tapir.ComponentStatusUpdate{
+					pd.ComponentStatusCh <- tapir.ComponentStatusUpdate{
 						Status:    tapir.StatusFail,
 						Component: "tapir-observation",
 						Msg:       fmt.Sprintf("ProcessTapirUpdate error: %v", err),
 					}
 					log.Printf("RefreshEngine: Error from ProcessTapirUpdate(): %v", err)
 				}
-				Gconfig.Internal.ComponentStatusCh <- tapir.ComponentStatusUpdate{
+				pd.ComponentStatusCh <- tapir.ComponentStatusUpdate{
 					Status:    tapir.StatusOK,
 					Component: "tapir-observation",
 					Msg:       fmt.Sprintf("ProcessTapirUpdate: MQTT observation message received"),
@@ -135,7 +140,7 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 
 			default:
 				log.Printf("RefreshEngine: Tapir Message: unknown msg type: %s", tm.MsgType)
-				Gconfig.Internal.ComponentStatusCh <- tapir.ComponentStatusUpdate{
+				pd.ComponentStatusCh <- tapir.ComponentStatusUpdate{
 					Status:    tapir.StatusFail,
 					Component: "mqtt-unknown",
 					Msg:       fmt.Sprintf("RefreshEngine: Tapir Message: unknown msg type: %s", tm.MsgType),
@@ -150,7 +155,7 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 				if zonedata, exist := pd.RpzSources[zone]; exist {
 					log.Printf("RefreshEngine: scheduling immediate refresh for known zone '%s'",
 						zone)
-					if _, known := refreshCounters[zone]; !known {
+					if rc = refreshCounters[zone]; rc == nil {
 						refresh = zonedata.SOA.Refresh
 
 						upstream = zr.Upstream
@@ -165,33 +170,32 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 							zr.Resp <- RpzRefreshResult{Error: true, ErrorMsg: "ParseFunc unspecified"}
 						}
 
-						refreshCounters[zone] = &RefreshCounter{
+						rc = &RefreshCounter{
 							Name:       zone,
 							SOARefresh: refresh,
 							CurRefresh: 1, // force immediate refresh
 							//							RRKeepFunc:  keepfunc,
 							RRParseFunc: parsefunc,
+							ParseDone:   zr.ParseDone,
 							Upstream:    upstream,
 							Downstreams: downstreams,
 						}
-					} else {
-						rc = refreshCounters[zone]
+						refreshCounters[zone] = rc
 					}
 					updated, err = pd.RpzSources[zone].Refresh(rc.Upstream)
 					if err != nil {
 						log.Printf("RefreshEngine: Error from zone refresh(%s): %v", zone, err)
 					}
+					if rc.ParseDone != nil {
+						rc.ParseDone(updated && err == nil)
+					}
 
-					if updated {
-						if resetSoaSerial {
-							pd.RpzSources[zone].SOA.Serial = uint32(time.Now().Unix())
-							log.Printf("RefreshEngine: %s updated from upstream. Resetting serial to unixtime: %d",
-								zone, pd.RpzSources[zone].SOA.Serial)
-						}
-						err := pd.NotifyDownstreams()
-						if err != nil {
-							log.Printf("RefreshEngine: Error notifying downstreams: %v", err)
-						}
+					if updated && resetSoaSerial {
+						pd.mu.Lock()
+						pd.RpzSources[zone].SOA.Serial = uint32(time.Now().Unix())
+						pd.mu.Unlock()
+						log.Printf("RefreshEngine: %s updated from upstream. Resetting serial to unixtime: %d",
+							zone, pd.RpzSources[zone].SOA.Serial)
 					}
 					// showing some apex details:
 					log.Printf("Showing some details for zone %s: ", zone)
@@ -224,6 +228,9 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 					}
 					// log.Printf("RefEng: New zone %s, keepfunc: %v", zone, keepfunc)
 					updated, err := zonedata.Refresh(upstream)
+					if zr.ParseDone != nil {
+						zr.ParseDone(updated && err == nil)
+					}
 					if err != nil {
 						log.Printf("RefreshEngine: Error from zone refresh(%s): %v", zone, err)
 						zr.Resp <- RpzRefreshResult{Error: true, ErrorMsg: err.Error()}
@@ -242,6 +249,7 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 						CurRefresh: refresh,
 						//						RRKeepFunc:  keepfunc,
 						RRParseFunc: parsefunc,
+						ParseDone:   zr.ParseDone,
 						Upstream:    upstream,
 						Downstreams: downstreams,
 					}
@@ -286,19 +294,17 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 					if err != nil {
 						log.Printf("RefreshEngine: Error from zd.Refresh(%s): %v", zone, err)
 					}
-					if updated {
-						if resetSoaSerial {
-							pd.RpzSources[zone].SOA.Serial = uint32(time.Now().Unix())
-							log.Printf("RefreshEngine: %s updated from upstream. Resetting serial to unixtime: %d",
-								zone, pd.RpzSources[zone].SOA.Serial)
-
-						}
+					// The changes in the source are applied to the output (and the downstreams
+					// notified) by ParseDone.
+					if rc.ParseDone != nil {
+						rc.ParseDone(updated && err == nil)
 					}
-					if updated {
-						err := pd.NotifyDownstreams()
-						if err != nil {
-							log.Printf("RefreshEngine: Error notifying downstreams: %v", err)
-						}
+					if updated && resetSoaSerial {
+						pd.mu.Lock()
+						pd.RpzSources[zone].SOA.Serial = uint32(time.Now().Unix())
+						pd.mu.Unlock()
+						log.Printf("RefreshEngine: %s updated from upstream. Resetting serial to unixtime: %d",
+							zone, pd.RpzSources[zone].SOA.Serial)
 					}
 				}
 			}
@@ -308,6 +314,22 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 			if err != nil {
 				log.Printf("Reaper: error: %v", err)
 			}
+			pd.expireGaps()
+			resigned, err := pd.Rpz.ResignRpz()
+			if err != nil {
+				log.Printf("RefreshEngine: error re-signing %s: %v", pd.Rpz.ZoneName, err)
+			} else if resigned {
+				log.Printf("RefreshEngine: refreshed expiring signatures in %s (serial %d)",
+					pd.Rpz.ZoneName, pd.Rpz.CurrentSerial())
+				err = pd.NotifyDownstreams()
+				if err != nil {
+					log.Printf("RefreshEngine: error from NotifyDownstreams(): %v", err)
+				}
+			}
+
+		case <-stopch:
+			log.Printf("RefreshEngine: stopping")
+			return
 
 		case cmd = <-rpzcmdch:
 			command := cmd.Command
@@ -322,9 +344,11 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 					if zd, exist := pd.RpzSources[zone]; exist {
 						log.Printf("RefreshEngine: bumping SOA serial for known zone '%s'",
 							zone)
+						pd.mu.Lock()
 						resp.OldSerial = zd.SOA.Serial
 						zd.SOA.Serial = uint32(time.Now().Unix())
 						resp.NewSerial = zd.SOA.Serial
+						pd.mu.Unlock()
 						rc = refreshCounters[zone]
 						err := pd.NotifyDownstreams()
 						if err != nil {
@@ -345,7 +369,10 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 
 			case "RPZ-ADD":
 				log.Printf("RefreshEngine: recieved an RPZ ADD command: %s (policy %s)", cmd.Domain, cmd.Policy)
-				if pd.Allowlisted(cmd.Domain) {
+				pd.mu.RLock()
+				allowlisted, denylisted := pd.Allowlisted(cmd.Domain), pd.Denylisted(cmd.Domain)
+				pd.mu.RUnlock()
+				if allowlisted {
 					resp.Error = true
 					resp.ErrorMsg = fmt.Sprintf("Domain name \"%s\" is allowlisted. No change.",
 						cmd.Domain)
@@ -353,7 +380,7 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 					continue
 				}
 
-				if pd.Denylisted(cmd.Domain) {
+				if denylisted {
 					resp.Error = true
 					resp.ErrorMsg = fmt.Sprintf("Domain name \"%s\" is already denylisted. No change.",
 						cmd.Domain)
@@ -385,28 +412,32 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 			case "RPZ-LOOKUP":
 				log.Printf("RefreshEngine: recieved an RPZ LOOKUP command: %s", cmd.Domain)
 				var msg string
-				if pd.Allowlisted(cmd.Domain) {
+				pd.mu.RLock()
+				allowlisted, denylisted := pd.Allowlisted(cmd.Domain), pd.Denylisted(cmd.Domain)
+				// if the name isn't either allowlisted or denylisted: go though all doubtlists
+				_, doubtmsg := pd.DoubtlistingReport(cmd.Domain)
+				pd.mu.RUnlock()
+				if allowlisted {
 					resp.Msg = fmt.Sprintf("Domain name \"%s\" is allowlisted.", cmd.Domain)
 					cmd.Result <- resp
 					continue
 				}
 				msg += fmt.Sprintf("Domain name \"%s\" is not allowlisted.\n", cmd.Domain)
 
-				if pd.Denylisted(cmd.Domain) {
+				if denylisted {
 					resp.Msg = fmt.Sprintf("Domain name \"%s\" is denylisted.", cmd.Domain)
 					cmd.Result <- resp
 					continue
 				}
 				msg += fmt.Sprintf("Domain name \"%s\" is not denylisted.\n", cmd.Domain)
 
-				// if the name isn't either allowlisted or denylisted: go though all doubtlists
-				_, doubtmsg := pd.DoubtlistingReport(cmd.Domain)
 				resp.Msg = msg + doubtmsg
 				cmd.Result <- resp
 				continue
 
 			case "RPZ-LIST-SOURCES":
 				log.Printf("RefreshEngine: recieved an RPZ LIST-SOURCES command")
+				pd.mu.RLock()
 				list := []string{}
 				//				for _, wl := range pd.Allowlists {
 				for _, wl := range pd.Lists["allowlist"] {
@@ -427,6 +458,7 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 					list = append(list, gl.Name)
 				}
 				resp.Msg += fmt.Sprintf("Doubtlist srcs: %s\n", strings.Join(list, ", "))
+				pd.mu.RUnlock()
 				cmd.Result <- resp
 
 			default:
@@ -442,45 +474,44 @@ func (pd *PopData) RefreshEngine(conf *Config, stopch chan struct{}) {
 
 func (pd *PopData) NotifyDownstreams() error {
 	pd.Logger.Printf("RefreshEngine: Notifying %d downstreams for RPZ zone %s", len(pd.Downstreams), pd.Rpz.ZoneName)
+	serial := pd.Rpz.CurrentSerial()
 	for _, d := range pd.Downstreams {
 		dest := net.JoinHostPort(d.Address, strconv.Itoa(d.Port))
 		csu := tapir.ComponentStatusUpdate{
 			Component: "downstream-notify",
 			Status:    tapir.StatusFail,
-			Msg:       fmt.Sprintf("Notifying downstream %s about new SOA serial (%d) for RPZ zone %s", dest, pd.Rpz.Axfr.SOA.Serial, pd.Rpz.ZoneName),
+			Msg:       fmt.Sprintf("Notifying downstream %s about new SOA serial (%d) for RPZ zone %s", dest, serial, pd.Rpz.ZoneName),
 			TimeStamp: time.Now(),
 		}
 
 		m := new(dns.Msg)
 		m.SetNotify(pd.Rpz.ZoneName)
-		pd.Rpz.Axfr.SOA.Serial = pd.Rpz.CurrentSerial
-		// m.Ns = append(m.Ns, dns.RR(&pd.Rpz.Axfr.SOA))
-		pd.Logger.Printf("RefreshEngine: Notifying downstream %s about new SOA serial (%d) for RPZ zone %s", dest, pd.Rpz.Axfr.SOA.Serial, pd.Rpz.ZoneName)
+		pd.Logger.Printf("RefreshEngine: Notifying downstream %s about new SOA serial (%d) for RPZ zone %s", dest, serial, pd.Rpz.ZoneName)
 		r, err := dns.Exchange(m, dest)
 		if err != nil {
 			// well, we tried
 			csu.Msg = fmt.Sprintf("Error from downstream %s on NOTIFY(%s): %v", dest, pd.Rpz.ZoneName, err)
-			Gconfig.Internal.ComponentStatusCh <- csu
+			pd.ComponentStatusCh <- csu
 			pd.Logger.Println(csu.Msg)
 			continue
 		}
 		if r.Opcode != dns.OpcodeNotify {
 			// well, we tried
 			csu.Msg = fmt.Sprintf("Error: not a NOTIFY response from downstream %s on NOTIFY(%s): %s", dest, pd.Rpz.ZoneName, dns.OpcodeToString[r.Opcode])
-			Gconfig.Internal.ComponentStatusCh <- csu
+			pd.ComponentStatusCh <- csu
 			pd.Logger.Println(csu.Msg)
 			continue
 
 		} else {
 			if r.Rcode != dns.RcodeSuccess {
-				csu.Msg = fmt.Sprintf("Downstream %s responded with rcode %s to NOTIFY(%s) about new SOA serial (%d)", dest, dns.RcodeToString[r.Rcode], pd.Rpz.ZoneName, pd.Rpz.Axfr.SOA.Serial)
-				Gconfig.Internal.ComponentStatusCh <- csu
+				csu.Msg = fmt.Sprintf("Downstream %s responded with rcode %s to NOTIFY(%s) about new SOA serial (%d)", dest, dns.RcodeToString[r.Rcode], pd.Rpz.ZoneName, serial)
+				pd.ComponentStatusCh <- csu
 				pd.Logger.Println(csu.Msg)
 				continue
 			}
 			csu.Status = tapir.StatusOK
-			csu.Msg = fmt.Sprintf("Downstream %s responded correctly to NOTIFY(%s) about new SOA serial (%d)", dest, pd.Rpz.ZoneName, pd.Rpz.Axfr.SOA.Serial)
-			Gconfig.Internal.ComponentStatusCh <- csu
+			csu.Msg = fmt.Sprintf("Downstream %s responded correctly to NOTIFY(%s) about new SOA serial (%d)", dest, pd.Rpz.ZoneName, serial)
+			pd.ComponentStatusCh <- csu
 			pd.Logger.Println(csu.Msg)
 		}
 	}
@@ -5,6 +5,10 @@
 package main
 
 import (
+	"fmt"
+	"slices"
+	"time"
+
 	"github.com/dnstapir/tapir"
 	"github.com/miekg/dns"
 )
@@ -25,10 +29,45 @@ import (
 // 3. When all names that should be in the output have been collected:
 //    a) iterate through the list generating dns.RR and put them in a []dns.RR
 //    b) add a header SOA+NS
+// 4. Publish the result as a new version of the output zone, with a new serial and an empty IXFR chain
+//
+// Must be called with pd.mu held for writing. Returns true if a new version was published; the
+// caller must then call NotifyDownstreams, after releasing pd.mu.
 
-func (pd *PopData) GenerateRpzAxfr() error {
+func (pd *PopData) GenerateRpzAxfr(trigger PolicyTrigger) (bool, error) {
 	var deny = make(map[string]bool, 10000)
 	var doubt = make(map[string]*tapir.TapirName, 10000)
+	var doubtRules = make(map[string]string, 10000)
+	var doubtActions = make(map[string]tapir.Action, 10000)
+	var audit []PolicyAuditRecord
+	now := time.Now()
+
+	pd.Rpz.writer.Lock()
+	cur := pd.Rpz.Snapshot()
+	newdata := make(map[string]*RpzRule, len(cur.Data))
+	serial := cur.Serial + 1 // XXX: not dealing with serial wraps
+
+	// Only names that are new in the output, or whose rule changes, are audited.
+	auditAdd := func(rpzn *RpzRule, rule string) {
+		rec := PolicyAuditRecord{
+			Time:      now,
+			Serial:    serial,
+			Op:        "add",
+			Name:      rpzn.Name,
+			NewAction: ActionString(rpzn.Action),
+			Ttl:       rpzn.RRs[0].Header().Ttl,
+			Trigger:   trigger.Kind,
+			Source:    trigger.Source,
+			Rule:      rule,
+		}
+		if old, exist := cur.Data[pd.rpzOwner(rpzn.Name)]; exist {
+			if old.Same(rpzn) {
+				return
+			}
+			rec.OldAction = ActionString(old.Action)
+		}
+		audit = append(audit, rec)
+	}
 
 	for bname, blist := range pd.Lists["denylist"] {
 		pd.Logger.Printf("---> GenerateRpzAxfr: working on denylist %s (%d names)",
@@ -36,18 +75,16 @@ func (pd *PopData) GenerateRpzAxfr() error {
 		switch blist.Format {
 		case "dawg":
 			pd.Logger.Printf("Cannot list DAWG lists. Ignoring denylist %s.", bname)
-		case "map":
+		case "map", "cidr":
 			for k := range blist.Names {
 				// if tapir.GlobalCF.Debug {
 				// pd.Logger.Printf("Adding name %s from denylist %s to tentative output.",
 				// 	k, bname)
 				// }
-				// if pd.Allowlisted(k) {
-				// pd.Logger.Printf("Denylisted name %s is also allowlisted. Dropped from output.", k)
-				// } else {
-				// pd.Logger.Printf("Denylisted name %s is not allowlisted. Added to output.", k)
-				deny[k] = true
-				// }
+				// Allowlisting wins over denylisting, as in ComputeRpzAction
+				if !pd.Allowlisted(k) {
+					deny[k] = true
+				}
 			}
 		}
 	}
@@ -58,7 +95,7 @@ func (pd *PopData) GenerateRpzAxfr() error {
 		pd.Logger.Printf("---> GenRpzAxfr: working on doubtlist %s (%d names)",
 			gname, len(glist.Names))
 		switch glist.Format {
-		case "map":
+		case "map", "cidr":
 			for k, v := range glist.Names {
 				// pd.Logger.Printf("Adding name %s from doubtlist %s to tentative output.", k, gname)
 				if _, exists := pd.DenylistedNames[k]; exists {
@@ -67,7 +104,9 @@ func (pd *PopData) GenerateRpzAxfr() error {
 					// pd.Logger.Printf("Doubtlisted name %s is also allowlisted. Dropped from output.", k)
 				} else {
 					// pd.Logger.Printf("Doubtlisted name %s is not allowlisted. Evalutate inclusion in output.", k)
-					action := pd.ComputeRpzAction(k)
+					action, rule := pd.ComputeRpzAction(k)
+					doubtRules[k] = rule
+					doubtActions[k] = action
 					if action == tapir.ALLOWLIST {
 						// pd.Logger.Printf("Doubtlisted name %s is not included in output.", k)
 					} else {
@@ -95,61 +134,73 @@ func (pd *PopData) GenerateRpzAxfr() error {
 	// newaxfrdata := []*tapir.RpzName{}
 	// pd.Rpz.RpzMap = map[string]*tapir.RpzName{}
 	for name := range pd.DenylistedNames {
-		cname := new(dns.CNAME)
-		cname.Hdr = dns.RR_Header{
-			Name:   name + pd.Rpz.ZoneName,
-			Rrtype: dns.TypeCNAME,
-			Class:  dns.ClassINET,
-			Ttl:    3600,
+		if rpzn := pd.rpzRule(name, pd.Policy.DenylistAction, "denylist"); rpzn != nil {
+			// newaxfrdata = append(newaxfrdata, rpzn)
+			auditAdd(rpzn, "denylist")
+			newdata[pd.rpzOwner(name)] = rpzn
 		}
-		cname.Target = tapir.ActionToCNAMETarget[pd.Policy.DenylistAction]
-		rr := dns.RR(cname)
+	}
 
-		rpzn := tapir.RpzName{
-			Name:   name,
-			RR:     &rr,
-			Action: pd.Policy.DenylistAction,
+	for name := range pd.DoubtlistedNames {
+		if rpzn := pd.rpzRule(name, doubtActions[name], doubtRules[name]); rpzn != nil {
+			auditAdd(rpzn, doubtRules[name])
+			newdata[pd.rpzOwner(name)] = rpzn
 		}
-		// newaxfrdata = append(newaxfrdata, &rpzn)
-		// pd.Rpz.RpzMap[nname+pd.Rpz.ZoneName] = &rpzn
-		pd.mu.Lock()
-		pd.Rpz.Axfr.Data[name+pd.Rpz.ZoneName] = &rpzn
-		pd.mu.Unlock()
 	}
 
-	for name, v := range pd.DoubtlistedNames {
-		rpzaction := ApplyDoubtPolicy(name, v)
-
-		if rpzaction != "" {
-			cname := new(dns.CNAME)
-			cname.Hdr = dns.RR_Header{
-				Name:     name + pd.Rpz.ZoneName,
-				Rrtype:   dns.TypeCNAME,
-				Class:    dns.ClassINET,
-				Ttl:      3600,
-				Rdlength: 1,
-			}
-			cname.Target = rpzaction // XXX: wrong
-			rr := dns.RR(cname)
+	// The changes of the output, for the MQTT outputs (see publishPolicy)
+	changes := RpzIxfr{FromSerial: cur.Serial, ToSerial: serial}
+	for owner, rpzn := range newdata {
+		if old, exist := cur.Data[owner]; !exist {
+			changes.Added = append(changes.Added, rpzn)
+		} else if !old.Same(rpzn) {
+			changes.Removed = append(changes.Removed, old)
+			changes.Added = append(changes.Added, rpzn)
+		}
+	}
 
-			rpzn := tapir.RpzName{
-				Name:   name,
-				RR:     &rr,
-				Action: pd.Policy.DenylistAction, // XXX: naa
-			}
-			// newaxfrdata = append(newaxfrdata, &rpzn)
-			// pd.Rpz.RpzMap[name+pd.Rpz.ZoneName] = &rpzn
-			pd.mu.Lock()
-			pd.Rpz.Axfr.Data[name+pd.Rpz.ZoneName] = &rpzn
-			pd.mu.Unlock()
+	// Names that are no longer in the output
+	for owner, old := range cur.Data {
+		if _, exist := newdata[owner]; !exist {
+			changes.Removed = append(changes.Removed, old)
+			audit = append(audit, PolicyAuditRecord{
+				Time:      now,
+				Serial:    serial,
+				Op:        "remove",
+				Name:      old.Name,
+				OldAction: ActionString(old.Action),
+				Trigger:   trigger.Kind,
+				Source:    trigger.Source,
+			})
 		}
 	}
 
-	//	pd.Rpz.Axfr.Data = pd.Rpz.RpzMap
-	pd.Logger.Printf("GenerateRpzAxfrData: put %d RRs in %s",
-		len(pd.Rpz.Axfr.Data), pd.Rpz.ZoneName)
-	err := pd.NotifyDownstreams()
-	return err
+	// A complete new version of the zone, so there is no IXFR that leads up to it
+	next := &RpzSnapshot{
+		Serial: serial,
+		NSrrs:  cur.NSrrs,
+		Glue:   cur.Glue,
+		Data:   newdata,
+	}
+	if err := pd.Rpz.signNext(next, false); err != nil {
+		pd.Rpz.writer.Unlock()
+		return false, fmt.Errorf("GenerateRpzAxfr: error signing %s serial %d: %v", pd.Rpz.ZoneName, serial, err)
+	}
+	pd.Rpz.publish(next)
+	if len(changes.Added) != 0 || len(changes.Removed) != 0 {
+		sortRpzNames(changes.Added)
+		sortRpzNames(changes.Removed)
+		pd.publishPolicy(changes, now)
+	}
+	pd.Rpz.writer.Unlock()
+
+	pd.Logger.Printf("GenerateRpzAxfrData: put %d RRs in %s (serial %d)",
+		len(newdata), pd.Rpz.ZoneName, serial)
+	err := pd.PolicyAudit.Append(audit)
+	if err != nil {
+		pd.Logger.Printf("GenerateRpzAxfr: Error writing to policy audit log: %v", err)
+	}
+	return true, nil
 }
 
 // Generate the RPZ representation of the names in the TapirMsg combined with the currently loaded sources.
@@ -177,43 +228,71 @@ func (pd *PopData) GenerateRpzAxfr() error {
 //              => DELETE current + ADD new
 //          - is the name present in current RPZ with same policy/action:
 //              => do nothing
+//
+// 3. If there are any changes, publish a new version of the output zone with the IXFR applied.
+//
+// Must be called with pd.mu held (at least for reading), as the policy evaluation reads the lists.
 
-func (pd *PopData) GenerateRpzIxfr(data *tapir.TapirMsg) (RpzIxfr, error) {
+func (pd *PopData) GenerateRpzIxfr(data *tapir.TapirMsg, trigger PolicyTrigger) (RpzIxfr, error) {
 
-	var removeData, addData []*tapir.RpzName
+	pd.Rpz.writer.Lock()
+	defer pd.Rpz.writer.Unlock()
+	cur := pd.Rpz.Snapshot()
+
+	var removeData, addData []*RpzRule
+	var audit []PolicyAuditRecord
+	auditRecord := func(op, name string, oldAction, newAction tapir.Action, ttl uint32, rule string) {
+		rec := PolicyAuditRecord{
+			Op:      op,
+			Name:    name,
+			Trigger: trigger.Kind,
+			Source:  trigger.Source,
+			Rule:    rule,
+		}
+		if op == "remove" {
+			rec.OldAction = ActionString(oldAction)
+		}
+		if newAction != tapir.ALLOWLIST {
+			rec.NewAction = ActionString(newAction)
+		}
+		if op == "add" {
+			rec.Ttl = ttl
+		}
+		audit = append(audit, rec)
+	}
+	// The new rule for name, nil if name is not in the output. A rule changes if the action or
+	// the RRset (including the TTL) changes.
+	newRule := func(name string) (*RpzRule, tapir.Action, string) {
+		newAction, rule := pd.ComputeRpzAction(name)
+		rpzn := pd.rpzRule(name, newAction, rule)
+		if rpzn == nil {
+			newAction = tapir.ALLOWLIST
+		}
+		return rpzn, newAction, rule
+	}
+	changed := func(old, rpzn *RpzRule) bool {
+		return rpzn == nil || !old.Same(rpzn)
+	}
 	pd.Policy.Logger.Printf("GenerateRpzIxfr: %d removed names and %d added names", len(data.Removed), len(data.Added))
 	for _, tn := range data.Removed {
 		tn.Name = dns.Fqdn(tn.Name)
 		pd.Policy.Logger.Printf("GenerateRpzIxfr: evaluating removed name %s", tn.Name)
-		if cur, exist := pd.Rpz.Axfr.Data[tn.Name]; exist {
-			newAction := pd.ComputeRpzAction(tn.Name)
-			oldAction := cur.Action
-			if newAction != oldAction {
+		if old, exist := cur.Data[pd.rpzOwner(tn.Name)]; exist {
+			rpzn, newAction, rule := newRule(tn.Name)
+			oldAction := old.Action
+			if changed(old, rpzn) {
 				if pd.Debug {
 					pd.Policy.Logger.Printf("GenRpzIxfr[DEL]: %s: oldaction(%s) != newaction(%s): -->DELETE",
 						tn.Name,
-						tapir.ActionToString[oldAction],
-						tapir.ActionToString[newAction])
+						ActionString(oldAction),
+						ActionString(newAction))
 				}
-				removeData = append(removeData, cur)
+				removeData = append(removeData, old)
+				auditRecord("remove", tn.Name, oldAction, newAction, 0, rule)
 
-				if newAction != tapir.ALLOWLIST {
-					cname := new(dns.CNAME)
-					cname.Hdr = dns.RR_Header{
-						Name:     tn.Name + pd.Rpz.ZoneName,
-						Rrtype:   dns.TypeCNAME,
-						Class:    dns.ClassINET,
-						Ttl:      3600,
-						Rdlength: 1,
-					}
-					cname.Target = tapir.ActionToCNAMETarget[newAction]
-					rr := dns.RR(cname)
-
-					addData = append(addData, &tapir.RpzName{
-						Name:   tn.Name,
-						RR:     &rr,
-						Action: newAction,
-					})
+				if rpzn != nil {
+					addData = append(addData, rpzn)
+					auditRecord("add", tn.Name, oldAction, newAction, rpzn.RRs[0].Header().Ttl, rule)
 				}
 			} else {
 				if pd.Debug {
@@ -228,27 +307,33 @@ func (pd *PopData) GenerateRpzIxfr(data *tapir.TapirMsg) (RpzIxfr, error) {
 	}
 
 	var addtorpz bool
-	for _, tn := range data.Added {
+	added := append(slices.Clone(data.Added), pd.coveredTriggers(cur, data.Added)...)
+	added = append(added, pd.uncoveredTriggers(cur, data.Removed)...)
+	for _, tn := range added {
 		tn.Name = dns.Fqdn(tn.Name)
 		pd.Policy.Logger.Printf("GenerateRpzIxfr: evaluating added name %s", tn.Name)
 		addtorpz = false
-		newAction := pd.ComputeRpzAction(tn.Name)
-		if cur, exist := pd.Rpz.Axfr.Data[tn.Name]; exist {
+		rpzn, newAction, rule := newRule(tn.Name)
+		oldAction := tapir.ALLOWLIST
+		if old, exist := cur.Data[pd.rpzOwner(tn.Name)]; exist {
+			oldAction = old.Action
 			if newAction == tapir.ALLOWLIST {
 				// delete from rpz
 				if pd.Debug {
 					pd.Policy.Logger.Printf("GenRpzIxfr[ADD]: name %s already exists in rpz, new action is ALLOWLIST: -->DELETE", tn.Name)
 				}
-				removeData = append(removeData, cur)
+				removeData = append(removeData, old)
+				auditRecord("remove", tn.Name, oldAction, newAction, 0, rule)
 			} else {
-				if cur.Action != newAction {
+				if changed(old, rpzn) {
 					// change, delete old rule, add new
-					removeData = append(removeData, cur)
+					removeData = append(removeData, old)
+					auditRecord("remove", tn.Name, oldAction, newAction, 0, rule)
 					addtorpz = true
 					if pd.Debug {
 						pd.Policy.Logger.Printf("GenRpzIxfr[ADD]: name %s present in rpz, newaction(%s) != oldaction(%s): -->ADD",
-							tn.Name, tapir.ActionToString[newAction],
-							tapir.ActionToString[cur.Action])
+							tn.Name, ActionString(newAction),
+							ActionString(old.Action))
 					}
 				}
 			}
@@ -258,45 +343,50 @@ func (pd *PopData) GenerateRpzIxfr(data *tapir.TapirMsg) (RpzIxfr, error) {
 				// add it
 				if pd.Debug {
 					pd.Policy.Logger.Printf("GenRpzIxfr[ADD]: name %s NOT present in rpz, newaction(%s) != ALLOWLIST: -->ADD",
-						tn.Name, tapir.ActionToString[newAction])
+						tn.Name, ActionString(newAction))
 				}
 				addtorpz = true
 			}
 		}
 		if addtorpz {
-			cname := new(dns.CNAME)
-			cname.Hdr = dns.RR_Header{
-				Name:     tn.Name + pd.Rpz.ZoneName,
-				Rrtype:   dns.TypeCNAME,
-				Class:    dns.ClassINET,
-				Ttl:      3600,
-				Rdlength: 1,
-			}
-			cname.Target = tapir.ActionToCNAMETarget[newAction]
-			rr := dns.RR(cname)
-
-			addData = append(addData, &tapir.RpzName{
-				Name:   tn.Name,
-				RR:     &rr,
-				Action: newAction,
-			})
+			addData = append(addData, rpzn)
+			auditRecord("add", tn.Name, oldAction, newAction, rpzn.RRs[0].Header().Ttl, rule)
 		}
 	}
 
 	if len(removeData) != 0 || len(addData) != 0 {
-		curserial := pd.Rpz.CurrentSerial
+		curserial := cur.Serial
 		newserial := curserial + 1 // XXX: not dealing with serial wraps
+		// Sorted, so that the IXFR is the same regardless of the order of the names in the update
+		sortRpzNames(removeData)
+		sortRpzNames(addData)
 		thisixfr := RpzIxfr{
 			FromSerial: curserial,
 			ToSerial:   newserial,
 			Removed:    removeData,
 			Added:      addData,
 		}
-		pd.Rpz.IxfrChain = append(pd.Rpz.IxfrChain, thisixfr)
-		pd.Rpz.CurrentSerial = newserial
+		next := pd.Rpz.next()
+		next.ApplyIxfr(thisixfr)
+		if err := pd.Rpz.signNext(next, true); err != nil {
+			return RpzIxfr{}, fmt.Errorf("GenRpzIxfr: error signing %s serial %d: %v", pd.Rpz.ZoneName, newserial, err)
+		}
+		thisixfr = next.IxfrChain[len(next.IxfrChain)-1] // with the DNSSEC changes
+		pd.Rpz.publish(next)
+
+		now := time.Now()
+		pd.publishPolicy(thisixfr, now)
+		for i := range audit {
+			audit[i].Time = now
+			audit[i].Serial = newserial
+		}
+		err := pd.PolicyAudit.Append(audit)
+		if err != nil {
+			pd.Logger.Printf("GenRpzIxfr: Error writing to policy audit log: %v", err)
+		}
 		if pd.Verbose {
 			pd.Policy.Logger.Printf("GenRpzIxfr: added new IXFR (serial from %d to %d) to chain. Chain has %d IXFRs",
-				curserial, newserial, len(pd.Rpz.IxfrChain))
+				curserial, newserial, len(next.IxfrChain))
 		}
 		return thisixfr, nil
 	}
@@ -304,3 +394,33 @@ func (pd *PopData) GenerateRpzIxfr(data *tapir.TapirMsg) (RpzIxfr, error) {
 	pd.Policy.Logger.Printf("GenRpzIxfr: no changes in RPZ policy, no new IXFR")
 	return RpzIxfr{}, nil
 }
+
+// rpzRule returns the rule in the RPZ output for name, which got action from the policy rule
+// rule (see ComputeRpzAction). Most actions are a CNAME to the target of the action, REDIRECT is
+// the local data of the redirect target of the policy rule. Returns nil if name has no rule in
+// the output. Must be called with pd.mu held.
+func (pd *PopData) rpzRule(name string, action tapir.Action, rule string) *RpzRule {
+	if action == tapir.ALLOWLIST {
+		return nil
+	}
+	owner := pd.rpzOwner(name)
+	ttl := pd.RpzTtl(name, action, rule)
+	if action == tapir.REDIRECT {
+		rt := pd.Policy.Redirect(rule)
+		if rt == nil {
+			pd.Policy.Logger.Printf("rpzRule: name %s is REDIRECT by rule %s, but there is no redirect target. Not included in output.",
+				name, rule)
+			return nil
+		}
+		return NewRpzRule(name, action, rt.RRs(owner, ttl))
+	}
+	target, exist := actionTargets[action]
+	if !exist {
+		pd.Policy.Logger.Printf("rpzRule: name %s has unknown action %d (rule %s). Not included in output.", name, action, rule)
+		return nil
+	}
+	return NewRpzRule(name, action, []dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: owner, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+		Target: target,
+	}})
+}
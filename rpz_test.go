@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+)
+
+func TestGenerateRpzIxfr(t *testing.T) {
+	pd, _ := newPopData(t)
+	tp := &testPop{pd: pd}
+	tp.addList("allowlist", "local-allow", "file", "good.example.com.")
+	feed := tp.addList("doubtlist", "dns-tapir", "mqtt")
+
+	// 1. A new doubtlisted name is added to the output
+	feed.Names["bad.example.com."] = tapir.TapirName{Name: "bad.example.com.", TimeAdded: time.Now()}
+	serial := pd.Rpz.CurrentSerial()
+	ixfr, err := pd.GenerateRpzIxfr(&tapir.TapirMsg{
+		Added: []tapir.Domain{{Name: "bad.example.com."}},
+	}, PolicyTrigger{Kind: TriggerMqtt, Source: "dns-tapir"})
+	if err != nil {
+		t.Fatalf("GenerateRpzIxfr: %v", err)
+	}
+	if ixfr.FromSerial != serial || ixfr.ToSerial != serial+1 || pd.Rpz.CurrentSerial() != serial+1 {
+		t.Fatalf("IXFR serials: from %d to %d (current %d), want from %d to %d",
+			ixfr.FromSerial, ixfr.ToSerial, pd.Rpz.CurrentSerial(), serial, serial+1)
+	}
+	if len(ixfr.Added) != 1 || len(ixfr.Removed) != 0 {
+		t.Fatalf("IXFR has %d adds and %d removes, want 1 and 0", len(ixfr.Added), len(ixfr.Removed))
+	}
+	cname, ok := (*ixfr.Added[0].RR).(*dns.CNAME)
+	if !ok {
+		t.Fatalf("added RR is not a CNAME: %s", (*ixfr.Added[0].RR).String())
+	}
+	if cname.Hdr.Name != "bad.example.com."+testRpzZone {
+		t.Errorf("added RR has owner %s, want %s", cname.Hdr.Name, "bad.example.com."+testRpzZone)
+	}
+	if want := tapir.ActionToCNAMETarget[pd.Policy.Doubtlist.NumSourcesAction]; cname.Target != want {
+		t.Errorf("added RR has target %s, want %s", cname.Target, want)
+	}
+	if _, exist := pd.Rpz.Snapshot().Data["bad.example.com."+testRpzZone]; !exist {
+		t.Errorf("output zone does not contain bad.example.com. after the IXFR")
+	}
+
+	// 2. An allowlisted name never makes it into the output
+	feed.Names["good.example.com."] = tapir.TapirName{Name: "good.example.com.", TimeAdded: time.Now()}
+	ixfr, err = pd.GenerateRpzIxfr(&tapir.TapirMsg{
+		Added: []tapir.Domain{{Name: "good.example.com."}},
+	}, PolicyTrigger{Kind: TriggerMqtt, Source: "dns-tapir"})
+	if err != nil {
+		t.Fatalf("GenerateRpzIxfr: %v", err)
+	}
+	if len(ixfr.Added) != 0 || len(ixfr.Removed) != 0 || pd.Rpz.CurrentSerial() != serial+1 {
+		t.Errorf("allowlisted name caused an IXFR with %d adds and %d removes (serial %d)",
+			len(ixfr.Added), len(ixfr.Removed), pd.Rpz.CurrentSerial())
+	}
+
+	// 3. The same name again is not a change
+	ixfr, err = pd.GenerateRpzIxfr(&tapir.TapirMsg{
+		Added: []tapir.Domain{{Name: "bad.example.com."}},
+	}, PolicyTrigger{Kind: TriggerMqtt, Source: "dns-tapir"})
+	if err != nil {
+		t.Fatalf("GenerateRpzIxfr: %v", err)
+	}
+	if len(ixfr.Added) != 0 || len(ixfr.Removed) != 0 {
+		t.Errorf("unchanged name caused an IXFR with %d adds and %d removes", len(ixfr.Added), len(ixfr.Removed))
+	}
+
+	// 4. When the name is no longer doubtlisted it is removed from the output
+	delete(feed.Names, "bad.example.com.")
+	ixfr, err = pd.GenerateRpzIxfr(&tapir.TapirMsg{
+		Removed: []tapir.Domain{{Name: "bad.example.com."}},
+	}, PolicyTrigger{Kind: TriggerReaper, Source: "dns-tapir"})
+	if err != nil {
+		t.Fatalf("GenerateRpzIxfr: %v", err)
+	}
+	if len(ixfr.Added) != 0 || len(ixfr.Removed) != 1 || ixfr.ToSerial != serial+2 {
+		t.Fatalf("IXFR has %d adds and %d removes (to serial %d), want 0 and 1 (to serial %d)",
+			len(ixfr.Added), len(ixfr.Removed), ixfr.ToSerial, serial+2)
+	}
+	snap := pd.Rpz.Snapshot()
+	if len(snap.Data) != 0 {
+		t.Errorf("output zone has %d rules after removal, want 0", len(snap.Data))
+	}
+	if len(snap.IxfrChain) != 2 || snap.IxfrChain[1].ToSerial != snap.Serial {
+		t.Errorf("IXFR chain has %d IXFRs ending in serial %d, want 2 ending in %d",
+			len(snap.IxfrChain), snap.IxfrChain[len(snap.IxfrChain)-1].ToSerial, snap.Serial)
+	}
+
+	// 5. Every change is in the audit log
+	recs, err := pd.PolicyAudit.Query(AuditQuery{Name: "bad.example.com."})
+	if err != nil {
+		t.Fatalf("PolicyAudit.Query: %v", err)
+	}
+	if len(recs) != 2 || recs[0].Op != "add" || recs[1].Op != "remove" || recs[1].Trigger != TriggerReaper {
+		t.Errorf("audit log for bad.example.com.: %+v, want one add followed by one remove by the reaper", recs)
+	}
+}
+
+// A published snapshot must never change, whatever happens to the output zone afterwards.
+func TestRpzSnapshotIsImmutable(t *testing.T) {
+	pd, _ := newPopData(t)
+	tp := &testPop{pd: pd}
+	feed := tp.addList("doubtlist", "dns-tapir", "mqtt")
+	feed.Names["one.example.com."] = tapir.TapirName{Name: "one.example.com.", Action: tapir.NXDOMAIN}
+
+	pd.mu.Lock()
+	if _, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup}); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	pd.mu.Unlock()
+	before := pd.Rpz.Snapshot()
+	if len(before.Data) != 1 || before.SOA.Serial != before.Serial {
+		t.Fatalf("snapshot has %d rules and SOA serial %d (serial %d), want 1 rule and matching serials",
+			len(before.Data), before.SOA.Serial, before.Serial)
+	}
+
+	pd.mu.Lock()
+	feed.Names["two.example.com."] = tapir.TapirName{Name: "two.example.com.", TimeAdded: time.Now()}
+	_, err := pd.GenerateRpzIxfr(&tapir.TapirMsg{
+		Added: []tapir.Domain{{Name: "two.example.com."}},
+	}, PolicyTrigger{Kind: TriggerMqtt, Source: "dns-tapir"})
+	pd.mu.Unlock()
+	if err != nil {
+		t.Fatalf("GenerateRpzIxfr: %v", err)
+	}
+
+	after := pd.Rpz.Snapshot()
+	if after == before || after.Serial != before.Serial+1 || after.SOA.Serial != after.Serial {
+		t.Fatalf("no new snapshot after the IXFR: serial %d (SOA %d), previous serial %d",
+			after.Serial, after.SOA.Serial, before.Serial)
+	}
+	if len(before.Data) != 1 || len(before.IxfrChain) != 0 || before.SOA.Serial != before.Serial {
+		t.Errorf("previous snapshot was modified: %d rules, %d IXFRs, SOA serial %d",
+			len(before.Data), len(before.IxfrChain), before.SOA.Serial)
+	}
+	if len(after.Data) != 2 || len(after.IxfrChain) != 1 {
+		t.Errorf("new snapshot has %d rules and %d IXFRs, want 2 and 1", len(after.Data), len(after.IxfrChain))
+	}
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+)
+
+// The MQTT observations of a list may be duplicated, reordered or lost on the way. An
+// observation carries its sequence number, counted by the publisher per list, as "Seq" next to
+// the fields of tapir.TapirMsg (see ParseMsgSeq); it is optional, 0 means none. Per list:
+//
+//   - Duplicates (sequence numbers already seen) are dropped.
+//   - Without sequence numbers, stale observations, with a time stamp more than reorderWindow
+//     before the latest one, are dropped.
+//   - A jump in the sequence numbers is a gap. Missing observations that have not arrived after
+//     gapTimeout are given up, and the list is bootstrapped again, see expireGaps.
+//   - An observation does not change a name that a later observation has already changed (so
+//     a late removal does not remove a name that was added again), see orderNames.
+
+// ParseMsgSeq returns the sequence number in the MQTT payload of an observation, or 0 if there
+// is none.
+func ParseMsgSeq(payload []byte) uint64 {
+	var msg struct {
+		Seq uint64
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return 0
+	}
+	return msg.Seq
+}
+
+var (
+	reorderWindow = time.Minute
+	gapTimeout    = time.Minute
+	maxMissing    = 10000 // larger gaps are given up at once
+)
+
+// MsgSequence is the state of the sequence of observations of a list.
+type MsgSequence struct {
+	Last       uint64               // the highest sequence number seen
+	LastTime   time.Time            // the latest time stamp seen
+	Missing    map[uint64]time.Time // the sequence numbers that have not arrived, and since when
+	Gaps       uint64               // the number of missing observations detected
+	Filled     uint64               // of those, the ones that arrived late
+	Unfilled   uint64               // of those, the ones that were given up
+	Duplicates uint64
+	Stale      uint64
+	resync     bool                 // a gap was given up, the list must be bootstrapped again
+	changed    map[string]time.Time // the time stamp of the latest observation that changed a name
+	pruned     time.Time
+}
+
+func (ms *MsgSequence) String() string {
+	return fmt.Sprintf("%d gaps (%d filled, %d unfilled, %d missing), %d duplicates, %d stale",
+		ms.Gaps, ms.Filled, ms.Unfilled, len(ms.Missing), ms.Duplicates, ms.Stale)
+}
+
+// SequenceStats are the counters of the sequence of observations of a list, as reported by the
+// doubtlist-status command.
+type SequenceStats struct {
+	Last       uint64
+	LastTime   time.Time
+	Gaps       uint64
+	Filled     uint64
+	Unfilled   uint64
+	Missing    int
+	Duplicates uint64
+	Stale      uint64
+}
+
+func (ms *MsgSequence) Stats() SequenceStats {
+	return SequenceStats{
+		Last:       ms.Last,
+		LastTime:   ms.LastTime,
+		Gaps:       ms.Gaps,
+		Filled:     ms.Filled,
+		Unfilled:   ms.Unfilled,
+		Missing:    len(ms.Missing),
+		Duplicates: ms.Duplicates,
+		Stale:      ms.Stale,
+	}
+}
+
+// sequence returns the sequence state of wbgl. Must be called with pd.mu held for writing.
+func (pd *PopData) sequence(wbgl *tapir.WBGlist) *MsgSequence {
+	ms := pd.Sequences[wbgl]
+	if ms == nil {
+		ms = &MsgSequence{Missing: map[uint64]time.Time{}, changed: map[string]time.Time{}}
+		pd.Sequences[wbgl] = ms
+	}
+	return ms
+}
+
+// checkSequence reports whether the observation tm with the sequence number seq should be
+// applied, and keeps track of the gaps in the sequence.
+func (pd *PopData) checkSequence(tm tapir.TapirMsg, seq uint64) bool {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	wbgl, exist := pd.Lists[tm.ListType][tm.SrcName]
+	if !exist {
+		return true // rejected later
+	}
+	ms := pd.sequence(wbgl)
+	now := time.Now()
+
+	newer := !tm.TimeStamp.IsZero() && tm.TimeStamp.After(ms.LastTime)
+	switch {
+	case seq == 0:
+	case ms.Last == 0 || seq == ms.Last+1:
+		ms.Last = seq
+	case seq > ms.Last+1:
+		n := seq - ms.Last - 1
+		ms.Gaps += n
+		if n > uint64(maxMissing) {
+			ms.Unfilled += n
+			ms.resync = true
+		} else {
+			for s := ms.Last + 1; s < seq; s++ {
+				ms.Missing[s] = now
+			}
+		}
+		ms.Last = seq
+		pd.ReportStatus("sequence", tapir.StatusWarn, "%s: observations %d-%d are missing (%s)", wbgl.Name, seq-n, seq-1, ms)
+	default:
+		if _, missing := ms.Missing[seq]; missing {
+			delete(ms.Missing, seq)
+			ms.Filled++
+			pd.Logger.Printf("checkSequence: %s: missing observation %d arrived", wbgl.Name, seq)
+			if len(ms.Missing) == 0 && !ms.resync {
+				pd.ReportStatus("sequence", tapir.StatusOK, "%s: all gaps filled (%s)", wbgl.Name, ms)
+			}
+			break
+		}
+		if newer {
+			// The publisher has started over
+			pd.Logger.Printf("checkSequence: %s: sequence restarted at %d (after %d)", wbgl.Name, seq, ms.Last)
+			ms.Last = seq
+			clear(ms.Missing)
+			break
+		}
+		ms.Duplicates++
+		pd.Logger.Printf("checkSequence: %s: duplicate observation %d dropped", wbgl.Name, seq)
+		return false
+	}
+
+	if seq == 0 && !tm.TimeStamp.IsZero() && tm.TimeStamp.Before(ms.LastTime.Add(-reorderWindow)) {
+		ms.Stale++
+		pd.Logger.Printf("checkSequence: %s: observation from %s dropped, more than %v older than the latest one (%s)",
+			wbgl.Name, tm.TimeStamp.Format(tapir.TimeLayout), reorderWindow, ms.LastTime.Format(tapir.TimeLayout))
+		return false
+	}
+	if newer {
+		ms.LastTime = tm.TimeStamp
+	}
+	return true
+}
+
+// orderNames removes the names from tm that a later observation has already changed, and
+// records the time stamp of tm for the rest. Must be called with pd.mu held for writing.
+func (pd *PopData) orderNames(wbgl *tapir.WBGlist, tm *tapir.TapirMsg) {
+	if tm.TimeStamp.IsZero() {
+		return
+	}
+	ms := pd.sequence(wbgl)
+	keep := func(domains []tapir.Domain) []tapir.Domain {
+		res := make([]tapir.Domain, 0, len(domains))
+		for _, d := range domains {
+			name := dns.Fqdn(d.Name)
+			if ts, exist := ms.changed[name]; exist && ts.After(tm.TimeStamp) {
+				pd.Logger.Printf("ProcessTapirUpdate: %s in %s was changed by a later observation (%s), not changed by this one (%s)",
+					name, wbgl.Name, ts.Format(tapir.TimeLayout), tm.TimeStamp.Format(tapir.TimeLayout))
+				continue
+			}
+			ms.changed[name] = tm.TimeStamp
+			res = append(res, d)
+		}
+		return res
+	}
+	tm.Added = keep(tm.Added)
+	tm.Removed = keep(tm.Removed)
+
+	// Older observations are dropped as stale, so their names need not be remembered
+	if horizon := ms.LastTime.Add(-reorderWindow - gapTimeout); horizon.After(ms.pruned.Add(reorderWindow)) {
+		for name, ts := range ms.changed {
+			if ts.Before(horizon) {
+				delete(ms.changed, name)
+			}
+		}
+		ms.pruned = horizon
+	}
+}
+
+// expireGaps gives up the missing observations that have not arrived within gapTimeout, and
+// bootstraps the lists with such gaps again.
+func (pd *PopData) expireGaps() {
+	var resync []*tapir.WBGlist
+	pd.mu.Lock()
+	for wbgl, ms := range pd.Sequences {
+		for seq, since := range ms.Missing {
+			if time.Since(since) > gapTimeout {
+				delete(ms.Missing, seq)
+				ms.Unfilled++
+				ms.resync = true
+			}
+		}
+		if !ms.resync {
+			continue
+		}
+		ms.resync = false
+		if _, busy := pd.Handovers[handoverKey(wbgl.Type, wbgl.Name)]; busy {
+			continue // being bootstrapped, which covers the gap
+		}
+		resync = append(resync, wbgl)
+		pd.ReportStatus("sequence", tapir.StatusFail, "%s: missing observations did not arrive, bootstrapping the list again (%s)", wbgl.Name, ms)
+	}
+	pd.mu.Unlock()
+
+	for _, wbgl := range resync {
+		src := pd.mqttSourceConf(wbgl)
+		if len(src.Bootstrap) == 0 {
+			pd.Logger.Printf("expireGaps: %s has no bootstrap servers, the missing observations are lost", wbgl.Name)
+			continue
+		}
+		go func() {
+			err := pd.rebootstrap(wbgl, func() (*ListExport, error) {
+				return pd.BootstrapMqttSource(src)
+			})
+			if err != nil {
+				pd.Logger.Printf("expireGaps: Error bootstrapping %s: %v", wbgl.Name, err)
+				pd.ReportStatus("bootstrap", tapir.StatusWarn, "Error bootstrapping MQTT source %s: %v", wbgl.Name, err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+)
+
+func TestParseMsgSeq(t *testing.T) {
+	for payload, want := range map[string]uint64{
+		`{"SrcName":"dns-tapir","Seq":17}`: 17,
+		`{"SrcName":"dns-tapir"}`:          0,
+		`{"Seq":"17"}`:                     0,
+		`not json`:                         0,
+	} {
+		if got := ParseMsgSeq([]byte(payload)); got != want {
+			t.Errorf("ParseMsgSeq(%s) = %d, want %d", payload, got, want)
+		}
+	}
+}
+
+func TestCheckSequence(t *testing.T) {
+	pd, conf := newPopData(t)
+	tp := &testPop{pd: pd}
+	wbgl := tp.addList("doubtlist", "dns-tapir", "mqtt")
+	start := time.Now().Add(-time.Hour)
+	check := func(seq uint64, ts time.Time) bool {
+		return pd.checkSequence(tapir.TapirMsg{SrcName: "dns-tapir", ListType: "doubtlist", TimeStamp: ts}, seq)
+	}
+
+	for i, tc := range []struct {
+		seq   uint64
+		ts    time.Duration // after start
+		apply bool
+	}{
+		{5, 0, true}, // the first one we see
+		{6, time.Second, true},
+		{6, time.Second, false}, // duplicate
+		{9, 4 * time.Second, true},
+		{7, 2 * time.Second, true}, // fills the gap
+		{7, 2 * time.Second, false},
+		{1, 10 * time.Second, true}, // the publisher started over
+		{0, 11 * time.Second, true},
+		{0, 10*time.Second - reorderWindow, false}, // stale
+		{0, 11*time.Second - reorderWindow, true},
+	} {
+		if got := check(tc.seq, start.Add(tc.ts)); got != tc.apply {
+			t.Errorf("%d: observation %d: applied %t, want %t", i, tc.seq, got, tc.apply)
+		}
+	}
+	ms := pd.Sequences[wbgl]
+	if ms.Gaps != 2 || ms.Filled != 1 || len(ms.Missing) != 0 || ms.Duplicates != 2 || ms.Stale != 1 || ms.Last != 1 {
+		t.Errorf("sequence state: last %d, %s", ms.Last, ms)
+	}
+
+	// A gap that is not filled in time is given up
+	check(3, start.Add(12*time.Second))
+	defer func(timeout time.Duration) { gapTimeout = timeout }(gapTimeout)
+	gapTimeout = 0
+	pd.expireGaps()
+	if ms.Unfilled != 1 || len(ms.Missing) != 0 || ms.resync {
+		t.Errorf("sequence state after expireGaps: %s, resync %t", ms, ms.resync)
+	}
+
+	// The counters are in the status of the list
+	conf.PopData = pd
+	conf.Internal.ApiAuth = &ApiAuth{Logger: testLogger()}
+	w := apiRequest(APIbootstrap(conf), RoleReadOnly, "/api/v1/bootstrap", tapir.BootstrapPost{Command: "doubtlist-status", ListName: "dns-tapir"})
+	var br BootstrapResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &br); err != nil || br.Error {
+		t.Fatalf("doubtlist-status: %v, %s", err, br.ErrorMsg)
+	}
+	if st := br.Sequences["dns-tapir"]; st.Last != 3 || !st.LastTime.Equal(ms.LastTime) || st.Gaps != 3 || st.Unfilled != 1 || st.Duplicates != 2 || st.Stale != 1 {
+		t.Errorf("doubtlist-status: sequence counters %+v, want %s", st, ms)
+	}
+}
+
+func TestOrderNames(t *testing.T) {
+	pd, _ := newPopData(t)
+	tp := &testPop{pd: pd}
+	wbgl := tp.addList("doubtlist", "dns-tapir", "mqtt")
+	start := time.Now().Add(-time.Minute)
+	update := func(ts time.Time, added, removed string) {
+		t.Helper()
+		tm := tapir.TapirMsg{SrcName: "dns-tapir", ListType: "doubtlist", MsgType: "observation", TimeStamp: ts}
+		if added != "" {
+			tm.Added = []tapir.Domain{{Name: added, TimeAdded: ts, TTL: 3600}}
+		}
+		if removed != "" {
+			tm.Removed = []tapir.Domain{{Name: removed}}
+		}
+		if ok, err := pd.ProcessTapirUpdate(tm, nil); !ok || err != nil {
+			t.Fatalf("ProcessTapirUpdate: %t, %v", ok, err)
+		}
+	}
+
+	// Added, removed and added again, with the removal arriving last
+	update(start, "evil.example.", "")
+	update(start.Add(2*time.Second), "evil.example.", "")
+	update(start.Add(time.Second), "", "evil.example.")
+	if tn, exist := wbgl.Names["evil.example."]; !exist || !tn.TimeAdded.Equal(start.Add(2*time.Second)) {
+		t.Errorf("name added again removed by an earlier removal: %+v, %t", tn, exist)
+	}
+
+	// A late addition does not undo a removal
+	update(start.Add(3*time.Second), "", "evil.example.")
+	update(start.Add(2500*time.Millisecond), "evil.example.", "")
+	if _, exist := wbgl.Names["evil.example."]; exist {
+		t.Errorf("removed name added again by an earlier addition")
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// ServerRegistry keeps track of all the HTTP and DNS servers that we start, so that
+// they can be shut down in an orderly fashion.
+type ServerRegistry struct {
+	mu          sync.Mutex
+	httpServers []*http.Server
+	dnsServers  []*dns.Server
+}
+
+func (sr *ServerRegistry) AddHttpServer(s *http.Server) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.httpServers = append(sr.httpServers, s)
+}
+
+func (sr *ServerRegistry) AddDnsServer(s *dns.Server) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.dnsServers = append(sr.dnsServers, s)
+}
+
+// ShutdownHttp stops all HTTP servers from accepting new requests and waits for
+// active requests to complete, or for the context to expire.
+func (sr *ServerRegistry) ShutdownHttp(ctx context.Context) error {
+	sr.mu.Lock()
+	servers := sr.httpServers
+	sr.mu.Unlock()
+
+	var errs []error
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("HTTP server %s: %v", s.Addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ShutdownDns stops all DNS servers from accepting new queries and waits for
+// active handlers to complete, or for the context to expire.
+func (sr *ServerRegistry) ShutdownDns(ctx context.Context) error {
+	sr.mu.Lock()
+	servers := sr.dnsServers
+	sr.mu.Unlock()
+
+	var errs []error
+	for _, s := range servers {
+		if err := s.ShutdownContext(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("DNS server %s (%s): %v", s.Addr, s.Net, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// waitWithContext waits for the WaitGroup to reach zero or the context to expire,
+// whichever happens first.
+func waitWithContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// beginXfr registers an outbound zone transfer in pd.XfrsInFlight, unless we are shutting down.
+// The caller must call pd.XfrsInFlight.Done when the transfer is done.
+func (pd *PopData) beginXfr() bool {
+	pd.xfrMu.Lock()
+	defer pd.xfrMu.Unlock()
+	if pd.ShuttingDown.Load() {
+		return false
+	}
+	pd.XfrsInFlight.Add(1)
+	return true
+}
+
+// startEngine runs engine (e.g. pd.RefreshEngine) in a goroutine that Shutdown waits for after
+// closing stopch, so that the state is not saved while the engine may still be changing it.
+func (pd *PopData) startEngine(engine func(*Config, chan struct{}), conf *Config, stopch chan struct{}) {
+	pd.Engines.Add(1)
+	go func() {
+		defer pd.Engines.Done()
+		engine(conf, stopch)
+	}()
+}
+
+// Shutdown winds down TAPIR-POP in an order that ensures that no zone transfer is
+// truncated and that no state is lost:
+//  1. Stop the API servers (in-flight API requests are allowed to complete)
+//  2. Stop serving new zone transfers and wait for in-flight transfers to complete
+//  3. Stop the DNS servers
+//  4. Stop the MQTT engine and the engines started by startEngine, and wait for the latter to
+//     exit, so that the lists, the RPZ serial and the audit log no longer change
+//  5. Save the list backups, the RPZ serial and the policy audit log
+func (pd *PopData) Shutdown(conf *Config, stopch chan struct{}) error {
+	timeout := viper.GetDuration("services.shutdown.timeout")
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var errs []error
+	pd.xfrMu.Lock()
+	pd.ShuttingDown.Store(true)
+	pd.xfrMu.Unlock()
+
+	log.Printf("Shutdown: stopping API servers (timeout %v)", timeout)
+	if err := conf.Internal.Servers.ShutdownHttp(ctx); err != nil {
+		log.Printf("Shutdown: Error stopping API servers: %v", err)
+		errs = append(errs, err)
+	}
+
+	log.Printf("Shutdown: waiting for in-flight zone transfers to complete")
+	if err := waitWithContext(ctx, &pd.XfrsInFlight); err != nil {
+		log.Printf("Shutdown: Error waiting for zone transfers: %v", err)
+		errs = append(errs, err)
+	}
+
+	log.Printf("Shutdown: stopping DNS servers")
+	if err := conf.Internal.Servers.ShutdownDns(ctx); err != nil {
+		log.Printf("Shutdown: Error stopping DNS servers: %v", err)
+		errs = append(errs, err)
+	}
+
+	if pd.MqttEngine != nil && pd.TapirMqttEngineRunning {
+		log.Printf("Shutdown: stopping MQTT engine")
+		if _, err := pd.MqttEngine.StopEngine(); err != nil {
+			log.Printf("Shutdown: Error stopping MQTT engine: %v", err)
+			errs = append(errs, err)
+		}
+		pd.TapirMqttEngineRunning = false
+	}
+
+	// Stops RefreshEngine, StatusUpdater, Reconciler, PolicyPublisher and HttpRefresher
+	close(stopch)
+	log.Printf("Shutdown: waiting for the engines to stop")
+	if err := waitWithContext(ctx, &pd.Engines); err != nil {
+		// The state is saved anyway, it is better than none
+		log.Printf("Shutdown: Error waiting for the engines: %v", err)
+		errs = append(errs, err)
+	}
+
+	log.Printf("Shutdown: saving state")
+	pd.BackupListsState()
+	if err := pd.SaveRpzSerial(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := pd.PolicyAudit.Close(); err != nil {
+		log.Printf("Shutdown: Error closing policy audit log: %v", err)
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestShutdownWaitsForEngines(t *testing.T) {
+	serialFile := filepath.Join(t.TempDir(), "serial.yaml")
+	pd, conf := newPopData(t, func() { viper.Set("services.rpz.serialcache", serialFile) })
+	tp := &testPop{pd: pd}
+	tp.addList("doubtlist", "dns-tapir", "mqtt", "evil.example.")
+
+	// An engine that is still changing the output when it is told to stop
+	stopch := make(chan struct{})
+	var engineErr error
+	pd.startEngine(func(conf *Config, stopch chan struct{}) {
+		<-stopch
+		time.Sleep(50 * time.Millisecond)
+		pd.mu.Lock()
+		defer pd.mu.Unlock()
+		_, engineErr = pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerApi, Source: "test"})
+	}, conf, stopch)
+
+	if err := pd.Shutdown(conf, stopch); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if engineErr != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", engineErr)
+	}
+	data, err := os.ReadFile(serialFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("current_serial: %d\n", pd.Rpz.CurrentSerial()); string(data) != want {
+		t.Errorf("saved serial %q, want %q", data, want)
+	}
+	if recs, err := pd.PolicyAudit.Query(AuditQuery{Name: "evil.example."}); err != nil || len(recs) != 1 {
+		t.Errorf("%d audit records of the change, %v, want it written before the log was closed", len(recs), err)
+	}
+}
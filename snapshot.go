@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+)
+
+// RpzRule is a rule in the RPZ output zone. Most rules are a single CNAME, but a REDIRECT rule
+// is local data that may be several RRs, e.g. both A and AAAA records. RRs is the complete RRset
+// of the rule and RR its first record.
+type RpzRule struct {
+	tapir.RpzName
+	RRs []dns.RR
+}
+
+// NewRpzRule returns the rule for name with the RRset rrs, which must not be empty.
+func NewRpzRule(name string, action tapir.Action, rrs []dns.RR) *RpzRule {
+	return &RpzRule{
+		RpzName: tapir.RpzName{Name: name, RR: &rrs[0], Action: action},
+		RRs:     rrs,
+	}
+}
+
+// Same reports whether r and o have the same action and the same RRset, including the TTLs.
+func (r *RpzRule) Same(o *RpzRule) bool {
+	return r.Action == o.Action && slices.EqualFunc(r.RRs, o.RRs, sameRR)
+}
+
+// RpzSnapshot is one version of the RPZ output zone. A published snapshot is immutable: every
+// change to the output creates a new snapshot (copy-on-write) that replaces the current one
+// atomically. Readers (zone transfers, queries, NOTIFYs) load the current snapshot once and use
+// only that, so they always see a zone whose contents match its serial.
+type RpzSnapshot struct {
+	Serial    uint32
+	SOA       *dns.SOA            // apex SOA with Serial set
+	NSrrs     []dns.RR            // apex NS RRset
+	Glue      []dns.RR            // addresses of the nameservers in the zone
+	Data      map[string]*RpzRule // map[owner name]rule; the owner name includes the RPZ zone name
+	IxfrChain []RpzIxfr           // oldest first, the last IXFR ends in Serial
+	Signed    *SignedZone         // nil if the output zone is not signed
+
+	sortOnce sync.Once
+	owners   []string // the keys of Data in canonical order, see Owners
+}
+
+// Snapshot returns the current version of the output zone. It never returns nil once
+// BootstrapRpzOutput has been called.
+func (rd *RpzData) Snapshot() *RpzSnapshot {
+	return rd.current.Load()
+}
+
+// CurrentSerial returns the serial of the current version of the output zone.
+func (rd *RpzData) CurrentSerial() uint32 {
+	if snap := rd.current.Load(); snap != nil {
+		return snap.Serial
+	}
+	return rd.initialSerial
+}
+
+// next returns a copy of the current snapshot that may be modified by the writer before it is
+// published. The rules themselves (*RpzRule) are shared, as they are never modified.
+// Must be called with rd.writer held.
+func (rd *RpzData) next() *RpzSnapshot {
+	cur := rd.current.Load()
+	snap := RpzSnapshot{
+		Serial:    cur.Serial,
+		SOA:       cur.SOA,
+		NSrrs:     cur.NSrrs,
+		Glue:      cur.Glue,
+		Data:      maps.Clone(cur.Data),
+		IxfrChain: cur.IxfrChain[:len(cur.IxfrChain):len(cur.IxfrChain)], // append must copy
+		Signed:    cur.Signed,
+	}
+	return &snap
+}
+
+// publish makes snap the current version of the output zone. Must be called with rd.writer held.
+func (rd *RpzData) publish(snap *RpzSnapshot) {
+	rd.setSOA(snap)
+	rd.current.Store(snap)
+}
+
+// setSOA gives snap an apex SOA with the serial of snap.
+func (rd *RpzData) setSOA(snap *RpzSnapshot) {
+	if snap.SOA == nil || snap.SOA.Serial != snap.Serial {
+		soa := dns.Copy(&rd.apexSOA).(*dns.SOA)
+		soa.Serial = snap.Serial
+		snap.SOA = soa
+	}
+}
+
+// rpzOwner returns the owner name of the rule for name in the RPZ output zone.
+func (pd *PopData) rpzOwner(name string) string {
+	return name + pd.Rpz.ZoneName
+}
+
+// Owners returns the owner names in Data in DNSSEC canonical order (RFC 4034, section 6.1), so
+// that every AXFR of the same serial is identical. The order is computed on first use.
+func (snap *RpzSnapshot) Owners() []string {
+	snap.sortOnce.Do(func() {
+		type keyed struct{ key, owner string }
+		keys := make([]keyed, 0, len(snap.Data))
+		for owner := range snap.Data {
+			keys = append(keys, keyed{canonicalKey(owner), owner})
+		}
+		slices.SortFunc(keys, func(a, b keyed) int { return strings.Compare(a.key, b.key) })
+		snap.owners = make([]string, len(keys))
+		for i, k := range keys {
+			snap.owners[i] = k.owner
+		}
+	})
+	return snap.owners
+}
+
+// canonicalKey returns a string that sorts like name does in canonical order: the labels are
+// lowercased and reversed, and separated by a byte that sorts before any byte in a label.
+// Labels are compared in presentation format, which only differs from the wire format for
+// labels with escaped characters.
+func canonicalKey(name string) string {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	slices.Reverse(labels)
+	return strings.Join(labels, "\x00")
+}
+
+// sortRpzNames sorts rules in canonical order of their owner names.
+func sortRpzNames(rns []*RpzRule) {
+	slices.SortFunc(rns, func(a, b *RpzRule) int {
+		return strings.Compare(canonicalKey((*a.RR).Header().Name), canonicalKey((*b.RR).Header().Name))
+	})
+}
+
+// EnvelopeSize returns the max number of RRs per message in outbound zone transfers.
+func (rd *RpzData) EnvelopeSize() int {
+	return int(rd.envelopeSize.Load())
+}
+
+// SetEnvelopeSize sets the envelope size from the global config (distributed via MQTT), unless
+// it is set in the local config.
+func (rd *RpzData) SetEnvelopeSize(size int) {
+	if size <= 0 || rd.localEnvSize {
+		return
+	}
+	rd.envelopeSize.Store(int32(size))
+}
+
+// ApplyIxfr applies ixfr to the (not yet published) snapshot and appends it to the IXFR chain.
+func (snap *RpzSnapshot) ApplyIxfr(ixfr RpzIxfr) {
+	for _, rn := range ixfr.Removed {
+		delete(snap.Data, (*rn.RR).Header().Name)
+	}
+	for _, rn := range ixfr.Added {
+		snap.Data[(*rn.RR).Header().Name] = rn
+	}
+	snap.IxfrChain = append(snap.IxfrChain, ixfr)
+	snap.Serial = ixfr.ToSerial
+}
+
+// Empty reports whether the IXFR contains no changes.
+func (ixfr RpzIxfr) Empty() bool {
+	return len(ixfr.Removed) == 0 && len(ixfr.Added) == 0 && len(ixfr.DelRRs) == 0 && len(ixfr.AddRRs) == 0
+}
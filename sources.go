@@ -4,7 +4,6 @@
 package main
 
 import (
-    "encoding/gob"
 	"fmt"
 	"log"
 	"os"
@@ -20,16 +19,6 @@ import (
 )
 
 func NewPopData(conf *Config, lg *log.Logger) (*PopData, error) {
-	rpzdata := RpzData{
-		CurrentSerial: 1,
-		ZoneName:      viper.GetString("services.rpz.zonename"),
-		IxfrChain:     []RpzIxfr{},
-		Axfr: RpzAxfr{
-			Data: map[string]*tapir.RpzName{},
-		},
-		// RpzMap: map[string]*tapir.RpzName{},
-	}
-
 	repint := viper.GetInt("services.reaper.interval")
 	if repint == 0 {
 		repint = 60
@@ -37,26 +26,46 @@ func NewPopData(conf *Config, lg *log.Logger) (*PopData, error) {
 
 	pd := PopData{
 		Lists:             map[string]map[string]*tapir.WBGlist{},
+		Cidrs:             map[*tapir.WBGlist]*PrefixTree{},
+		Positions:         map[*tapir.WBGlist]ListPosition{},
+		Bootstrapped:      map[*tapir.WBGlist]time.Time{},
+		Sequences:         map[*tapir.WBGlist]*MsgSequence{},
+		BadipRefs:         map[*tapir.WBGlist]BadipRefs{},
+		MqttSources:       map[*tapir.WBGlist]SourceConf{},
+		HttpSources:       map[*tapir.WBGlist]SourceConf{},
 		Logger:            lg,
 		MqttLogger:        conf.Loggers.Mqtt,
 		RpzRefreshCh:      make(chan RpzRefresh, 10),
 		RpzCommandCh:      make(chan RpzCmdData, 10),
+		PolicyUpdates:     make(chan tapir.MqttPkgOut, policyQueueSize),
 		ComponentStatusCh: conf.Internal.ComponentStatusCh,
-		Rpz:               rpzdata,
 		ReaperInterval:    time.Duration(repint) * time.Second,
 		Verbose:           viper.GetBool("log.verbose"),
 		Debug:             viper.GetBool("log.debug"),
 	}
 
+	pd.Rpz.ZoneName = viper.GetString("services.rpz.zonename")
+	pd.Rpz.Ttl = 3600
+	if ttl := viper.GetUint32("services.rpz.ttl"); ttl != 0 {
+		pd.Rpz.Ttl = ttl
+	}
+	pd.Rpz.envelopeSize.Store(500)
+	if size := viper.GetInt("services.rpz.envelopesize"); size > 0 {
+		pd.Rpz.envelopeSize.Store(int32(size))
+		pd.Rpz.localEnvSize = true
+	}
 	pd.Lists["allowlist"] = make(map[string]*tapir.WBGlist, 3)
 	pd.Lists["doubtlist"] = make(map[string]*tapir.WBGlist, 3)
 	pd.Lists["denylist"] = make(map[string]*tapir.WBGlist, 3)
 	pd.Downstreams = map[string]RpzDownstream{}
 	pd.DownstreamSerials = map[string]uint32{}
 
-	err := pd.ParseOutputs()
+	// The outputs are parsed by main, once the MQTT Engine exists, see ParseOutputs
+	pd.LoadRpzSerial()
+	var err error
+	pd.Rpz.signer, err = LoadRpzSigner(pd.Rpz.ZoneName)
 	if err != nil {
-		POPExiter("NewPopData: Error from ParseOutputs(): %v", err)
+		return nil, fmt.Errorf("NewPopData: Error from LoadRpzSigner(): %v", err)
 	}
 
 	//	pd.Rpz.IxfrChain = map[uint32]RpzIxfr{}
@@ -64,48 +73,124 @@ func NewPopData(conf *Config, lg *log.Logger) (*PopData, error) {
 
 	err = pd.BootstrapRpzOutput()
 	if err != nil {
-		pd.Logger.Printf("Error from BootstrapRpzOutput(): %v", err)
+		return nil, fmt.Errorf("NewPopData: Error from BootstrapRpzOutput(): %v", err)
 	}
 
 	pd.Policy.Logger = conf.Loggers.Policy
-	pd.Policy.AllowlistAction, err = tapir.StringToAction(viper.GetString("policy.allowlist.action"))
+	if auditlog := viper.GetString("policy.auditlog"); auditlog != "" {
+		pd.PolicyAudit, err = NewPolicyAudit(auditlog)
+		if err != nil {
+			return nil, err
+		}
+		pd.Logger.Printf("NewPopData: policy audit log is %s", pd.PolicyAudit.Filename)
+	}
+	pd.Policy.AllowlistAction, err = ParseAction(viper.GetString("policy.allowlist.action"))
 	if err != nil {
-		POPExiter("Error parsing allowlist policy: %v", err)
+		return nil, fmt.Errorf("error parsing allowlist policy: %v", err)
 	}
-	pd.Policy.DenylistAction, err = tapir.StringToAction(viper.GetString("policy.denylist.action"))
+	pd.Policy.DenylistAction, err = ParseAction(viper.GetString("policy.denylist.action"))
 	if err != nil {
-		POPExiter("Error parsing denylist policy: %v", err)
+		return nil, fmt.Errorf("error parsing denylist policy: %v", err)
 	}
 	pd.Policy.Doubtlist.NumSources = viper.GetInt("policy.doubtlist.numsources.limit")
 	if pd.Policy.Doubtlist.NumSources == 0 {
-		//nolint:typecheck
-		POPExiter("Error parsing policy: doubtlist.numsources.limit cannot be 0")
+		return nil, fmt.Errorf("error parsing policy: doubtlist.numsources.limit cannot be 0")
 	}
 	pd.Policy.Doubtlist.NumSourcesAction, err =
-		tapir.StringToAction(viper.GetString("policy.doubtlist.numsources.action"))
+		ParseAction(viper.GetString("policy.doubtlist.numsources.action"))
 	if err != nil {
-		POPExiter("Error parsing policy: %v", err)
+		return nil, fmt.Errorf("error parsing policy: %v", err)
 	}
 
 	pd.Policy.Doubtlist.NumTapirTags = viper.GetInt("policy.doubtlist.numtapirtags.limit")
 	if pd.Policy.Doubtlist.NumTapirTags == 0 {
-		POPExiter("Error parsing policy: doubtlist.numtapirtags.limit cannot be 0")
+		return nil, fmt.Errorf("error parsing policy: doubtlist.numtapirtags.limit cannot be 0")
 	}
 	pd.Policy.Doubtlist.NumTapirTagsAction, err =
-		tapir.StringToAction(viper.GetString("policy.doubtlist.numtapirtags.action"))
+		ParseAction(viper.GetString("policy.doubtlist.numtapirtags.action"))
 	if err != nil {
-		POPExiter("Error parsing policy: %v", err)
+		return nil, fmt.Errorf("error parsing policy: %v", err)
 	}
 
 	tmp := viper.GetStringSlice("policy.doubtlist.denytapir.tags")
 	pd.Policy.Doubtlist.DenyTapirTags, err = tapir.StringsToTagMask(tmp)
 	if err != nil {
-		POPExiter("Error parsing policy: %v", err)
+		return nil, fmt.Errorf("error parsing policy: %v", err)
 	}
 	pd.Policy.Doubtlist.DenyTapirAction, err =
-		tapir.StringToAction(viper.GetString("policy.doubtlist.denytapir.action"))
+		ParseAction(viper.GetString("policy.doubtlist.denytapir.action"))
 	if err != nil {
-		POPExiter("Error parsing policy: %v", err)
+		return nil, fmt.Errorf("error parsing policy: %v", err)
+	}
+
+	pd.Policy.Redirects = map[string]*RedirectTarget{}
+	for _, rule := range append([]string{""}, redirectRules...) {
+		key := "policy.redirect"
+		if rule != "" {
+			key = "policy." + rule + ".redirect"
+		}
+		rt, err := ParseRedirectTarget(key)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing policy: %v", err)
+		}
+		if rt != nil {
+			pd.Policy.Redirects[rule] = rt
+		}
+	}
+	for rule, action := range map[string]tapir.Action{
+		"denylist":               pd.Policy.DenylistAction,
+		"doubtlist.numsources":   pd.Policy.Doubtlist.NumSourcesAction,
+		"doubtlist.numtapirtags": pd.Policy.Doubtlist.NumTapirTagsAction,
+		"doubtlist.denytapir":    pd.Policy.Doubtlist.DenyTapirAction,
+	} {
+		if action == tapir.REDIRECT && pd.Policy.Redirect(rule) == nil {
+			return nil, fmt.Errorf("error parsing policy: %s.action is REDIRECT, but neither policy.%s.redirect nor policy.redirect is set",
+				rule, rule)
+		}
+	}
+
+	pd.Policy.Ttl = TtlPolicy{
+		Denylist:  viper.GetUint32("policy.ttl.denylist"),
+		Doubtlist: viper.GetUint32("policy.ttl.doubtlist"),
+		Actions:   map[tapir.Action]uint32{},
+		Sources:   map[string]uint32{},
+		Lifetime:  viper.GetBool("policy.ttl.lifetime"),
+		Min:       viper.GetUint32("policy.ttl.min"),
+	}
+	for actionstr := range viper.GetStringMap("policy.ttl.actions") {
+		action, err := ParseAction(actionstr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing policy: ttl.actions: %v", err)
+		}
+		pd.Policy.Ttl.Actions[action] = viper.GetUint32("policy.ttl.actions." + actionstr)
+	}
+	for source := range viper.GetStringMap("policy.ttl.sources") {
+		pd.Policy.Ttl.Sources[source] = viper.GetUint32("policy.ttl.sources." + source) // viper lowercases keys
+	}
+
+	pd.Policy.BadIp.Tags, err = tapir.StringsToTagMask(viper.GetStringSlice("policy.badip.tags"))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing policy: badip.tags: %v", err)
+	}
+	pd.Policy.BadIp.Ipv4Prefix, pd.Policy.BadIp.Ipv6Prefix = 32, 128
+	if bits := viper.GetInt("policy.badip.ipv4prefix"); bits != 0 {
+		if bits < 1 || bits > 32 {
+			return nil, fmt.Errorf("error parsing policy: badip.ipv4prefix %d is not between 1 and 32", bits)
+		}
+		pd.Policy.BadIp.Ipv4Prefix = bits
+	}
+	if bits := viper.GetInt("policy.badip.ipv6prefix"); bits != 0 {
+		if bits < 1 || bits > 128 {
+			return nil, fmt.Errorf("error parsing policy: badip.ipv6prefix %d is not between 1 and 128", bits)
+		}
+		pd.Policy.BadIp.Ipv6Prefix = bits
+	}
+
+	if keyfile := viper.GetString("bootstrapserver.signingkey"); keyfile != "" {
+		pd.ExportSigner, err = tapir.FetchMqttSigningKey("", filepath.Clean(keyfile))
+		if err != nil {
+			return nil, fmt.Errorf("NewPopData: error reading bootstrap signing key %s: %v", keyfile, err)
+		}
 	}
 
 	// Note: We can not parse data sources here, as RefreshEngine has not yet started.
@@ -130,30 +215,7 @@ func (pd *PopData) ParseSourcesNG() error {
 	//		log.Printf("  %s: %s", name, src.Description)
 	//	}
 
-	pd.mu.Lock()
-	pd.Lists["allowlist"]["allow_catchall"] =
-		&tapir.WBGlist{
-			Name:        "allow_catchall",
-			Description: "Allowlist consisting of allow names found in deny- or doubtlist sources",
-			Type:        "allowlist",
-			SrcFormat:   "none",
-			Format:      "map",
-			Datasource:  "Data misplaced in other sources",
-			Names:       map[string]tapir.TapirName{},
-			ReaperData:  map[time.Time]map[string]bool{},
-		}
-	pd.Lists["doubtlist"]["doubt_catchall"] =
-		&tapir.WBGlist{
-			Name:        "doubt_catchall",
-			Description: "Doubtlist consisting of doubt names found in allowlist sources",
-			Type:        "doubtlist",
-			SrcFormat:   "none",
-			Format:      "map",
-			Datasource:  "Data misplaced in other sources",
-			Names:       map[string]tapir.TapirName{},
-			ReaperData:  map[time.Time]map[string]bool{},
-		}
-	pd.mu.Unlock()
+	pd.AddCatchallLists()
 
 	srcs := srcfoo.Sources
 	pd.Logger.Printf("*** ParseSourcesNG: there are %d sources defined in config", len(srcs))
@@ -176,9 +238,11 @@ func (pd *PopData) ParseSourcesNG() error {
 		threads++
 
 		go func(name string, src SourceConf, thread int) {
-			//			defer func() {
-			//pd.Logger.Printf("<--Thread %d: source \"%s\" (%s) is now complete. %d remaining", thread, name, src.Source, threads)
-			// }()
+			// Always report back, also when the source fails, so that one bad source
+			// doesn't prevent the others from being used.
+			defer func() {
+				rptchan <- name
+			}()
 			pd.Logger.Printf("-->Thread %d: parsing source \"%s\" (source %s)", thread, name, src.Source)
 
 			newsource := tapir.WBGlist{
@@ -202,10 +266,22 @@ func (pd *PopData) ParseSourcesNG() error {
 					pd.Logger.Printf("ParseSourcesNG: Fetching MQTT validator key for topic %s", src.Topic)
 				}
 
+				pd.mu.RLock()
+				_, ok := pd.Lists[src.Type]
+				pd.mu.RUnlock()
+				if !ok {
+					err = fmt.Errorf("unknown list type %q", src.Type)
+					break
+				}
+				// Updates that arrive before the list is complete are applied afterwards
+				pd.bufferUpdates(src.Type, src.Name)
 				pd.Logger.Printf("ParseSourcesNG: Adding topic '%s' to MQTT Engine", src.Topic)
-				topicdata, err := pd.MqttEngine.SubToTopic(src.Topic, pd.TapirObservations, "struct", true) // XXX: Brr. kludge.
+				var topicdata map[string]tapir.TopicData
+				topicdata, err = pd.MqttEngine.SubToTopic(src.Topic, pd.TapirObservations, "struct", true) // XXX: Brr. kludge.
 				if err != nil {
-					POPExiter("Error adding topic %s to MQTT Engine: %v", src.Topic, err)
+					pd.dropHandover(src.Type, src.Name)
+					err = fmt.Errorf("error adding topic %s to MQTT Engine: %v", src.Topic, err)
+					break
 				}
 				pd.Logger.Printf("ParseSourcesNG: Topic data for topic %s: %+v", src.Topic, topicdata)
 
@@ -219,42 +295,58 @@ func (pd *PopData) ParseSourcesNG() error {
                 newsource.Immutable = src.Immutable
 
 
-				newsource.Format = "map" // for now
+				format := "map" // for now
+				if src.Format == "cidr" {
+					format = "cidr"
+				}
+				newsource.Format = format
+				var boot *ListExport
 				if len(src.Bootstrap) > 0 {
 					pd.Logger.Printf("ParseSourcesNG: The %s MQTT source has %d bootstrap servers: %v", src.Name, len(src.Bootstrap), src.Bootstrap)
-					tmp, err := pd.BootstrapMqttSource(src)
+					le, err := pd.BootstrapMqttSource(src)
 					if err != nil {
 						pd.Logger.Printf("Error bootstrapping MQTT source %s: %v", src.Name, err)
 					} else {
-						newsource = *tmp
+						boot = le
 					}
 				}
 
-                backup, ok := pd.restoreFromBackup(src.BackupFile)
-                if ok {
-                    newsource.Names = backup
-				    pd.Logger.Printf("Backup loaded for [%s]", newsource.Name)
-                } else {
-				    pd.Logger.Printf("Will not load backup for [%s]", newsource.Name)
-                }
+				var backup *ListBackup
+				if src.BackupFile != "" {
+					var ok bool
+					if backup, ok = pd.restoreFromBackup(src.BackupFile); ok {
+						pd.Logger.Printf("Backup loaded for [%s]", newsource.Name)
+					} else {
+						pd.Logger.Printf("Will not load backup for [%s]", newsource.Name)
+					}
+				}
 
 				pd.mu.Lock()
-				pd.Lists["doubtlist"][newsource.Name] = &newsource
-				pd.Logger.Printf("Created list [doubtlist][%s]", newsource.Name)
+				pd.Lists[src.Type][newsource.Name] = &newsource
+				pd.MqttSources[&newsource] = src
+				pd.Logger.Printf("Created list [%s][%s]", src.Type, newsource.Name)
 				pd.mu.Unlock()
+				pd.completeHandover(src.Type, &newsource, boot, backup, false)
 				pd.Logger.Printf("*** MQTT sources are only managed via RefreshEngine.")
-				rptchan <- name
 			case "file":
-				err = pd.ParseLocalFile(name, &newsource, rptchan)
+				err = pd.ParseLocalFile(name, &newsource)
+			case "http":
+				err = pd.ParseHttpSource(name, src.Url, &newsource)
+				if err == nil && src.Refresh > 0 {
+					pd.mu.Lock()
+					pd.HttpSources[&newsource] = src
+					pd.mu.Unlock()
+				}
 			case "xfr":
-				err = pd.ParseRpzFeed(name, &newsource, rptchan)
+				err = pd.ParseRpzFeed(name, &newsource)
 				pd.Logger.Printf("Thread %d: source \"%s\" now returned from ParseRpzFeed(). %d remaining", thread, name, threads)
 			default:
-				pd.Logger.Printf("*** ParseSourcesNG: Error: unhandled source type %s", src.Source)
+				err = fmt.Errorf("unhandled source type %s", src.Source)
 			}
 			if err != nil {
-				log.Printf("Error parsing source %s (datasource %s): %v",
+				log.Printf("Error parsing source %s (datasource %s): %v. Source is not used.",
 					name, src.Source, err)
+				pd.ReportStatus("sources", tapir.StatusFail, "Source %s (datasource %s) not used: %v", name, src.Source, err)
 			}
 		}(name, src, threads)
 	}
@@ -271,28 +363,64 @@ func (pd *PopData) ParseSourcesNG() error {
 	if pd.MqttEngine != nil && !pd.TapirMqttEngineRunning {
 		err := pd.StartMqttEngine(pd.MqttEngine)
 		if err != nil {
-			POPExiter("Error starting MQTT Engine: %v", err)
+			return fmt.Errorf("error starting MQTT Engine: %v", err)
 		}
 	}
 
 	pd.Logger.Printf("ParseSources: static sources done.")
 
-	err = pd.GenerateRpzAxfr()
+	pd.mu.Lock()
+	notify, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup})
+	pd.mu.Unlock()
 	if err != nil {
 		pd.Logger.Printf("ParseSources: Error from GenerateRpzAxfr(): %v", err)
 	}
+	if notify {
+		if err := pd.NotifyDownstreams(); err != nil {
+			pd.Logger.Printf("ParseSources: Error from NotifyDownstreams(): %v", err)
+		}
+	}
 
 	return nil
 }
 
-func (pd *PopData) ParseLocalFile(sourceid string, s *tapir.WBGlist, rpt chan string) error {
+// AddCatchallLists creates the lists that receive rules found in sources of the "wrong" type,
+// see rpzFeedParser. They must exist before any RPZ source is parsed.
+func (pd *PopData) AddCatchallLists() {
+	pd.mu.Lock()
+	pd.Lists["allowlist"]["allow_catchall"] =
+		&tapir.WBGlist{
+			Name:        "allow_catchall",
+			Description: "Allowlist consisting of allow names found in deny- or doubtlist sources",
+			Type:        "allowlist",
+			SrcFormat:   "none",
+			Format:      "map",
+			Datasource:  "Data misplaced in other sources",
+			Names:       map[string]tapir.TapirName{},
+			ReaperData:  map[time.Time]map[string]bool{},
+		}
+	pd.Lists["doubtlist"]["doubt_catchall"] =
+		&tapir.WBGlist{
+			Name:        "doubt_catchall",
+			Description: "Doubtlist consisting of doubt names found in allowlist sources",
+			Type:        "doubtlist",
+			SrcFormat:   "none",
+			Format:      "map",
+			Datasource:  "Data misplaced in other sources",
+			Names:       map[string]tapir.TapirName{},
+			ReaperData:  map[time.Time]map[string]bool{},
+		}
+	pd.mu.Unlock()
+}
+
+func (pd *PopData) ParseLocalFile(sourceid string, s *tapir.WBGlist) error {
 	pd.Logger.Printf("ParseLocalFile: %s (%s)", sourceid, s.Type)
 	var df dawg.Finder
 	var err error
 
 	s.Filename = viper.GetString(fmt.Sprintf("sources.%s.filename", sourceid))
 	if s.Filename == "" {
-		POPExiter("ParseLocalFile: source %s of type file has undefined filename",
+		return fmt.Errorf("ParseLocalFile: source %s of type file has undefined filename",
 			sourceid)
 	}
 
@@ -303,10 +431,10 @@ func (pd *PopData) ParseLocalFile(sourceid string, s *tapir.WBGlist, rpt chan st
 		_, err := tapir.ParseText(s.Filename, s.Names, true)
 		if err != nil {
 			if os.IsNotExist(err) {
-				POPExiter("ParseLocalFile: source %s (type file: %s) does not exist",
+				return fmt.Errorf("ParseLocalFile: source %s (type file: %s) does not exist",
 					sourceid, s.Filename)
 			}
-			POPExiter("ParseLocalFile: error parsing file %s: %v", s.Filename, err)
+			return fmt.Errorf("ParseLocalFile: error parsing file %s: %v", s.Filename, err)
 		}
 
 	case "csv":
@@ -315,39 +443,88 @@ func (pd *PopData) ParseLocalFile(sourceid string, s *tapir.WBGlist, rpt chan st
 		_, err := tapir.ParseCSV(s.Filename, s.Names, true)
 		if err != nil {
 			if os.IsNotExist(err) {
-				POPExiter("ParseLocalFile: source %s (type file: %s) does not exist",
+				return fmt.Errorf("ParseLocalFile: source %s (type file: %s) does not exist",
 					sourceid, s.Filename)
 			}
-			POPExiter("ParseLocalFile: error parsing file %s: %v", s.Filename, err)
+			return fmt.Errorf("ParseLocalFile: error parsing file %s: %v", s.Filename, err)
 		}
 
 	case "dawg":
 		if s.Type != "allowlist" {
-			POPExiter("Error: source %s (file %s): DAWG is only defined for allowlists.",
+			return fmt.Errorf("source %s (file %s): DAWG is only defined for allowlists",
 				sourceid, s.Filename)
 		}
 		pd.Logger.Printf("ParseLocalFile: loading DAWG: %s", s.Filename)
 		df, err = dawg.Load(s.Filename)
 		if err != nil {
-			POPExiter("Error from dawg.Load(%s): %v", s.Filename, err)
+			return fmt.Errorf("error from dawg.Load(%s): %v", s.Filename, err)
 		}
 		pd.Logger.Printf("ParseLocalFile: DAWG loaded")
 		s.Format = "dawg"
 		s.Dawgf = df
 
+	case "cidr":
+		s.Names = map[string]tapir.TapirName{}
+		s.Format = "cidr"
+		_, err := ParseCidrFile(s.Filename, s.Names)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("ParseLocalFile: source %s (type file: %s) does not exist",
+					sourceid, s.Filename)
+			}
+			return fmt.Errorf("ParseLocalFile: error parsing file %s: %v", s.Filename, err)
+		}
+
 	default:
-		POPExiter("ParseLocalFile: SrcFormat \"%s\" is unknown.", s.SrcFormat)
+		return fmt.Errorf("ParseLocalFile: SrcFormat \"%s\" is unknown", s.SrcFormat)
+	}
+	if err := checkListFormat(s); err != nil {
+		return fmt.Errorf("ParseLocalFile: %v", err)
 	}
 
 	pd.mu.Lock()
 	pd.Lists[s.Type][s.Name] = s
+	if s.Format == "cidr" {
+		pd.indexCidrList(s)
+	}
 	pd.mu.Unlock()
-	rpt <- sourceid
 
 	return nil
 }
 
-func (pd *PopData) ParseRpzFeed(sourceid string, s *tapir.WBGlist, rpt chan string) error {
+// ParseHttpSource fetches the list s from url. Only CIDR lists can be fetched over HTTP.
+func (pd *PopData) ParseHttpSource(sourceid, url string, s *tapir.WBGlist) error {
+	pd.Logger.Printf("ParseHttpSource: %s (%s)", sourceid, s.Type)
+	if url == "" {
+		return fmt.Errorf("ParseHttpSource: source %s of type http has undefined url", sourceid)
+	}
+
+	switch s.SrcFormat {
+	case "cidr":
+		s.Names = map[string]tapir.TapirName{}
+		s.Format = "cidr"
+		n, err := FetchCidrs(url, s.Names)
+		if err != nil {
+			return fmt.Errorf("ParseHttpSource: error fetching %s: %v", url, err)
+		}
+		pd.Logger.Printf("ParseHttpSource: %d prefixes fetched from %s", n, url)
+
+	default:
+		return fmt.Errorf("ParseHttpSource: SrcFormat \"%s\" is not supported for http sources", s.SrcFormat)
+	}
+	if err := checkListFormat(s); err != nil {
+		return fmt.Errorf("ParseHttpSource: %v", err)
+	}
+
+	pd.mu.Lock()
+	pd.Lists[s.Type][s.Name] = s
+	pd.indexCidrList(s)
+	pd.mu.Unlock()
+
+	return nil
+}
+
+func (pd *PopData) ParseRpzFeed(sourceid string, s *tapir.WBGlist) error {
 	//	zone := viper.GetString(fmt.Sprintf("sources.%s.zone", sourceid)) // XXX: not the way to do it
 	//	if zone == "" {
 	//		return fmt.Errorf("Unable to load RPZ source %s, upstream zone not specified.",
@@ -367,116 +544,175 @@ func (pd *PopData) ParseRpzFeed(sourceid string, s *tapir.WBGlist, rpt chan stri
 	pd.Logger.Printf("---> SetupRPZFeed: about to transfer zone %s from %s", s.RpzZoneName, s.RpzUpstream)
 
 	var reRpt = make(chan RpzRefreshResult, 1)
+	parser := pd.newRpzFeedParser(s)
 	pd.RpzRefreshCh <- RpzRefresh{
 		Name:        s.RpzZoneName,
 		Upstream:    s.RpzUpstream,
-		RRParseFunc: pd.RpzParseFuncFactory(s),
+		RRParseFunc: parser.Parse,
+		ParseDone:   parser.Done,
 		ZoneType:    tapir.RpzZone,
 		Resp:        reRpt,
 	}
 
-	<-reRpt
+	rr := <-reRpt
+	if rr.Error {
+		return fmt.Errorf("error transferring RPZ %s from %s: %s", s.RpzZoneName, s.RpzUpstream, rr.ErrorMsg)
+	}
 
 	pd.mu.Lock()
 	pd.Lists[s.Type][s.Name] = s
 	pd.mu.Unlock()
-	rpt <- sourceid
 	pd.Logger.Printf("ParseRpzFeed: parsing RPZ %s complete", s.RpzZoneName)
 
 	return nil
 }
 
-// Parse the CNAME (in the shape of a dns.RR) that is found in the RPZ and sort the data into the
-// appropriate list in PopData. Note that there are two special cases:
+// rpzFeedParser sorts the rules of an RPZ source into its list. The parsing is done inline to the
+// zone transfer, so the rules are staged and only become visible in the list (and in the output)
+// when the transfer is complete, see Done. That way the lists are never seen half-updated and
+// pd.mu is not held during the transfer.
+type rpzFeedParser struct {
+	pd    *PopData
+	s     *tapir.WBGlist
+	names map[string]tapir.TapirName // staged contents of s
+	allow map[string]tapir.TapirName // staged additions to allow_catchall
+	doubt map[string]tapir.TapirName // staged additions to doubt_catchall
+}
+
+func (pd *PopData) newRpzFeedParser(s *tapir.WBGlist) *rpzFeedParser {
+	p := &rpzFeedParser{pd: pd, s: s}
+	p.reset()
+	return p
+}
+
+func (p *rpzFeedParser) reset() {
+	p.names = map[string]tapir.TapirName{}
+	p.allow = map[string]tapir.TapirName{}
+	p.doubt = map[string]tapir.TapirName{}
+}
+
+// Parse the rule (a CNAME action or local data, see RpzAction) that is found in the RPZ and sort
+// the data into the appropriate list in PopData. Note that there are two special cases:
 //  1. If a "allowlist" RPZ source has a rule with an action other than "rpz-passthru." then that rule doesn't
 //     really belong in a "allowlist" source. So we take that rule an put it in the doubt_catchall bucket instead.
 //  2. If a "{doubt|deny}list" RPZ source has a rule with an "rpz-passthru." (i.e. allowlist) action then that
 //     rule doesn't really belong in a "{doubt|deny}list" source. So we take that rule an put it in the
 //     allow_catchall bucket instead.
-func (pd *PopData) RpzParseFuncFactory(s *tapir.WBGlist) func(*dns.RR, *tapir.ZoneData) bool {
-	return func(rr *dns.RR, zd *tapir.ZoneData) bool {
-		var action tapir.Action
-		name := strings.TrimSuffix((*rr).Header().Name, zd.ZoneName)
-		switch (*rr).Header().Rrtype {
-		case dns.TypeSOA, dns.TypeNS:
-			if tapir.GlobalCF.Debug {
-				pd.Logger.Printf("ParseFunc: RPZ %s: looking at %s", zd.ZoneName,
-					dns.TypeToString[(*rr).Header().Rrtype])
-			}
+func (p *rpzFeedParser) Parse(rr *dns.RR, zd *tapir.ZoneData) bool {
+	pd, s := p.pd, p.s
+	var action tapir.Action
+	name := strings.TrimSuffix((*rr).Header().Name, zd.ZoneName)
+	switch (*rr).Header().Rrtype {
+	case dns.TypeSOA, dns.TypeNS:
+		if tapir.GlobalCF.Debug {
+			pd.Logger.Printf("ParseFunc: RPZ %s: looking at %s", zd.ZoneName,
+				dns.TypeToString[(*rr).Header().Rrtype])
+		}
+		return true
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeNSEC3PARAM, dns.TypeDNSKEY:
+		return true // a signed upstream RPZ, the DNSSEC records are not rules
+	default:
+		// CNAMEs to the special targets are actions, anything else is local data (REDIRECT).
+		// The local data itself is not kept, the policy decides what names are redirected to.
+		action = RpzAction(name, *rr)
+		// Other triggers than QNAME are kept by their canonical owner name, see RpzTrigger
+		trigger, err := ParseRpzTrigger(name)
+		if err != nil {
+			pd.Logger.Printf("RPZ source %s: invalid trigger %s, ignored: %v", s.Name, name, err)
 			return true
-		case dns.TypeCNAME:
-			switch (*rr).(*dns.CNAME).Target {
-			case ".":
-				action = tapir.NXDOMAIN
-			case "*.":
-				action = tapir.NODATA
-			case "rpz-drop.":
-				action = tapir.DROP
-			case "rpz-passthru.":
-				action = tapir.ALLOWLIST
-			default:
-				pd.Logger.Printf("UNKNOWN RPZ action: \"%s\" (src: %s)", (*rr).(*dns.CNAME).Target, s.Name)
-				action = tapir.UnknownAction
+		}
+		name = trigger.String()
+		if tapir.GlobalCF.Debug {
+			pd.Logger.Printf("ParseFunc: zone %s: %s trigger %s action: %s", zd.ZoneName,
+				TriggerTypeToString[trigger.Type], name, ActionString(action))
+		}
+		switch s.Type {
+		case "allowlist":
+			if action == tapir.ALLOWLIST {
+				p.names[name] = tapir.TapirName{Name: name} // drop all other actions
+			} else {
+				pd.Logger.Printf("Warning: allowlist RPZ source %s has denylisted name: %s",
+					s.RpzZoneName, name)
+				p.doubt[name] = tapir.TapirName{
+					Name:   name,
+					Action: action,
+				} // drop all other actions
 			}
-			if tapir.GlobalCF.Debug {
-				pd.Logger.Printf("ParseFunc: zone %s: name %s action: %v", zd.ZoneName,
-					name, action)
+		case "denylist":
+			if action != tapir.ALLOWLIST {
+				p.names[name] = tapir.TapirName{Name: name, Action: action}
+			} else {
+				pd.Logger.Printf("Warning: denylist RPZ source %s has allowlisted name: %s",
+					s.RpzZoneName, name)
+				p.allow[name] = tapir.TapirName{Name: name}
 			}
-			switch s.Type {
-			case "allowlist":
-				if action == tapir.ALLOWLIST {
-					s.Names[name] = tapir.TapirName{Name: name} // drop all other actions
-				} else {
-					pd.Logger.Printf("Warning: allowlist RPZ source %s has denylisted name: %s",
-						s.RpzZoneName, name)
-					pd.mu.Lock()
-					pd.Lists["doubtlist"]["doubt_catchall"].Names[name] =
-						tapir.TapirName{
-							Name:   name,
-							Action: action,
-						} // drop all other actions
-					pd.mu.Unlock()
-				}
-			case "denylist":
-				if action != tapir.ALLOWLIST {
-					s.Names[name] = tapir.TapirName{Name: name, Action: action}
-				} else {
-					pd.Logger.Printf("Warning: denylist RPZ source %s has allowlisted name: %s",
-						s.RpzZoneName, name)
-					pd.mu.Lock()
-					pd.Lists["allowlist"]["allow_catchall"].Names[name] = tapir.TapirName{Name: name}
-					pd.mu.Unlock()
-				}
-			case "doubtlist":
-				if action != tapir.ALLOWLIST {
-					s.Names[name] = tapir.TapirName{Name: name, Action: action}
-				} else {
-					pd.Logger.Printf("Warning: doubtlist RPZ source %s has allowlisted name: %s",
-						s.RpzZoneName, name)
-					pd.mu.Lock()
-					pd.Lists["allowlist"]["allow_catchall"].Names[name] = tapir.TapirName{Name: name}
-					pd.mu.Unlock()
-				}
+		case "doubtlist":
+			if action != tapir.ALLOWLIST {
+				p.names[name] = tapir.TapirName{Name: name, Action: action}
+			} else {
+				pd.Logger.Printf("Warning: doubtlist RPZ source %s has allowlisted name: %s",
+					s.RpzZoneName, name)
+				p.allow[name] = tapir.TapirName{Name: name}
 			}
 		}
-		return true
 	}
+	return true
 }
 
-func (pd *PopData) restoreFromBackup(filename string) (map[string]tapir.TapirName, bool) {
-    newMap := make(map[string]tapir.TapirName)
-
-    file, err := os.Open(filename)
-    defer file.Close()
-    if err != nil {
-        pd.Logger.Printf("Could not open '%s' for reading backup, err: '%s'", filename, err)
-        return nil, false
-    }
-    defer file.Close()
+// Done is called by the RefreshEngine when a transfer of the RPZ source has ended. If the zone was
+// updated the staged rules replace the contents of the list and, if the list is already in use,
+// the changes are applied to the output as an IXFR. Otherwise the staged rules are discarded.
+func (p *rpzFeedParser) Done(updated bool) {
+	pd, s := p.pd, p.s
+	if !updated {
+		p.reset()
+		return
+	}
 
-    decoder := gob.NewDecoder(file)
+	pd.mu.Lock()
+	old := s.Names
+	s.Names = p.names
+	for name, tn := range p.allow {
+		pd.Lists["allowlist"]["allow_catchall"].Names[name] = tn
+	}
+	for name, tn := range p.doubt {
+		pd.Lists["doubtlist"]["doubt_catchall"].Names[name] = tn
+	}
 
-    decoder.Decode(&newMap)
+	var ixfr RpzIxfr
+	var err error
+	if pd.Lists[s.Type][s.Name] == s {
+		tm := tapir.TapirMsg{SrcName: s.Name, ListType: s.Type}
+		for name, tn := range s.Names {
+			if otn, exist := old[name]; !exist || otn.Action != tn.Action {
+				tm.Added = append(tm.Added, tapir.Domain{Name: name})
+			}
+		}
+		for name := range old {
+			if _, exist := s.Names[name]; !exist {
+				tm.Removed = append(tm.Removed, tapir.Domain{Name: name})
+			}
+		}
+		for name := range p.allow {
+			tm.Added = append(tm.Added, tapir.Domain{Name: name})
+		}
+		for name := range p.doubt {
+			tm.Added = append(tm.Added, tapir.Domain{Name: name})
+		}
+		if len(tm.Added) != 0 || len(tm.Removed) != 0 {
+			ixfr, err = pd.GenerateRpzIxfr(&tm, PolicyTrigger{Kind: TriggerXfr, Source: s.Name})
+		}
+	}
+	pd.mu.Unlock()
+	p.reset()
 
-    return newMap, true
+	if err != nil {
+		pd.Logger.Printf("RPZ source %s: Error from GenerateRpzIxfr(): %v", s.Name, err)
+	}
+	if !ixfr.Empty() {
+		err = pd.NotifyDownstreams()
+		if err != nil {
+			pd.Logger.Printf("RPZ source %s: Error notifying downstreams: %v", s.Name, err)
+		}
+	}
 }
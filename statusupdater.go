@@ -14,14 +14,46 @@ import (
 	"github.com/spf13/viper"
 )
 
+// ReportStatus sends a status update for a component to the StatusUpdater. If the
+// StatusUpdater is not keeping up (or has been stopped) the update is logged and dropped.
+func (pd *PopData) ReportStatus(component string, status tapir.ComponentStatus, format string, args ...interface{}) {
+	csu := tapir.ComponentStatusUpdate{
+		Component: component,
+		Status:    status,
+		Msg:       fmt.Sprintf(format, args...),
+		TimeStamp: time.Now(),
+	}
+	select {
+	case pd.ComponentStatusCh <- csu:
+	default:
+		pd.Logger.Printf("ReportStatus: status channel full, dropped %s report for %s: %s", status, component, csu.Msg)
+	}
+}
+
 func (pd *PopData) StatusUpdater(conf *Config, stopch chan struct{}) {
 
+	// Read status updates from the channel without publishing anything, so that
+	// nobody blocks on the channel.
+	drain := func() {
+		for {
+			select {
+			case csu := <-pd.ComponentStatusCh:
+				log.Printf("StatusUpdater: got status update message: %+v", csu)
+				if csu.Response != nil {
+					csu.Response <- tapir.StatusUpdaterResponse{Msg: "StatusUpdater is not publishing status"}
+				}
+			case <-stopch:
+				log.Printf("StatusUpdater: stopping")
+				return
+			}
+		}
+	}
+
 	active := viper.GetBool("tapir.status.active")
 	if !active {
 		pd.Logger.Printf("*** StatusUpdater: not active, will just read status updates from channel and not publish anything")
-		for csu := range pd.ComponentStatusCh {
-			log.Printf("StatusUpdater: got status update message: %+v", csu)
-		}
+		drain()
+		return
 	}
 
 	var s = tapir.TapirFunctionStatus{
@@ -52,43 +84,60 @@ func (pd *PopData) StatusUpdater(conf *Config, stopch chan struct{}) {
 	// 	}
 	// }()
 
+	// If status publishing cannot be set up, we keep running without it.
+	degrade := func(format string, args ...interface{}) {
+		pd.Logger.Printf("StatusUpdater: "+format+". Status will not be published.", args...)
+		drain()
+	}
+
+	if me == nil {
+		degrade("MQTT Engine not running")
+		return
+	}
+
 	certCN, _, _, err := tapir.FetchTapirClientCert(log.Default(), pd.ComponentStatusCh)
 	if err != nil {
-		POPExiter("StatusUpdater: Error fetching client certificate: %v", err)
+		degrade("Error fetching client certificate: %v", err)
+		return
 	}
 
 	statusTopic, err := tapir.MqttTopic(certCN, "tapir.status.topic")
 	if err != nil {
-		POPExiter("StatusUpdater: MQTT status topic not set")
+		degrade("MQTT status topic not set: %v", err)
+		return
 	}
 
 	keyfile := viper.GetString("tapir.status.signingkey")
 	if keyfile == "" {
-		POPExiter("StatusUpdater: MQTT status signing key not set")
+		degrade("MQTT status signing key not set")
+		return
 	}
 
 	keyfile = filepath.Clean(keyfile)
 	signkey, err := tapir.FetchMqttSigningKey(statusTopic, keyfile)
 	if err != nil {
-		POPExiter("StatusUpdater: Error fetching MQTT signing key for topic %s: %v", statusTopic, err)
+		degrade("Error fetching MQTT signing key for topic %s: %v", statusTopic, err)
+		return
 	}
 
 	pd.Logger.Printf("StatusUpdater: Adding pub topic '%s' to MQTT Engine", statusTopic)
 	msg, err := me.PubToTopic(statusTopic, signkey, "struct", true) // XXX: Brr. kludge.
 	if err != nil {
-		POPExiter("Error adding topic %s to MQTT Engine: %v", statusTopic, err)
+		degrade("Error adding topic %s to MQTT Engine: %v", statusTopic, err)
+		return
 	}
 	pd.Logger.Printf("StatusUpdater: Topic status for MQTT engine %s: %+v", me.Creator, msg)
 
 	_, outbox, _, err := me.StartEngine()
 	if err != nil {
-		POPExiter("StatusUpdater: Error starting MQTT Engine: %v", err)
+		degrade("Error starting MQTT Engine: %v", err)
+		return
 	}
 
 	log.Printf("StatusUpdater: Starting")
 
 	var known_components = []string{"tapir-observation", "mqtt-event", "rpz", "rpz-ixfr", "rpz-inbound", "downstream-notify",
-		"downstream-ixfr", "mqtt-config", "mqtt-unknown", "main-boot", "cert-status"}
+		"downstream-ixfr", "mqtt-config", "mqtt-unknown", "main-boot", "cert-status", "sources", "bootstrap", "policy", "reconciler", "sequence", "mqtt-output", "http-output"}
 
 	var csu tapir.ComponentStatusUpdate
 	var dirty bool
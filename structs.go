@@ -4,8 +4,10 @@
 package main
 
 import (
+	"crypto/ecdsa"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dnstapir/tapir"
@@ -13,8 +15,18 @@ import (
 )
 
 type PopData struct {
-	mu                     sync.RWMutex
+	mu                     sync.RWMutex // protects Lists (including the list contents), RpzSources and DownstreamSerials
 	Lists                  map[string]map[string]*tapir.WBGlist
+	Cidrs                  map[*tapir.WBGlist]*PrefixTree  // the prefixes of the lists with Format "cidr", protected by mu
+	Positions              map[*tapir.WBGlist]ListPosition // of the MQTT updates of the lists, protected by mu
+	Bootstrapped           map[*tapir.WBGlist]time.Time    // the time of the initial contents (bootstrap or backup) of the lists, protected by mu
+	Handovers              map[string][]bufferedUpdate     // the buffered updates of the lists being bootstrapped, protected by mu
+	Sequences              map[*tapir.WBGlist]*MsgSequence // of the MQTT updates of the lists, protected by mu
+	BadipRefs              map[*tapir.WBGlist]BadipRefs    // of the rpz-ip entries in the lists, protected by mu
+	Exports                ExportSnapshots                 // the bootstrap exports in progress
+	ExportSigner           *ecdsa.PrivateKey               // signs the bootstrap exports, if set
+	MqttSources            map[*tapir.WBGlist]SourceConf   // the configuration of the MQTT lists, protected by mu
+	HttpSources            map[*tapir.WBGlist]SourceConf   // the HTTP lists that are fetched again, protected by mu
 	RpzRefreshCh           chan RpzRefresh
 	RpzCommandCh           chan RpzCmdData
 	TapirMqttEngineRunning bool
@@ -22,17 +34,25 @@ type PopData struct {
 	// TapirMqttSubCh         chan tapir.MqttPkg
 	TapirObservations chan tapir.MqttPkgIn
 	TapirMqttPubCh    chan tapir.MqttPkgOut
+	MqttOutputs       []*MqttOutput         // publish the policy changes, protected by mu
+	PolicyUpdates     chan tapir.MqttPkgOut // the policy changes to publish, see publishPolicy
+	HttpOutputs       []*HttpOutput         // serve the policy, protected by mu
 	ComponentStatusCh chan tapir.ComponentStatusUpdate
 	Logger            *log.Logger
 	MqttLogger        *log.Logger
-	DenylistedNames  map[string]bool
-	DoubtlistedNames   map[string]*tapir.TapirName
+	DenylistedNames   map[string]bool             // from the last GenerateRpzAxfr, protected by mu
+	DoubtlistedNames  map[string]*tapir.TapirName // from the last GenerateRpzAxfr, protected by mu
 	Policy            PopPolicy
+	PolicyAudit       *PolicyAudit
 	Rpz               RpzData
 	RpzSources        map[string]*tapir.ZoneData
 	Downstreams       map[string]RpzDownstream // map[ipaddr]RpzDownstream
 	DownstreamSerials map[string]uint32        // New map to track SOA serials by address
 	ReaperInterval    time.Duration
+	XfrsInFlight      sync.WaitGroup // outbound zone transfers, waited for on shutdown
+	ShuttingDown      atomic.Bool
+	xfrMu             sync.Mutex     // orders XfrsInFlight.Add before the Wait on shutdown, see beginXfr
+	Engines           sync.WaitGroup // the goroutines that are stopped via stopch, see startEngine
 	MqttEngine        *tapir.MqttEngine
 	Verbose           bool
 	Debug             bool
@@ -45,35 +65,55 @@ type RpzDownstream struct {
 	// Downstreams []string
 }
 
+// RpzData is the RPZ output zone. The zone content is only accessed via immutable snapshots,
+// see RpzSnapshot. All changes to the output are serialized via the writer mutex.
 type RpzData struct {
-	CurrentSerial uint32
 	ZoneName      string
-	Axfr          RpzAxfr
-	IxfrChain     []RpzIxfr // NOTE: the IxfrChain is in reverse order, newest first!
-	// RpzZone       *tapir.ZoneData
-	// RpzMap map[string]*tapir.RpzName
+	ZoneData      *tapir.ZoneData // the apex of the output zone, from BootstrapRpzOutput
+	writer        sync.Mutex
+	current       atomic.Pointer[RpzSnapshot]
+	apexSOA       dns.SOA
+	initialSerial uint32 // from the serial cache, used for the first snapshot
+	Ttl           uint32 // TTL of all RRs in the output zone
+	envelopeSize  atomic.Int32
+	localEnvSize  bool       // envelope size set in the local config, overrides the global config
+	signer        *RpzSigner // nil if the output zone is not signed
 }
 
 type RpzIxfr struct {
 	FromSerial uint32
 	ToSerial   uint32
-	Removed    []*tapir.RpzName
-	Added      []*tapir.RpzName
-}
-
-type RpzAxfr struct {
-	Serial   uint32
-	SOA      dns.SOA
-	NSrrs    []dns.RR
-	Data     map[string]*tapir.RpzName
-	ZoneData *tapir.ZoneData
+	Removed    []*RpzRule
+	Added      []*RpzRule
+	DelRRs     []dns.RR // DNSSEC records removed (signed output only)
+	AddRRs     []dns.RR // DNSSEC records added (signed output only)
 }
 
 type PopPolicy struct {
 	Logger          *log.Logger
 	AllowlistAction tapir.Action
-	DenylistAction tapir.Action
-	Doubtlist        DoubtlistPolicy
+	DenylistAction  tapir.Action
+	Doubtlist       DoubtlistPolicy
+	Ttl             TtlPolicy
+	Redirects       map[string]*RedirectTarget // map[policy rule]target, "" is the default, see Redirect
+	BadIp           BadIpPolicy
+}
+
+// BadIpPolicy decides which observed addresses become rpz-ip entries, see badipTriggers.
+type BadIpPolicy struct {
+	Tags       tapir.TagMask // observations with any of these tags; none means that addresses are ignored
+	Ipv4Prefix int           // the addresses are aggregated into prefixes of these lengths
+	Ipv6Prefix int
+}
+
+// TtlPolicy decides the TTL of the rules in the RPZ output, see RpzTtl.
+type TtlPolicy struct {
+	Denylist  uint32                  // TTL for denylisted names, 0 means services.rpz.ttl
+	Doubtlist uint32                  // TTL for doubtlisted names, 0 means services.rpz.ttl
+	Actions   map[tapir.Action]uint32 // overrides the list type TTL
+	Sources   map[string]uint32       // map[list name]TTL, overrides the action TTL
+	Lifetime  bool                    // never longer than the remaining TAPIR lifetime (TimeAdded + TTL)
+	Min       uint32
 }
 
 type DoubtlistPolicy struct {
@@ -81,8 +121,8 @@ type DoubtlistPolicy struct {
 	NumSourcesAction   tapir.Action
 	NumTapirTags       int
 	NumTapirTagsAction tapir.Action
-	DenyTapirTags     tapir.TagMask
-	DenyTapirAction   tapir.Action
+	DenyTapirTags      tapir.TagMask
+	DenyTapirAction    tapir.Action
 }
 
 // type WBGC map[string]*tapir.WBGlist
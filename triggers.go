@@ -0,0 +1,322 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+)
+
+// TriggerType is the type of an RPZ trigger (draft-vixie-dnsop-dns-rpz, section 4). QNAME
+// triggers are plain domain names, the other types are encoded in the owner name and end in a
+// label that identifies the type.
+type TriggerType uint8
+
+const (
+	QnameTrigger    TriggerType = iota
+	IpTrigger                   // rpz-ip: an address in the answer
+	NsdnameTrigger              // rpz-nsdname: the name of an authoritative nameserver
+	NsipTrigger                 // rpz-nsip: the address of an authoritative nameserver
+	ClientIpTrigger             // rpz-client-ip: the address of the client
+)
+
+var triggerLabels = map[TriggerType]string{
+	IpTrigger:       "rpz-ip",
+	NsdnameTrigger:  "rpz-nsdname",
+	NsipTrigger:     "rpz-nsip",
+	ClientIpTrigger: "rpz-client-ip",
+}
+
+var TriggerTypeToString = map[TriggerType]string{
+	QnameTrigger:    "QNAME",
+	IpTrigger:       "IP",
+	NsdnameTrigger:  "NSDNAME",
+	NsipTrigger:     "NSIP",
+	ClientIpTrigger: "CLIENT-IP",
+}
+
+// RpzTrigger is a parsed RPZ trigger. The lists and the output zone keep triggers by their
+// canonical owner name (see String), relative to the RPZ zone, so that all trigger types go
+// through the same policy evaluation as QNAME triggers.
+type RpzTrigger struct {
+	Type   TriggerType
+	Name   string       // QNAME and NSDNAME triggers
+	Prefix netip.Prefix // IP, NSIP and CLIENT-IP triggers, always masked
+}
+
+// TriggerTypeOf returns the type of the trigger with the owner name name (relative to the RPZ
+// zone) without parsing it.
+func TriggerTypeOf(name string) TriggerType {
+	name = strings.TrimSuffix(name, ".")
+	last := name[strings.LastIndexByte(name, '.')+1:]
+	if len(last) < 4 || !strings.EqualFold(last[:4], "rpz-") {
+		return QnameTrigger
+	}
+	for tt, label := range triggerLabels {
+		if strings.EqualFold(last, label) {
+			return tt
+		}
+	}
+	return QnameTrigger
+}
+
+// ParseRpzTrigger parses the owner name name (relative to the RPZ zone) of an RPZ rule.
+func ParseRpzTrigger(name string) (RpzTrigger, error) {
+	name = dns.Fqdn(name)
+	tt := TriggerTypeOf(name)
+	if tt == QnameTrigger {
+		return RpzTrigger{Type: tt, Name: name}, nil
+	}
+	labels := dns.SplitDomainName(name)
+	labels = labels[:len(labels)-1] // the trigger type label
+	if tt == NsdnameTrigger {
+		if len(labels) == 0 {
+			return RpzTrigger{}, fmt.Errorf("%s: no nameserver name", name)
+		}
+		return RpzTrigger{Type: tt, Name: dns.Fqdn(strings.Join(labels, "."))}, nil
+	}
+	prefix, err := decodePrefix(labels)
+	if err != nil {
+		return RpzTrigger{}, fmt.Errorf("%s: %v", name, err)
+	}
+	return RpzTrigger{Type: tt, Prefix: prefix}, nil
+}
+
+// String returns the canonical owner name of t, relative to the RPZ zone.
+func (t RpzTrigger) String() string {
+	switch t.Type {
+	case QnameTrigger:
+		return t.Name
+	case NsdnameTrigger:
+		return t.Name + triggerLabels[t.Type] + "."
+	}
+	return encodePrefix(t.Prefix) + "." + triggerLabels[t.Type] + "."
+}
+
+// IsPrefix reports whether t is an address trigger.
+func (t RpzTrigger) IsPrefix() bool {
+	return t.Type == IpTrigger || t.Type == NsipTrigger || t.Type == ClientIpTrigger
+}
+
+// Covers reports whether t and o are address triggers and the prefix of t contains the prefix
+// of o. The trigger types may differ.
+func (t RpzTrigger) Covers(o RpzTrigger) bool {
+	return t.IsPrefix() && o.IsPrefix() && t.Prefix.Bits() <= o.Prefix.Bits() &&
+		t.Prefix.Contains(o.Prefix.Addr())
+}
+
+// encodePrefix returns the RPZ encoding of p: the prefix length followed by the address in
+// reverse order, the octets of an IPv4 address and the 16 bit words of an IPv6 address, with the
+// longest run of zero words replaced by "zz".
+func encodePrefix(p netip.Prefix) string {
+	labels := []string{strconv.Itoa(p.Bits())}
+	if p.Addr().Is4() {
+		a := p.Addr().As4()
+		for i := 3; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(a[i])))
+		}
+		return strings.Join(labels, ".")
+	}
+	a := p.Addr().As16()
+	var words [8]uint16
+	for i := range words {
+		words[i] = uint16(a[2*i])<<8 | uint16(a[2*i+1])
+	}
+	// The longest run of (at least two) zero words, the first one if there are several
+	zstart, zlen := -1, 1
+	for i := 0; i < 8; {
+		j := i
+		for j < 8 && words[j] == 0 {
+			j++
+		}
+		if j-i > zlen {
+			zstart, zlen = i, j-i
+		}
+		i = j + 1
+	}
+	for i := 7; i >= 0; i-- {
+		switch {
+		case i >= zstart && i < zstart+zlen && zstart >= 0:
+			if i == zstart {
+				labels = append(labels, "zz")
+			}
+		default:
+			labels = append(labels, strconv.FormatUint(uint64(words[i]), 16))
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// decodePrefix parses the labels of an RPZ encoded prefix, see encodePrefix. The address is
+// masked with the prefix length.
+func decodePrefix(labels []string) (netip.Prefix, error) {
+	if len(labels) < 2 {
+		return netip.Prefix{}, fmt.Errorf("too few labels for an address prefix")
+	}
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid prefix length %q", labels[0])
+	}
+	rev := slices.Clone(labels[1:])
+	slices.Reverse(rev)
+
+	var addr netip.Addr
+	if len(rev) == 4 && !slices.Contains(rev, "zz") {
+		var a [4]byte
+		for i, l := range rev {
+			n, err := strconv.ParseUint(l, 10, 8)
+			if err != nil {
+				return netip.Prefix{}, fmt.Errorf("invalid IPv4 octet %q", l)
+			}
+			a[i] = byte(n)
+		}
+		addr = netip.AddrFrom4(a)
+	} else {
+		var words []uint16
+		zz := false
+		for _, l := range rev {
+			if strings.EqualFold(l, "zz") {
+				if zz {
+					return netip.Prefix{}, fmt.Errorf("more than one \"zz\" in an IPv6 address")
+				}
+				if len(rev) > 8 {
+					return netip.Prefix{}, fmt.Errorf("IPv6 address with too many words")
+				}
+				zz = true
+				words = append(words, make([]uint16, 9-len(rev))...)
+				continue
+			}
+			n, err := strconv.ParseUint(l, 16, 16)
+			if err != nil {
+				return netip.Prefix{}, fmt.Errorf("invalid IPv6 word %q", l)
+			}
+			words = append(words, uint16(n))
+		}
+		if len(words) != 8 {
+			return netip.Prefix{}, fmt.Errorf("IPv6 address with %d words", len(words))
+		}
+		var a [16]byte
+		for i, w := range words {
+			a[2*i], a[2*i+1] = byte(w>>8), byte(w)
+		}
+		addr = netip.AddrFrom16(a)
+	}
+	if bits < 1 || bits > addr.BitLen() {
+		return netip.Prefix{}, fmt.Errorf("invalid prefix length %d for %s", bits, addr)
+	}
+	return netip.PrefixFrom(addr, bits).Masked(), nil
+}
+
+// allowKeys returns the names that allowlist name, i.e. name itself, and for an address trigger
+// all less specific prefixes of the same type, and for an NSDNAME trigger also the nameserver
+// name as a QNAME (so that allowlisting a name also protects it as a nameserver).
+func allowKeys(name string) []string {
+	tt := TriggerTypeOf(name)
+	if tt == QnameTrigger {
+		return []string{name}
+	}
+	t, err := ParseRpzTrigger(name)
+	if err != nil {
+		return []string{name}
+	}
+	keys := []string{name}
+	switch {
+	case tt == NsdnameTrigger:
+		keys = append(keys, t.Name)
+	case t.IsPrefix():
+		for bits := t.Prefix.Bits() - 1; bits > 0; bits-- {
+			p, _ := t.Prefix.Addr().Prefix(bits)
+			keys = append(keys, RpzTrigger{Type: tt, Prefix: p}.String())
+		}
+	}
+	return keys
+}
+
+// coveredTriggers returns the address triggers in the output snapshot snap that are more
+// specific than the allowlisted address triggers in names, and are now allowlisted. A new
+// allowlisted prefix is only in an update as itself, but it also removes the more specific
+// triggers from the output (of any address trigger type that it allowlists, see Allowlisted).
+func (pd *PopData) coveredTriggers(snap *RpzSnapshot, names []tapir.Domain) []tapir.Domain {
+	var prefixes []RpzTrigger
+	for _, d := range names {
+		if TriggerTypeOf(d.Name) == QnameTrigger || !pd.Allowlisted(d.Name) {
+			continue
+		}
+		if t, err := ParseRpzTrigger(d.Name); err == nil && t.IsPrefix() {
+			prefixes = append(prefixes, t)
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil
+	}
+	var covered []tapir.Domain
+	for _, rn := range snap.Data {
+		if TriggerTypeOf(rn.Name) == QnameTrigger {
+			continue
+		}
+		t, err := ParseRpzTrigger(rn.Name)
+		if err != nil {
+			continue
+		}
+		for _, p := range prefixes {
+			if p.Covers(t) && p != t && pd.Allowlisted(rn.Name) {
+				covered = append(covered, tapir.Domain{Name: rn.Name})
+				break
+			}
+		}
+	}
+	return covered
+}
+
+// uncoveredTriggers returns the address triggers in the deny- and doubtlists that are within the
+// address triggers in names, which have been removed, and that are not in the output snapshot
+// snap. A removed allowlisted prefix is only in an update as itself, but the triggers that it
+// protected may now go into the output, so they are evaluated again.
+func (pd *PopData) uncoveredTriggers(snap *RpzSnapshot, names []tapir.Domain) []tapir.Domain {
+	var prefixes []RpzTrigger
+	for _, d := range names {
+		if TriggerTypeOf(d.Name) == QnameTrigger {
+			continue
+		}
+		if t, err := ParseRpzTrigger(d.Name); err == nil && t.IsPrefix() {
+			prefixes = append(prefixes, t)
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil
+	}
+	var uncovered []tapir.Domain
+	seen := map[string]bool{}
+	for _, listtype := range []string{"denylist", "doubtlist"} {
+		for _, list := range pd.Lists[listtype] {
+			for name := range list.Names {
+				if seen[name] || TriggerTypeOf(name) == QnameTrigger {
+					continue
+				}
+				seen[name] = true
+				if _, exist := snap.Data[pd.rpzOwner(name)]; exist {
+					continue
+				}
+				t, err := ParseRpzTrigger(name)
+				if err != nil {
+					continue
+				}
+				for _, p := range prefixes {
+					if p.Covers(t) {
+						uncovered = append(uncovered, tapir.Domain{Name: name})
+						break
+					}
+				}
+			}
+		}
+	}
+	return uncovered
+}
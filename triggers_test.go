@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+)
+
+func TestParseRpzTrigger(t *testing.T) {
+	for _, tc := range []struct {
+		name, want string
+		tt         TriggerType
+	}{
+		{"www.example.com.", "www.example.com.", QnameTrigger},
+		{"*.example.com.", "*.example.com.", QnameTrigger},
+		{"32.1.2.0.192.rpz-ip.", "32.1.2.0.192.rpz-ip.", IpTrigger},
+		{"24.99.2.0.192.RPZ-IP.", "24.0.2.0.192.rpz-ip.", IpTrigger}, // masked
+		{"128.1.zz.db8.2001.rpz-nsip.", "128.1.zz.db8.2001.rpz-nsip.", NsipTrigger},
+		{"128.1.0.0.0.0.0.db8.2001.rpz-client-ip.", "128.1.zz.db8.2001.rpz-client-ip.", ClientIpTrigger},
+		{"48.zz.1.0.0.0.db8.2001.rpz-ip.", "48.zz.db8.2001.rpz-ip.", IpTrigger},
+		{"64.zz.1.0.0.db8.2001.rpz-ip.", "64.zz.db8.2001.rpz-ip.", IpTrigger},
+		{"128.1.0.0.1.0.0.0.0.rpz-ip.", "128.1.0.0.1.zz.rpz-ip.", IpTrigger}, // the longest zero run
+		{"1.zz.rpz-ip.", "1.zz.rpz-ip.", IpTrigger},
+		{"ns.evil.example.rpz-nsdname.", "ns.evil.example.rpz-nsdname.", NsdnameTrigger},
+	} {
+		trigger, err := ParseRpzTrigger(tc.name)
+		if err != nil {
+			t.Errorf("ParseRpzTrigger(%s): %v", tc.name, err)
+			continue
+		}
+		if trigger.Type != tc.tt || trigger.String() != tc.want {
+			t.Errorf("ParseRpzTrigger(%s) = %s trigger %s, want %s trigger %s", tc.name,
+				TriggerTypeToString[trigger.Type], trigger, TriggerTypeToString[tc.tt], tc.want)
+		}
+	}
+
+	for _, name := range []string{
+		"33.1.2.0.192.rpz-ip.",
+		"32.256.2.0.192.rpz-ip.",
+		"32.1.2.0.rpz-ip.",
+		"0.1.2.0.192.rpz-ip.",
+		"64.zz.1.zz.rpz-ip.",
+		"128.1.2.3.4.5.6.7.8.9.rpz-ip.",
+		"128.1.2.3.4.5.6.7.8.zz.rpz-ip.",
+		"128.10000.zz.rpz-ip.",
+		"rpz-nsdname.",
+	} {
+		if trigger, err := ParseRpzTrigger(name); err == nil {
+			t.Errorf("ParseRpzTrigger(%s) = %s, want an error", name, trigger)
+		}
+	}
+}
+
+func TestTriggerPolicy(t *testing.T) {
+	pd, _ := newPopData(t)
+	tp := &testPop{pd: pd}
+	tp.addList("allowlist", "local-allow", "file", "24.0.2.0.192.rpz-ip.", "ns.example.net.")
+	tp.addList("denylist", "local-deny", "file",
+		"32.1.2.0.192.rpz-ip.",         // in the allowlisted prefix
+		"32.1.100.51.198.rpz-ip.",      // not allowlisted
+		"16.0.0.51.198.rpz-ip.",        // less specific than the allowlisted prefix
+		"ns.example.net.rpz-nsdname.",  // allowlisted as a name
+		"ns.evil.example.rpz-nsdname.", // not allowlisted
+		"32.1.113.0.203.rpz-client-ip.",
+	)
+	if _, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup}); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	snap := pd.Rpz.Snapshot()
+	for name, want := range map[string]bool{
+		"32.1.2.0.192.rpz-ip.":          false,
+		"32.1.100.51.198.rpz-ip.":       true,
+		"16.0.0.51.198.rpz-ip.":         true,
+		"ns.example.net.rpz-nsdname.":   false,
+		"ns.evil.example.rpz-nsdname.":  true,
+		"32.1.113.0.203.rpz-client-ip.": true,
+	} {
+		if _, exist := snap.Data[pd.rpzOwner(name)]; exist != want {
+			t.Errorf("trigger %s in the output: %t, want %t", name, exist, want)
+		}
+	}
+
+	// A new allowlisted prefix also removes the more specific triggers in the output
+	tp.addList("allowlist", "more-allow", "file", "24.0.100.51.198.rpz-ip.")
+	ixfr, err := pd.GenerateRpzIxfr(&tapir.TapirMsg{
+		ListType: "allowlist",
+		Added:    []tapir.Domain{{Name: "24.0.100.51.198.rpz-ip."}},
+	}, PolicyTrigger{Kind: TriggerMqtt, Source: "more-allow"})
+	if err != nil {
+		t.Fatalf("GenerateRpzIxfr: %v", err)
+	}
+	if len(ixfr.Removed) != 1 || ixfr.Removed[0].Name != "32.1.100.51.198.rpz-ip." || len(ixfr.Added) != 0 {
+		t.Errorf("IXFR for an allowlisted prefix removes %d and adds %d rules, want the covered trigger removed",
+			len(ixfr.Removed), len(ixfr.Added))
+	}
+}
+
+func TestRpzFeedTriggers(t *testing.T) {
+	pd, _ := newPopData(t)
+	const zone = "upstream.rpz."
+	p := pd.newRpzFeedParser(&tapir.WBGlist{Name: "upstream", Type: "doubtlist", RpzZoneName: zone})
+	zd := &tapir.ZoneData{ZoneName: zone}
+	for _, rule := range []struct{ owner, target string }{
+		{"32.1.0.0.0.0.0.db8.2001.rpz-ip.", "."}, // masked to 32.zz.db8.2001
+		{"ns1.evil.example.rpz-nsdname.", "rpz-drop."},
+		{"24.0.2.0.192.rpz-nsip.", "*."},
+		{"32.1.2.0.192.rpz-client-ip.", "rpz-passthru."},
+		{"33.1.2.0.192.rpz-ip.", "."}, // invalid, ignored
+	} {
+		rr := dns.RR(&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: rule.owner + zone, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: rule.target,
+		})
+		p.Parse(&rr, zd)
+	}
+	for _, name := range []string{"32.zz.db8.2001.rpz-ip.", "ns1.evil.example.rpz-nsdname.", "24.0.2.0.192.rpz-nsip."} {
+		if _, exist := p.names[name]; !exist {
+			t.Errorf("trigger %s not parsed from the feed: %v", name, p.names)
+		}
+	}
+	if len(p.names) != 3 {
+		t.Errorf("parsed %d triggers, want 3: %v", len(p.names), p.names)
+	}
+	if _, exist := p.allow["32.1.2.0.192.rpz-client-ip."]; !exist {
+		t.Errorf("passthru CLIENT-IP trigger not moved to allow_catchall")
+	}
+}
@@ -5,12 +5,13 @@
 package main
 
 import (
+	"cmp"
 	"fmt"
 	"log"
 	"math"
 	"net"
+	"slices"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/dnstapir/tapir"
@@ -18,23 +19,128 @@ import (
 	"github.com/spf13/viper"
 )
 
-func (pd *PopData) BootstrapRpzOutput() error {
-	apextmpl := `
-$TTL 3600
-${ZONE}		IN	SOA	mname. hostmaster.dnstapir.se. (
-				${SERIAL}
-				60
-				60
-				86400
-				60 )
-${ZONE}		IN	NS	ns1.${ZONE}
-${ZONE}		IN	NS	ns2.${ZONE}
-ns1.${ZONE}	IN	A	127.0.0.1
-ns2.${ZONE}	IN	AAAA	::1`
+// RpzApex is the apex of the RPZ output zone, see ParseRpzApex.
+type RpzApex struct {
+	SOA   *dns.SOA
+	NSrrs []dns.RR
+	Glue  []dns.RR // address RRs for the nameservers in the zone
+}
+
+// ParseRpzApex builds the apex of the output zone from services.rpz.apex and checks that it
+// makes sense: every nameserver in the zone has glue, and the SOA timers are consistent.
+//
+// The default timers assume that downstream resolvers get a NOTIFY for every new serial, so
+// refresh is only a fallback. It is 5 minutes, as BIND raises anything lower to that
+// (min-refresh-time). An expire of one day means that a resolver that cannot reach us drops
+// the policy after a day, rather than keep applying an increasingly stale one.
+func ParseRpzApex(zone string, ttl, serial uint32) (*RpzApex, error) {
+	zone = dns.Fqdn(zone)
+	conf := RpzApexConf{
+		Rname:   "hostmaster.dnstapir.se.",
+		Ttl:     ttl,
+		Refresh: 300,
+		Retry:   60,
+		Expire:  86400,
+		Minimum: 60,
+	}
+	err := viper.UnmarshalKey("services.rpz.apex", &conf)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling services.rpz.apex: %v", err)
+	}
+
+	if len(conf.Nameservers) == 0 {
+		return nil, fmt.Errorf("services.rpz.apex.nameservers: the RPZ zone %s needs at least one nameserver", zone)
+	}
+	if conf.Mname == "" {
+		conf.Mname = conf.Nameservers[0].Name
+	}
+	for _, name := range []string{conf.Mname, conf.Rname} {
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("services.rpz.apex: %q is not a domain name", name)
+		}
+	}
+	switch {
+	case conf.Ttl == 0:
+		return nil, fmt.Errorf("services.rpz.apex.ttl must be larger than 0")
+	case conf.Refresh == 0 || conf.Retry == 0:
+		return nil, fmt.Errorf("services.rpz.apex: refresh (%d) and retry (%d) must be larger than 0", conf.Refresh, conf.Retry)
+	case conf.Retry > conf.Refresh:
+		return nil, fmt.Errorf("services.rpz.apex: retry (%d) must not be larger than refresh (%d)", conf.Retry, conf.Refresh)
+	case conf.Expire <= conf.Refresh+conf.Retry:
+		return nil, fmt.Errorf("services.rpz.apex: expire (%d) must be larger than refresh + retry (%d)",
+			conf.Expire, conf.Refresh+conf.Retry)
+	case conf.Minimum > 86400:
+		return nil, fmt.Errorf("services.rpz.apex: minimum (%d) must not be larger than 86400", conf.Minimum)
+	}
+
+	hdr := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: conf.Ttl}
+	}
+	apex := RpzApex{
+		SOA: &dns.SOA{
+			Hdr:     hdr(zone, dns.TypeSOA),
+			Ns:      dns.CanonicalName(conf.Mname),
+			Mbox:    dns.Fqdn(conf.Rname),
+			Serial:  serial,
+			Refresh: conf.Refresh,
+			Retry:   conf.Retry,
+			Expire:  conf.Expire,
+			Minttl:  conf.Minimum,
+		},
+	}
+	seen := map[string]bool{}
+	for _, ns := range conf.Nameservers {
+		if _, ok := dns.IsDomainName(ns.Name); !ok {
+			return nil, fmt.Errorf("services.rpz.apex.nameservers: %q is not a domain name", ns.Name)
+		}
+		name := dns.CanonicalName(ns.Name)
+		if seen[name] {
+			return nil, fmt.Errorf("services.rpz.apex.nameservers: %s is listed more than once", name)
+		}
+		seen[name] = true
+		apex.NSrrs = append(apex.NSrrs, &dns.NS{Hdr: hdr(zone, dns.TypeNS), Ns: name})
+
+		inzone := dns.IsSubDomain(zone, name)
+		switch {
+		case name == zone:
+			return nil, fmt.Errorf("services.rpz.apex.nameservers: the nameserver cannot be the zone apex %s", zone)
+		case inzone && len(ns.Addresses) == 0:
+			return nil, fmt.Errorf("services.rpz.apex.nameservers: %s is in the zone %s and needs addresses (glue)", name, zone)
+		case !inzone && len(ns.Addresses) != 0:
+			return nil, fmt.Errorf("services.rpz.apex.nameservers: %s is not in the zone %s and cannot have glue", name, zone)
+		}
+		for _, addr := range ns.Addresses {
+			ip := net.ParseIP(addr)
+			switch {
+			case ip == nil:
+				return nil, fmt.Errorf("services.rpz.apex.nameservers: %s: %q is not an IP address", name, addr)
+			case ip.To4() != nil:
+				apex.Glue = append(apex.Glue, &dns.A{Hdr: hdr(name, dns.TypeA), A: ip.To4()})
+			default:
+				apex.Glue = append(apex.Glue, &dns.AAAA{Hdr: hdr(name, dns.TypeAAAA), AAAA: ip})
+			}
+		}
+	}
+	// One RRset after the other
+	slices.SortStableFunc(apex.Glue, func(a, b dns.RR) int {
+		return cmp.Or(strings.Compare(a.Header().Name, b.Header().Name),
+			cmp.Compare(a.Header().Rrtype, b.Header().Rrtype))
+	})
+	return &apex, nil
+}
 
+// BootstrapRpzOutput sets up the apex of the output zone and publishes the first, empty,
+// version of the zone.
+func (pd *PopData) BootstrapRpzOutput() error {
 	rpzzone := viper.GetString("services.rpz.zonename")
-	apex := strings.Replace(apextmpl, "${ZONE}", rpzzone, -1)
-	apex = strings.Replace(apex, "${SERIAL}", fmt.Sprintf("%d", pd.Rpz.CurrentSerial), -1)
+	apex, err := ParseRpzApex(rpzzone, pd.Rpz.Ttl, pd.Rpz.initialSerial)
+	if err != nil {
+		return err
+	}
+	var zonetext strings.Builder
+	for _, rr := range append([]dns.RR{apex.SOA}, apex.NSrrs...) {
+		zonetext.WriteString(rr.String() + "\n")
+	}
 
 	zd := tapir.ZoneData{
 		ZoneName: rpzzone,
@@ -44,86 +150,172 @@ ns2.${ZONE}	IN	AAAA	::1`
 		Debug:    true,
 	}
 
-	_, err := zd.ReadZoneString(apex)
+	_, err = zd.ReadZoneString(zonetext.String())
 	if err != nil {
-		pd.Logger.Printf("Error from ReadZoneString(): %v", err)
+		return fmt.Errorf("error from ReadZoneString(): %v", err)
 	}
-	// pd.Rpz.CurrentSerial = serial
 
-	pd.mu.Lock()
-	pd.Rpz.Axfr.ZoneData = &zd // XXX: This is not thread safe
-	pd.Rpz.Axfr.SOA = zd.SOA
-	pd.Rpz.Axfr.NSrrs = zd.NSrrs
-	pd.mu.Unlock()
+	pd.Rpz.writer.Lock()
+	defer pd.Rpz.writer.Unlock()
+	pd.Rpz.ZoneData = &zd
+	pd.Rpz.apexSOA = zd.SOA
+	// The first snapshot is empty, the content is added by GenerateRpzAxfr
+	first := &RpzSnapshot{
+		Serial: pd.Rpz.initialSerial,
+		NSrrs:  zd.NSrrs,
+		Glue:   apex.Glue,
+		Data:   map[string]*RpzRule{},
+	}
+	if err := pd.Rpz.signNext(first, false); err != nil {
+		return fmt.Errorf("BootstrapRpzOutput: error signing %s: %v", rpzzone, err)
+	}
+	pd.Rpz.publish(first)
 	return nil
 }
 
+// xfrOut runs a dns.Transfer for an outbound zone transfer. The envelopes are produced by the
+// caller via send, which fails if the transfer has already ended (e.g. the client went away), so
+// that the producer never blocks on a transfer that nobody reads from.
+type xfrOut struct {
+	ch       chan *dns.Envelope
+	done     chan struct{}
+	err      error // from dns.Transfer.Out, valid once done is closed
+	finished bool
+}
+
+func startXfrOut(w dns.ResponseWriter, r *dns.Msg) *xfrOut {
+	xo := &xfrOut{
+		ch:   make(chan *dns.Envelope),
+		done: make(chan struct{}),
+	}
+	go func() {
+		tr := new(dns.Transfer)
+		xo.err = tr.Out(w, r, xo.ch)
+		close(xo.done)
+	}()
+	return xo
+}
+
+func (xo *xfrOut) send(rrs []dns.RR) error {
+	select {
+	case xo.ch <- &dns.Envelope{RR: rrs}:
+		return nil
+	case <-xo.done:
+		if xo.err != nil {
+			return fmt.Errorf("transfer aborted: %v", xo.err)
+		}
+		return fmt.Errorf("transfer aborted")
+	}
+}
+
+// finish waits until everything is written out and returns the error from the transfer, if any.
+// It may be called more than once.
+func (xo *xfrOut) finish() error {
+	if !xo.finished {
+		close(xo.ch)
+		xo.finished = true
+	}
+	<-xo.done
+	return xo.err
+}
+
+// RpzAxfrOut sends the current version of the RPZ output zone to the client.
+// Returns: serial that we gave the client, number of RRs sent, error
 func (pd *PopData) RpzAxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, error) {
+	return pd.rpzAxfrOut(w, r, pd.Rpz.Snapshot())
+}
 
+// rpzAxfrOut sends the version snap of the RPZ output zone. The entire transfer, including the
+// leading and trailing SOA, is served from snap regardless of how the output zone changes while
+// the transfer is running.
+func (pd *PopData) rpzAxfrOut(w dns.ResponseWriter, r *dns.Msg, snap *RpzSnapshot) (uint32, int, error) {
 	zone := pd.Rpz.ZoneName
 
 	// if pd.Verbose {
 	//		pd.Logger.Printf("RpzAxfrOut: Will try to serve RPZ %s (%d RRs)", zone,
-	//			len(pd.Rpz.Axfr.Data))
+	//			len(snap.Data))
 	//	}
 
-	outbound_xfr := make(chan *dns.Envelope)
-	tr := new(dns.Transfer)
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	go func() {
-		err := tr.Out(w, r, outbound_xfr)
+	xo := startXfrOut(w, r)
+	envsize := pd.Rpz.EnvelopeSize()
+	defer func() {
+		err := w.Close() // close connection
 		if err != nil {
-			fmt.Printf("Error from transfer.Out(): %v\n", err)
-			pd.Logger.Printf("Error from transfer.Out(): %v", err)
+			pd.Logger.Printf("RpzAxfrOut: Error from Close(): %v", err)
 		}
-		wg.Done()
 	}()
 
-	count := 0
 	send_count := 0
+	sz := snap.Signed // nil if the zone is not signed
 
-	pd.Rpz.Axfr.SOA.Serial = pd.Rpz.CurrentSerial
-	rrs := []dns.RR{dns.RR(&pd.Rpz.Axfr.SOA)}
+	rrs := []dns.RR{dns.RR(snap.SOA)}
 	// pd.Logger.Printf("RpzAxfrOut: Adding SOA RR to env:%s", rrs[0].String())
 	var total_sent int
 
-	rrs = append(rrs, pd.Rpz.Axfr.NSrrs...)
-	count = len(rrs)
+	// add adds RRs to the current envelope and sends it when it is full
+	add := func(more ...dns.RR) error {
+		rrs = append(rrs, more...)
+		if len(rrs) < envsize {
+			return nil
+		}
+		send_count++
+		total_sent += len(rrs)
+		// fmt.Printf("Sending %d RRs\n", len(rrs))
+		if err := xo.send(rrs); err != nil {
+			_ = xo.finish()
+			total_sent -= len(rrs)
+			return fmt.Errorf("AXFR of %s serial %d: %v", zone, snap.Serial, err)
+		}
+		rrs = []dns.RR{}
+		// fmt.Printf("Sent %d RRs: done\n", len(rrs))
+		return nil
+	}
+
+	if sz != nil {
+		rrs = append(rrs, sz.soaSigs...)
+	}
+	rrs = append(rrs, snap.NSrrs...)
+	rrs = append(rrs, snap.Glue...)
+	if sz != nil {
+		rrs = append(rrs, sz.apex...)
+	}
 
-	for _, rpzn := range pd.Rpz.Axfr.Data {
+	for _, owner := range snap.Owners() {
+		rpzn := snap.Data[owner]
 		// pd.Logger.Printf("RpzAxfrOut: Adding RR to env:%s", (*rpzn.RR).String())
-		rrs = append(rrs, *rpzn.RR)
-		count++
-		if count >= 500 {
-			send_count++
-			total_sent += len(rrs)
-			// fmt.Printf("Sending %d RRs\n", len(rrs))
-			outbound_xfr <- &dns.Envelope{RR: rrs}
-			rrs = []dns.RR{}
-			// fmt.Printf("Sent %d RRs: done\n", len(rrs))
-			count = 0
+		err := add(rpzn.RRs...)
+		if err == nil && sz != nil {
+			err = add(sz.ruleSigs[owner]...)
+		}
+		if err != nil {
+			return 0, total_sent, err
 		}
 	}
 
-	rrs = append(rrs, dns.RR(&pd.Rpz.Axfr.SOA)) // trailing SOA
+	if sz != nil {
+		for _, rr := range sz.ChainRRs() {
+			if err := add(rr); err != nil {
+				return 0, total_sent, err
+			}
+		}
+	}
+
+	rrs = append(rrs, dns.RR(snap.SOA)) // trailing SOA, same serial as the leading one
 
 	total_sent += len(rrs)
 	//	pd.Logger.Printf("RpzAxfrOut: Zone %s: Sending final %d RRs (including trailing SOA, total sent %d)\n",
 	//		zone, len(rrs), total_sent)
-	outbound_xfr <- &dns.Envelope{RR: rrs}
-
-	close(outbound_xfr)
-	wg.Wait()        // wait until everything is written out
-	err := w.Close() // close connection
+	err := xo.send(rrs)
+	if ferr := xo.finish(); err == nil {
+		err = ferr
+	}
 	if err != nil {
-		pd.Logger.Printf("RpzAxfrOut: Error from Close(): %v", err)
+		return 0, total_sent - len(rrs), fmt.Errorf("AXFR of %s serial %d: %v", zone, snap.Serial, err)
 	}
 
 	pd.Logger.Printf("ZoneTransferOut: %s: Sent %d RRs (including SOA twice).", zone, total_sent)
 
-	return pd.Rpz.CurrentSerial, total_sent - 1, nil
+	return snap.Serial, total_sent - 1, nil
 }
 
 // An IXFR has the following structure:
@@ -178,19 +370,34 @@ func (pd *PopData) RpzIxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 
 	pd.mu.Lock()
 	pd.DownstreamSerials[downstream] = curserial
-	zone := pd.Rpz.ZoneName
 	pd.mu.Unlock()
+	zone := pd.Rpz.ZoneName
+	snap := pd.Rpz.Snapshot() // the entire transfer is served from this version of the zone
+
+	if curserial == snap.Serial {
+		// RFC 1995: the client is up to date, the response is only the current SOA
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = []dns.RR{dns.RR(snap.SOA)}
+		err = w.WriteMsg(m)
+		if err != nil {
+			return 0, 0, err
+		}
+		return snap.Serial, 1, nil
+	}
 
-	if len(pd.Rpz.IxfrChain) == 0 {
+	// The fallback AXFR is served from the same version of the zone that the decision was based on
+	if len(snap.IxfrChain) == 0 {
 		pd.Logger.Printf("RpzIxfrOut: Downstream %s claims to have RPZ %s with serial %d, but the IXFR chain is empty; AXFR needed", downstream, zone, curserial)
-		serial, _, err := pd.RpzAxfrOut(w, r)
+		serial, _, err := pd.rpzAxfrOut(w, r, snap)
 		if err != nil {
 			return 0, 0, err
 		}
 		return serial, 0, nil
-	} else if curserial < pd.Rpz.IxfrChain[0].FromSerial {
-		pd.Logger.Printf("RpzIxfrOut: Downstream %s claims to have RPZ %s with serial %d, but the IXFR chain starts at %d; AXFR needed", downstream, zone, curserial, pd.Rpz.IxfrChain[0].FromSerial)
-		serial, _, err := pd.RpzAxfrOut(w, r)
+	} else if curserial < snap.IxfrChain[0].FromSerial || curserial > snap.Serial {
+		pd.Logger.Printf("RpzIxfrOut: Downstream %s claims to have RPZ %s with serial %d, but the IXFR chain covers %d to %d; AXFR needed", downstream, zone, curserial, snap.IxfrChain[0].FromSerial, snap.Serial)
+		serial, _, err := pd.rpzAxfrOut(w, r, snap)
 		if err != nil {
 			return 0, 0, err
 		}
@@ -199,46 +406,50 @@ func (pd *PopData) RpzIxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 
 	if pd.Verbose {
 		pd.Logger.Printf("RpzIxfrOut: Will try to serve RPZ %s to %v (%d IXFRs in chain)\n", zone,
-			w.RemoteAddr().String(), len(pd.Rpz.IxfrChain))
+			w.RemoteAddr().String(), len(snap.IxfrChain))
 		pd.Logger.Printf("RpzIxfrOut: Client claims to have RPZ %s with serial %d", zone, curserial)
 	}
 
-	outbound_xfr := make(chan *dns.Envelope)
-	tr := new(dns.Transfer)
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	go func() {
-		err := tr.Out(w, r, outbound_xfr)
-		if err != nil {
-			pd.Logger.Printf("Error from transfer.Out(): %v", err)
-			pd.ComponentStatusCh <- tapir.ComponentStatusUpdate{
-				Component: "rpz-ixfr",
-				Status:    tapir.StatusFail,
-				Msg:       fmt.Sprintf("Error from transfer.Out(): %v", err),
-				TimeStamp: time.Now(),
-			}
+	xo := startXfrOut(w, r)
+	envsize := pd.Rpz.EnvelopeSize()
+	fail := func(err error) (uint32, int, error) {
+		_ = xo.finish()
+		_ = w.Close()
+		pd.Logger.Printf("RpzIxfrOut: Error from transfer.Out(): %v", err)
+		pd.ComponentStatusCh <- tapir.ComponentStatusUpdate{
+			Component: "rpz-ixfr",
+			Status:    tapir.StatusFail,
+			Msg:       fmt.Sprintf("Error from transfer.Out(): %v", err),
+			TimeStamp: time.Now(),
 		}
-		wg.Done()
-	}()
+		return 0, 0, fmt.Errorf("IXFR of %s serial %d: %v", zone, snap.Serial, err)
+	}
 
 	rrs := []dns.RR{}
 
 	var total_sent int
 
-	pd.Rpz.Axfr.SOA.Serial = pd.Rpz.CurrentSerial
-	rrs = append(rrs, dns.RR(&pd.Rpz.Axfr.SOA))
+	rrs = append(rrs, dns.RR(snap.SOA))
 
 	var totcount, count int
 	var finalSerial uint32
-	for _, ixfr := range pd.Rpz.IxfrChain {
+	flush := func() error {
+		if err := xo.send(rrs); err != nil {
+			return err
+		}
+		rrs = []dns.RR{}
+		totcount += count
+		count = 0
+		return nil
+	}
+	for _, ixfr := range snap.IxfrChain {
 		pd.Logger.Printf("RpzIxfrOut: checking client serial(%d) against IXFR[from:%d, to:%d]",
 			curserial, ixfr.FromSerial, ixfr.ToSerial)
 		if ixfr.FromSerial >= curserial {
 			finalSerial = ixfr.ToSerial
 			pd.Logger.Printf("PushIxfrs: pushing the IXFR[from:%d, to:%d] onto output",
 				ixfr.FromSerial, ixfr.ToSerial)
-			fromsoa := dns.Copy(dns.RR(&pd.Rpz.Axfr.ZoneData.SOA))
+			fromsoa := dns.Copy(dns.RR(snap.SOA))
 			fromsoa.(*dns.SOA).Serial = ixfr.FromSerial
 			if pd.Debug {
 				pd.Logger.Printf("IxfrOut: adding FROMSOA to output: %s", fromsoa.String())
@@ -251,20 +462,30 @@ func (pd *PopData) RpzIxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 				if pd.Debug {
 					pd.Logger.Printf("DEL: adding RR to ixfr output: %s", tn.Name)
 				}
-				rrs = append(rrs, *tn.RR) // should do proper slice magic instead
+				for _, rr := range tn.RRs {
+					rrs = append(rrs, rr) // should do proper slice magic instead
+					count++
+					if count >= envsize {
+						pd.Logger.Printf("Sending %d RRs\n", len(rrs))
+						for _, rr := range rrs {
+							pd.Logger.Printf("SEND DELS: %s", rr.String())
+						}
+						if err := flush(); err != nil {
+							return fail(err)
+						}
+					}
+				}
+			}
+			for _, rr := range ixfr.DelRRs { // DNSSEC records
+				rrs = append(rrs, rr)
 				count++
-				if count >= 500 {
-					pd.Logger.Printf("Sending %d RRs\n", len(rrs))
-					for _, rr := range rrs {
-						pd.Logger.Printf("SEND DELS: %s", rr.String())
+				if count >= envsize {
+					if err := flush(); err != nil {
+						return fail(err)
 					}
-					outbound_xfr <- &dns.Envelope{RR: rrs}
-					rrs = []dns.RR{}
-					totcount += count
-					count = 0
 				}
 			}
-			tosoa := dns.Copy(dns.RR(&pd.Rpz.Axfr.ZoneData.SOA))
+			tosoa := dns.Copy(dns.RR(snap.SOA))
 			tosoa.(*dns.SOA).Serial = ixfr.ToSerial
 			if pd.Debug {
 				pd.Logger.Printf("RpzIxfrOut: adding TOSOA to output: %s", tosoa.String())
@@ -277,24 +498,34 @@ func (pd *PopData) RpzIxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 				if pd.Debug {
 					pd.Logger.Printf("ADD: adding RR to ixfr output: %s", tn.Name)
 				}
-				rrs = append(rrs, *tn.RR) // should do proper slice magic instead
+				for _, rr := range tn.RRs {
+					rrs = append(rrs, rr) // should do proper slice magic instead
+					count++
+					if count >= envsize {
+						pd.Logger.Printf("Sending %d RRs\n", len(rrs))
+						for _, rr := range rrs {
+							pd.Logger.Printf("SEND ADDS: %s", rr.String())
+						}
+						if err := flush(); err != nil {
+							return fail(err)
+						}
+						// fmt.Printf("Sent %d RRs: done\n", len(rrs))
+					}
+				}
+			}
+			for _, rr := range ixfr.AddRRs { // DNSSEC records
+				rrs = append(rrs, rr)
 				count++
-				if count >= 500 {
-					pd.Logger.Printf("Sending %d RRs\n", len(rrs))
-					for _, rr := range rrs {
-						pd.Logger.Printf("SEND ADDS: %s", rr.String())
+				if count >= envsize {
+					if err := flush(); err != nil {
+						return fail(err)
 					}
-					outbound_xfr <- &dns.Envelope{RR: rrs}
-					// fmt.Printf("Sent %d RRs: done\n", len(rrs))
-					rrs = []dns.RR{}
-					totcount += count
-					count = 0
 				}
 			}
 		}
 	}
 
-	rrs = append(rrs, dns.RR(&pd.Rpz.Axfr.SOA)) // trailing SOA
+	rrs = append(rrs, dns.RR(snap.SOA)) // trailing SOA
 
 	total_sent += len(rrs)
 	pd.Logger.Printf("RpzIxfrOut: Zone %s: Sending final %d RRs (including trailing SOA, total sent %d)\n",
@@ -304,10 +535,12 @@ func (pd *PopData) RpzIxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 	//	for _, rr := range rrs {
 	//		pd.Logger.Printf("SEND FINAL: %s", rr.String())
 	//	}
-	outbound_xfr <- &dns.Envelope{RR: rrs}
-
-	close(outbound_xfr)
-	wg.Wait()       // wait until everything is written out
+	if err := xo.send(rrs); err != nil {
+		return fail(err)
+	}
+	if err := xo.finish(); err != nil { // wait until everything is written out
+		return fail(err)
+	}
 	err = w.Close() // close connection
 	if err != nil {
 		pd.Logger.Printf("RpzIxfrOut: Error from Close(): %v", err)
@@ -330,22 +563,29 @@ func (pd *PopData) RpzIxfrOut(w dns.ResponseWriter, r *dns.Msg) (uint32, int, er
 
 func (pd *PopData) PruneRpzIxfrChain() error {
 	lowSerial := uint32(math.MaxUint32)
+	pd.mu.RLock()
 	for _, serial := range pd.DownstreamSerials {
 		if serial < lowSerial {
 			lowSerial = serial
 		}
 	}
+	pd.mu.RUnlock()
+
+	pd.Rpz.writer.Lock()
+	defer pd.Rpz.writer.Unlock()
+	snap := pd.Rpz.next()
 
 	indexToDeleteUpTo := -1
-	for i := 0; i < len(pd.Rpz.IxfrChain); i++ {
-		if pd.Rpz.IxfrChain[i].FromSerial == lowSerial {
+	for i := 0; i < len(snap.IxfrChain); i++ {
+		if snap.IxfrChain[i].FromSerial == lowSerial {
 			indexToDeleteUpTo = i - 2
 			break
 		}
 	}
 
 	if indexToDeleteUpTo >= 0 {
-		pd.Rpz.IxfrChain = pd.Rpz.IxfrChain[indexToDeleteUpTo+1:]
+		snap.IxfrChain = snap.IxfrChain[indexToDeleteUpTo+1:]
+		pd.Rpz.publish(snap) // same serial and content, shorter chain
 		pd.Logger.Printf("PruneRpzIxfrChain: Pruning IXFR chain up to two serials before serial %d", lowSerial)
 	} else {
 		pd.Logger.Printf("PruneRpzIxfrChain: Nothing to prune from the IXFR chain")
@@ -0,0 +1,474 @@
+/*
+ * Copyright (c) 2024 Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/tapir"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// TestRpzFeedAndObservationsToXfr runs the whole chain: an upstream RPZ is transferred by the
+// RefreshEngine, combined with local lists into the output zone, which is then transferred by a
+// downstream. An observation is then injected as if it arrived over MQTT and the resulting
+// change is verified both via IXFR and via a new AXFR.
+func TestRpzFeedAndObservationsToXfr(t *testing.T) {
+	up := startUpstreamRpz(t, "upstream.rpz.", map[string]string{
+		"bad1.example.com.": ".",
+		"bad2.example.com.": "rpz-drop.",
+		"good.example.com.": "rpz-passthru.", // misplaced allow rule, goes to allow_catchall
+	})
+
+	tp := newTestPop(t, func() {
+		viper.Set("sources.upstream.upstream", up.addr)
+	})
+	pd := tp.pd
+	tp.addList("denylist", "local-deny", "file", "evil.example.net.")
+	tp.addList("doubtlist", "dns-tapir", "mqtt") // stand-in for the MQTT source
+
+	feed := tapir.WBGlist{
+		Name:        "upstream",
+		Type:        "doubtlist",
+		Datasource:  "xfr",
+		RpzZoneName: up.zone,
+		RpzUpstream: up.addr,
+		ReaperData:  map[time.Time]map[string]bool{},
+	}
+	if err := pd.ParseRpzFeed("upstream", &feed); err != nil {
+		t.Fatalf("ParseRpzFeed: %v", err)
+	}
+	pd.mu.Lock()
+	if len(feed.Names) != 2 {
+		t.Errorf("RPZ feed %s has %d names, want 2: %v", up.zone, len(feed.Names), feed.Names)
+	}
+	if _, exist := pd.Lists["allowlist"]["allow_catchall"].Names["good.example.com."]; !exist {
+		t.Errorf("passthru rule in doubtlist feed not moved to allow_catchall")
+	}
+	_, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup})
+	pd.mu.Unlock()
+	if err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+
+	// 1. Initial AXFR
+	startSerial := soaSerial(t, tp.addr, testRpzZone)
+	rrs := axfr(t, tp.addr, testRpzZone)
+	if soa, ok := rrs[0].(*dns.SOA); !ok || soa.Serial != startSerial {
+		t.Fatalf("AXFR does not start with SOA serial %d: %s", startSerial, rrs[0].String())
+	}
+	if soa, ok := rrs[len(rrs)-1].(*dns.SOA); !ok || soa.Serial != startSerial {
+		t.Fatalf("AXFR does not end with SOA serial %d: %s", startSerial, rrs[len(rrs)-1].String())
+	}
+	rules := rpzRules(rrs)
+	for _, owner := range []string{"bad1.example.com.", "bad2.example.com.", "evil.example.net."} {
+		if _, exist := rules[owner+testRpzZone]; !exist {
+			t.Errorf("AXFR is missing the rule for %s: %v", owner, rules)
+		}
+	}
+	if _, exist := rules["good.example.com."+testRpzZone]; exist {
+		t.Errorf("AXFR contains a rule for the allowlisted name good.example.com.")
+	}
+	if got, want := rules["evil.example.net."+testRpzZone], tapir.ActionToCNAMETarget[pd.Policy.DenylistAction]; got != want {
+		t.Errorf("denylisted name has target %s, want %s", got, want)
+	}
+
+	// 2. An observation arrives over "MQTT"
+	tp.injectObservation(t, tapir.TapirMsg{
+		SrcName:  "dns-tapir",
+		MsgType:  "observation",
+		ListType: "doubtlist",
+		Added: []tapir.Domain{
+			{Name: "new.example.org.", TimeAdded: time.Now(), TTL: 3600},
+			{Name: "good.example.com.", TimeAdded: time.Now(), TTL: 3600}, // allowlisted, no change
+		},
+		TimeStamp: time.Now(),
+	})
+	newSerial := tp.waitForSerial(t, startSerial+1)
+	if newSerial != startSerial+1 {
+		t.Errorf("serial after one observation is %d, want %d", newSerial, startSerial+1)
+	}
+
+	// 3. The downstream asks for the changes since the initial AXFR
+	rrs = ixfr(t, tp.addr, testRpzZone, startSerial)
+	if soa, ok := rrs[0].(*dns.SOA); !ok || soa.Serial != newSerial {
+		t.Fatalf("IXFR does not start with SOA serial %d: %s", newSerial, rrs[0].String())
+	}
+	removed, added := ixfrDiff(t, rrs)
+	if len(removed) != 0 {
+		t.Errorf("IXFR removes %v, want nothing", removed)
+	}
+	if len(added) != 1 {
+		t.Errorf("IXFR adds %v, want only new.example.org.", added)
+	}
+	if got, want := added["new.example.org."+testRpzZone], tapir.ActionToCNAMETarget[pd.Policy.Doubtlist.NumSourcesAction]; got != want {
+		t.Errorf("IXFR adds new.example.org. with target %q, want %q", got, want)
+	}
+
+	// 4. A new AXFR contains both the old and the new rules
+	rules = rpzRules(axfr(t, tp.addr, testRpzZone))
+	for _, owner := range []string{"bad1.example.com.", "bad2.example.com.", "evil.example.net.", "new.example.org."} {
+		if _, exist := rules[owner+testRpzZone]; !exist {
+			t.Errorf("AXFR after update is missing the rule for %s: %v", owner, rules)
+		}
+	}
+}
+
+// Zone transfers that run while the output zone is being updated must each see one consistent
+// version of the zone: the same serial in the leading and trailing SOA, and exactly the rules
+// of that serial. Run with -race to also catch unsynchronised access.
+func TestXfrDuringUpdates(t *testing.T) {
+	tp := newTestPop(t)
+	pd := tp.pd
+	tp.addList("doubtlist", "dns-tapir", "mqtt")
+
+	pd.mu.Lock()
+	_, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup})
+	pd.mu.Unlock()
+	if err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	startSerial := pd.Rpz.CurrentSerial()
+
+	const updates = 50
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < updates; i++ {
+			tp.injectObservation(t, tapir.TapirMsg{
+				SrcName:   "dns-tapir",
+				MsgType:   "observation",
+				ListType:  "doubtlist",
+				Added:     []tapir.Domain{{Name: fmt.Sprintf("name%d.example.org.", i), TimeAdded: time.Now(), TTL: 3600}},
+				TimeStamp: time.Now(),
+			})
+		}
+	}()
+
+	for xfrs := 0; ; xfrs++ {
+		rrs := axfr(t, tp.addr, testRpzZone)
+		first, ok1 := rrs[0].(*dns.SOA)
+		last, ok2 := rrs[len(rrs)-1].(*dns.SOA)
+		if !ok1 || !ok2 || first.Serial != last.Serial {
+			t.Fatalf("AXFR %d is not bracketed by the same SOA: %s ... %s", xfrs, rrs[0], rrs[len(rrs)-1])
+		}
+		// Every observation adds one name, so the serial gives the number of rules
+		if got, want := len(rpzRules(rrs)), int(first.Serial-startSerial); got != want {
+			t.Fatalf("AXFR %d with serial %d has %d rules, want %d", xfrs, first.Serial, got, want)
+		}
+		if first.Serial == startSerial+updates {
+			break
+		}
+		select {
+		case <-done:
+			tp.waitForSerial(t, startSerial+updates)
+		default:
+		}
+	}
+}
+
+// An AXFR is served from the version of the zone that was current when it started, also when
+// the zone changes between two messages of the transfer.
+func TestAxfrPinnedToSnapshot(t *testing.T) {
+	pd, _ := newPopData(t)
+	tp := &testPop{pd: pd}
+	feed := tp.addList("doubtlist", "dns-tapir", "mqtt")
+	const numnames = 1200 // more than one message
+	for i := 0; i < numnames; i++ {
+		name := fmt.Sprintf("name%d.example.org.", i)
+		feed.Names[name] = tapir.TapirName{Name: name, Action: tapir.NXDOMAIN}
+	}
+	if _, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup}); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	startSerial := pd.Rpz.CurrentSerial()
+
+	m := new(dns.Msg)
+	m.SetAxfr(testRpzZone)
+	rw := &recordingWriter{onWrite: func(n int) error {
+		if n != 1 {
+			return nil
+		}
+		// Between the first and the second message: one name removed, one added
+		delete(feed.Names, "name0.example.org.")
+		feed.Names["late.example.org."] = tapir.TapirName{Name: "late.example.org.", Action: tapir.NXDOMAIN}
+		_, err := pd.GenerateRpzIxfr(&tapir.TapirMsg{
+			Added:   []tapir.Domain{{Name: "late.example.org."}},
+			Removed: []tapir.Domain{{Name: "name0.example.org."}},
+		}, PolicyTrigger{Kind: TriggerMqtt, Source: "dns-tapir"})
+		return err
+	}}
+	serial, _, err := pd.RpzAxfrOut(rw, m)
+	if err != nil {
+		t.Fatalf("RpzAxfrOut: %v", err)
+	}
+	if len(rw.msgs) < 3 {
+		t.Fatalf("AXFR was sent in %d messages, the update must land mid-transfer", len(rw.msgs))
+	}
+	if pd.Rpz.CurrentSerial() != startSerial+1 {
+		t.Fatalf("serial after the update is %d, want %d", pd.Rpz.CurrentSerial(), startSerial+1)
+	}
+
+	rrs := rw.rrs()
+	first, ok1 := rrs[0].(*dns.SOA)
+	last, ok2 := rrs[len(rrs)-1].(*dns.SOA)
+	if !ok1 || !ok2 || first.Serial != startSerial || last.Serial != startSerial || serial != startSerial {
+		t.Fatalf("AXFR is not pinned to serial %d: leading SOA %s, trailing SOA %s, returned serial %d",
+			startSerial, rrs[0], rrs[len(rrs)-1], serial)
+	}
+	rules := rpzRules(rrs)
+	if len(rules) != numnames {
+		t.Errorf("AXFR has %d rules, want %d", len(rules), numnames)
+	}
+	if _, exist := rules["name0.example.org."+testRpzZone]; !exist {
+		t.Errorf("AXFR of serial %d is missing name0.example.org., which was removed in a later serial", startSerial)
+	}
+	if _, exist := rules["late.example.org."+testRpzZone]; exist {
+		t.Errorf("AXFR of serial %d contains late.example.org., which was added in a later serial", startSerial)
+	}
+}
+
+func TestIxfrEdgeCases(t *testing.T) {
+	pd, _ := newPopData(t)
+	tp := &testPop{pd: pd}
+	feed := tp.addList("doubtlist", "dns-tapir", "mqtt")
+	feed.Names["one.example.org."] = tapir.TapirName{Name: "one.example.org.", Action: tapir.NXDOMAIN}
+	if _, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup}); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	feed.Names["two.example.org."] = tapir.TapirName{Name: "two.example.org.", Action: tapir.NXDOMAIN}
+	if _, err := pd.GenerateRpzIxfr(&tapir.TapirMsg{Added: []tapir.Domain{{Name: "two.example.org."}}},
+		PolicyTrigger{Kind: TriggerMqtt, Source: "dns-tapir"}); err != nil {
+		t.Fatalf("GenerateRpzIxfr: %v", err)
+	}
+	serial := pd.Rpz.CurrentSerial()
+
+	ixfrOut := func(clientSerial uint32) []dns.RR {
+		m := new(dns.Msg)
+		m.SetIxfr(testRpzZone, clientSerial, "ns."+testRpzZone, "hostmaster."+testRpzZone)
+		rw := &recordingWriter{}
+		if _, _, err := pd.RpzIxfrOut(rw, m); err != nil {
+			t.Fatalf("RpzIxfrOut(serial %d): %v", clientSerial, err)
+		}
+		return rw.rrs()
+	}
+
+	// Up to date: only the current SOA
+	if rrs := ixfrOut(serial); len(rrs) != 1 || rrs[0].(*dns.SOA).Serial != serial {
+		t.Errorf("IXFR from the current serial %d: got %v, want only the SOA", serial, rrs)
+	}
+	// One version behind: the diff
+	rrs := ixfrOut(serial - 1)
+	if _, added := ixfrDiff(t, rrs); len(added) != 1 {
+		t.Errorf("IXFR from serial %d adds %v, want only two.example.org.", serial-1, added)
+	}
+	// A serial from the future (e.g. the client saw a previous incarnation): full zone
+	rrs = ixfrOut(serial + 10)
+	if rules := rpzRules(rrs); len(rules) != 2 || rrs[len(rrs)-1].(*dns.SOA).Serial != serial {
+		t.Errorf("IXFR from serial %d: got %d rules, want an AXFR of serial %d with 2 rules", serial+10, len(rules), serial)
+	}
+}
+
+// Two AXFRs of the same serial must be identical, in canonical order, in messages of the
+// configured size and with the same TTL throughout.
+func TestAxfrDeterministic(t *testing.T) {
+	pd, _ := newPopData(t, func() {
+		viper.Set("services.rpz.envelopesize", 100)
+		viper.Set("services.rpz.ttl", 600)
+	})
+	tp := &testPop{pd: pd}
+	feed := tp.addList("doubtlist", "dns-tapir", "mqtt")
+	for i := 0; i < 450; i++ {
+		name := fmt.Sprintf("n%d.example%d.org.", i, i%7)
+		feed.Names[name] = tapir.TapirName{Name: name, Action: tapir.NXDOMAIN}
+	}
+	if _, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup}); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+	pd.Rpz.SetEnvelopeSize(400) // from the global config, must not override the local config
+
+	m := new(dns.Msg)
+	m.SetAxfr(testRpzZone)
+	transfer := func() (*recordingWriter, []byte) {
+		rw := &recordingWriter{}
+		if _, _, err := pd.RpzAxfrOut(rw, m); err != nil {
+			t.Fatalf("RpzAxfrOut: %v", err)
+		}
+		var wire []byte
+		for _, msg := range rw.msgs {
+			buf, err := msg.Pack()
+			if err != nil {
+				t.Fatalf("Pack: %v", err)
+			}
+			wire = append(wire, buf...)
+		}
+		return rw, wire
+	}
+
+	rw1, wire1 := transfer()
+	_, wire2 := transfer()
+	if string(wire1) != string(wire2) {
+		t.Errorf("two AXFRs of the same serial differ")
+	}
+	for i, msg := range rw1.msgs {
+		if len(msg.Answer) > 100+3 { // the first message also has SOA and NS
+			t.Errorf("message %d has %d RRs, envelope size is 100", i, len(msg.Answer))
+		}
+	}
+
+	rrs := rw1.rrs()
+	var prev string
+	for _, rr := range rrs {
+		if rr.Header().Ttl != 600 {
+			t.Errorf("RR has TTL %d, want 600: %s", rr.Header().Ttl, rr)
+		}
+		if _, ok := rr.(*dns.CNAME); !ok {
+			continue
+		}
+		if prev != "" && canonicalKey(prev) >= canonicalKey(rr.Header().Name) {
+			t.Errorf("%s comes after %s in the AXFR, not canonical order", rr.Header().Name, prev)
+		}
+		prev = rr.Header().Name
+	}
+}
+
+func TestCanonicalOrder(t *testing.T) {
+	// RFC 4034, section 6.1, except the examples with escaped octets, see canonicalKey
+	want := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.",
+		"zABC.a.EXAMPLE.", "z.example.", "*.z.example."}
+	got := slices.Clone(want)
+	slices.Reverse(got)
+	slices.SortFunc(got, func(a, b string) int { return strings.Compare(canonicalKey(a), canonicalKey(b)) })
+	if !slices.Equal(got, want) {
+		t.Errorf("canonical order: got %v, want %v", got, want)
+	}
+}
+
+// When the client goes away in the middle of a transfer, the transfer must end with an error
+// rather than block forever.
+func TestAxfrAbortedByClient(t *testing.T) {
+	pd, _ := newPopData(t)
+	tp := &testPop{pd: pd}
+	feed := tp.addList("doubtlist", "dns-tapir", "mqtt")
+	for i := 0; i < 1200; i++ {
+		name := fmt.Sprintf("name%d.example.org.", i)
+		feed.Names[name] = tapir.TapirName{Name: name, Action: tapir.NXDOMAIN}
+	}
+	if _, err := pd.GenerateRpzAxfr(PolicyTrigger{Kind: TriggerStartup}); err != nil {
+		t.Fatalf("GenerateRpzAxfr: %v", err)
+	}
+
+	m := new(dns.Msg)
+	m.SetAxfr(testRpzZone)
+	rw := &recordingWriter{onWrite: func(n int) error {
+		if n == 0 {
+			return nil
+		}
+		return errors.New("connection reset by peer")
+	}}
+	errch := make(chan error, 1)
+	go func() {
+		_, _, err := pd.RpzAxfrOut(rw, m)
+		errch <- err
+	}()
+	select {
+	case err := <-errch:
+		if err == nil {
+			t.Errorf("RpzAxfrOut returned no error for an aborted transfer")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("RpzAxfrOut did not return after the client went away")
+	}
+}
+
+// Zone transfers must be refused once shutdown has started, so that no transfer is truncated.
+func TestXfrRefusedDuringShutdown(t *testing.T) {
+	tp := newTestPop(t)
+	tp.pd.ShuttingDown.Store(true)
+
+	m := new(dns.Msg)
+	m.SetAxfr(testRpzZone)
+	c := dns.Client{Net: "tcp", Timeout: 2 * time.Second}
+	r, _, err := c.Exchange(m, tp.addr)
+	if err != nil {
+		t.Fatalf("AXFR request: %v", err)
+	}
+	if r.Rcode != dns.RcodeRefused {
+		t.Errorf("AXFR during shutdown got rcode %s, want REFUSED", dns.RcodeToString[r.Rcode])
+	}
+}
+
+func TestRpzApex(t *testing.T) {
+	pd, _ := newPopData(t, func() {
+		viper.Set("services.rpz.ttl", 900)
+		viper.Set("services.rpz.apex", map[string]any{
+			"rname":   "noc.example.net.",
+			"refresh": 600,
+			"retry":   120,
+			"expire":  604800,
+			"minimum": 30,
+			"nameservers": []map[string]any{
+				{"name": "NS1." + testRpzZone, "addresses": []string{"192.0.2.1", "2001:db8::1", "192.0.2.2"}},
+				{"name": "ns.example.net."},
+			},
+		})
+	})
+	m := new(dns.Msg)
+	m.SetAxfr(testRpzZone)
+	rw := &recordingWriter{}
+	if _, _, err := pd.RpzAxfrOut(rw, m); err != nil {
+		t.Fatalf("RpzAxfrOut: %v", err)
+	}
+	var got []string
+	for _, rr := range rw.rrs() {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa.Serial = 0 // not from the config
+		}
+		got = append(got, rr.String())
+	}
+	want := []string{
+		"rpz.test.\t900\tIN\tSOA\tns1.rpz.test. noc.example.net. 0 600 120 604800 30",
+		"rpz.test.\t900\tIN\tNS\tns1.rpz.test.",
+		"rpz.test.\t900\tIN\tNS\tns.example.net.",
+		"ns1.rpz.test.\t900\tIN\tA\t192.0.2.1",
+		"ns1.rpz.test.\t900\tIN\tA\t192.0.2.2",
+		"ns1.rpz.test.\t900\tIN\tAAAA\t2001:db8::1",
+		"rpz.test.\t900\tIN\tSOA\tns1.rpz.test. noc.example.net. 0 600 120 604800 30",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("AXFR of the empty zone:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	for _, tc := range []struct {
+		name string
+		apex map[string]any
+	}{
+		{"no nameservers", map[string]any{}},
+		{"in-zone nameserver without glue", map[string]any{
+			"nameservers": []map[string]any{{"name": "ns1." + testRpzZone}}}},
+		{"glue for an out-of-zone nameserver", map[string]any{
+			"nameservers": []map[string]any{{"name": "ns.example.net.", "addresses": []string{"192.0.2.1"}}}}},
+		{"bad address", map[string]any{
+			"nameservers": []map[string]any{{"name": "ns1." + testRpzZone, "addresses": []string{"192.0.2.256"}}}}},
+		{"retry larger than refresh", map[string]any{"refresh": 60, "retry": 300,
+			"nameservers": []map[string]any{{"name": "ns.example.net."}}}},
+		{"expire too short", map[string]any{"refresh": 3600, "retry": 600, "expire": 3600,
+			"nameservers": []map[string]any{{"name": "ns.example.net."}}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testConfig(t)
+			viper.Set("services.rpz.apex", tc.apex)
+			if _, err := ParseRpzApex(testRpzZone, 3600, 1); err == nil {
+				t.Errorf("ParseRpzApex accepted an apex with %s", tc.name)
+			}
+		})
+	}
+}